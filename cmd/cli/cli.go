@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"kevin-rd/my-tier/internal/cli/print"
+	"kevin-rd/my-tier/internal/ratelimit"
 	"kevin-rd/my-tier/pkg/ipc/message"
 	"kevin-rd/my-tier/pkg/ipc/unix_socket"
 	"kevin-rd/my-tier/pkg/packet"
@@ -12,6 +13,8 @@ import (
 	"kevin-rd/my-tier/pkg/utils"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,9 +36,21 @@ var app = &cli.App{
 	Commands: []*cli.Command{
 		subTest,
 		subPeers,
+		subLimit,
+		subAnycast,
+		subMACs,
+		subMembers,
+		subExit,
+		subNetworks,
+		subLeases,
+		subConflicts,
+		subKey,
 	},
 }
 
+// networkFlag selects the network of a command, the primary network of the daemon if empty
+var networkFlag = &cli.StringFlag{Name: "network", Aliases: []string{"n"}, Usage: "network name, the primary network if empty"}
+
 var subTest = &cli.Command{
 	Name:  "test",
 	Usage: "test tier network",
@@ -46,7 +61,7 @@ var subTest = &cli.Command{
 		&cli.StringFlag{Name: "data", Usage: "Packet body data", Value: "hello"},
 	},
 	Action: func(c *cli.Context) error {
-		addr := fmt.Sprintf("%s:%d", c.String("host"), c.Int("port"))
+		addr := net.JoinHostPort(c.String("host"), strconv.Itoa(c.Int("port")))
 		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
 		if err != nil {
 			return fmt.Errorf("failed to connect: %w", err)
@@ -93,8 +108,9 @@ var subTest = &cli.Command{
 var subPeers = &cli.Command{
 	Name:  "peers",
 	Usage: "Get peers",
+	Flags: []cli.Flag{networkFlag},
 	Action: func(c *cli.Context) error {
-		req, err := message.New(message.KindPeers, &message.PeersReq{Network: "tao"})
+		req, err := message.New(message.KindPeers, &message.PeersReq{Network: c.String("network")})
 		if err != nil {
 			log.Printf("[peers] new req error: %v", err)
 			return err
@@ -103,9 +119,285 @@ var subPeers = &cli.Command{
 		if err != nil {
 			log.Fatalf("[peers] get resp error: %v", err)
 		}
-		if err := print.PrintPeers(resp.Peers); err != nil {
+		if resp.Error != "" {
+			return fmt.Errorf("get peers error: %s", resp.Error)
+		}
+		if err := print.PrintPeers(resp.Peers, resp.Usage); err != nil {
+			return err
+		}
+		return nil
+	},
+}
+
+var subAnycast = &cli.Command{
+	Name:  "anycast",
+	Usage: "Get anycast service VIPs and their claimants",
+	Flags: []cli.Flag{networkFlag},
+	Action: func(c *cli.Context) error {
+		req, err := message.New(message.KindAnycast, &message.AnycastReq{Network: c.String("network")})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.AnycastResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("get anycast error: %s", resp.Error)
+		}
+		return print.PrintAnycast(resp.Services)
+	},
+}
+
+var subMACs = &cli.Command{
+	Name:  "macs",
+	Usage: "Get the MAC addresses learned in TAP mode",
+	Flags: []cli.Flag{networkFlag},
+	Action: func(c *cli.Context) error {
+		req, err := message.New(message.KindMACs, &message.MACsReq{Network: c.String("network")})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.MACsResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("get macs error: %s", resp.Error)
+		}
+		return print.PrintMACs(resp.MACs)
+	},
+}
+
+var subMembers = &cli.Command{
+	Name:  "members",
+	Usage: "Get the cluster members and their state as seen by the gossip",
+	Flags: []cli.Flag{networkFlag},
+	Action: func(c *cli.Context) error {
+		req, err := message.New(message.KindMembers, &message.MembersReq{Network: c.String("network")})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.MembersResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("get members error: %s", resp.Error)
+		}
+		return print.PrintMembers(resp.Members)
+	},
+}
+
+var subLeases = &cli.Command{
+	Name:  "leases",
+	Usage: "Get the addresses this node handed out to DHCP nodes",
+	Flags: []cli.Flag{networkFlag},
+	Action: func(c *cli.Context) error {
+		req, err := message.New(message.KindLeases, &message.LeasesReq{Network: c.String("network")})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.LeasesResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("get leases error: %s", resp.Error)
+		}
+		return print.PrintLeases(resp.Leases)
+	},
+}
+
+var subConflicts = &cli.Command{
+	Name:  "conflicts",
+	Usage: "Get the handshakes rejected for a duplicate id or virtual ip",
+	Flags: []cli.Flag{networkFlag},
+	Action: func(c *cli.Context) error {
+		req, err := message.New(message.KindConflicts, &message.ConflictsReq{Network: c.String("network")})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.ConflictsResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("get conflicts error: %s", resp.Error)
+		}
+		return print.PrintConflicts(resp.Conflicts)
+	},
+}
+
+var subKey = &cli.Command{
+	Name:      "key",
+	Usage:     "Show or rotate the identity keypair of the node, the node id derives from it",
+	UsageText: "skytier-cli key [show | rotate]",
+	Action: func(c *cli.Context) error {
+		action := c.Args().First()
+		switch action {
+		case "", "show", "rotate":
+		default:
+			return fmt.Errorf("unknown key action: %q", action)
+		}
+
+		req, err := message.New(message.KindIdentity, &message.IdentityReq{Rotate: action == "rotate"})
+		if err != nil {
 			return err
 		}
+		resp, err := unix_socket.Get[message.IdentityResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("key error: %s", resp.Error)
+		}
+		return print.PrintIdentity(resp.Identity)
+	},
+}
+
+var subNetworks = &cli.Command{
+	Name:  "networks",
+	Usage: "Get the networks joined by the daemon",
+	Action: func(c *cli.Context) error {
+		req, err := message.New(message.KindNetworks, &message.NetworksReq{})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.NetworksResp](req)
+		if err != nil {
+			return err
+		}
+		return print.PrintNetworks(resp.Networks)
+	},
+}
+
+var subExit = &cli.Command{
+	Name:      "exit",
+	Usage:     "Show exit nodes, control the clients of this exit node or select the exit node to use",
+	UsageText: "skytier-cli exit [--network <name>] [status | allow <peer-id> | deny <peer-id> | via <peer-id>]",
+	Flags:     []cli.Flag{networkFlag},
+	Action: func(c *cli.Context) error {
+		action := c.Args().First()
+		if action == "" {
+			action = message.ExitStatus
+		}
+		switch action {
+		case message.ExitStatus:
+		case message.ExitAllow, message.ExitDeny:
+			if c.Args().Get(1) == "" {
+				return fmt.Errorf("%s needs a peer id", action)
+			}
+		case message.ExitVia:
+			// an empty peer id disables the exit node
+		default:
+			return fmt.Errorf("unknown exit action: %q", action)
+		}
+
+		req, err := message.New(message.KindExit, &message.ExitReq{
+			Network: c.String("network"),
+			Action:  action,
+			Peer:    c.Args().Get(1),
+		})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.ExitResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("exit error: %s", resp.Error)
+		}
+		return print.PrintExit(resp.Status)
+	},
+}
+
+var subLimit = &cli.Command{
+	Name:      "limit",
+	Usage:     "Set bandwidth limits and traffic quota of a peer or network",
+	UsageText: "skytier-cli limit --peer <id> --in 1M --out 512K --quota 10G --period month --action throttle --throttle 64K",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "peer", Usage: "peer id, limited in the network of --network, the network itself is limited if empty"},
+		networkFlag,
+		&cli.StringFlag{Name: "in", Usage: "ingress rate in bytes/s, e.g. 1M"},
+		&cli.StringFlag{Name: "in-burst", Usage: "ingress burst in bytes"},
+		&cli.StringFlag{Name: "out", Usage: "egress rate in bytes/s, e.g. 512K"},
+		&cli.StringFlag{Name: "out-burst", Usage: "egress burst in bytes"},
+		&cli.StringFlag{Name: "quota", Usage: "traffic quota in bytes per period, e.g. 10G"},
+		&cli.StringFlag{Name: "period", Usage: "quota period: day or month"},
+		&cli.StringFlag{Name: "action", Usage: "action once the quota is exceeded: block or throttle", Value: string(ratelimit.ActionBlock)},
+		&cli.StringFlag{Name: "throttle", Usage: "rate in bytes/s once throttled"},
+	},
+	Action: func(c *cli.Context) error {
+		var limit ratelimit.Limit
+		for _, f := range []struct {
+			name string
+			dst  *uint64
+		}{
+			{"in", &limit.IngressRate},
+			{"in-burst", &limit.IngressBurst},
+			{"out", &limit.EgressRate},
+			{"out-burst", &limit.EgressBurst},
+			{"quota", &limit.Quota},
+			{"throttle", &limit.ThrottleRate},
+		} {
+			v, err := parseBytes(c.String(f.name))
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %w", f.name, err)
+			}
+			*f.dst = v
+		}
+		limit.Period = ratelimit.Period(c.String("period"))
+		limit.Action = ratelimit.QuotaAction(c.String("action"))
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+
+		req, err := message.New(message.KindLimit, &message.LimitReq{
+			Network: c.String("network"),
+			Peer:    c.String("peer"),
+			Limit:   limit,
+		})
+		if err != nil {
+			return err
+		}
+		resp, err := unix_socket.Get[message.LimitResp](req)
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("set limit error: %s", resp.Error)
+		}
+		fmt.Println("✅ Limit updated.")
 		return nil
 	},
 }
+
+// parseBytes parses sizes like 512, 64K, 10M or 2G (base 1024)
+func parseBytes(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "B")
+	unit := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		unit = 1 << 40
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return v * unit, nil
+}
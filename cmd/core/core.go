@@ -3,9 +3,12 @@ package main
 import (
 	"github.com/urfave/cli/v2"
 	"kevin-rd/my-tier/internal/core"
+	"kevin-rd/my-tier/internal/peer"
 	"kevin-rd/my-tier/pkg/utils"
 	"log"
 	"os"
+	"strings"
+	"syscall"
 )
 
 const version = "latest"
@@ -18,14 +21,166 @@ var app = &cli.App{
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "id",
-			Usage: "id name of this tier",
+			Usage: "id name of this tier, derived from the identity key in the state dir if empty",
 			Value: "",
 		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "name of the overlay network, peers are resolved as <id>.<network>.sky",
+			Value: "default",
+		},
+		&cli.StringFlag{
+			Name:    "secret",
+			Usage:   "secret of the network, peers without it are rejected at handshake",
+			EnvVars: []string{"SKYTIER_SECRET"},
+		},
+		&cli.GenericFlag{
+			Name:  "join",
+			Usage: "join another network, repeatable: name=office,vip=10.1.0.1/24|dhcp[,port=6781][,tun=skytier1][,secret=...][,pool=...][,peer=host:port]..., not with --netstack",
+			Value: &networksFlag{},
+		},
+		&cli.StringFlag{
+			Name:  "virtual-ip",
+			Usage: "virtual ip of this tier, e.g. 10.0.0.1/24, or dhcp to lease one from the peers; the first node needs a static one",
+			Value: "dhcp",
+		},
+		&cli.StringFlag{
+			Name:  "dhcp-pool",
+			Usage: "addresses handed out to dhcp nodes, e.g. 10.0.0.100-10.0.0.200, the whole subnet if empty, off to hand out none",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dhcp-reserve",
+			Usage: "reserve an address for a node id, id=ip",
+		},
+		&cli.DurationFlag{
+			Name:  "dhcp-lease",
+			Usage: "lease time of the handed out addresses",
+			Value: peer.DefaultLeaseTTL,
+		},
 		&cli.IntFlag{
 			Name:  "fixed-port",
 			Usage: "fixed port for mixed server",
 			Value: 0,
 		},
+		&cli.IntFlag{
+			Name:  "mtu",
+			Usage: "overlay MTU",
+			Value: 1420,
+		},
+		&cli.BoolFlag{
+			Name:  "mss-clamp",
+			Usage: "clamp the TCP MSS of SYNs to the overlay MTU, disable with --mss-clamp=false",
+			Value: true,
+		},
+		&cli.Uint64Flag{
+			Name:  "broadcast-rate",
+			Usage: "broadcast and multicast packets per second of every source, IPv4 groups are snooped with IGMP, IPv6 multicast (MLD) is not snooped",
+			Value: 200,
+		},
+		&cli.DurationFlag{
+			Name:  "keepalive",
+			Usage: "ping peers silent for this long",
+			Value: peer.DefaultLiveness.Keepalive,
+		},
+		&cli.DurationFlag{
+			Name:  "suspect-after",
+			Usage: "silence which marks a peer suspect, routes avoid it",
+			Value: peer.DefaultLiveness.SuspectAfter,
+		},
+		&cli.DurationFlag{
+			Name:  "dead-after",
+			Usage: "silence which evicts a peer, static peers handshake again",
+			Value: peer.DefaultLiveness.DeadAfter,
+		},
+		&cli.StringFlag{
+			Name:  "state-dir",
+			Usage: "directory to keep state across restarts, e.g. the identity key, default /var/lib/skytier or ~/.config/skytier without root",
+		},
+		&cli.StringSliceFlag{
+			Name:  "anycast",
+			Usage: "claim an anycast service VIP, e.g. 10.0.100.10 or 10.0.100.10@50 with weight",
+		},
+		&cli.StringSliceFlag{
+			Name:  "nat",
+			Usage: "map a remote network prefix 1:1 to a local one, [network:]remote=local, e.g. office:192.168.100.0/24=10.200.0.0/24, the primary network without a network",
+		},
+		&cli.StringFlag{
+			Name:  "tun",
+			Usage: "TUN interface name, no TUN is created if empty",
+			Value: "skytier0",
+		},
+		&cli.BoolFlag{
+			Name:  "tap",
+			Usage: "create a TAP instead of a TUN and carry Ethernet frames, e.g. to bridge it",
+		},
+		&cli.IntFlag{
+			Name:  "queues",
+			Usage: "number of TUN queues and UDP sockets, each handled by its own worker",
+			Value: 1,
+		},
+		&cli.BoolFlag{
+			Name:  "offload",
+			Usage: "open the TUN with segmentation offload, TCP super-packets are split and coalesced",
+		},
+		&cli.BoolFlag{
+			Name:  "netstack",
+			Usage: "run a userspace network stack instead of a TUN, no root needed",
+		},
+		&cli.StringFlag{
+			Name:  "socks5",
+			Usage: "SOCKS5 proxy address into the overlay in netstack mode",
+			Value: "127.0.0.1:1080",
+		},
+		&cli.StringFlag{
+			Name:  "http-connect",
+			Usage: "HTTP CONNECT proxy address into the overlay in netstack mode, disabled if empty",
+		},
+		&cli.StringSliceFlag{
+			Name:  "forward",
+			Usage: "forward an overlay TCP port to a local address in netstack mode, port=host:port, e.g. 8080=127.0.0.1:80",
+		},
+		&cli.BoolFlag{
+			Name:  "dns",
+			Usage: "serve the peer names on the virtual ip, disable with --dns=false",
+			Value: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-upstream",
+			Usage: "resolver for the names outside the overlay, the name servers of /etc/resolv.conf if empty",
+		},
+		&cli.StringFlag{
+			Name:  "split-dns",
+			Usage: "point the host resolver to the overlay dns: resolved, resolvconf or auto",
+		},
+		&cli.BoolFlag{
+			Name:  "configure-tun",
+			Usage: "assign the virtual ip, MTU and routes to the TUN, disable with --configure-tun=false",
+			Value: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "advertise-subnet",
+			Usage: "advertise a subnet reachable behind this node, e.g. 192.168.1.0/24",
+		},
+		&cli.BoolFlag{
+			Name:  "accept-routes",
+			Usage: "install the routes of the subnets advertised by peers, needs --configure-tun",
+		},
+		&cli.StringSliceFlag{
+			Name:  "accept-subnet",
+			Usage: "install the routes of the subnets advertised by peers inside this prefix, e.g. 192.168.0.0/16",
+		},
+		&cli.BoolFlag{
+			Name:  "exit-node",
+			Usage: "advertise this node as exit node, traffic of clients is masqueraded to the internet",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exit-allow",
+			Usage: "peer ids allowed to use this exit node, all peers if empty",
+		},
+		&cli.StringFlag{
+			Name:  "exit-via",
+			Usage: "peer id of the exit node to route traffic outside the overlay through, with --configure-tun the default route leads into the TUN",
+		},
 		&cli.StringSliceFlag{
 			Name:    "peer",
 			Aliases: []string{"p"},
@@ -37,10 +192,31 @@ var app = &cli.App{
 		log.Println("starting my-tier core")
 		e := core.New(
 			core.WithID(c.String("id")),
-			core.WithVirtualIP("10.0.0.1"),
+			core.WithNetwork(c.String("network")),
+			core.WithSecret(c.String("secret")),
+			core.WithNetworks(*c.Generic("join").(*networksFlag)...),
+			core.WithVirtualIP(c.String("virtual-ip")),
 			core.WithFixedPort(c.Int("fixed-port")),
-			core.WithTunName(""),
+			core.WithTunName(c.String("tun")),
+			core.WithTAP(c.Bool("tap")),
+			core.WithQueues(c.Int("queues")),
+			core.WithOffload(c.Bool("offload")),
+			core.WithNetstack(c.Bool("netstack"), c.String("socks5"), c.String("http-connect"), c.StringSlice("forward")...),
+			core.WithDNS(c.Bool("dns"), c.String("split-dns"), c.StringSlice("dns-upstream")...),
+			core.WithConfigureTun(c.Bool("configure-tun")),
+			core.WithSubnets(c.StringSlice("advertise-subnet")...),
+			core.WithAcceptSubnets(c.Bool("accept-routes"), c.StringSlice("accept-subnet")...),
+			core.WithStateDir(c.String("state-dir")),
+			core.WithMTU(c.Int("mtu")),
+			core.WithMSSClamp(c.Bool("mss-clamp")),
+			core.WithBroadcastRate(c.Uint64("broadcast-rate")),
 			core.WithPublicAddr(c.StringSlice("peer")...),
+			core.WithDHCPPool(c.String("dhcp-pool"), c.Duration("dhcp-lease"), c.StringSlice("dhcp-reserve")...),
+			core.WithLiveness(c.Duration("keepalive"), c.Duration("suspect-after"), c.Duration("dead-after")),
+			core.WithAnycast(c.StringSlice("anycast")...),
+			core.WithNAT(c.StringSlice("nat")...),
+			core.WithExitNode(c.Bool("exit-node"), c.StringSlice("exit-allow")...),
+			core.WithExitVia(c.String("exit-via")),
 		)
 
 		go func() {
@@ -49,10 +225,31 @@ var app = &cli.App{
 			}
 		}()
 
-		utils.WaitSignal([]os.Signal{os.Interrupt}, func() {
+		utils.WaitSignal([]os.Signal{os.Interrupt, syscall.SIGTERM}, func() {
 			log.Println("Stopping...")
 			e.Stop()
 		})
 		return nil
 	},
 }
+
+// networksFlag collects the repeated --join flags, unlike a string slice flag it keeps
+// the commas of a network spec
+type networksFlag []core.NetworkConfig
+
+func (f *networksFlag) Set(s string) error {
+	nc, err := core.ParseNetwork(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, nc)
+	return nil
+}
+
+func (f *networksFlag) String() string {
+	names := make([]string, 0, len(*f))
+	for _, nc := range *f {
+		names = append(names, nc.Name)
+	}
+	return strings.Join(names, ",")
+}
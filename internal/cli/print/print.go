@@ -1,17 +1,28 @@
 package print
 
 import (
+	"fmt"
 	"github.com/olekukonko/tablewriter"
 	"github.com/olekukonko/tablewriter/renderer"
 	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/ratelimit"
+	"kevin-rd/my-tier/internal/router"
+	"kevin-rd/my-tier/pkg/ipc/message"
 	"os"
+	"time"
 )
 
-func PrintPeers(peers []*peer.Peer) error {
+func PrintPeers(peers []*peer.Peer, usage map[string]ratelimit.Usage) error {
 	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
-	table.Header([]string{"ID", "VirtualIP", "RemoteAddr", "State"})
+	table.Header([]string{"ID", "VirtualIP", "RemoteAddr", "State", "Queue", "Dropped", "RX", "TX", "Quota"})
 	for _, p := range peers {
-		_ = table.Append([]any{p.ID, p.VirtualIP, p.RemoteAddr, p.State})
+		u := usage[p.ID]
+		quota := "ok"
+		if u.Exceeded {
+			quota = "exceeded"
+		}
+		_ = table.Append([]any{p.ID, p.VirtualIP, p.RemoteAddr, peer.StateName(p.State()), p.Queue.Depth, p.Queue.Dropped,
+			formatBytes(u.RxBytes), formatBytes(u.TxBytes), quota})
 	}
 
 	if err := table.Render(); err != nil {
@@ -19,3 +30,150 @@ func PrintPeers(peers []*peer.Peer) error {
 	}
 	return nil
 }
+
+func PrintAnycast(services []router.AnycastService) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"VIP", "Local", "Claimant", "ClaimantVIP", "Weight", "Healthy", "Latency"})
+	for _, s := range services {
+		if len(s.Claimants) == 0 {
+			_ = table.Append([]any{s.VIP, s.Local, "", "", "", "", ""})
+		}
+		for _, c := range s.Claimants {
+			_ = table.Append([]any{s.VIP, s.Local, c.ID, c.VIP, c.Weight, c.Healthy, c.Latency})
+		}
+	}
+
+	if err := table.Render(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func PrintMACs(macs []router.MACEntry) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"MAC", "Peer", "VIP", "Age"})
+	for _, m := range macs {
+		_ = table.Append([]any{m.MAC, m.ID, m.VIP, fmt.Sprintf("%ds", m.Age)})
+	}
+
+	if err := table.Render(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func PrintMembers(members []peer.Member) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"ID", "VirtualIP", "Addr", "State", "Incarnation", "Since"})
+	for _, m := range members {
+		since := "-"
+		if !m.Since.IsZero() {
+			since = fmt.Sprintf("%ds", int(time.Since(m.Since).Seconds()))
+		}
+		_ = table.Append([]any{m.ID, m.VirtualIP, m.Addr, peer.MemberStateName(m.State), m.Incarnation, since})
+	}
+
+	if err := table.Render(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func PrintLeases(leases []peer.Lease) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"ID", "VirtualIP", "Expires", "Reserved"})
+	for _, l := range leases {
+		expires := "-"
+		if !l.Expires.IsZero() {
+			expires = fmt.Sprintf("%ds", int(time.Until(l.Expires).Seconds()))
+		}
+		_ = table.Append([]any{l.ID, l.VirtualIP, expires, l.Reserved})
+	}
+
+	if err := table.Render(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func PrintConflicts(conflicts []peer.Conflict) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"Reason", "ID", "VirtualIP", "RemoteAddr", "Holder", "RejectedBy", "Count", "Last"})
+	for _, c := range conflicts {
+		holder, by := c.Holder, c.RejectedBy
+		if holder == "" {
+			holder = "-"
+		}
+		if by == "" {
+			by = "self"
+		}
+		_ = table.Append([]any{c.Reason, c.ID, c.VirtualIP, c.RemoteAddr, holder, by, c.Count, c.Last.Format(time.TimeOnly)})
+	}
+
+	if err := table.Render(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func PrintNetworks(networks []message.Network) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"Name", "VirtualIP", "UDPPort", "Tun", "Secret", "Peers", "Primary"})
+	for _, n := range networks {
+		_ = table.Append([]any{n.Name, n.VirtualIP, n.UDPPort, n.Tun, n.Secret, n.Peers, n.Primary})
+	}
+
+	if err := table.Render(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func PrintIdentity(id message.Identity) error {
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"ID", "KeyID", "PublicKey", "KeyAgreement", "Path"})
+	_ = table.Append([]any{id.ID, id.KeyID, id.PublicKey, id.KeyAgreement, id.Path})
+	if err := table.Render(); err != nil {
+		return err
+	}
+	if id.Restart {
+		fmt.Println("the key was rotated, restart the node to use it")
+	}
+	return nil
+}
+
+func PrintExit(status router.ExitStatus) error {
+	fmt.Printf("exit node: %v, allow all clients: %v, via: %q\n", status.Enabled, status.AllowAll, status.Via)
+
+	table := tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"ExitNode", "VIP", "Selected", "Healthy"})
+	for _, n := range status.Nodes {
+		_ = table.Append([]any{n.ID, n.VIP, n.Selected, n.Healthy})
+	}
+	if err := table.Render(); err != nil {
+		return err
+	}
+
+	if len(status.Clients) == 0 {
+		return nil
+	}
+	table = tablewriter.NewTable(os.Stdout, tablewriter.WithRenderer(renderer.NewMarkdown()))
+	table.Header([]string{"Client", "Allowed"})
+	for _, c := range status.Clients {
+		_ = table.Append([]any{c.ID, c.Allowed})
+	}
+	return table.Render()
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,17 +2,96 @@ package core
 
 import (
 	"fmt"
+	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/router"
+	"kevin-rd/my-tier/internal/tun"
 	"kevin-rd/my-tier/pkg/utils"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	ID        string // limit 32 bits
-	VirtualIP string // e.g. "192.168.10.1/24"
+	// ID limit 32 bytes, derived from the identity key in StateDir if empty
+	ID string
+	// Network is the name of the overlay network, peers are named <id>.<network>.sky
+	Network string
+	// Secret authenticates the handshakes of the network, it is open if empty
+	Secret    string
+	VirtualIP string // e.g. "192.168.10.1/24", or DHCP to lease one from the peers
 	UDPPort   int
 	TunName   string
+	// TAP creates a TAP instead of a TUN, the overlay carries Ethernet frames
+	TAP bool
+	// Queues is the number of TUN queues and UDP sockets, each with its own worker, and of
+	// the goroutines sending to the peers
+	Queues int
+	// Offload opens the TUN with segmentation offload (virtio-net header, GSO/GRO)
+	Offload bool
+	// Netstack runs a userspace TCP/IP stack instead of a TUN, no root needed.
+	// Applications use the SOCKS5 and HTTP CONNECT proxies, Forwards expose local ports.
+	Netstack        bool
+	SOCKS5Addr      string
+	HTTPConnectAddr string
+	// Forwards relay overlay TCP ports to local addresses, "port=host:port"
+	Forwards []string
+	// ConfigureTun assigns VirtualIP and MTU to the created TUN, brings it up and installs the routes
+	ConfigureTun bool
+	// Device is used instead of creating a TUN named TunName, e.g. an in-memory tun.Pipe
+	Device tun.Device
+	MTU    int // overlay MTU of the TUN device
+	// MSSClamp rewrites the TCP MSS option of SYNs crossing TUN to fit MTU
+	MSSClamp bool
+	// BroadcastRate limits broadcast and multicast packets per second of every source, the
+	// only protection of the multicast which is not snooped like IPv6 (MLD)
+	BroadcastRate uint64
+	// StateDir keeps the state across restarts, e.g. traffic usage and the identity key
+	StateDir string
 
 	Peers []string
+	// DHCPPool is the range handed out to the DHCP nodes, "10.0.0.100-10.0.0.200", the
+	// whole subnet if empty or "off". DHCPReserve keeps addresses for node ids, "id=ip".
+	DHCPPool    string
+	DHCPReserve []string
+	LeaseTTL    time.Duration
+	// Liveness pings silent peers, marks them suspect and evicts the dead ones
+	Liveness peer.Liveness
+
+	// DNS serves the peer names on VirtualIP:53, other names go to DNSUpstreams,
+	// the name servers of resolv.conf if empty
+	DNS          bool
+	DNSUpstreams []string
+	// SplitDNS points the host resolver for the overlay names to the DNS server:
+	// "resolved", "resolvconf", "auto" for resolved if it is running, or "" to leave it
+	SplitDNS string
+
+	// Anycast service VIPs claimed by this node, e.g. "10.0.100.10" or "10.0.100.10@50" with weight
+	Anycast []string
+
+	// NAT maps remote network prefixes 1:1 to local ones, "[network:]remote=local". A rule
+	// applies to the network it names, the primary network without a name.
+	NAT []string
+
+	// Subnets reachable behind this node advertised to the peers, e.g. "192.168.1.0/24"
+	Subnets []string
+	// AcceptRoutes installs the routes of all the subnets advertised by peers, AcceptSubnets
+	// the ones inside its prefixes. No subnet route is installed without them.
+	AcceptRoutes  bool
+	AcceptSubnets []string
+
+	// ExitNode advertises this node as exit node, ExitAllow limits its clients by peer id
+	ExitNode  bool
+	ExitAllow []string
+	// ExitVia is the peer id of the exit node the traffic outside the overlay is routed through.
+	// A configured TUN gets the split default routes, the peer endpoints bypass them.
+	ExitVia string
+
+	// Networks are joined next to the primary network configured above, each one with its
+	// own subnet, credentials, peers, UDP port and TUN
+	Networks []NetworkConfig
 
 	// Deprecated: PublicServerAddr is the address of the public server.
 	PublicServerAddr string
@@ -20,9 +99,18 @@ type Config struct {
 
 func NewConfig(opts ...Option) *Config {
 	c := &Config{
-		ID:        utils.RandomString(16),
+		Network:   "default",
 		UDPPort:   6780,
 		VirtualIP: "192.168.100.1/24",
+		StateDir:  defaultStateDir(),
+		MTU:       router.DefaultMTU,
+		MSSClamp:  true,
+
+		DNS:           true,
+		Queues:        1,
+		ConfigureTun:  true,
+		BroadcastRate: router.DefaultBroadcastRate,
+		Liveness:      peer.DefaultLiveness,
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -32,6 +120,9 @@ func NewConfig(opts ...Option) *Config {
 
 type Option func(*Config)
 
+// DHCP as VirtualIP leases the address from the peers
+const DHCP = "dhcp"
+
 func WithID(id string) Option {
 	return func(c *Config) {
 		if id == "" {
@@ -43,22 +134,27 @@ func WithID(id string) Option {
 
 func WithVirtualIP(ipStr string) Option {
 	return func(c *Config) {
-		ip, ipNet, err := net.ParseCIDR(ipStr)
-		if err == nil && ip != nil {
-			ip = ip.To4()
-			if ip != nil {
-				c.VirtualIP = fmt.Sprintf("%s/%d", ip.String(), ipNet.Mask)
-				return
-			}
-		}
-		ip = net.ParseIP(ipStr)
-		if ip != nil {
-			c.VirtualIP = fmt.Sprintf("%s/24", ip.String())
-			return
+		if strings.EqualFold(ipStr, DHCP) {
+			c.VirtualIP = DHCP
+		} else if vip, ok := parseVirtualIP(ipStr); ok {
+			c.VirtualIP = vip
 		}
 	}
 }
 
+// parseVirtualIP normalizes an IPv4 CIDR, a bare address gets a /24
+func parseVirtualIP(s string) (string, bool) {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err == nil && ip.To4() != nil {
+		ones, _ := ipNet.Mask.Size()
+		return fmt.Sprintf("%s/%d", ip.To4(), ones), true
+	}
+	if ip = net.ParseIP(s).To4(); ip != nil {
+		return fmt.Sprintf("%s/24", ip), true
+	}
+	return "", false
+}
+
 func WithFixedPort(port int) Option {
 	return func(c *Config) {
 		if port > 0 && port < 65535 {
@@ -73,8 +169,310 @@ func WithTunName(tunName string) Option {
 	}
 }
 
+func WithQueues(n int) Option {
+	return func(c *Config) {
+		if n > 0 {
+			c.Queues = n
+		}
+	}
+}
+
+func WithOffload(enable bool) Option {
+	return func(c *Config) {
+		c.Offload = enable
+	}
+}
+
+// WithNetstack replaces the TUN with a userspace stack, the proxies listen on the given
+// local addresses, empty ones are disabled.
+func WithNetstack(enable bool, socks5Addr, httpConnectAddr string, forwards ...string) Option {
+	return func(c *Config) {
+		c.Netstack = enable
+		c.SOCKS5Addr = socks5Addr
+		c.HTTPConnectAddr = httpConnectAddr
+		c.Forwards = forwards
+	}
+}
+
+func WithConfigureTun(enable bool) Option {
+	return func(c *Config) {
+		c.ConfigureTun = enable
+	}
+}
+
+func WithTAP(enable bool) Option {
+	return func(c *Config) {
+		c.TAP = enable
+	}
+}
+
+// WithDevice makes the core use dev as its TUN, it is closed on Stop
+func WithDevice(dev tun.Device) Option {
+	return func(c *Config) {
+		c.Device = dev
+	}
+}
+
+// WithDHCPPool sets the addresses handed out to the DHCP nodes, see Config.DHCPPool
+func WithDHCPPool(pool string, ttl time.Duration, reservations ...string) Option {
+	return func(c *Config) {
+		c.DHCPPool = pool
+		c.LeaseTTL = ttl
+		c.DHCPReserve = reservations
+	}
+}
+
+// parsePool parses "10.0.0.100-10.0.0.200"
+func parsePool(s string) (utils.IPv4, utils.IPv4, error) {
+	from, to, _ := strings.Cut(s, "-")
+	first, last := net.ParseIP(from).To4(), net.ParseIP(to).To4()
+	if first == nil || last == nil {
+		return utils.IPv4{}, utils.IPv4{}, fmt.Errorf("invalid dhcp pool: %q", s)
+	}
+	return utils.IPv4(first), utils.IPv4(last), nil
+}
+
 func WithPublicAddr(addr ...string) Option {
 	return func(c *Config) {
 		c.Peers = addr
 	}
 }
+
+// defaultStateDir is /var/lib/skytier for root, a node without root, e.g. one running
+// netstack, keeps its state in the user config directory
+func defaultStateDir() string {
+	if os.Geteuid() != 0 {
+		if dir, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(dir, "skytier")
+		}
+	}
+	return "/var/lib/skytier"
+}
+
+func WithStateDir(dir string) Option {
+	return func(c *Config) {
+		if dir != "" {
+			c.StateDir = dir
+		}
+	}
+}
+
+func WithMTU(mtu int) Option {
+	return func(c *Config) {
+		if mtu >= 576 && mtu <= 65535 {
+			c.MTU = mtu
+		}
+	}
+}
+
+func WithMSSClamp(enable bool) Option {
+	return func(c *Config) {
+		c.MSSClamp = enable
+	}
+}
+
+func WithBroadcastRate(pps uint64) Option {
+	return func(c *Config) {
+		if pps > 0 {
+			c.BroadcastRate = pps
+		}
+	}
+}
+
+// WithLiveness sets the keepalive interval and the silences marking a peer suspect and
+// dead, zero keeps the default
+func WithLiveness(keepalive, suspectAfter, deadAfter time.Duration) Option {
+	return func(c *Config) {
+		if keepalive > 0 {
+			c.Liveness.Keepalive = keepalive
+		}
+		if suspectAfter > 0 {
+			c.Liveness.SuspectAfter = suspectAfter
+		}
+		if deadAfter > 0 {
+			c.Liveness.DeadAfter = deadAfter
+		}
+	}
+}
+
+func WithAnycast(vips ...string) Option {
+	return func(c *Config) {
+		c.Anycast = vips
+	}
+}
+
+// parseAnycast parses "10.0.100.10" or "10.0.100.10@50"
+func parseAnycast(s string) (utils.IPv4, uint16, error) {
+	addr, weightStr, _ := strings.Cut(s, "@")
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return utils.IPv4{}, 0, fmt.Errorf("invalid anycast ip: %q", addr)
+	}
+	var weight uint64
+	if weightStr != "" {
+		var err error
+		if weight, err = strconv.ParseUint(weightStr, 10, 16); err != nil {
+			return utils.IPv4{}, 0, fmt.Errorf("invalid anycast weight: %q", weightStr)
+		}
+	}
+	return utils.IPv4(ip), uint16(weight), nil
+}
+
+func WithNAT(rules ...string) Option {
+	return func(c *Config) {
+		c.NAT = rules
+	}
+}
+
+func WithSubnets(prefixes ...string) Option {
+	return func(c *Config) {
+		c.Subnets = prefixes
+	}
+}
+
+// WithAcceptSubnets installs the routes of the subnets advertised by peers, all of them or
+// the ones inside the allowed prefixes
+func WithAcceptSubnets(all bool, allowed ...string) Option {
+	return func(c *Config) {
+		c.AcceptRoutes = all
+		c.AcceptSubnets = allowed
+	}
+}
+
+// parseSubnet parses an IPv4 prefix, the default route is refused
+func parseSubnet(s string) (*net.IPNet, error) {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid subnet: %q", s)
+	}
+	if ones, _ := prefix.Mask.Size(); ones == 0 {
+		return nil, fmt.Errorf("invalid subnet: %q, use an exit node for the default route", s)
+	}
+	prefix.IP = prefix.IP.To4()
+	return prefix, nil
+}
+
+func WithExitNode(enable bool, allow ...string) Option {
+	return func(c *Config) {
+		c.ExitNode = enable
+		c.ExitAllow = allow
+	}
+}
+
+func WithExitVia(id string) Option {
+	return func(c *Config) {
+		c.ExitVia = id
+	}
+}
+
+func WithNetwork(name string) Option {
+	return func(c *Config) {
+		if name != "" {
+			c.Network = name
+		}
+	}
+}
+
+func WithSecret(secret string) Option {
+	return func(c *Config) {
+		c.Secret = secret
+	}
+}
+
+// NetworkConfig is an additional network joined by the daemon
+type NetworkConfig struct {
+	Name      string
+	VirtualIP string
+	// UDPPort and TunName default to the ones of the primary network plus the index of the network
+	UDPPort int
+	TunName string
+	Secret  string
+	Peers   []string
+	// Pool is the DHCP pool, see Config.DHCPPool
+	Pool string
+}
+
+// ParseNetwork parses "name=office,vip=10.1.0.1/24[,port=6781][,tun=skytier1][,secret=...][,pool=...][,peer=host:port]...",
+// vip may be dhcp and peer may be repeated
+func ParseNetwork(s string) (NetworkConfig, error) {
+	var nc NetworkConfig
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nc, fmt.Errorf("invalid network field %q in %q", field, s)
+		}
+		switch key {
+		case "name":
+			nc.Name = value
+		case "vip":
+			vip, ok := parseVirtualIP(value)
+			if strings.EqualFold(value, DHCP) {
+				vip, ok = DHCP, true
+			}
+			if !ok {
+				return nc, fmt.Errorf("invalid network vip: %q", value)
+			}
+			nc.VirtualIP = vip
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return nc, fmt.Errorf("invalid network port: %q", value)
+			}
+			nc.UDPPort = int(port)
+		case "tun":
+			nc.TunName = value
+		case "secret":
+			nc.Secret = value
+		case "peer":
+			nc.Peers = append(nc.Peers, value)
+		case "pool":
+			nc.Pool = value
+		default:
+			return nc, fmt.Errorf("unknown network field %q in %q", key, s)
+		}
+	}
+	if nc.Name == "" || nc.VirtualIP == "" {
+		return nc, fmt.Errorf("network needs a name and a vip: %q", s)
+	}
+	return nc, nil
+}
+
+func WithNetworks(networks ...NetworkConfig) Option {
+	return func(c *Config) {
+		c.Networks = networks
+	}
+}
+
+// networkConfig derives the configuration of the i-th additional network. The node wide
+// settings are shared, the routes, proxies and split DNS stay with the primary network. The
+// NAT rules are shared, every network picks the ones naming it.
+func (c *Config) networkConfig(i int) *Config {
+	nc := c.Networks[i]
+	n := *c
+	n.Network, n.VirtualIP, n.Secret, n.Peers = nc.Name, nc.VirtualIP, nc.Secret, nc.Peers
+	n.UDPPort = nc.UDPPort
+	if n.UDPPort == 0 {
+		n.UDPPort = c.UDPPort + i + 1
+	}
+	n.TunName = nc.TunName
+	if n.TunName == "" && c.TunName != "" {
+		n.TunName = fmt.Sprintf("%s%d", strings.TrimRight(c.TunName, "0123456789"), i+1)
+	}
+	n.DHCPPool, n.DHCPReserve = nc.Pool, nil
+	n.Networks = nil
+	n.Device = nil
+	n.Netstack, n.Forwards = false, nil
+	n.SplitDNS = ""
+	n.Anycast, n.Subnets = nil, nil
+	n.AcceptRoutes, n.AcceptSubnets = false, nil
+	n.ExitNode, n.ExitAllow, n.ExitVia = false, nil, ""
+	return &n
+}
+
+func WithDNS(enable bool, splitDNS string, upstreams ...string) Option {
+	return func(c *Config) {
+		c.DNS = enable
+		c.SplitDNS = splitDNS
+		c.DNSUpstreams = upstreams
+	}
+}
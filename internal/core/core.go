@@ -2,69 +2,247 @@
 package core
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"kevin-rd/my-tier/internal/identity"
 	"kevin-rd/my-tier/internal/ipc/unixsocket"
 	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/ratelimit"
 	"kevin-rd/my-tier/internal/router"
-	"kevin-rd/my-tier/internal/tun"
 	"kevin-rd/my-tier/pkg/ipc/message"
 	ipc_unix "kevin-rd/my-tier/pkg/ipc/unix_socket"
 	"kevin-rd/my-tier/pkg/utils"
 	"log"
 	"net"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// usageSaveInterval is how often the traffic usage is persisted
+	usageSaveInterval = time.Minute
+	// limiterIdle evicts the limiters of the peers which sent nothing for that long
+	limiterIdle = 30 * time.Minute
 )
 
 type Core struct {
 	config *Config
 
-	Tun *tun.TunDevice
+	// networks joined by the daemon, the first one is the primary network
+	networks []*network
 
 	// unix socket server
 	UnixSocket *unix_socket.UnixSocket
 
-	// udp server
-	udpServer *UDPServer
+	// bandwidth limits and quotas
+	limits *ratelimit.Registry
+
+	// identity is the keypair of the node, nil if it could not be loaded. rotated is set
+	// once it was replaced, the new one is used after a restart.
+	idMu     sync.Mutex
+	identity *identity.Identity
+	rotated  bool
 
-	peerManager *peer.Manager
+	stopCh chan struct{}
 }
 
 func New(opts ...Option) *Core {
 	cfg := NewConfig(opts...)
 
-	return &Core{
+	c := &Core{
 		config: cfg,
+		limits: ratelimit.NewRegistry(filepath.Join(cfg.StateDir, "usage.json"), cfg.MTU),
+		stopCh: make(chan struct{}),
 	}
+	c.loadIdentity()
+	// the peer managers are created here so that embedders may subscribe to the peer
+	// events before Run
+	c.networks = append(c.networks, newNetwork(cfg, true))
+	for i := range cfg.Networks {
+		c.networks = append(c.networks, newNetwork(cfg.networkConfig(i), false))
+	}
+	return c
 }
 
-func (c *Core) Run() error {
+// loadIdentity loads the keypair of the node from the state directory, it is created on
+// the first run. The node id derives from it unless one is configured, without a
+// configured id a key which cannot be loaded is fatal.
+func (c *Core) loadIdentity() {
+	id, err := identity.Load(filepath.Join(c.config.StateDir, identity.FileName))
+	if err != nil {
+		if c.config.ID == "" {
+			log.Fatalf("[core] load identity error: %v", err)
+		}
+		log.Printf("[core] load identity error: %v, using the configured id %s", err, c.config.ID)
+		return
+	}
+	c.identity = id
+	if c.config.ID == "" {
+		c.config.ID = id.ID()
+	}
+}
 
-	if c.config.TunName != "" {
-		t, err := tun.NewTunDevice(c.config.TunName)
+// identityInfo shows the identity of the node, rotate replaces its keypair
+func (c *Core) identityInfo(rotate bool) (message.Identity, error) {
+	path := filepath.Join(c.config.StateDir, identity.FileName)
+	c.idMu.Lock()
+	defer c.idMu.Unlock()
+	if rotate {
+		id, backup, err := identity.Rotate(path)
 		if err != nil {
-			log.Fatal(err)
+			return message.Identity{}, err
+		}
+		if backup != "" {
+			log.Printf("[core] old identity key kept as %s", backup)
 		}
-		c.Tun = t
+		log.Printf("[core] rotated identity %s, restart to use it", id.ID())
+		c.identity, c.rotated = id, true
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(3)
+	info := message.Identity{ID: c.config.ID, Path: path, Restart: c.rotated}
+	if c.identity == nil {
+		return info, fmt.Errorf("no identity key, %s could not be loaded", path)
+	}
+	info.KeyID = c.identity.ID()
+	info.PublicKey = base64.StdEncoding.EncodeToString(c.identity.PublicKey())
+	info.KeyAgreement = base64.StdEncoding.EncodeToString(c.identity.KeyAgreement().PublicKey().Bytes())
+	return info, nil
+}
 
-	// Peers Manager
-	vip := utils.Must2IPMask(c.config.VirtualIP)
-	c.peerManager = peer.NewManager(c.config.ID, vip, c.config.Peers...)
-	go func() {
-		defer wg.Done()
+// SubscribePeerEvents returns the peer connect, disconnect, endpoint and latency events
+// of the primary network, buffering up to size of them. Events are dropped while the
+// subscriber falls behind.
+func (c *Core) SubscribePeerEvents(size int) *peer.Subscription {
+	return c.networks[0].peerManager.Subscribe(size)
+}
 
-		if err := c.peerManager.Manage(); err != nil {
-			log.Fatalf("[core] peers manager error: %v", err)
+// UnsubscribePeerEvents stops the events of s and closes s.C
+func (c *Core) UnsubscribePeerEvents(s *peer.Subscription) {
+	c.networks[0].peerManager.Unsubscribe(s)
+}
+
+// network returns the network named name, the primary network if name is empty
+func (c *Core) network(name string) (*network, error) {
+	if name == "" {
+		return c.networks[0], nil
+	}
+	for _, n := range c.networks {
+		if strings.EqualFold(n.config.Network, name) {
+			return n, nil
 		}
-	}()
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+// checkNetworks rejects networks which would share a name, port or TUN. A joined network
+// always gets a TUN, so it cannot be combined with the userspace stack of a node which has
+// no root.
+func (c *Core) checkNetworks() error {
+	if c.config.Netstack && len(c.networks) > 1 {
+		return errors.New("netstack cannot be combined with joined networks, they need a TUN")
+	}
+	names, ports, tuns := map[string]bool{}, map[int]bool{}, map[string]bool{}
+	for _, n := range c.networks {
+		name := strings.ToLower(n.config.Network)
+		if names[name] {
+			return fmt.Errorf("duplicate network %q", n.config.Network)
+		}
+		if ports[n.config.UDPPort] {
+			return fmt.Errorf("network %q: udp port %d is used by another network", n.config.Network, n.config.UDPPort)
+		}
+		if t := n.config.TunName; t != "" && tuns[t] {
+			return fmt.Errorf("network %q: tun %s is used by another network", n.config.Network, t)
+		}
+		names[name], ports[n.config.UDPPort], tuns[n.config.TunName] = true, true, true
+	}
+	return nil
+}
+
+func (c *Core) Run() error {
+	if err := c.checkNetworks(); err != nil {
+		log.Fatalf("[core] %v", err)
+	}
+
+	if err := c.limits.Load(); err != nil {
+		log.Printf("[core] load traffic usage error: %v", err)
+	}
+	go c.saveUsage()
+
+	wg := &sync.WaitGroup{}
+	for _, n := range c.networks {
+		if err := n.start(c.limits, c.stopCh, wg); errors.Is(err, errStopped) {
+			return nil
+		} else if err != nil {
+			log.Fatalf("[core] network %s: %v", n.config.Network, err)
+		}
+	}
 
 	// Unix Socket Server
 	c.UnixSocket = unix_socket.NewServer(ipc_unix.UNIX_SOCKET_PATH)
-	c.UnixSocket.Register(message.KindPeers, c.UnixSocket.HandleGetPeers(c.peerManager.GetPeers))
+	c.UnixSocket.Register(message.KindPeers, c.UnixSocket.HandleGetPeers(func(name string) ([]*peer.Peer, error) {
+		n, err := c.network(name)
+		if err != nil {
+			return nil, err
+		}
+		return n.peerManager.GetPeers(""), nil
+	}, c.peerUsage))
+	c.UnixSocket.Register(message.KindLimit, c.UnixSocket.HandleSetLimit(c.setLimit))
+	c.UnixSocket.Register(message.KindAnycast, c.UnixSocket.HandleGetAnycast(func(name string) ([]router.AnycastService, error) {
+		n, err := c.network(name)
+		if err != nil {
+			return nil, err
+		}
+		return n.router.AnycastServices(), nil
+	}))
+	c.UnixSocket.Register(message.KindMACs, c.UnixSocket.HandleGetMACs(func(name string) ([]router.MACEntry, error) {
+		n, err := c.network(name)
+		if err != nil {
+			return nil, err
+		}
+		return n.router.MACTable(), nil
+	}))
+	c.UnixSocket.Register(message.KindMembers, c.UnixSocket.HandleGetMembers(func(name string) ([]peer.Member, error) {
+		n, err := c.network(name)
+		if err != nil {
+			return nil, err
+		}
+		return n.peerManager.Members(), nil
+	}))
+	c.UnixSocket.Register(message.KindExit, c.UnixSocket.HandleExit(func(req *message.ExitReq) (router.ExitStatus, error) {
+		n, err := c.network(req.Network)
+		if err != nil {
+			return router.ExitStatus{}, err
+		}
+		switch req.Action {
+		case message.ExitAllow, message.ExitDeny:
+			n.router.SetExitClient(req.Peer, req.Action == message.ExitAllow)
+		case message.ExitVia:
+			n.router.SetExitVia(req.Peer)
+			n.routeExit(req.Peer)
+		}
+		return n.router.ExitStatus(), nil
+	}))
+	c.UnixSocket.Register(message.KindLeases, c.UnixSocket.HandleGetLeases(func(name string) ([]peer.Lease, error) {
+		n, err := c.network(name)
+		if err != nil {
+			return nil, err
+		}
+		return n.peerManager.Leases(), nil
+	}))
+	c.UnixSocket.Register(message.KindConflicts, c.UnixSocket.HandleGetConflicts(func(name string) ([]peer.Conflict, error) {
+		n, err := c.network(name)
+		if err != nil {
+			return nil, err
+		}
+		return n.peerManager.Conflicts(), nil
+	}))
+	c.UnixSocket.Register(message.KindNetworks, c.UnixSocket.HandleGetNetworks(c.networkInfos))
+	c.UnixSocket.Register(message.KindIdentity, c.UnixSocket.HandleIdentity(c.identityInfo))
 	log.Printf("[core] start unix socket server on: %v", ipc_unix.UNIX_SOCKET_PATH)
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		if err := c.UnixSocket.ListenAndServe(); err != nil {
@@ -72,29 +250,90 @@ func (c *Core) Run() error {
 		}
 	}()
 
-	// UDP Server
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", c.config.UDPPort))
-	if err != nil {
-		log.Fatalf("[core] resolve udp addr error: %v", err)
-	}
-	c.udpServer = &UDPServer{
-		ListenAddr:  addr,
-		router:      router.NewRouter(c.Tun, c.peerManager),
-		peerManager: c.peerManager,
-	}
-	log.Printf("[core] start udp server on: %v", addr)
-	go func() {
-		defer wg.Done()
-		if err := c.udpServer.ListenAndServe(); err != nil {
-			log.Fatalf("[core] start udp server error: %v", err)
-		}
-	}()
-
 	wg.Wait()
 	log.Println("[core] all server done.")
 	return nil
 }
 
 func (c *Core) Stop() {
+	close(c.stopCh)
+	for _, n := range c.networks {
+		n.stop()
+	}
+	if err := c.limits.Save(); err != nil {
+		log.Printf("[core] save traffic usage error: %v", err)
+	}
+}
 
+// networkInfos describes the joined networks
+func (c *Core) networkInfos() []message.Network {
+	infos := make([]message.Network, 0, len(c.networks))
+	for _, n := range c.networks {
+		info := message.Network{
+			Name:      n.config.Network,
+			VirtualIP: n.config.VirtualIP,
+			UDPPort:   n.config.UDPPort,
+			Secret:    n.config.Secret != "",
+			Primary:   n.primary,
+		}
+		for _, p := range n.peerManager.GetPeers("") {
+			// self has no writer
+			if p.Writer != nil {
+				info.Peers++
+			}
+		}
+		if n.tun != nil {
+			info.Tun = n.tun.Name()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// overlaySubnet returns the network of vip in CIDR notation, e.g. 10.0.0.0/24
+func overlaySubnet(vip utils.IPMask) string {
+	_, ipNet, err := net.ParseCIDR(vip.String())
+	if err != nil {
+		return vip.String()
+	}
+	return ipNet.String()
+}
+
+// setLimit limits a peer in the network of req, or the network itself without a peer
+func (c *Core) setLimit(req *message.LimitReq) error {
+	n, err := c.network(req.Network)
+	if err != nil {
+		return err
+	}
+	if req.Peer != "" {
+		return c.limits.SetPeer(n.config.Network, req.Peer, req.Limit)
+	}
+	return c.limits.SetNetwork(n.config.Network, req.Limit)
+}
+
+// peerUsage returns the traffic usage of the peers in the network name
+func (c *Core) peerUsage(name string) map[string]ratelimit.Usage {
+	n, err := c.network(name)
+	if err != nil {
+		return nil
+	}
+	return c.limits.PeerUsage(n.config.Network)
+}
+
+// saveUsage persists the traffic usage and evicts the idle limiters periodically until
+// the core stops.
+func (c *Core) saveUsage() {
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.limits.Evict(limiterIdle)
+			if err := c.limits.Save(); err != nil {
+				log.Printf("[core] save traffic usage error: %v", err)
+			}
+		case <-c.stopCh:
+			return
+		}
+	}
 }
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// masqueradeRules lets the overlay subnet reach the internet through this node
+func masqueradeRules(subnet, tunName string) [][]string {
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", tunName, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", tunName, "-s", subnet, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", tunName, "-d", subnet, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+func iptables(action string, rule []string) error {
+	// rule is: -t <table> <chain> <match...>
+	args := append([]string{rule[0], rule[1], action, rule[2]}, rule[3:]...)
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// enableMasquerade turns on IPv4 forwarding and masquerades the overlay subnet leaving
+// through any other interface than the TUN. The returned func removes the rules this call
+// added and puts the previous forwarding setting back, rules which were already present
+// are left alone.
+func enableMasquerade(subnet, tunName string) (func(), error) {
+	prev, err := os.ReadFile(ipForwardPath)
+	if err != nil {
+		return nil, errors.Join(errors.New("read ip forward error"), err)
+	}
+	prev = bytes.TrimSpace(prev)
+	if !bytes.Equal(prev, []byte("1")) {
+		if err := os.WriteFile(ipForwardPath, []byte("1"), 0o644); err != nil {
+			return nil, errors.Join(errors.New("enable ip forward error"), err)
+		}
+	}
+
+	var added [][]string
+	cleanup := func() {
+		for i := len(added) - 1; i >= 0; i-- {
+			if err := iptables("-D", added[i]); err != nil {
+				log.Printf("[core] remove masquerade rule error: %v", err)
+			}
+		}
+		if !bytes.Equal(prev, []byte("1")) {
+			if err := os.WriteFile(ipForwardPath, prev, 0o644); err != nil {
+				log.Printf("[core] restore ip forward error: %v", err)
+			}
+		}
+	}
+	for _, rule := range masqueradeRules(subnet, tunName) {
+		// -C fails when the rule is missing, e.g. left behind by a core which was killed
+		if iptables("-C", rule) == nil {
+			continue
+		}
+		if err := iptables("-A", rule); err != nil {
+			cleanup()
+			return nil, err
+		}
+		added = append(added, rule)
+	}
+	log.Printf("[core] masquerade %s leaving through other interfaces than %s", subnet, tunName)
+	return cleanup, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package core
+
+import "errors"
+
+func enableMasquerade(subnet, tunName string) (func(), error) {
+	return nil, errors.New("exit node masquerade is only supported on linux")
+}
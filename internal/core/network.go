@@ -0,0 +1,586 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"kevin-rd/my-tier/internal/dns"
+	"kevin-rd/my-tier/internal/netstack"
+	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/ratelimit"
+	"kevin-rd/my-tier/internal/router"
+	"kevin-rd/my-tier/internal/tun"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// network is one overlay network joined by the daemon. It has its own TUN, UDP sockets,
+// peers and router, the packets of the networks never meet.
+type network struct {
+	config *Config
+	// primary is the network configured by the flags, the IPC selects it by default
+	primary bool
+
+	tun tun.Device
+	// netconf configures the TUN created by the core, nil if it is not configured
+	netconf *tun.Configurator
+
+	udpServer   *UDPServer
+	peerManager *peer.Manager
+	router      *router.Router
+
+	// cleanups undo the system changes on stop, e.g. masquerade rules
+	cleanups []func()
+
+	// exitRouted is set while the default route leads into the TUN for the selected exit
+	// node, guarded by exitMu
+	exitMu     sync.Mutex
+	exitRouted bool
+}
+
+func newNetwork(cfg *Config, primary bool) *network {
+	var vip utils.IPMask
+	if cfg.VirtualIP != DHCP {
+		vip = utils.Must2IPMask(cfg.VirtualIP)
+	}
+	m := peer.NewManager(cfg.ID, vip, cfg.Peers...)
+	m.SetNetwork(cfg.Network, cfg.Secret)
+	return &network{config: cfg, primary: primary, peerManager: m}
+}
+
+// errStopped the network was stopped before its address was bound
+var errStopped = errors.New("stopped")
+
+// start brings up the sockets, waits for the address of a DHCP node, then brings up the
+// TUN and the router. The peer manager and the UDP server run until stop, wg is done when
+// they return.
+func (n *network) start(limits *ratelimit.Registry, stopCh <-chan struct{}, wg *sync.WaitGroup) error {
+	pool, err := n.newPool()
+	if err != nil {
+		return err
+	}
+
+	// UDP Server, bound first so that the peers are dialed through its sockets
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", n.config.UDPPort))
+	if err != nil {
+		return fmt.Errorf("resolve udp addr error: %w", err)
+	}
+	n.udpServer = &UDPServer{
+		ListenAddr: addr,
+		MTU:        n.config.MTU,
+		Workers:    n.config.Queues,
+	}
+	if err := n.udpServer.Listen(); err != nil {
+		return fmt.Errorf("listen udp error: %w", err)
+	}
+
+	// Peers Manager
+	n.peerManager.SetDialer(n.udpServer.Dial)
+	n.peerManager.SetLiveness(n.config.Liveness)
+	n.peerManager.SetSendWorkers(n.config.Queues)
+	if pool != nil {
+		n.peerManager.SetPool(pool)
+	}
+	n.udpServer.peerManager = n.peerManager
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		if err := n.peerManager.Manage(); err != nil {
+			log.Fatalf("[core] %s peers manager error: %v", n.config.Network, err)
+		}
+	}()
+	log.Printf("[core] network %s: udp server on: %v", n.config.Network, addr)
+	go func() {
+		defer wg.Done()
+		if err := n.udpServer.Serve(); err != nil {
+			log.Fatalf("[core] start udp server error: %v", err)
+		}
+	}()
+
+	if n.config.VirtualIP == DHCP {
+		log.Printf("[core] network %s: waiting for an address lease", n.config.Network)
+	}
+	select {
+	case <-n.peerManager.Bound():
+	case <-stopCh:
+		return errStopped
+	}
+	vip := n.peerManager.Address()
+	n.config.VirtualIP = vip.String()
+	log.Printf("[core] network %s: %s", n.config.Network, vip)
+
+	if n.config.Device != nil {
+		n.tun = n.config.Device
+	} else if n.config.Netstack {
+		if err := n.startNetstack(vip); err != nil {
+			return fmt.Errorf("start netstack error: %w", err)
+		}
+	} else if n.config.TunName != "" {
+		t, err := n.newTun()
+		if err != nil {
+			return err
+		}
+		n.tun = t
+		if n.config.ConfigureTun {
+			if err := n.configureTun(vip); err != nil {
+				return fmt.Errorf("configure tun error: %w", err)
+			}
+		}
+	}
+
+	// Router
+	mtu := n.config.MTU
+	if n.tun != nil {
+		mtu = n.tun.MTU()
+	}
+	opts := []router.Option{
+		router.WithNetwork(n.config.Network),
+		router.WithMTU(mtu),
+		router.WithMSSClamp(n.config.MSSClamp),
+		router.WithBroadcastRate(n.config.BroadcastRate),
+	}
+	for _, s := range n.config.Anycast {
+		vip, weight, err := parseAnycast(s)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, router.WithAnycast(vip, weight))
+		// the kernel accepts the packets of the claimed VIP like the ones of its own address
+		if n.netconf != nil {
+			if err := n.netconf.AddAddr(utils.IPMask{vip[0], vip[1], vip[2], vip[3], 32}); err != nil {
+				return fmt.Errorf("configure tun error: %w", err)
+			}
+		}
+	}
+	for _, s := range n.config.NAT {
+		rule, err := router.ParseNATRule(s)
+		if err != nil {
+			return err
+		}
+		if !n.natRule(rule) {
+			continue
+		}
+		opts = append(opts, router.WithNAT(rule))
+		// the local prefix reaches the remote network through the TUN of its network
+		if n.netconf != nil {
+			if err := n.netconf.AddRoute(rule.Local); err != nil {
+				return fmt.Errorf("configure tun error: %w", err)
+			}
+		}
+	}
+	for _, s := range n.config.Subnets {
+		prefix, err := parseSubnet(s)
+		if err != nil {
+			return err
+		}
+		if _, overlay, _ := net.ParseCIDR(vip.String()); prefix.Contains(overlay.IP) || overlay.Contains(prefix.IP) {
+			return fmt.Errorf("subnet %s overlaps the overlay %s", s, overlay)
+		}
+		opts = append(opts, router.WithSubnet(prefix))
+	}
+	if n.netconf != nil {
+		opts = append(opts, router.WithRouteHook(n.subnetRoute))
+	}
+	if n.config.AcceptRoutes || len(n.config.AcceptSubnets) > 0 {
+		var allowed []utils.IPMask
+		for _, s := range n.config.AcceptSubnets {
+			prefix, err := parseSubnet(s)
+			if err != nil {
+				return err
+			}
+			ones, _ := prefix.Mask.Size()
+			allowed = append(allowed, utils.IPMask{prefix.IP[0], prefix.IP[1], prefix.IP[2], prefix.IP[3], byte(ones)})
+		}
+		opts = append(opts, router.WithAcceptSubnets(n.config.AcceptRoutes, allowed...))
+	}
+	if n.config.ExitNode {
+		opts = append(opts, router.WithExitNode(n.config.ExitAllow...))
+	}
+	// exit nodes and subnet routers masquerade the overlay leaving through them
+	if n.config.ExitNode || len(n.config.Subnets) > 0 {
+		if n.tun != nil && !n.config.Netstack {
+			cleanup, err := enableMasquerade(overlaySubnet(vip), n.tun.Name())
+			if err != nil {
+				log.Printf("[core] enable masquerade error: %v", err)
+			} else {
+				n.cleanups = append(n.cleanups, cleanup)
+			}
+		}
+	}
+	if n.config.ExitVia != "" {
+		opts = append(opts, router.WithExitVia(n.config.ExitVia))
+	}
+	if n.config.TAP {
+		opts = append(opts, router.WithTAP())
+	}
+	n.router = router.NewRouter(n.tun, n.peerManager, limits, opts...)
+	go n.router.Run(stopCh)
+	if n.netconf != nil {
+		go n.watchEndpoints(stopCh)
+		n.routeExit(n.config.ExitVia)
+	}
+
+	if n.config.DNS && n.tun != nil {
+		if err := n.startDNS(vip); err != nil {
+			log.Printf("[core] start dns server error: %v", err)
+		}
+	}
+
+	if n.tun != nil {
+		go func() {
+			if err := tun.Run(n.tun, n.router.Output); err != nil {
+				log.Printf("[core] tun run error: %v", err)
+			}
+		}()
+	}
+	n.udpServer.router.Store(n.router)
+	return nil
+}
+
+// natRule reports whether the NAT rule belongs to this network, a rule without a network
+// belongs to the primary one. The primary network refuses rules of unknown networks.
+func (n *network) natRule(rule router.NATRule) bool {
+	switch rule.Network {
+	case "":
+		return n.primary
+	case n.config.Network:
+		return true
+	}
+	if n.primary && !slices.ContainsFunc(n.config.Networks, func(nc NetworkConfig) bool { return nc.Name == rule.Network }) {
+		log.Printf("[core] nat rule of unknown network %s ignored", rule.Network)
+	}
+	return false
+}
+
+// newPool returns the DHCP pool handed out by a node with a static address, nil if the
+// node has no pool
+func (n *network) newPool() (*peer.Pool, error) {
+	if n.config.VirtualIP == DHCP || n.config.DHCPPool == "off" {
+		return nil, nil
+	}
+	subnet := utils.Must2IPMask(n.config.VirtualIP)
+	var (
+		pool *peer.Pool
+		err  error
+	)
+	if n.config.DHCPPool == "" {
+		pool, err = peer.SubnetPool(subnet, n.config.LeaseTTL)
+	} else {
+		first, last, perr := parsePool(n.config.DHCPPool)
+		if perr != nil {
+			return nil, perr
+		}
+		pool, err = peer.NewPool(subnet, first, last, n.config.LeaseTTL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range n.config.DHCPReserve {
+		id, ipStr, _ := strings.Cut(r, "=")
+		ip := net.ParseIP(ipStr).To4()
+		if id == "" || ip == nil {
+			return nil, fmt.Errorf("invalid dhcp reservation: %q", r)
+		}
+		if err := pool.Reserve(id, utils.IPv4(ip)); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+// stop leaves the network and undoes its system changes
+func (n *network) stop() {
+	n.peerManager.Stop()
+	for i := len(n.cleanups) - 1; i >= 0; i-- {
+		n.cleanups[i]()
+	}
+	if n.tun != nil {
+		if err := n.tun.Close(); err != nil {
+			log.Printf("[core] close tun error: %v", err)
+		}
+	}
+}
+
+// startNetstack uses a userspace stack as TUN and starts its proxies and port forwards,
+// they are closed on Stop.
+func (n *network) startNetstack(vip utils.IPMask) error {
+	s, err := netstack.New(vip, n.config.MTU)
+	if err != nil {
+		return err
+	}
+	n.tun = s
+
+	closeLn := func(ln net.Listener) {
+		n.cleanups = append(n.cleanups, func() { _ = ln.Close() })
+	}
+	serve := func(name, addr string, fn func(net.Listener) error) error {
+		if addr == "" {
+			return nil
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen %s proxy error: %w", name, err)
+		}
+		closeLn(ln)
+		log.Printf("[core] %s proxy on: %v", name, ln.Addr())
+		go func() {
+			if err := fn(ln); err != nil {
+				log.Printf("[core] %s proxy error: %v", name, err)
+			}
+		}()
+		return nil
+	}
+	if err := serve("socks5", n.config.SOCKS5Addr, s.ServeSOCKS5); err != nil {
+		return err
+	}
+	if err := serve("http connect", n.config.HTTPConnectAddr, s.ServeHTTPConnect); err != nil {
+		return err
+	}
+	for _, str := range n.config.Forwards {
+		f, err := netstack.ParseForward(str)
+		if err != nil {
+			return err
+		}
+		ln, err := s.ServeForward(f)
+		if err != nil {
+			return err
+		}
+		closeLn(ln)
+		log.Printf("[core] forward overlay port %d to %s", f.Port, f.Local)
+	}
+	return nil
+}
+
+// startDNS serves the peer names on vip:53 and points the host resolver to it if configured
+func (n *network) startDNS(vip utils.IPMask) error {
+	ip := vip.IPv4()
+	lookup := func(network, id string) (utils.IPv4, bool) {
+		if network != strings.ToLower(n.config.Network) {
+			return utils.IPv4{}, false
+		}
+		p := n.peerManager.PeerByID(id)
+		if p == nil {
+			return utils.IPv4{}, false
+		}
+		return p.VirtualIP.IPv4(), true
+	}
+	reverse := func(vip utils.IPv4) (string, string, bool) {
+		p := n.peerManager.GetPeer(vip)
+		if p == nil {
+			return "", "", false
+		}
+		return p.ID, n.config.Network, true
+	}
+
+	upstreams := n.config.DNSUpstreams
+	if len(upstreams) == 0 {
+		var err error
+		if upstreams, err = dns.SystemUpstreams(dns.ResolvConf, ip.String()); err != nil {
+			log.Printf("[core] read dns upstreams error: %v", err)
+		}
+	}
+
+	var (
+		pc  net.PacketConn
+		ln  net.Listener
+		err error
+	)
+	if s, ok := n.tun.(*netstack.Stack); ok {
+		if pc, err = s.ListenUDP(53); err == nil {
+			ln, err = s.ListenTCP(53)
+		}
+	} else {
+		addr := net.JoinHostPort(ip.String(), "53")
+		if pc, err = net.ListenPacket("udp4", addr); err == nil {
+			ln, err = net.Listen("tcp4", addr)
+		}
+	}
+	if err != nil {
+		if pc != nil {
+			_ = pc.Close()
+		}
+		return err
+	}
+	server := dns.NewServer(lookup, reverse, upstreams...)
+	server.Serve(pc, ln)
+	n.cleanups = append(n.cleanups, func() {
+		if err := server.Close(); err != nil {
+			log.Printf("[core] close dns server error: %v", err)
+		}
+	})
+	log.Printf("[core] dns server for %s on %v, upstreams: %v", dns.Zone(n.config.Network), ip, upstreams)
+
+	if n.config.SplitDNS == "" || n.config.Netstack {
+		return nil
+	}
+	mode := n.config.SplitDNS
+	if mode == "auto" {
+		mode = "resolvconf"
+		if dns.ResolvedRunning() {
+			mode = "resolved"
+		}
+	}
+	var revert func()
+	switch mode {
+	case "resolved":
+		revert, err = dns.ConfigureResolved(n.tun.Name(), net.IP(ip[:]), dns.Zone(n.config.Network))
+	case "resolvconf":
+		revert, err = dns.ConfigureResolvConf(dns.ResolvConf, net.IP(ip[:]), dns.Zone(n.config.Network))
+	default:
+		err = fmt.Errorf("unknown split dns mode %q", n.config.SplitDNS)
+	}
+	if err != nil {
+		return fmt.Errorf("configure split dns error: %w", err)
+	}
+	n.cleanups = append(n.cleanups, revert)
+	return nil
+}
+
+// newTun creates the TUN, or TAP, with the configured number of queues
+func (n *network) newTun() (tun.Device, error) {
+	name, mtu, queues := n.config.TunName, n.config.MTU, n.config.Queues
+	if n.config.Offload {
+		if n.config.TAP || queues > 1 {
+			return nil, errors.New("segmentation offload supports a single queue TUN only")
+		}
+		return tun.NewOffloadDevice(name, mtu)
+	}
+	switch {
+	case queues > 1 && n.config.TAP:
+		return tun.NewMultiQueueTap(name, mtu, queues)
+	case queues > 1:
+		return tun.NewMultiQueueTun(name, mtu, queues)
+	case n.config.TAP:
+		return tun.NewTapDevice(name, mtu)
+	default:
+		return tun.NewTunDevice(name, mtu)
+	}
+}
+
+// configureTun assigns vip to the TUN, sets its MTU and brings it up. The route of the
+// overlay network comes with the address, everything is removed again on Stop.
+func (n *network) configureTun(vip utils.IPMask) error {
+	conf, err := tun.NewConfigurator(n.tun.Name())
+	if err != nil {
+		return err
+	}
+	if err := conf.Up(tun.NetConfig{Addr: vip, MTU: n.tun.MTU()}); err != nil {
+		return errors.Join(err, conf.Close())
+	}
+	n.netconf = conf
+	n.cleanups = append(n.cleanups, func() {
+		if err := conf.Close(); err != nil {
+			log.Printf("[core] remove tun configuration error: %v", err)
+		}
+	})
+	return nil
+}
+
+// subnetRoute installs or removes the route of a subnet or an anycast VIP advertised by a peer
+func (n *network) subnetRoute(prefix *net.IPNet, add bool) {
+	var err error
+	if add {
+		// the routes of the host win, e.g. a peer advertising the LAN of this node
+		if err = n.netconf.RouteConflict(prefix); err == nil {
+			err = n.netconf.AddRoute(prefix)
+		}
+	} else {
+		err = n.netconf.DelRoute(prefix)
+	}
+	if err != nil {
+		log.Printf("[core] %v", err)
+	}
+}
+
+// routeExit leads the default route into the TUN while an exit node is selected and
+// restores it without one. The endpoints of the peers bypass the TUN, otherwise the overlay
+// would be routed through itself.
+func (n *network) routeExit(via string) {
+	if n.netconf == nil {
+		return
+	}
+	n.exitMu.Lock()
+	defer n.exitMu.Unlock()
+	if (via != "") == n.exitRouted {
+		return
+	}
+	if via == "" {
+		if err := n.netconf.RouteDefault(false); err != nil {
+			log.Printf("[core] %v", err)
+		}
+		n.exitRouted = false
+		return
+	}
+
+	// the bypasses go first, the endpoints still take the underlay route
+	for _, ip := range n.endpoints() {
+		if err := n.netconf.AddBypass(ip); err != nil {
+			log.Printf("[core] %v", err)
+		}
+	}
+	if err := n.netconf.RouteDefault(true); err != nil {
+		log.Printf("[core] route the default route through %s error: %v", n.tun.Name(), err)
+		return
+	}
+	n.exitRouted = true
+	log.Printf("[core] default route through %s, exit via %s", n.tun.Name(), via)
+}
+
+// endpoints returns the underlay addresses of the handshaked and the configured peers
+func (n *network) endpoints() []net.IP {
+	var ips []net.IP
+	for _, p := range n.peerManager.GetPeers("") {
+		if ip := endpointIP(p.RemoteAddr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	for _, addr := range n.config.Peers {
+		if ua, err := net.ResolveUDPAddr("udp4", addr); err == nil {
+			ips = append(ips, ua.IP)
+		}
+	}
+	return ips
+}
+
+// watchEndpoints adds the bypasses of the peers which handshake while the default route
+// leads into the TUN. The bypasses are only removed with the TUN configuration, a peer may
+// come back at the same address.
+func (n *network) watchEndpoints(stopCh <-chan struct{}) {
+	sub := n.peerManager.Subscribe(0)
+	defer n.peerManager.Unsubscribe(sub)
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if ev.Type != peer.EventConnected && ev.Type != peer.EventEndpointChanged {
+				continue
+			}
+			ip := endpointIP(ev.RemoteAddr)
+			n.exitMu.Lock()
+			if n.exitRouted && ip != nil {
+				if err := n.netconf.AddBypass(ip); err != nil {
+					log.Printf("[core] %v", err)
+				}
+			}
+			n.exitMu.Unlock()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// endpointIP is the IP of the remote address "ip:port" of a peer, nil if there is none
+func endpointIP(addr string) net.IP {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.IP(ap.Addr().Unmap().AsSlice())
+}
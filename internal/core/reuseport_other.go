@@ -0,0 +1,15 @@
+//go:build !unix
+
+package core
+
+import (
+	"errors"
+	"syscall"
+)
+
+// msgTrunc is never set, the reads fall back to one packet per call
+const msgTrunc = 0
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("multiple udp workers need SO_REUSEPORT, which is not supported on this platform")
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package core
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// msgTrunc flags a datagram which did not fit the read buffer
+const msgTrunc = unix.MSG_TRUNC
+
+// reusePort lets several UDP sockets bind the same port, the kernel spreads the peers over them
+func reusePort(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -1,42 +1,206 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"kevin-rd/my-tier/internal/peer"
 	"kevin-rd/my-tier/internal/router"
 	"kevin-rd/my-tier/pkg/packet"
 	"log"
+	"math"
 	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
 )
 
 type UDPServer struct {
-	ListenAddr  *net.UDPAddr
-	router      *router.Router
+	ListenAddr *net.UDPAddr
+	// MTU of the overlay, the batch buffers fit a data packet of this size
+	MTU int
+	// Workers is the number of sockets sharing ListenAddr with SO_REUSEPORT, each read by
+	// its own goroutine. The kernel hashes the remote address to a socket, so the packets
+	// of one peer are always handled in order by the same worker.
+	Workers int
+	// router is set once the address of the node is bound, until then only the control
+	// packets reach peerManager, e.g. the handshakes of a DHCP node
+	router      atomic.Pointer[router.Router]
 	peerManager *peer.Manager
+
+	conns []*net.UDPConn
 }
 
+const (
+	// packetHeaderLen is the overlay header in front of the payload
+	packetHeaderLen = 4 + 4*2
+	// udpBufSize is the largest overlay packet, its header and the largest payload length
+	udpBufSize = packetHeaderLen + math.MaxUint16
+)
+
 func (s *UDPServer) ListenAndServe() error {
-	ln, errL := net.ListenUDP("udp", s.ListenAddr)
-	if errL != nil {
-		return errL
+	if err := s.Listen(); err != nil {
+		return err
 	}
+	return s.Serve()
+}
 
-	buf := make([]byte, 1500)
-	for {
+// Listen binds the sockets, the peers may be dialed through them before Serve
+func (s *UDPServer) Listen() error {
+	workers := max(s.Workers, 1)
+	lc := net.ListenConfig{}
+	if workers > 1 {
+		lc.Control = reusePort
+	}
 
-		n, addr, err := ln.ReadFromUDP(buf)
+	// one socket per address family, batched I/O needs the destinations in the socket family
+	networks := []string{"udp4", "udp6"}
+	if ip := s.ListenAddr.IP; ip != nil && !ip.IsUnspecified() {
+		networks = []string{"udp6"}
+		if ip.To4() != nil {
+			networks = []string{"udp4"}
+		}
+	}
+
+	var conns []*net.UDPConn
+	closeAll := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	port := s.ListenAddr.Port
+	for _, network := range networks {
+		for i := 0; i < workers; i++ {
+			addr := &net.UDPAddr{IP: s.ListenAddr.IP, Port: port, Zone: s.ListenAddr.Zone}
+			pc, err := lc.ListenPacket(context.Background(), network, addr.String())
+			if err != nil {
+				if network == "udp6" && len(conns) > 0 {
+					log.Printf("[udp_server] no IPv6: %v", err)
+					break
+				}
+				closeAll()
+				return err
+			}
+			conn := pc.(*net.UDPConn)
+			// the other sockets join the port picked for the first one
+			port = conn.LocalAddr().(*net.UDPAddr).Port
+			conns = append(conns, conn)
+		}
+	}
+	s.conns = conns
+	return nil
+}
+
+// Serve reads the sockets bound by Listen until they are closed
+func (s *UDPServer) Serve() error {
+	errs := make([]error, len(s.conns))
+	wg := sync.WaitGroup{}
+	wg.Add(len(s.conns))
+	for i, conn := range s.conns {
+		go func() {
+			defer wg.Done()
+			errs[i] = s.serve(conn)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Dial returns a writer to addr through a listening socket of its address family, so the
+// replies are read by Serve like any other packet.
+func (s *UDPServer) Dial(addr string) (packet.Writer, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	v4 := raddr.IP.To4() != nil
+	for _, conn := range s.conns {
+		local := conn.LocalAddr().(*net.UDPAddr)
+		if (local.IP.To4() != nil) == v4 {
+			if v4 {
+				raddr.IP = raddr.IP.To4()
+			}
+			return packet.NewWriter(conn, raddr), nil
+		}
+	}
+	return nil, fmt.Errorf("no socket for %s", addr)
+}
+
+// serve reads batches of packets into a ring of buffers which is reused for every batch,
+// TUN is flushed once a batch is handled so its segments can be coalesced. The buffers fit
+// a data packet of MTU, a larger packet, e.g. a big control payload or the data of a peer
+// with a larger MTU, spills into one fallback buffer shared by the batch. Only the last
+// packet which spilled in a batch is intact, the earlier ones are dropped.
+func (s *UDPServer) serve(ln *net.UDPConn) error {
+	mtu := s.MTU
+	if mtu <= 0 {
+		mtu = router.DefaultMTU
+	}
+	slot := min(packetHeaderLen+mtu, udpBufSize)
+	fallback := make([]byte, udpBufSize-slot)
+	spill := make([]byte, 0, udpBufSize)
+
+	bc := packet.NewBatchConn(ln)
+	msgs := make([]ipv4.Message, packet.BatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, slot), fallback}
+	}
+
+	for {
+		n, err := bc.ReadBatch(msgs, 0)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Println("[udp_server] read error:", err)
 			continue
 		}
 
-		log.Printf("[udp_server] read from %v: %v", addr, string(buf[:n]))
-
-		pkt := &packet.Packet[packet.Packable]{}
-		if err = pkt.Decode(buf[:n]); err != nil {
-			log.Printf("[udp_server] packet decode error from %v: %v", addr, err)
-			continue
+		spilled := -1
+		for i, msg := range msgs[:n] {
+			if msg.N > slot {
+				spilled = i
+			}
 		}
+		for i, msg := range msgs[:n] {
+			addr, ok := msg.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			if msg.Flags&msgTrunc != 0 {
+				log.Printf("[udp_server] truncated packet from %v dropped", addr)
+				continue
+			}
+			data := msg.Buffers[0][:min(msg.N, slot)]
+			if msg.N > slot {
+				if i != spilled {
+					log.Printf("[udp_server] packet of %d bytes from %v dropped, fallback buffer taken", msg.N, addr)
+					continue
+				}
+				data = append(append(spill[:0], data...), fallback[:msg.N-slot]...)
+			}
+			pkt := &packet.Packet[packet.Packable]{}
+			if err = pkt.Decode(data); err != nil {
+				log.Printf("[udp_server] packet decode error from %v: %v", addr, err)
+				continue
+			}
 
-		s.router.Input(packet.NewWriter(ln, addr), pkt)
+			w := packet.NewWriter(ln, addr)
+			r := s.router.Load()
+			if r == nil {
+				switch pkt.Type {
+				case packet.TypeData, packet.TypeFrame, packet.TypeRouteAdvert:
+				default:
+					s.peerManager.Seen(addr)
+					s.peerManager.HandlePacket(w, pkt)
+				}
+				continue
+			}
+			r.Input(w, pkt)
+		}
+		if r := s.router.Load(); r != nil {
+			r.Flush()
+		}
 	}
 }
@@ -0,0 +1,195 @@
+// Package dns serves the names of the overlay, <peer-id>.<network>.sky resolves to the
+// virtual IP of the peer. Other names are forwarded to upstream resolvers.
+package dns
+
+import (
+	"errors"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// TLD of the overlay names
+	TLD = "sky"
+
+	// ttl of the overlay records, peers come and go
+	ttl = 60
+	// upstreamTimeout bounds one exchange with an upstream resolver
+	upstreamTimeout = 2 * time.Second
+)
+
+// Lookup returns the VIP of peer id in network
+type Lookup func(network, id string) (utils.IPv4, bool)
+
+// Reverse returns the peer id and network of vip
+type Reverse func(vip utils.IPv4) (id, network string, ok bool)
+
+// Name returns the overlay name of a peer, e.g. "node1.office.sky."
+func Name(id, network string) string {
+	return dns.Fqdn(strings.ToLower(id + "." + network + "." + TLD))
+}
+
+// Zone is the domain of a network, e.g. "office.sky"
+func Zone(network string) string {
+	return strings.ToLower(network + "." + TLD)
+}
+
+type Server struct {
+	lookup    Lookup
+	reverse   Reverse
+	upstreams []string
+
+	client *dns.Client
+	tcp    *dns.Client
+
+	servers []*dns.Server
+}
+
+// NewServer answers the overlay names with lookup and reverse, other queries go to the
+// upstreams, "host:port" or "host" for port 53.
+func NewServer(lookup Lookup, reverse Reverse, upstreams ...string) *Server {
+	s := &Server{
+		lookup:  lookup,
+		reverse: reverse,
+		client:  &dns.Client{Net: "udp", Timeout: upstreamTimeout},
+		tcp:     &dns.Client{Net: "tcp", Timeout: upstreamTimeout},
+	}
+	for _, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		s.upstreams = append(s.upstreams, u)
+	}
+	return s
+}
+
+// Serve answers the queries on pc and ln until Close, either may be nil
+func (s *Server) Serve(pc net.PacketConn, ln net.Listener) {
+	if pc != nil {
+		srv := &dns.Server{PacketConn: pc, Handler: s}
+		s.servers = append(s.servers, srv)
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil {
+				log.Printf("[dns] serve udp error: %v", err)
+			}
+		}()
+	}
+	if ln != nil {
+		srv := &dns.Server{Listener: ln, Handler: s}
+		s.servers = append(s.servers, srv)
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil {
+				log.Printf("[dns] serve tcp error: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) Close() error {
+	var errs []error
+	for _, srv := range s.servers {
+		errs = append(errs, srv.Shutdown())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := s.handle(req)
+	if err := w.WriteMsg(resp); err != nil {
+		log.Printf("[dns] write response to %v error: %v", w.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) handle(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		resp := new(dns.Msg)
+		return resp.SetRcode(req, dns.RcodeFormatError)
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	switch {
+	case dns.IsSubDomain(TLD+".", name):
+		return s.answerName(req, q, name)
+	case q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa."):
+		if resp, ok := s.answerPTR(req, q, name); ok {
+			return resp
+		}
+	}
+	return s.forward(req)
+}
+
+// answerName answers <peer-id>.<network>.sky, the overlay zone is authoritative
+func (s *Server) answerName(req *dns.Msg, q dns.Question, name string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	labels := dns.SplitDomainName(name)
+	if len(labels) != 3 {
+		return resp.SetRcode(req, dns.RcodeNameError)
+	}
+	vip, ok := s.lookup(labels[1], labels[0])
+	if !ok {
+		return resp.SetRcode(req, dns.RcodeNameError)
+	}
+	// other types of an existing name are answered without records
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IP(vip[:]).To4(),
+		})
+	}
+	return resp
+}
+
+// answerPTR answers the reverse name of a peer VIP, ok is false for other addresses
+func (s *Server) answerPTR(req *dns.Msg, q dns.Question, name string) (*dns.Msg, bool) {
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, "in-addr.arpa."))
+	if len(labels) != 4 {
+		return nil, false
+	}
+	var vip utils.IPv4
+	for i, label := range labels {
+		ip := net.ParseIP("0.0.0." + label).To4()
+		if ip == nil {
+			return nil, false
+		}
+		vip[3-i] = ip[3]
+	}
+	id, network, ok := s.reverse(vip)
+	if !ok {
+		return nil, false
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.Answer = append(resp.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: Name(id, network),
+	})
+	return resp, true
+}
+
+// forward asks the upstreams in turn, a truncated answer is retried over TCP
+func (s *Server) forward(req *dns.Msg) *dns.Msg {
+	for _, upstream := range s.upstreams {
+		resp, _, err := s.client.Exchange(req, upstream)
+		if err == nil && resp.Truncated {
+			resp, _, err = s.tcp.Exchange(req, upstream)
+		}
+		if err != nil {
+			log.Printf("[dns] forward %s to %s error: %v", req.Question[0].Name, upstream, err)
+			continue
+		}
+		return resp
+	}
+	resp := new(dns.Msg)
+	return resp.SetRcode(req, dns.RcodeServerFailure)
+}
@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves s on a loopback UDP port and returns its address
+func startServer(t *testing.T, h dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	resp, err := dns.Exchange(req, addr)
+	require.NoError(t, err)
+	return resp
+}
+
+func newTestServer(t *testing.T) string {
+	upstream := startServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(93, 184, 216, 34),
+		})
+		_ = w.WriteMsg(resp)
+	}))
+
+	peers := map[string]utils.IPv4{"node1": {10, 0, 0, 2}}
+	lookup := func(network, id string) (utils.IPv4, bool) {
+		vip, ok := peers[id]
+		return vip, ok && network == "office"
+	}
+	reverse := func(vip utils.IPv4) (string, string, bool) {
+		if vip == peers["node1"] {
+			return "Node1", "office", true
+		}
+		return "", "", false
+	}
+	return startServer(t, NewServer(lookup, reverse, upstream))
+}
+
+func TestServer_PeerName(t *testing.T) {
+	addr := newTestServer(t)
+
+	resp := query(t, addr, "NODE1.office.sky.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, "10.0.0.2", resp.Answer[0].(*dns.A).A.String())
+
+	resp = query(t, addr, "node1.office.sky.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	for _, name := range []string{"node2.office.sky.", "node1.home.sky.", "office.sky."} {
+		assert.Equal(t, dns.RcodeNameError, query(t, addr, name, dns.TypeA).Rcode, name)
+	}
+}
+
+func TestServer_PTR(t *testing.T) {
+	addr := newTestServer(t)
+
+	resp := query(t, addr, "2.0.0.10.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "node1.office.sky.", resp.Answer[0].(*dns.PTR).Ptr)
+}
+
+func TestServer_Forward(t *testing.T) {
+	addr := newTestServer(t)
+
+	resp := query(t, addr, "example.com.", dns.TypeA)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "93.184.216.34", resp.Answer[0].(*dns.A).A.String())
+}
+
+func TestConfigureResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	orig := "nameserver 1.1.1.1\nsearch example.com\noptions edns0\n"
+	require.NoError(t, os.WriteFile(path, []byte(orig), 0o644))
+
+	upstreams, err := SystemUpstreams(path, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1.1:53"}, upstreams)
+
+	revert, err := ConfigureResolvConf(path, net.IPv4(10, 0, 0, 1), Zone("office"))
+	require.NoError(t, err)
+	conf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(string(conf), "\n")
+	assert.Equal(t, "nameserver 10.0.0.1", lines[1])
+	assert.Equal(t, "search office.sky example.com", lines[2])
+	assert.Contains(t, string(conf), "nameserver 1.1.1.1\n")
+
+	upstreams, err = SystemUpstreams(path, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1.1:53"}, upstreams)
+
+	revert()
+	conf, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, orig, string(conf))
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	resolvedDest = "org.freedesktop.resolve1"
+	resolvedPath = "/org/freedesktop/resolve1"
+	resolvedIfc  = "org.freedesktop.resolve1.Manager"
+)
+
+// ConfigureResolved makes systemd-resolved send the queries of zone to server on link
+// ifName (split DNS), the other queries keep their resolvers. The returned func reverts it.
+func ConfigureResolved(ifName string, server net.IP, zone string) (func(), error) {
+	link, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connect system bus error: %w", err)
+	}
+	obj := conn.Object(resolvedDest, resolvedPath)
+	index := int32(link.Index)
+
+	type address struct {
+		Family  int32
+		Address []byte
+	}
+	type domain struct {
+		Domain      string
+		RoutingOnly bool
+	}
+	addr := address{Family: syscall.AF_INET, Address: server.To4()}
+	if err := obj.Call(resolvedIfc+".SetLinkDNS", 0, index, []address{addr}).Err; err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("resolved SetLinkDNS error: %w", err)
+	}
+	// a routing only domain, ~zone, is used to pick the link but not as search domain
+	if err := obj.Call(resolvedIfc+".SetLinkDomains", 0, index, []domain{{Domain: zone, RoutingOnly: true}}).Err; err != nil {
+		_ = obj.Call(resolvedIfc+".RevertLink", 0, index).Err
+		_ = conn.Close()
+		return nil, fmt.Errorf("resolved SetLinkDomains error: %w", err)
+	}
+	log.Printf("[dns] resolved sends %s to %v on %s", zone, server, ifName)
+
+	return func() {
+		if err := obj.Call(resolvedIfc+".RevertLink", 0, index).Err; err != nil {
+			log.Printf("[dns] resolved RevertLink error: %v", err)
+		}
+		_ = conn.Close()
+	}, nil
+}
+
+// ConfigureResolvConf puts server in front of the name servers of resolv.conf and zone
+// into its search list. All queries reach server, which forwards the other names. The
+// returned func restores the original file.
+func ConfigureResolvConf(path string, server net.IP, zone string) (func(), error) {
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	search := []string{zone}
+	var rest bytes.Buffer
+	for _, line := range bytes.SplitAfter(orig, []byte("\n")) {
+		// the resolver uses one search line, the other domains are kept
+		if fields := strings.Fields(string(line)); len(fields) > 0 && fields[0] == "search" {
+			search = append(search, fields[1:]...)
+			continue
+		}
+		rest.Write(line)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# added by skytier, restored on exit\nnameserver %s\nsearch %s\n", server, strings.Join(search, " "))
+	buf.Write(rest.Bytes())
+	if err := os.WriteFile(path, buf.Bytes(), info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	log.Printf("[dns] %s uses %v for %s", path, server, zone)
+
+	return func() {
+		if err := os.WriteFile(path, orig, info.Mode().Perm()); err != nil {
+			log.Printf("[dns] restore %s error: %v", path, err)
+		}
+	}, nil
+}
+
+// ResolvedRunning reports whether systemd-resolved manages the host resolver
+func ResolvedRunning() bool {
+	_, err := os.Stat("/run/systemd/resolve/io.systemd.Resolve")
+	return err == nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package dns
+
+import (
+	"errors"
+	"net"
+)
+
+var errSplitUnsupported = errors.New("split DNS is only supported on linux")
+
+func ConfigureResolved(ifName string, server net.IP, zone string) (func(), error) {
+	return nil, errSplitUnsupported
+}
+
+func ConfigureResolvConf(path string, server net.IP, zone string) (func(), error) {
+	return nil, errSplitUnsupported
+}
+
+func ResolvedRunning() bool {
+	return false
+}
@@ -0,0 +1,31 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ResolvConf is the resolver configuration of the host
+const ResolvConf = "/etc/resolv.conf"
+
+// SystemUpstreams returns the name servers of resolv.conf, the addresses in exclude are
+// skipped so the server never forwards to itself.
+func SystemUpstreams(path string, exclude ...string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, addr := range exclude {
+		skip[addr] = true
+	}
+	var res []string
+	for _, server := range conf.Servers {
+		if skip[server] {
+			continue
+		}
+		res = append(res, net.JoinHostPort(server, conf.Port))
+	}
+	return res, nil
+}
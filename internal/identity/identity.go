@@ -0,0 +1,214 @@
+// Package identity keeps the long-term keypair of a node. The node id derives from the
+// public key, so a restarted node is recognized by its peers.
+//
+// The handshake does not prove the id: the key is neither exchanged nor used to sign, a
+// peer takes the id of a handshake as given. Any node knowing the network secret may claim
+// the id of another one, the peers only refuse it while the holder is alive. Signing a
+// handshake nonce and checking the id against the public key is out of scope for now.
+package identity
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileName is the key file in the state directory
+const FileName = "identity.key"
+
+// idLen is the number of bytes of the public key hash in the id, 16 base32 characters
+const idLen = 10
+
+var idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Identity is the Ed25519 keypair of a node, the X25519 key agreement key is derived
+// from the same seed
+type Identity struct {
+	key  ed25519.PrivateKey
+	path string
+}
+
+// Generate returns a new identity which is not stored yet
+func Generate() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// Load reads the identity at path, it is created on the first run. A key file readable
+// by other users is refused.
+func Load(path string) (*Identity, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		id, err := Generate()
+		if err != nil {
+			return nil, err
+		}
+		return id, id.Save(path)
+	} else if err != nil {
+		return nil, err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return nil, fmt.Errorf("identity key %s is accessible by other users (%04o), chmod 600 it", path, perm)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("identity key %s: no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("identity key %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key %s: not an ed25519 key", path)
+	}
+	return &Identity{key: key, path: path}, nil
+}
+
+// Save writes the identity to path readable by the owner only, the directory is created
+func (i *Identity) Save(path string) error {
+	tmp := path + ".tmp"
+	if err := i.write(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	i.path = path
+	return nil
+}
+
+// write stores the key in the new file path readable by the owner only
+func (i *Identity) write(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(i.key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// the umask or a stale file may have widened the mode
+	if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// Rotate replaces the identity at path by a new one and returns it with the backup of the
+// old key: path.old, or path.old.N if an older backup exists already. The new key is
+// written aside first, path holds either key at any time. The node uses the new id after
+// a restart.
+func Rotate(path string) (*Identity, string, error) {
+	id, err := Generate()
+	if err != nil {
+		return nil, "", err
+	}
+	tmp := path + ".new"
+	if err = id.write(tmp); err != nil {
+		return nil, "", err
+	}
+	backup, err := backupKey(path)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return nil, "", err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return nil, "", err
+	}
+	id.path = path
+	return id, backup, nil
+}
+
+// backupKey links the key at path to the first free path.old, path.old.1, ... so that no
+// backup is overwritten. Empty if there is no key at path.
+func backupKey(path string) (string, error) {
+	for n := 0; ; n++ {
+		backup := path + ".old"
+		if n > 0 {
+			backup += "." + strconv.Itoa(n)
+		}
+		err := os.Link(path, backup)
+		switch {
+		case err == nil:
+			return backup, nil
+		case errors.Is(err, fs.ErrExist):
+			continue
+		case errors.Is(err, fs.ErrNotExist):
+			if _, statErr := os.Stat(path); errors.Is(statErr, fs.ErrNotExist) {
+				return "", nil
+			}
+			return "", err
+		default:
+			return "", fmt.Errorf("back up identity key %s: %w", path, err)
+		}
+	}
+}
+
+// ID derives the node id from the public key: the lowercase base32 of its hash, a valid
+// DNS label
+func (i *Identity) ID() string {
+	return IDOf(i.PublicKey())
+}
+
+// IDOf is the node id of the public key pub
+func IDOf(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return strings.ToLower(idEncoding.EncodeToString(sum[:idLen]))
+}
+
+func (i *Identity) PublicKey() ed25519.PublicKey {
+	return i.key.Public().(ed25519.PublicKey)
+}
+
+// Path is the key file, empty if the identity is not stored
+func (i *Identity) Path() string {
+	return i.path
+}
+
+// KeyAgreement returns the X25519 key of the identity, its scalar is derived from the
+// Ed25519 seed like the Ed25519 one
+func (i *Identity) KeyAgreement() *ecdh.PrivateKey {
+	h := sha512.Sum512(i.key.Seed())
+	key, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		// a 32 bytes scalar is always valid
+		panic(err)
+	}
+	return key
+}
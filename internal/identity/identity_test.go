@@ -0,0 +1,71 @@
+package identity
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", FileName)
+
+	id, err := Load(path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.Len(t, id.ID(), 16)
+	assert.Len(t, id.KeyAgreement().PublicKey().Bytes(), 32)
+
+	// the same id after a restart
+	again, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, id.ID(), again.ID())
+	assert.Equal(t, id.KeyAgreement().PublicKey().Bytes(), again.KeyAgreement().PublicKey().Bytes())
+
+	require.NoError(t, os.Chmod(path, 0o644))
+	_, err = Load(path)
+	assert.ErrorContains(t, err, "accessible by other users")
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	id, err := Load(path)
+	require.NoError(t, err)
+
+	rotated, backup, err := Rotate(path)
+	require.NoError(t, err)
+	assert.NotEqual(t, id.ID(), rotated.ID())
+	assert.Equal(t, path+".old", backup)
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, rotated.ID(), loaded.ID())
+
+	// a second rotation keeps both old keys
+	again, backup, err := Rotate(path)
+	require.NoError(t, err)
+	assert.Equal(t, path+".old.1", backup)
+	for backup, want := range map[string]string{path + ".old": id.ID(), path + ".old.1": rotated.ID()} {
+		old, err := Load(backup)
+		require.NoError(t, err)
+		assert.Equal(t, want, old.ID())
+	}
+	_, err = os.Stat(path + ".new")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// a failed rotation keeps the key in place, the new key cannot be written aside
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".new", "busy"), 0o700))
+	failed, backup, err := Rotate(path)
+	assert.Error(t, err)
+	assert.Nil(t, failed)
+	assert.Empty(t, backup)
+	_, err = os.Stat(path + ".old.2")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	loaded, err = Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, again.ID(), loaded.ID())
+}
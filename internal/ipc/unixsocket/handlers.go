@@ -3,11 +3,13 @@ package unix_socket
 import (
 	"kevin-rd/my-tier/internal/ipc"
 	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/ratelimit"
+	"kevin-rd/my-tier/internal/router"
 	"kevin-rd/my-tier/pkg/ipc/message"
 	"log"
 )
 
-func (_ *UnixSocket) HandleGetPeers(fGet func(network string) []*peer.Peer) ipc.Handler {
+func (_ *UnixSocket) HandleGetPeers(fGet func(network string) ([]*peer.Peer, error), fUsage func(network string) map[string]ratelimit.Usage) ipc.Handler {
 	return func(writer message.Writer, r *message.Message) {
 		body, err := message.DecodePayload[message.PeersReq](r)
 		if err != nil {
@@ -15,8 +17,223 @@ func (_ *UnixSocket) HandleGetPeers(fGet func(network string) []*peer.Peer) ipc.
 		}
 		log.Printf("[unixsocket] get peers request: %v", body)
 
-		msg, err := message.New(message.KindPeers, &message.PeersResp{
-			Peers: fGet(""),
+		resp := &message.PeersResp{}
+		if resp.Peers, err = fGet(body.Network); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Usage = fUsage(body.Network)
+		}
+		msg, err := message.New(message.KindPeers, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleSetLimit(fSet func(req *message.LimitReq) error) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.LimitReq](r)
+		if err != nil {
+			return
+		}
+		log.Printf("[unixsocket] set limit request: %+v", body)
+
+		resp := &message.LimitResp{}
+		if err = fSet(body); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindLimit, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleGetAnycast(fGet func(network string) ([]router.AnycastService, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.AnycastReq](r)
+		if err != nil {
+			return
+		}
+
+		resp := &message.AnycastResp{}
+		if resp.Services, err = fGet(body.Network); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindAnycast, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleExit(fExit func(req *message.ExitReq) (router.ExitStatus, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.ExitReq](r)
+		if err != nil {
+			return
+		}
+		log.Printf("[unixsocket] exit request: %+v", body)
+
+		resp := &message.ExitResp{}
+		if resp.Status, err = fExit(body); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindExit, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleGetMACs(fGet func(network string) ([]router.MACEntry, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.MACsReq](r)
+		if err != nil {
+			return
+		}
+
+		resp := &message.MACsResp{}
+		if resp.MACs, err = fGet(body.Network); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindMACs, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleGetMembers(fGet func(network string) ([]peer.Member, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.MembersReq](r)
+		if err != nil {
+			return
+		}
+
+		resp := &message.MembersResp{}
+		if resp.Members, err = fGet(body.Network); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindMembers, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleGetLeases(fGet func(network string) ([]peer.Lease, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.LeasesReq](r)
+		if err != nil {
+			return
+		}
+
+		resp := &message.LeasesResp{}
+		if resp.Leases, err = fGet(body.Network); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindLeases, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleGetConflicts(fGet func(network string) ([]peer.Conflict, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.ConflictsReq](r)
+		if err != nil {
+			return
+		}
+
+		resp := &message.ConflictsResp{}
+		if resp.Conflicts, err = fGet(body.Network); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindConflicts, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleIdentity(f func(rotate bool) (message.Identity, error)) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		body, err := message.DecodePayload[message.IdentityReq](r)
+		if err != nil {
+			return
+		}
+
+		resp := &message.IdentityResp{}
+		if resp.Identity, err = f(body.Rotate); err != nil {
+			resp.Error = err.Error()
+		}
+		msg, err := message.New(message.KindIdentity, resp)
+		if err != nil {
+			log.Printf("[unixsocket] new message error: %v", err)
+			return
+		}
+
+		if err := writer.Write(msg); err != nil {
+			log.Printf("[unixsocket] write error: %v", err)
+			return
+		}
+	}
+}
+
+func (_ *UnixSocket) HandleGetNetworks(fGet func() []message.Network) ipc.Handler {
+	return func(writer message.Writer, r *message.Message) {
+		msg, err := message.New(message.KindNetworks, &message.NetworksResp{
+			Networks: fGet(),
 		})
 		if err != nil {
 			log.Printf("[unixsocket] new message error: %v", err)
@@ -0,0 +1,65 @@
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const forwardDialTimeout = 10 * time.Second
+
+// Forward forwards the TCP connections to a port of the virtual IP to a local address
+type Forward struct {
+	Port  uint16
+	Local string
+}
+
+// ParseForward parses "port=host:port", e.g. "8080=127.0.0.1:80"
+func ParseForward(s string) (Forward, error) {
+	portStr, local, ok := strings.Cut(s, "=")
+	if !ok {
+		return Forward{}, fmt.Errorf("invalid forward %q, want port=host:port", s)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return Forward{}, fmt.Errorf("invalid forward port %q", portStr)
+	}
+	if _, _, err := net.SplitHostPort(local); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward target %q: %w", local, err)
+	}
+	return Forward{Port: uint16(port), Local: local}, nil
+}
+
+// ServeForward accepts the overlay connections to f.Port and relays them to f.Local
+// until the returned listener is closed.
+func (s *Stack) ServeForward(f Forward) (net.Listener, error) {
+	ln, err := s.ListenTCP(f.Port)
+	if err != nil {
+		return nil, fmt.Errorf("listen on overlay port %d error: %w", f.Port, err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) && s.ctx.Err() == nil {
+					log.Printf("[netstack] forward %d accept error: %v", f.Port, err)
+				}
+				return
+			}
+			go func() {
+				local, err := net.DialTimeout("tcp", f.Local, forwardDialTimeout)
+				if err != nil {
+					log.Printf("[netstack] forward %d to %s error: %v", f.Port, f.Local, err)
+					_ = conn.Close()
+					return
+				}
+				relay(conn, local)
+			}()
+		}
+	}()
+	return ln, nil
+}
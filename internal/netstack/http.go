@@ -0,0 +1,68 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpDialTimeout bounds the connect to the target of a CONNECT request
+const httpDialTimeout = 30 * time.Second
+
+// ServeHTTPConnect serves an HTTP proxy on ln which tunnels CONNECT requests through the
+// stack until ln is closed. Other methods are refused.
+func (s *Stack) ServeHTTPConnect(ln net.Listener) error {
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(s.handleConnect),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Stack) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), httpDialTimeout)
+	remote, err := s.DialContext(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		log.Printf("[netstack] http connect %s error: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		_ = remote.Close()
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		_ = conn.Close()
+		_ = remote.Close()
+		return
+	}
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		if _, err := remote.Write(buffered); err != nil {
+			_ = conn.Close()
+			_ = remote.Close()
+			return
+		}
+	}
+	relay(conn, remote)
+}
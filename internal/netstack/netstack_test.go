@@ -0,0 +1,107 @@
+package netstack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// newStackPair connects two stacks back to back, as if the router carried their packets
+func newStackPair(t *testing.T) (*Stack, *Stack) {
+	a, err := New(utils.Must2IPMask("10.0.0.1/24"), 1420)
+	require.NoError(t, err)
+	b, err := New(utils.Must2IPMask("10.0.0.2/24"), 1420)
+	require.NoError(t, err)
+
+	link := func(from, to *Stack) {
+		buf := make([]byte, 65535)
+		for {
+			n, err := from.ReadPacket(buf)
+			if err != nil {
+				return
+			}
+			_ = to.WritePacket(buf[:n])
+		}
+	}
+	go link(a, b)
+	go link(b, a)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b
+}
+
+func TestSOCKS5ToForward(t *testing.T) {
+	a, b := newStackPair(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "hello from b")
+	}))
+	defer srv.Close()
+	ln, err := b.ServeForward(Forward{Port: 80, Local: srv.Listener.Addr().String()})
+	require.NoError(t, err)
+	defer ln.Close()
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socks.Close()
+	go func() { _ = a.ServeSOCKS5(socks) }()
+
+	dialer, err := proxy.SOCKS5("tcp", socks.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+	resp, err := client.Get("http://10.0.0.2/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from b", string(body))
+}
+
+func TestHTTPConnect(t *testing.T) {
+	a, b := newStackPair(t)
+
+	echo, err := b.ListenTCP(7)
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err == nil {
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() { _ = a.ServeHTTPConnect(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "CONNECT 10.0.0.2:7 HTTP/1.1\r\nHost: 10.0.0.2:7\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(status, "200"), status)
+	_, _ = r.ReadString('\n')
+
+	_, err = fmt.Fprint(conn, "ping\n")
+	require.NoError(t, err)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
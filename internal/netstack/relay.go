@@ -0,0 +1,27 @@
+package netstack
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// relay copies between a and b until both directions are done, then closes them
+func relay(a, b net.Conn) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
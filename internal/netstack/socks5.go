@@ -0,0 +1,166 @@
+package netstack
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5, RFC 1928. Only CONNECT without authentication is supported.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5HostUnreachable  = 0x04
+	socks5CmdNotSupported  = 0x07
+	socks5AtypNotSupported = 0x08
+	socks5HandshakeTimeout = 10 * time.Second
+	socks5DialTimeout      = 30 * time.Second
+)
+
+// ServeSOCKS5 accepts SOCKS5 clients on ln and connects them through the stack until ln is closed
+func (s *Stack) ServeSOCKS5(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.handleSOCKS5(conn); err != nil {
+				log.Printf("[netstack] socks5 %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *Stack) handleSOCKS5(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	r := bufio.NewReader(conn)
+
+	// greeting: VER NMETHODS METHODS...
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil || hdr[0] != socks5Version {
+		_ = conn.Close()
+		return fmt.Errorf("invalid greeting")
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil || method != socks5AuthNone {
+		_ = conn.Close()
+		return fmt.Errorf("no acceptable auth method")
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	host, err := readSOCKS5Addr(r, req[3])
+	if err != nil {
+		socks5Reply(conn, socks5AtypNotSupported)
+		_ = conn.Close()
+		return err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if req[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5CmdNotSupported)
+		_ = conn.Close()
+		return fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	ctx, cancel := context.WithTimeout(context.Background(), socks5DialTimeout)
+	remote, err := s.DialContext(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		socks5Reply(conn, socks5HostUnreachable)
+		_ = conn.Close()
+		return fmt.Errorf("connect %s error: %w", addr, err)
+	}
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		_ = conn.Close()
+		_ = remote.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// the client may have pipelined data behind the request
+	if n := r.Buffered(); n > 0 {
+		buffered, _ := r.Peek(n)
+		if _, err := remote.Write(buffered); err != nil {
+			_ = conn.Close()
+			_ = remote.Close()
+			return err
+		}
+	}
+	relay(conn, remote)
+	return nil
+}
+
+func readSOCKS5Addr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		var ip [4]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", err
+		}
+		return net.IP(ip[:]).String(), nil
+	case socks5AtypIPv6:
+		var ip [16]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", err
+		}
+		return net.IP(ip[:]).String(), nil
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		return string(name), nil
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp)
+	}
+}
+
+// socks5Reply answers a request, the bound address is left unspecified
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
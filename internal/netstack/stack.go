@@ -0,0 +1,179 @@
+// Package netstack runs a userspace TCP/IP stack in place of a TUN device, so the core
+// works without root or /dev/net/tun. Local applications reach the overlay through the
+// SOCKS5 and HTTP CONNECT proxies, overlay connections are forwarded to local ports.
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kevin-rd/my-tier/internal/tun"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"os"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	nicID = 1
+	// outboundQueueSize is the number of packets of the stack waiting for ReadPacket
+	outboundQueueSize = 1024
+)
+
+// Stack is a gVisor netstack with the virtual IP of the node. It is a tun.Device, the
+// router reads the packets the stack sends and writes the packets from peers into it.
+type Stack struct {
+	stack *stack.Stack
+	ep    *channel.Endpoint
+	mtu   int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var _ tun.Device = (*Stack)(nil)
+
+func New(vip utils.IPMask, mtu int) (*Stack, error) {
+	if mtu <= 0 {
+		mtu = tun.DefaultMTU
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+		HandleLocal:        true,
+	})
+	ep := channel.New(outboundQueueSize, uint32(mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("create netstack nic error: %v", err)
+	}
+
+	ip := vip.IPv4()
+	addr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(ip),
+			PrefixLen: int(vip[4]),
+		},
+	}
+	if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("add netstack address %v error: %v", vip, err)
+	}
+	// everything leaves through the overlay, the router picks the peer, subnet or exit node
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Stack{stack: s, ep: ep, mtu: mtu, ctx: ctx, cancel: cancel}, nil
+}
+
+// ReadPacket returns the next IP packet sent by the stack
+func (s *Stack) ReadPacket(buf []byte) (int, error) {
+	pkt := s.ep.ReadContext(s.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	defer pkt.DecRef()
+
+	n := 0
+	for _, b := range pkt.AsSlices() {
+		n += copy(buf[n:], b)
+	}
+	return n, nil
+}
+
+// WritePacket hands an IP packet from the overlay to the stack
+func (s *Stack) WritePacket(data []byte) error {
+	if s.ctx.Err() != nil {
+		return os.ErrClosed
+	}
+	var proto tcpip.NetworkProtocolNumber
+	switch header.IPVersion(data) {
+	case header.IPv4Version:
+		proto = ipv4.ProtocolNumber
+	case header.IPv6Version:
+		proto = ipv6.ProtocolNumber
+	default:
+		return errors.New("not an IP packet")
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), data...)),
+	})
+	s.ep.InjectInbound(proto, pkt)
+	pkt.DecRef()
+	return nil
+}
+
+func (s *Stack) MTU() int {
+	return s.mtu
+}
+
+func (s *Stack) Name() string {
+	return "netstack"
+}
+
+func (s *Stack) Close() error {
+	s.cancel()
+	s.ep.Close()
+	s.stack.Close()
+	return nil
+}
+
+// DialContext connects to addr through the overlay, network is tcp or udp
+func (s *Stack) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	full, err := s.fullAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4":
+		return gonet.DialContextTCP(ctx, s.stack, full, ipv4.ProtocolNumber)
+	case "udp", "udp4":
+		return gonet.DialUDP(s.stack, nil, &full, ipv4.ProtocolNumber)
+	default:
+		return nil, fmt.Errorf("netstack: unsupported network %q", network)
+	}
+}
+
+// ListenTCP listens on port of the virtual IP
+func (s *Stack) ListenTCP(port uint16) (net.Listener, error) {
+	return gonet.ListenTCP(s.stack, tcpip.FullAddress{NIC: nicID, Port: port}, ipv4.ProtocolNumber)
+}
+
+// ListenUDP listens on port of the virtual IP
+func (s *Stack) ListenUDP(port uint16) (net.PacketConn, error) {
+	return gonet.DialUDP(s.stack, &tcpip.FullAddress{NIC: nicID, Port: port}, nil, ipv4.ProtocolNumber)
+}
+
+// fullAddr resolves "host:port", names are resolved by the host resolver
+func (s *Stack) fullAddr(ctx context.Context, addr string) (tcpip.FullAddress, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tcpip.FullAddress{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return tcpip.FullAddress{}, err
+		}
+		ip = ips[0].To4()
+	}
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ip), Port: uint16(port)}, nil
+}
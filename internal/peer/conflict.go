@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"bytes"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxConflicts is the number of conflicts kept for the operators
+const maxConflicts = 32
+
+// Conflict is a handshake rejected because a node uses the id or the address of another
+// one, either rejected by this node or this node rejected by a peer
+type Conflict struct {
+	Reason string `json:"reason"`
+	// ID and VirtualIP are the identity of the rejected node, RemoteAddr the address of
+	// the other side
+	ID         string       `json:"id"`
+	VirtualIP  utils.IPMask `json:"virtual_ip"`
+	RemoteAddr string       `json:"remote_addr,omitempty"`
+	// Holder is the node keeping the id or address, RejectedBy the peer which rejected
+	// this node, empty if this node rejected the other one
+	Holder     string    `json:"holder,omitempty"`
+	RejectedBy string    `json:"rejected_by,omitempty"`
+	Count      int       `json:"count"`
+	Last       time.Time `json:"last"`
+}
+
+// Conflicts returns the recent conflicts, the latest first
+func (m *Manager) Conflicts() []Conflict {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conflicts := slices.Clone(m.conflicts)
+	slices.Reverse(conflicts)
+	return conflicts
+}
+
+// recordConflict keeps c for the operators, a repeated conflict is counted, m.mu must be held
+func (m *Manager) recordConflict(c Conflict) {
+	c.Last = time.Now()
+	for i, o := range m.conflicts {
+		if o.Reason == c.Reason && o.ID == c.ID && o.VirtualIP == c.VirtualIP && o.RemoteAddr == c.RemoteAddr && o.RejectedBy == c.RejectedBy {
+			c.Count = o.Count + 1
+			m.conflicts = append(slices.Delete(m.conflicts, i, i+1), c)
+			return
+		}
+	}
+	c.Count = 1
+	if len(m.conflicts) >= maxConflicts {
+		m.conflicts = slices.Delete(m.conflicts, 0, 1)
+	}
+	m.conflicts = append(m.conflicts, c)
+}
+
+// identityConflict checks a node handshaking as id at vip from addr against this node and
+// the connected peers. A node handshaking again from the same address is the same node. A
+// node with the id of a peer at another address is refused while that peer is alive, once
+// it went silent the node moved, e.g. it restarted or leased another address, and
+// handshaked replaces the peer. The holder of the id or address is returned with the code.
+// m.mu must be held.
+func (m *Manager) identityConflict(id string, vip utils.IPMask, addr string) (payload.RejectCode, string) {
+	if strings.EqualFold(id, m.ID) {
+		return payload.RejectDuplicateID, m.ID
+	}
+	if vip != (utils.IPMask{}) && vip.IPv4() == m.VirtualIP.IPv4() {
+		return payload.RejectDuplicateVIP, m.ID
+	}
+	now := time.Now()
+	for _, p := range m.peerMap {
+		if p.Writer == nil || p.RemoteAddr == addr {
+			continue
+		}
+		sameID := strings.EqualFold(p.ID, id)
+		sameVIP := vip != (utils.IPMask{}) && p.VirtualIP.IPv4() == vip.IPv4()
+		switch {
+		case sameID && !m.silent(p, now):
+			return payload.RejectDuplicateID, p.ID
+		case sameVIP && !sameID:
+			return payload.RejectDuplicateVIP, p.ID
+		}
+	}
+	return 0, ""
+}
+
+// reject refuses the handshake of the node info at p with code, m.mu must be held
+func (m *Manager) reject(p *Peer, info Info, code payload.RejectCode, holder string) {
+	log.Printf("[peer] reject %s %s at %s: %s, held by %s", info.ID, info.VirtualIP, p.RemoteAddr, code, holder)
+	m.recordConflict(Conflict{Reason: code.String(), ID: info.ID, VirtualIP: info.VirtualIP, RemoteAddr: p.RemoteAddr, Holder: holder})
+
+	var idBytes [32]byte
+	copy(idBytes[:], m.ID)
+	pkt := packet.NewPacket(packet.TypeHandshakeReject, &payload.HandshakeRejectPayload{
+		ID:        idBytes,
+		Network:   m.networkID,
+		MAC:       m.mac(macReject, idBytes, info.VirtualIP),
+		Code:      code,
+		VirtualIP: info.VirtualIP,
+	})
+	pkt.SrcVIP = m.VirtualIP.IPv4()
+	if err := m.sched.enqueue(p, pkt); err != nil {
+		log.Printf("[peer] queue handshake reject to %s error: %v", p.RemoteAddr, err)
+	}
+}
+
+// HandshakeReject takes the refusal of a handshake of this node. The peer is retried with
+// backoff, the operators may resolve the conflict meanwhile. A DHCP node in probation
+// leases another address.
+func (m *Manager) HandshakeReject(w packet.Writer, rej *payload.HandshakeRejectPayload) {
+	key := w.RemoteAddr().String()
+	id := string(bytes.Trim(rej.ID[:], "\x00"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.tempPeers[key]
+	if !ok || (p.State() != STATE_HANDSHAKE_SENT && p.State() != STATE_HANDSHAKE_RECEIVED) {
+		return
+	}
+	if rej.VirtualIP != m.VirtualIP {
+		// a reject of an address this node left
+		return
+	}
+	if reason := m.admit(rej.Network, rej.MAC, macReject, rej.ID, rej.VirtualIP); reason != "" {
+		log.Printf("[peer] ignore handshake reject of %s: %s", key, reason)
+		return
+	}
+
+	log.Printf("[peer] rejected by %s %s: %s", id, key, rej.Code)
+	m.recordConflict(Conflict{Reason: rej.Code.String(), ID: m.ID, VirtualIP: m.VirtualIP, RemoteAddr: key, RejectedBy: id})
+	m.fail(p, time.Now(), "rejected: "+rej.Code.String())
+	if rej.Code == payload.RejectDuplicateVIP && m.dhcp && !m.isBound() {
+		m.readdress(utils.IPMask{}, nil)
+		m.lease = leaseState{}
+	}
+}
@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflicts(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+	// another node with the VIP of a, and a node with the id of a
+	handshakeFrom(m, "b", "10.0.0.2/24", "192.0.2.3:6780")
+	handshakeFrom(m, "a", "10.0.0.4/24", "192.0.2.4:6780")
+	handshakeFrom(m, "a", "10.0.0.4/24", "192.0.2.4:6780")
+	// a node with the id of this one
+	handshakeFrom(m, "self", "10.0.0.5/24", "192.0.2.5:6780")
+
+	assert.Equal(t, "a", m.GetPeer(utils.IPv4{10, 0, 0, 2}).ID)
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 4}))
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 5}))
+	assert.Len(t, m.GetPeers(""), 2)
+
+	conflicts := m.Conflicts()
+	require.Len(t, conflicts, 3)
+	assert.Equal(t, Conflict{Reason: "duplicate_id", ID: "self", VirtualIP: utils.Must2IPMask("10.0.0.5/24"),
+		RemoteAddr: "192.0.2.5:6780", Holder: "self", Count: 1, Last: conflicts[0].Last}, conflicts[0])
+	assert.Equal(t, "duplicate_id", conflicts[1].Reason)
+	assert.Equal(t, 2, conflicts[1].Count)
+	assert.Equal(t, "duplicate_vip", conflicts[2].Reason)
+	assert.Equal(t, "b", conflicts[2].ID)
+	assert.Equal(t, "a", conflicts[2].Holder)
+}
+
+func TestConflicts_Rejected(t *testing.T) {
+	a := NewManager("a", utils.Must2IPMask("10.0.0.1/24"))
+	b := NewManager("b", utils.Must2IPMask("10.0.0.1/24"), "192.0.2.1:6780")
+	addrA, addrB := udpAddr("192.0.2.1:6780"), udpAddr("192.0.2.2:6780")
+	b.SetDialer(func(string) (packet.Writer, error) {
+		return &linkWriter{local: addrB, remote: addrA, from: b, to: a}, nil
+	})
+
+	go func() { _ = a.Manage() }()
+	go func() { _ = b.Manage() }()
+	t.Cleanup(func() {
+		a.Stop()
+		b.Stop()
+	})
+
+	// b is told why it was rejected and backs off
+	require.Eventually(t, func() bool {
+		return len(b.Conflicts()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	c := b.Conflicts()[0]
+	assert.Equal(t, "duplicate_vip", c.Reason)
+	assert.Equal(t, "a", c.RejectedBy)
+	assert.Equal(t, "192.0.2.1:6780", c.RemoteAddr)
+
+	c = a.Conflicts()[0]
+	assert.Equal(t, "b", c.ID)
+	assert.Equal(t, "a", c.Holder)
+	assert.Len(t, a.GetPeers(""), 1)
+	assert.Len(t, b.GetPeers(""), 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.Equal(t, STATE_RECONNECTING, b.tempPeers["192.0.2.1:6780"].State())
+}
+
+// dhcpHandshakeFrom handshakes a DHCP node wanting vip from addr
+func dhcpHandshakeFrom(m *Manager, id string, want utils.IPMask, addr string) {
+	w := &linkWriter{local: udpAddr("192.0.2.1:6780"), remote: udpAddr(addr), drop: true}
+	var idBytes [32]byte
+	copy(idBytes[:], id)
+	m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeInit, &payload.HandshakeInitPayload{
+		ID:        idBytes,
+		VirtualIP: want,
+		DHCP:      true,
+	}))
+	m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeFinalize, new(payload.StringPayload)))
+}
+
+// silence makes p silent for the suspect timeout
+func silence(p *Peer) {
+	p.lastSeen.Store(time.Now().Add(-DefaultLiveness.SuspectAfter).UnixNano())
+}
+
+func TestConflicts_DuplicateID(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+
+	// a node with the id and address of a live peer is refused
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.3:6780")
+	assert.Equal(t, "192.0.2.2:6780", m.GetPeer(utils.IPv4{10, 0, 0, 2}).RemoteAddr)
+	require.Len(t, m.Conflicts(), 1)
+	assert.Equal(t, "duplicate_id", m.Conflicts()[0].Reason)
+
+	// once the peer went silent it moved
+	silence(m.GetPeer(utils.IPv4{10, 0, 0, 2}))
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.3:6780")
+	assert.Equal(t, "192.0.2.3:6780", m.GetPeer(utils.IPv4{10, 0, 0, 2}).RemoteAddr)
+	assert.Len(t, m.GetPeers(""), 2)
+}
+
+func TestConflicts_DHCPRestart(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	pool, err := SubnetPool(m.VirtualIP, time.Minute)
+	require.NoError(t, err)
+	m.SetPool(pool)
+
+	dhcpHandshakeFrom(m, "c", utils.Must2IPMask("10.0.0.50/24"), "192.0.2.3:6780")
+	require.NotNil(t, m.GetPeer(utils.IPv4{10, 0, 0, 50}))
+
+	// a rejected node is leased nothing
+	dhcpHandshakeFrom(m, "self", utils.IPMask{}, "192.0.2.4:6780")
+	dhcpHandshakeFrom(m, "c", utils.Must2IPMask("10.0.0.60/24"), "192.0.2.5:6780")
+	assert.Equal(t, []Lease{{ID: "c", VirtualIP: utils.Must2IPMask("10.0.0.50/24"), Expires: m.Leases()[0].Expires}}, m.Leases())
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 60}))
+
+	// c restarts from another port after its lease expired and leases another address
+	silence(m.GetPeer(utils.IPv4{10, 0, 0, 50}))
+	pool.Release("c")
+	dhcpHandshakeFrom(m, "c", utils.Must2IPMask("10.0.0.60/24"), "192.0.2.3:6781")
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 50}))
+	p := m.GetPeer(utils.IPv4{10, 0, 0, 60})
+	require.NotNil(t, p)
+	assert.Equal(t, "c", p.ID)
+	assert.Equal(t, "192.0.2.3:6781", p.RemoteAddr)
+	assert.Len(t, m.GetPeers(""), 2)
+	require.Len(t, m.Leases(), 1)
+	assert.Equal(t, utils.Must2IPMask("10.0.0.60/24"), m.Leases()[0].VirtualIP)
+}
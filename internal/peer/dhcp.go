@@ -0,0 +1,289 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"time"
+)
+
+const (
+	// leaseProbation is how long a DHCP node watches for address conflicts before it binds
+	// its address, until then the loser of a conflict moves to another address
+	leaseProbation = 5 * time.Second
+	// leaseRetry is the interval of the renewals once a lease is due
+	leaseRetry = 10 * time.Second
+)
+
+// leaseState is the address lease of a DHCP node
+type leaseState struct {
+	// server is the allocator renewing the lease, zero if unknown
+	server utils.IPv4
+	ttl    time.Duration
+	// renewAt is the next renewal, expires the end of the lease
+	renewAt, expires time.Time
+	// probation ends the conflict watch of a new address, zero before an address is offered
+	probation time.Time
+	warned    bool
+}
+
+// SetPool makes this node an allocator, it hands out the addresses of pool to the nodes
+// which handshake with DHCP. It must be called before Manage.
+func (m *Manager) SetPool(pool *Pool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pool = pool
+}
+
+// Leases returns the leases handed out by this node, nil if it is not an allocator
+func (m *Manager) Leases() []Lease {
+	m.mu.Lock()
+	pool := m.pool
+	m.mu.Unlock()
+	if pool == nil {
+		return nil
+	}
+	return pool.Leases()
+}
+
+// Bound is closed once the address of the node is final: at once for a static address,
+// after the probation of the first lease for a DHCP node
+func (m *Manager) Bound() <-chan struct{} {
+	return m.bound
+}
+
+// Address returns the virtual IP of the node, zero while a DHCP node waits for a lease
+func (m *Manager) Address() utils.IPMask {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.VirtualIP
+}
+
+// isBound reports whether the address is final, m.mu must be held
+func (m *Manager) isBound() bool {
+	select {
+	case <-m.bound:
+		return true
+	default:
+		return false
+	}
+}
+
+// taken reports whether ip is used by another node than id as far as this node knows,
+// the cluster membership included. m.mu must be held.
+func (m *Manager) taken(ip utils.IPv4, id string) bool {
+	if ip == m.VirtualIP.IPv4() && id != m.ID {
+		return true
+	}
+	if p, ok := m.peerMap[ip]; ok && p.ID != id {
+		return true
+	}
+	for _, mem := range m.swim.Members() {
+		if mem.VirtualIP.IPv4() == ip && mem.ID != id && (mem.State == payload.MemberAlive || mem.State == payload.MemberSuspect) {
+			return true
+		}
+	}
+	return false
+}
+
+// offer returns the address of a node handshaking with DHCP: a lease of the pool, or the
+// address it brings if that one is leased by another allocator. m.mu must be held.
+func (m *Manager) offer(id string, want utils.IPMask) (utils.IPMask, uint32, string) {
+	if m.pool == nil || (want != utils.IPMask{} && !m.pool.contains(want.IPv4())) {
+		if want == (utils.IPMask{}) {
+			return want, 0, "no address pool"
+		}
+		return want, 0, ""
+	}
+	vip, ttl, err := m.pool.Allocate(id, want.IPv4(), m.taken, time.Now())
+	if err != nil {
+		return vip, 0, err.Error()
+	}
+	if vip != want {
+		log.Printf("[peer] lease %s to %s for %v", vip, id, ttl)
+	}
+	return vip, uint32(ttl / time.Second), ""
+}
+
+// acceptOffer adopts the address offered by the allocator of a handshake reply. A node
+// still in probation moves to the offered address, a bound one refuses to move.
+// m.mu must be held.
+func (m *Manager) acceptOffer(p *Peer, reply *payload.HandshakeReplyPayload, now time.Time) string {
+	offered := reply.VirtualIP
+	switch {
+	case offered == (utils.IPMask{}):
+		if m.VirtualIP == (utils.IPMask{}) {
+			return "no address offered"
+		}
+		return ""
+	case offered != m.VirtualIP:
+		if m.isBound() {
+			return fmt.Sprintf("offers %s while %s is bound", offered, m.VirtualIP)
+		}
+		m.readdress(offered, p)
+		m.lease = leaseState{probation: now.Add(leaseProbation)}
+	}
+	if reply.Lease > 0 {
+		m.renewed(reply.Self.IPv4(), time.Duration(reply.Lease)*time.Second, now)
+	}
+	return ""
+}
+
+// renewed records a lease granted by server, m.mu must be held
+func (m *Manager) renewed(server utils.IPv4, ttl time.Duration, now time.Time) {
+	m.lease.server = server
+	m.lease.ttl = ttl
+	m.lease.renewAt = now.Add(ttl / 2)
+	m.lease.expires = now.Add(ttl)
+	m.lease.warned = false
+}
+
+// readdress moves a DHCP node to vip. The sessions of the old address are dropped, the
+// static peers handshake again except keep, whose handshake completes the move.
+// m.mu must be held.
+func (m *Manager) readdress(vip utils.IPMask, keep *Peer) {
+	old := m.VirtualIP
+	for _, p := range m.peerMap {
+		if p.Writer == nil {
+			continue
+		}
+		m.removePeer(p)
+		p.setState(STATE_DEAD)
+		p.queue.clear()
+		m.emit(Event{Type: EventDisconnected, Peer: p.Info, RemoteAddr: p.RemoteAddr})
+		if _, ok := m.tempPeers[p.addr]; p.addr != "" && !ok {
+			m.tempPeers[p.addr] = &Peer{addr: p.addr, queue: newSendQueue()}
+		}
+	}
+	// the handshakes in flight announced the old address
+	for _, p := range m.tempPeers {
+		if p != keep && p.addr != "" && (p.State() == STATE_HANDSHAKE_SENT || p.State() == STATE_HANDSHAKE_RECEIVED) {
+			p.setState(STATE_INIT)
+		}
+	}
+	if self, ok := m.peerMap[old.IPv4()]; ok && self.Writer == nil {
+		m.removePeer(self)
+	}
+
+	m.VirtualIP = vip
+	ip := vip.IPv4()
+	m.srcVIP.Store(&ip)
+	if vip != (utils.IPMask{}) {
+		m.addPeer("", &Peer{Info: m.Info})
+		log.Printf("[peer] address %s", vip)
+	} else {
+		log.Printf("[peer] released address %s", old)
+	}
+	m.swim.setSelf(m.Info)
+}
+
+// addressConflict resolves another node using the address of this one. The node with the
+// lower id keeps the address, so every node comes to the same decision. Only a DHCP node
+// in probation moves. m.mu must be held.
+func (m *Manager) addressConflict(other Info) {
+	switch {
+	case !m.dhcp || m.isBound():
+		log.Printf("[peer] address conflict: %s uses %s as well", other.ID, m.VirtualIP)
+		m.recordConflict(Conflict{Reason: payload.RejectDuplicateVIP.String(), ID: other.ID, VirtualIP: other.VirtualIP, Holder: m.ID})
+	case other.ID < m.ID:
+		log.Printf("[peer] address %s is taken by %s, asking for another one", m.VirtualIP, other.ID)
+		m.readdress(utils.IPMask{}, nil)
+		m.lease = leaseState{}
+	default:
+		log.Printf("[peer] address %s is claimed by %s as well, keeping it", m.VirtualIP, other.ID)
+	}
+}
+
+// checkLease binds the address after its probation and renews the lease once it is due,
+// with the allocator of the lease or with every peer if that one is gone. m.mu must be held.
+func (m *Manager) checkLease(now time.Time) {
+	if !m.dhcp || m.VirtualIP == (utils.IPMask{}) {
+		return
+	}
+	if !m.isBound() && !m.lease.probation.IsZero() && now.After(m.lease.probation) {
+		log.Printf("[peer] bound address %s", m.VirtualIP)
+		close(m.bound)
+	}
+
+	l := &m.lease
+	if l.ttl == 0 || now.Before(l.renewAt) {
+		return
+	}
+	l.renewAt = now.Add(leaseRetry)
+	if now.After(l.expires) && !l.warned {
+		log.Printf("[peer] lease of %s expired, no allocator renewed it", m.VirtualIP)
+		l.warned = true
+	}
+
+	renew := func(p *Peer) {
+		pkt := packet.NewPacket(packet.TypeLease, &payload.LeasePayload{Kind: payload.LeaseRenew, VIP: m.VirtualIP})
+		pkt.SrcVIP = m.VirtualIP.IPv4()
+		pkt.DstVIP = p.VirtualIP.IPv4()
+		if err := m.sched.enqueue(p, pkt); err != nil {
+			log.Printf("[peer] queue lease renewal to %s error: %v", p.RemoteAddr, err)
+		}
+	}
+	if p, ok := m.peerMap[l.server]; ok && p.Writer != nil {
+		renew(p)
+		return
+	}
+	for _, p := range m.peerMap {
+		if p.Writer != nil {
+			renew(p)
+		}
+	}
+}
+
+// handleLease renews the leases of the pool and takes the answers to the renewals of
+// this node
+func (m *Manager) handleLease(pkt *packet.Packet[packet.Packable]) {
+	l, ok := pkt.Payload.(*payload.LeasePayload)
+	if !ok {
+		return
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peerMap[pkt.SrcVIP]
+	if !ok || p.Writer == nil {
+		return
+	}
+
+	switch l.Kind {
+	case payload.LeaseRenew:
+		if m.pool == nil {
+			return
+		}
+		ttl, err := m.pool.Renew(p.ID, l.VIP.IPv4(), m.taken, now)
+		if errors.Is(err, errForeignAddr) {
+			return
+		}
+		resp := &payload.LeasePayload{Kind: payload.LeaseGrant, VIP: l.VIP, TTL: uint32(ttl / time.Second)}
+		if err != nil {
+			log.Printf("[peer] refuse lease of %s to %s: %v", l.VIP, p.ID, err)
+			resp = &payload.LeasePayload{Kind: payload.LeaseNak, VIP: l.VIP}
+		}
+		reply := packet.NewPacket(packet.TypeLease, resp)
+		reply.SrcVIP = m.VirtualIP.IPv4()
+		reply.DstVIP = p.VirtualIP.IPv4()
+		if err := m.sched.enqueue(p, reply); err != nil {
+			log.Printf("[peer] queue lease to %s error: %v", p.RemoteAddr, err)
+		}
+	case payload.LeaseGrant:
+		if m.dhcp && l.VIP == m.VirtualIP {
+			m.renewed(pkt.SrcVIP, time.Duration(l.TTL)*time.Second, now)
+		}
+	case payload.LeaseNak:
+		if m.dhcp && l.VIP == m.VirtualIP {
+			log.Printf("[peer] lease of %s refused by %s", l.VIP, p.ID)
+			if !m.isBound() {
+				m.readdress(utils.IPMask{}, nil)
+				m.lease = leaseState{}
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDHCP(t *testing.T) {
+	a := NewManager("a", utils.Must2IPMask("10.0.0.1/24"))
+	pool, err := SubnetPool(a.VirtualIP, time.Minute)
+	require.NoError(t, err)
+	a.SetPool(pool)
+	c := NewManager("c", utils.IPMask{}, "192.0.2.1:6780")
+	addrA, addrC := udpAddr("192.0.2.1:6780"), udpAddr("192.0.2.3:6780")
+	c.SetDialer(func(string) (packet.Writer, error) {
+		return &linkWriter{local: addrC, remote: addrA, from: c, to: a}, nil
+	})
+
+	go func() { _ = a.Manage() }()
+	go func() { _ = c.Manage() }()
+	t.Cleanup(func() {
+		a.Stop()
+		c.Stop()
+	})
+
+	require.Eventually(t, func() bool {
+		vip := c.Address()
+		return vip != utils.IPMask{} && a.GetPeer(vip.IPv4()) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	vip := c.Address()
+	assert.True(t, a.VirtualIP.Contains(vip.IPv4()))
+	assert.NotEqual(t, a.VirtualIP, vip)
+	leases := a.Leases()
+	require.Len(t, leases, 1)
+	assert.Equal(t, Lease{ID: "c", VirtualIP: vip, Expires: leases[0].Expires}, leases[0])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a node with a lower id claims the address during the probation, c moves
+	assert.False(t, c.isBound())
+	c.addressConflict(Info{ID: "b", VirtualIP: vip})
+	assert.Equal(t, utils.IPMask{}, c.VirtualIP)
+	assert.Contains(t, c.tempPeers, "192.0.2.1:6780")
+
+	// once bound the address is kept
+	c.readdress(vip, nil)
+	c.lease.probation = time.Now()
+	c.checkLease(time.Now().Add(time.Second))
+	assert.True(t, c.isBound())
+	c.addressConflict(Info{ID: "b", VirtualIP: vip})
+	assert.Equal(t, vip, c.VirtualIP)
+}
@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of a peer event
+type EventType byte
+
+const (
+	// EventConnected a peer handshaked
+	EventConnected EventType = iota
+	// EventDisconnected a peer is gone, e.g. evicted or moved to another VIP
+	EventDisconnected
+	// EventEndpointChanged a peer handshaked again from another remote address
+	EventEndpointChanged
+	// EventLatencyChanged the round trip time of a peer moved to another LatencyClass
+	EventLatencyChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventEndpointChanged:
+		return "endpoint_changed"
+	case EventLatencyChanged:
+		return "latency_changed"
+	}
+	return "unknown"
+}
+
+// LatencyClass buckets the round trip time, so that small jitter is not reported
+type LatencyClass byte
+
+const (
+	LatencyUnknown LatencyClass = iota
+	// LatencyLAN below 5ms
+	LatencyLAN
+	// LatencyRegional below 50ms
+	LatencyRegional
+	// LatencyWAN below 200ms
+	LatencyWAN
+	// LatencyPoor 200ms and above
+	LatencyPoor
+)
+
+func LatencyClassOf(rtt time.Duration) LatencyClass {
+	switch {
+	case rtt <= 0:
+		return LatencyUnknown
+	case rtt < 5*time.Millisecond:
+		return LatencyLAN
+	case rtt < 50*time.Millisecond:
+		return LatencyRegional
+	case rtt < 200*time.Millisecond:
+		return LatencyWAN
+	}
+	return LatencyPoor
+}
+
+func (c LatencyClass) String() string {
+	switch c {
+	case LatencyLAN:
+		return "lan"
+	case LatencyRegional:
+		return "regional"
+	case LatencyWAN:
+		return "wan"
+	case LatencyPoor:
+		return "poor"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Peer is the identity of the peer, VirtualIP is its key in the routing maps
+	Peer       Info
+	RemoteAddr string
+	// OldRemoteAddr is set by EventEndpointChanged
+	OldRemoteAddr string
+	// Latency and RTT are set by EventLatencyChanged
+	Latency LatencyClass
+	RTT     time.Duration
+}
+
+// DefaultEventBuffer is the number of events a subscriber may fall behind
+const DefaultEventBuffer = 64
+
+// Subscription receives the peer events on C until it is unsubscribed. Events are
+// dropped instead of blocking the manager when the subscriber falls behind.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	dropped atomic.Uint64
+}
+
+// Dropped is the number of events lost because C was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Subscribe returns a subscription buffering up to size events, DefaultEventBuffer if
+// size is not positive
+func (m *Manager) Subscribe(size int) *Subscription {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+	ch := make(chan Event, size)
+	s := &Subscription{C: ch, ch: ch}
+
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe stops the events of s and closes s.C
+func (m *Manager) Unsubscribe(s *Subscription) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if _, ok := m.subs[s]; ok {
+		delete(m.subs, s)
+		close(s.ch)
+	}
+}
+
+// emit delivers ev to every subscriber without blocking
+func (m *Manager) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+	for s := range m.subs {
+		select {
+		case s.ch <- ev:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// observeRTT records a round trip time of p and reports a change of its LatencyClass
+func (m *Manager) observeRTT(p *Peer, rtt time.Duration) {
+	p.rtt.Store(int64(rtt))
+	class := LatencyClassOf(rtt)
+	if LatencyClass(p.latency.Swap(uint32(class))) == class {
+		return
+	}
+	m.emit(Event{Type: EventLatencyChanged, Peer: p.Info, RemoteAddr: p.RemoteAddr, Latency: class, RTT: rtt})
+}
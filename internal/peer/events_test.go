@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshakeFrom completes a handshake initiated by a peer at addr
+func handshakeFrom(m *Manager, id, vip, addr string) {
+	w := &linkWriter{local: udpAddr("192.0.2.1:6780"), remote: udpAddr(addr), drop: true}
+	var idBytes [32]byte
+	copy(idBytes[:], id)
+	m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeInit, &payload.HandshakeInitPayload{
+		ID:        idBytes,
+		VirtualIP: utils.Must2IPMask(vip),
+	}))
+	m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeFinalize, new(payload.StringPayload)))
+}
+
+func nextEvent(t *testing.T, s *Subscription) Event {
+	t.Helper()
+	select {
+	case ev := <-s.C:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+		return Event{}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	s := m.Subscribe(0)
+
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+	ev := nextEvent(t, s)
+	assert.Equal(t, EventConnected, ev.Type)
+	assert.Equal(t, "a", ev.Peer.ID)
+	assert.Equal(t, "192.0.2.2:6780", ev.RemoteAddr)
+
+	// the same node from another address once the old one went silent
+	silence(m.GetPeer(utils.IPv4{10, 0, 0, 2}))
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.3:6780")
+	ev = nextEvent(t, s)
+	assert.Equal(t, EventEndpointChanged, ev.Type)
+	assert.Equal(t, "192.0.2.2:6780", ev.OldRemoteAddr)
+	assert.Equal(t, "192.0.2.3:6780", ev.RemoteAddr)
+
+	// the node moves to another VIP
+	handshakeFrom(m, "a", "10.0.0.3/24", "192.0.2.3:6780")
+	ev = nextEvent(t, s)
+	assert.Equal(t, EventDisconnected, ev.Type)
+	assert.Equal(t, "10.0.0.2/24", ev.Peer.VirtualIP.String())
+	assert.Equal(t, EventConnected, nextEvent(t, s).Type)
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 2}))
+
+	p := m.GetPeer(utils.IPv4{10, 0, 0, 3})
+	m.observeRTT(p, 30*time.Millisecond)
+	m.observeRTT(p, 40*time.Millisecond)
+	ev = nextEvent(t, s)
+	assert.Equal(t, EventLatencyChanged, ev.Type)
+	assert.Equal(t, LatencyRegional, ev.Latency)
+	assert.Equal(t, 40*time.Millisecond, p.RTT())
+
+	m.Unsubscribe(s)
+	_, open := <-s.C
+	assert.False(t, open)
+}
+
+func TestEvents_SlowSubscriber(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	s := m.Subscribe(1)
+	defer m.Unsubscribe(s)
+
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+	handshakeFrom(m, "b", "10.0.0.3/24", "192.0.2.3:6780")
+	handshakeFrom(m, "c", "10.0.0.4/24", "192.0.2.4:6780")
+
+	require.Equal(t, "a", nextEvent(t, s).Peer.ID)
+	assert.Equal(t, uint64(2), s.Dropped())
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"kevin-rd/my-tier/pkg/packet"
 	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
 	"log"
+	"time"
 )
 
 func (m *Manager) HandlePacket(w packet.Writer, pkt *packet.Packet[packet.Packable]) {
@@ -13,8 +15,7 @@ func (m *Manager) HandlePacket(w packet.Writer, pkt *packet.Packet[packet.Packab
 		// authentication
 		// todo
 
-		networkName := "default"
-		peers := m.GetPeers(networkName)
+		peers := m.GetPeers("")
 
 		if _, err := w.WritePayload(packet.TypeAuxPeersReply, &PeersReplyPayload{
 			Peers: peers,
@@ -26,6 +27,14 @@ func (m *Manager) HandlePacket(w packet.Writer, pkt *packet.Packet[packet.Packab
 		if p := m.GetPeer(pkt.SrcVIP); p != nil {
 			p.HandlePing(pkt)
 		}
+	case packet.TypePong:
+		m.handlePong(w, pkt)
+	case packet.TypeLease:
+		m.handleLease(pkt)
+	case packet.TypeGossip:
+		if g, ok := pkt.Payload.(*payload.GossipPayload); ok {
+			m.swim.handle(pkt.SrcVIP, g, time.Now())
+		}
 	case packet.TypeHandshakeInit:
 		handshake, ok := pkt.Payload.(*payload.HandshakeInitPayload)
 		if !ok {
@@ -34,40 +43,168 @@ func (m *Manager) HandlePacket(w packet.Writer, pkt *packet.Packet[packet.Packab
 		}
 		m.HandshakeInit(w, pkt, handshake)
 	case packet.TypeHandshakeReply:
-		panic("unhandled HandshakeReply cae")
+		reply, ok := pkt.Payload.(*payload.HandshakeReplyPayload)
+		if !ok {
+			log.Printf("[router] invalid handshake reply payload")
+			return
+		}
+		m.HandshakeReply(w, reply)
 	case packet.TypeHandshakeFinalize:
-		p := m.GetPeer(pkt.SrcVIP)
-		if p != nil {
-			p.State = STATE_HANDSHAKED
+		m.HandshakeFinalize(w)
+	case packet.TypeHandshakeReject:
+		rej, ok := pkt.Payload.(*payload.HandshakeRejectPayload)
+		if !ok {
+			log.Printf("[router] invalid handshake reject payload")
+			return
 		}
+		m.HandshakeReject(w, rej)
 	default:
-		panic("unhandled default case")
+		log.Printf("[peer] unhandled packet type %d from %v", pkt.Type, w.RemoteAddr())
 	}
 }
 
 // HandshakeInit 处理握手消息, 被动连接Peer
 func (m *Manager) HandshakeInit(w packet.Writer, pkt *packet.Packet[packet.Packable], handshake *payload.HandshakeInitPayload) {
 	id := bytes.Trim(handshake.ID[:], "\x00")
+	key := w.RemoteAddr().String()
 
-	peer, ok := m.tempPeers[w.RemoteAddr().String()]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if reason := m.admit(handshake.Network, handshake.MAC, macInit, handshake.ID, handshake.VirtualIP); reason != "" {
+		log.Printf("[peer] reject handshake of %s %s: %s", id, key, reason)
+		return
+	}
+
+	// the conflicts are checked before the DHCP offer so a rejected node is leased nothing,
+	// the address of a DHCP node is checked by the offer which skips the taken ones
+	vip := handshake.VirtualIP
+	checked := vip
+	if handshake.DHCP {
+		checked = utils.IPMask{}
+	}
+	if code, holder := m.identityConflict(string(id), checked, key); code != 0 {
+		m.reject(newPeer(w), Info{ID: string(id), VirtualIP: vip}, code, holder)
+		return
+	}
+
+	var lease uint32
+	if handshake.DHCP {
+		var reason string
+		if vip, lease, reason = m.offer(string(id), vip); reason != "" {
+			log.Printf("[peer] reject dhcp handshake of %s %s: %s", id, key, reason)
+			return
+		}
+		// an address of another allocator is not leased here, it is checked like a static one
+		if code, holder := m.identityConflict(string(id), vip, key); lease == 0 && code != 0 {
+			m.reject(newPeer(w), Info{ID: string(id), VirtualIP: vip}, code, holder)
+			return
+		}
+	}
+
+	peer, ok := m.tempPeers[key]
 	if !ok {
-		log.Printf("[peer] new peer: %s %s", id, handshake.VirtualIP)
-		peer = m.newConn(w)
+		if peer = m.peerByAddr(key); peer != nil {
+			// the peer restarted, handshake again
+			log.Printf("[peer] re-handshake with %s %s", id, key)
+			m.removePeer(peer)
+			m.emit(Event{Type: EventDisconnected, Peer: peer.Info, RemoteAddr: peer.RemoteAddr})
+			static := peer.addr
+			peer = newPeer(w)
+			peer.addr = static
+			m.tempPeers[key] = peer
+		} else {
+			log.Printf("[peer] new peer: %s %s", id, vip)
+			peer = newPeer(w)
+			m.tempPeers[key] = peer
+		}
 	}
+	peer.Info = Info{ID: string(id), VirtualIP: vip}
 
 	// write reply message
-	resp := packet.NewPacket(packet.TypeHandshakeReply, &payload.HandshakeReplyPayload{Hello: "ni hao"})
-	if _, err := w.WriteP(resp); err != nil {
-		log.Printf("[peer] write handshake reply error: %v", err)
+	var idBytes [32]byte
+	copy(idBytes[:], m.ID)
+	reply := &payload.HandshakeReplyPayload{
+		ID:      idBytes,
+		Self:    m.VirtualIP,
+		Network: m.networkID,
+		Lease:   lease,
+		Hello:   "ni hao",
+	}
+	if handshake.DHCP {
+		reply.VirtualIP = vip
+	}
+	reply.MAC = m.mac(macReply, idBytes, reply.Self, reply.VirtualIP)
+	resp := packet.NewPacket(packet.TypeHandshakeReply, reply)
+	resp.SrcVIP = m.VirtualIP.IPv4()
+	if err := m.sched.enqueue(peer, resp); err != nil {
+		log.Printf("[peer] queue handshake reply error: %v", err)
+	}
+
+	// both sides initiated, the reply of the other side completes the handshake as well
+	if peer.State() != STATE_HANDSHAKE_SENT {
+		peer.setState(STATE_HANDSHAKE_RECEIVED)
+		peer.deadline = time.Now().Add(handshakeTimeout)
+	}
+}
+
+// HandshakeReply completes a handshake initiated by us and confirms it with HandshakeFinalize
+func (m *Manager) HandshakeReply(w packet.Writer, reply *payload.HandshakeReplyPayload) {
+	key := w.RemoteAddr().String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peer, ok := m.tempPeers[key]
+	if !ok || (peer.State() != STATE_HANDSHAKE_SENT && peer.State() != STATE_HANDSHAKE_RECEIVED) {
+		log.Printf("[peer] unexpected handshake reply from %s", key)
+		return
+	}
+	if reason := m.admit(reply.Network, reply.MAC, macReply, reply.ID, reply.Self, reply.VirtualIP); reason != "" {
+		// the handshake times out and is retried, the secret may be fixed meanwhile
+		log.Printf("[peer] reject handshake reply of %s: %s", key, reason)
+		return
+	}
+	if m.dhcp {
+		if reason := m.acceptOffer(peer, reply, time.Now()); reason != "" {
+			log.Printf("[peer] reject handshake reply of %s: %s", key, reason)
+			return
+		}
+	}
+	info := Info{ID: string(bytes.Trim(reply.ID[:], "\x00")), VirtualIP: reply.Self}
+	if code, holder := m.identityConflict(info.ID, info.VirtualIP, key); code != 0 {
+		m.reject(peer, info, code, holder)
+		m.fail(peer, time.Now(), code.String())
 		return
 	}
-	peer.State = STATE_HANDSHAKE_RECEIVED
+	log.Printf("[peer] handshake reply from %s: %s", key, reply.Hello)
+
+	finalize := payload.StringPayload("ok")
+	pkt := packet.NewPacket(packet.TypeHandshakeFinalize, &finalize)
+	pkt.SrcVIP = m.VirtualIP.IPv4()
+	if err := m.sched.enqueue(peer, pkt); err != nil {
+		log.Printf("[peer] queue handshake finalize error: %v", err)
+	}
+	m.handshaked(peer, info)
+}
 
-	// send handshake finalize
-	relay := payload.HandshakeReplyPayload{Hello: "ok"}
-	if _, err := w.WritePayload(packet.TypeHandshakeFinalize, &relay); err != nil {
-		log.Printf("[peer] write handshake finalize error: %v", err)
+// HandshakeFinalize completes a handshake initiated by the other side
+func (m *Manager) HandshakeFinalize(w packet.Writer) {
+	key := w.RemoteAddr().String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peer, ok := m.tempPeers[key]
+	if !ok || peer.State() != STATE_HANDSHAKE_RECEIVED {
+		// a duplicate or the finalize of a simultaneous handshake
+		return
+	}
+	// another node may have taken the id or address since the init
+	if code, holder := m.identityConflict(peer.ID, peer.VirtualIP, key); code != 0 {
+		m.reject(peer, peer.Info, code, holder)
+		m.fail(peer, time.Now(), code.String())
+		return
 	}
-	// handshake success
-	m.handshaked(peer, Info{ID: string(id), VirtualIP: handshake.VirtualIP})
+	m.handshaked(peer, peer.Info)
 }
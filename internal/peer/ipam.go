@@ -0,0 +1,239 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"kevin-rd/my-tier/pkg/utils"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultLeaseTTL is the lease time of the addresses handed out by a Pool
+const DefaultLeaseTTL = time.Hour
+
+var (
+	ErrPoolExhausted = errors.New("address pool exhausted")
+	// errForeignAddr the address is outside the pool, another allocator manages it
+	errForeignAddr = errors.New("address outside the pool")
+)
+
+// Lease is an address handed out to a node
+type Lease struct {
+	ID        string       `json:"id"`
+	VirtualIP utils.IPMask `json:"virtual_ip"`
+	Expires   time.Time    `json:"expires"`
+	// Reserved leases are static reservations, they never expire
+	Reserved bool `json:"reserved,omitempty"`
+}
+
+// Taken reports whether ip is used by another node than id, e.g. a member of the cluster
+type Taken func(ip utils.IPv4, id string) bool
+
+// Pool hands out the addresses of a range to the DHCP nodes. Every allocator has its own
+// pool and checks the cluster membership before handing out an address, the address of a
+// node is derived from its id so that allocators agree on it and it survives restarts.
+type Pool struct {
+	mu sync.Mutex
+	// first and last address of the range, prefix is the mask of the leases
+	first, last uint32
+	prefix      byte
+	ttl         time.Duration
+
+	reserved map[string]utils.IPv4
+	leases   map[string]*Lease
+	byIP     map[utils.IPv4]string
+}
+
+// NewPool returns a pool of the addresses from first to last in the network of subnet,
+// the network and broadcast addresses are never handed out
+func NewPool(subnet utils.IPMask, first, last utils.IPv4, ttl time.Duration) (*Pool, error) {
+	if !subnet.Contains(first) || !subnet.Contains(last) {
+		return nil, fmt.Errorf("pool %s-%s is outside %s", first, last, subnet)
+	}
+	p := &Pool{
+		first:    max(ipUint(first), networkAddr(subnet)+1),
+		last:     min(ipUint(last), broadcastAddr(subnet)-1),
+		prefix:   subnet[4],
+		ttl:      ttl,
+		reserved: map[string]utils.IPv4{},
+		leases:   map[string]*Lease{},
+		byIP:     map[utils.IPv4]string{},
+	}
+	if p.ttl <= 0 {
+		p.ttl = DefaultLeaseTTL
+	}
+	if p.first > p.last {
+		return nil, fmt.Errorf("empty pool %s-%s", first, last)
+	}
+	return p, nil
+}
+
+// SubnetPool returns a pool of all the host addresses of the network of subnet
+func SubnetPool(subnet utils.IPMask, ttl time.Duration) (*Pool, error) {
+	return NewPool(subnet, uintIP(networkAddr(subnet)), uintIP(broadcastAddr(subnet)), ttl)
+}
+
+func ipUint(ip utils.IPv4) uint32 {
+	return binary.BigEndian.Uint32(ip[:])
+}
+
+func uintIP(n uint32) utils.IPv4 {
+	var ip utils.IPv4
+	binary.BigEndian.PutUint32(ip[:], n)
+	return ip
+}
+
+func networkAddr(subnet utils.IPMask) uint32 {
+	if subnet[4] == 0 {
+		return 0
+	}
+	return ipUint(subnet.IPv4()) &^ (1<<(32-subnet[4]) - 1)
+}
+
+func broadcastAddr(subnet utils.IPMask) uint32 {
+	if subnet[4] == 0 {
+		return ^uint32(0)
+	}
+	return networkAddr(subnet) | (1<<(32-subnet[4]) - 1)
+}
+
+func (p *Pool) contains(ip utils.IPv4) bool {
+	n := ipUint(ip)
+	return n >= p.first && n <= p.last
+}
+
+func (p *Pool) mask(ip utils.IPv4) utils.IPMask {
+	return utils.IPMask{ip[0], ip[1], ip[2], ip[3], p.prefix}
+}
+
+// Reserve hands ip always to the node id, the reservation wins over the leases
+func (p *Pool) Reserve(id string, ip utils.IPv4) error {
+	if !p.contains(ip) {
+		return fmt.Errorf("reservation %s of %s: %w", ip, id, errForeignAddr)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reserved[id] = ip
+	return nil
+}
+
+// Allocate leases an address to id: its reservation, its current lease, the wanted
+// address or the first free one after the hash of id, in that order. Addresses taken by
+// other nodes are skipped.
+func (p *Pool) Allocate(id string, want utils.IPv4, taken Taken, now time.Time) (utils.IPMask, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(now)
+
+	if ip, ok := p.reserved[id]; ok {
+		return p.lease(id, ip, now), p.ttl, nil
+	}
+	if l, ok := p.leases[id]; ok && !taken(l.VirtualIP.IPv4(), id) {
+		return p.lease(id, l.VirtualIP.IPv4(), now), p.ttl, nil
+	}
+	if p.contains(want) && p.free(want, id, taken) {
+		return p.lease(id, want, now), p.ttl, nil
+	}
+
+	size := p.last - p.first + 1
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	start := h.Sum32() % size
+	for i := uint32(0); i < size; i++ {
+		ip := uintIP(p.first + (start+i)%size)
+		if p.free(ip, id, taken) {
+			return p.lease(id, ip, now), p.ttl, nil
+		}
+	}
+	return utils.IPMask{}, 0, ErrPoolExhausted
+}
+
+// Renew extends the lease of ip to id. An address of the pool without a lease is adopted,
+// e.g. after a restart of the allocator. errForeignAddr is returned for the addresses of
+// other pools.
+func (p *Pool) Renew(id string, ip utils.IPv4, taken Taken, now time.Time) (time.Duration, error) {
+	if !p.contains(ip) {
+		return 0, errForeignAddr
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(now)
+
+	if r, ok := p.reserved[id]; ok && r != ip {
+		return 0, fmt.Errorf("%s is reserved %s", id, r)
+	}
+	if !p.free(ip, id, taken) {
+		return 0, fmt.Errorf("%s is used by another node", ip)
+	}
+	p.lease(id, ip, now)
+	return p.ttl, nil
+}
+
+// Release gives the address of id back, its reservation is kept
+func (p *Pool) Release(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.leases[id]; ok {
+		delete(p.byIP, l.VirtualIP.IPv4())
+		delete(p.leases, id)
+	}
+}
+
+// Leases returns the leases and the reservations sorted by address
+func (p *Pool) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(time.Now())
+
+	leases := make([]Lease, 0, len(p.leases)+len(p.reserved))
+	for id, ip := range p.reserved {
+		if _, ok := p.leases[id]; !ok {
+			leases = append(leases, Lease{ID: id, VirtualIP: p.mask(ip), Reserved: true})
+		}
+	}
+	for id, l := range p.leases {
+		_, reserved := p.reserved[id]
+		leases = append(leases, Lease{ID: l.ID, VirtualIP: l.VirtualIP, Expires: l.Expires, Reserved: reserved})
+	}
+	slices.SortFunc(leases, func(a, b Lease) int {
+		return int(int64(ipUint(a.VirtualIP.IPv4())) - int64(ipUint(b.VirtualIP.IPv4())))
+	})
+	return leases
+}
+
+// free reports whether ip may be leased to id, p.mu must be held
+func (p *Pool) free(ip utils.IPv4, id string, taken Taken) bool {
+	if owner, ok := p.byIP[ip]; ok && owner != id {
+		return false
+	}
+	for owner, r := range p.reserved {
+		if r == ip && owner != id {
+			return false
+		}
+	}
+	return !taken(ip, id)
+}
+
+// lease records ip as leased to id until now+ttl, p.mu must be held
+func (p *Pool) lease(id string, ip utils.IPv4, now time.Time) utils.IPMask {
+	if l, ok := p.leases[id]; ok && l.VirtualIP.IPv4() != ip {
+		delete(p.byIP, l.VirtualIP.IPv4())
+	}
+	vip := p.mask(ip)
+	p.leases[id] = &Lease{ID: id, VirtualIP: vip, Expires: now.Add(p.ttl)}
+	p.byIP[ip] = id
+	return vip
+}
+
+// expire drops the leases which were not renewed, p.mu must be held
+func (p *Pool) expire(now time.Time) {
+	for id, l := range p.leases {
+		if now.After(l.Expires) {
+			delete(p.byIP, l.VirtualIP.IPv4())
+			delete(p.leases, id)
+		}
+	}
+}
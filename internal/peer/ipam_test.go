@@ -0,0 +1,75 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Allocate(t *testing.T) {
+	subnet := utils.Must2IPMask("10.0.0.1/24")
+	pool, err := NewPool(subnet, utils.IPv4{10, 0, 0, 10}, utils.IPv4{10, 0, 0, 13}, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, pool.Reserve("r", utils.IPv4{10, 0, 0, 13}))
+	now := time.Now()
+	none := func(utils.IPv4, string) bool { return false }
+
+	// the address of a node is derived from its id, allocators agree on it
+	a, ttl, err := pool.Allocate("a", utils.IPv4{}, none, now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	other, err := NewPool(subnet, utils.IPv4{10, 0, 0, 10}, utils.IPv4{10, 0, 0, 13}, time.Minute)
+	require.NoError(t, err)
+	same, _, err := other.Allocate("a", utils.IPv4{}, none, now)
+	require.NoError(t, err)
+	assert.Equal(t, a, same)
+	assert.Equal(t, byte(24), a[4])
+
+	// the lease sticks, the reservation wins
+	again, _, _ := pool.Allocate("a", utils.IPv4{10, 0, 0, 12}, none, now)
+	assert.Equal(t, a, again)
+	r, _, _ := pool.Allocate("r", utils.IPv4{}, none, now)
+	assert.Equal(t, utils.Must2IPMask("10.0.0.13/24"), r)
+
+	// addresses taken by the cluster are skipped, the pool runs out
+	taken := func(ip utils.IPv4, id string) bool { return ip == utils.IPv4{10, 0, 0, 10} && id != "x" }
+	var got []utils.IPv4
+	for _, id := range []string{"b", "c"} {
+		vip, _, err := pool.Allocate(id, utils.IPv4{}, taken, now)
+		require.NoError(t, err)
+		got = append(got, vip.IPv4())
+	}
+	assert.NotContains(t, got, utils.IPv4{10, 0, 0, 10})
+	assert.NotContains(t, got, a.IPv4())
+	_, _, err = pool.Allocate("d", utils.IPv4{}, taken, now)
+	assert.ErrorIs(t, err, ErrPoolExhausted)
+
+	// expired leases are handed out again
+	vip, _, err := pool.Allocate("d", utils.IPv4{}, taken, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Contains(t, append(got, a.IPv4()), vip.IPv4())
+}
+
+func TestPool_Renew(t *testing.T) {
+	pool, err := SubnetPool(utils.Must2IPMask("10.0.0.1/24"), time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	none := func(utils.IPv4, string) bool { return false }
+
+	// an unknown lease of the pool is adopted, e.g. after a restart of the allocator
+	_, err = pool.Renew("a", utils.IPv4{10, 0, 0, 20}, none, now)
+	require.NoError(t, err)
+	_, err = pool.Renew("b", utils.IPv4{10, 0, 0, 20}, none, now)
+	assert.Error(t, err)
+	_, err = pool.Renew("a", utils.IPv4{10, 0, 1, 20}, none, now)
+	assert.ErrorIs(t, err, errForeignAddr)
+	_, err = pool.Renew("a", utils.IPv4{10, 0, 0, 255}, none, now)
+	assert.ErrorIs(t, err, errForeignAddr)
+
+	pool.Release("a")
+	_, err = pool.Renew("b", utils.IPv4{10, 0, 0, 20}, none, now)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,131 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// handshakeTimeout is how long a sent or received handshake waits for the other side
+	handshakeTimeout = 5 * time.Second
+	// backoffBase and backoffMax bound the wait before the next handshake attempt
+	backoffBase = time.Second
+	backoffMax  = time.Minute
+	// maxHandshakeAttempts failed handshakes in a row mark a peer dead
+	maxHandshakeAttempts = 8
+	// deadRetryInterval is how often a dead static peer is tried again
+	deadRetryInterval = 5 * time.Minute
+	// tickInterval is the resolution of the timeouts
+	tickInterval = 200 * time.Millisecond
+)
+
+// backoff returns the wait after n failed attempts, exponential with equal jitter
+// so that peers failing together do not retry in lockstep.
+func backoff(n int) time.Duration {
+	d := backoffMax
+	if n <= 0 {
+		n = 1
+	}
+	if n < 32 && backoffBase<<(n-1) < backoffMax {
+		d = backoffBase << (n - 1)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// tick drives the peers which are not handshaked, m.mu must be held
+func (m *Manager) tick(now time.Time) {
+	for _, p := range m.tempPeers {
+		switch p.State() {
+		case STATE_INIT:
+			m.startHandshake(p, now)
+		case STATE_HANDSHAKE_SENT, STATE_HANDSHAKE_RECEIVED:
+			if now.After(p.deadline) {
+				m.fail(p, now, "handshake timeout")
+			}
+		case STATE_RECONNECTING:
+			if now.After(p.deadline) {
+				m.startHandshake(p, now)
+			}
+		case STATE_DEAD:
+			if now.After(p.deadline) {
+				log.Printf("[peer] retry dead peer %s", p.addr)
+				p.attempts = 0
+				m.startHandshake(p, now)
+			}
+		}
+	}
+}
+
+// startHandshake (re)dials a static peer and sends HandshakeInit, m.mu must be held
+func (m *Manager) startHandshake(p *Peer, now time.Time) {
+	if p.addr != "" {
+		// resolve again, the address of the peer may have changed
+		w, err := m.dial(p.addr)
+		if err != nil {
+			m.fail(p, now, err.Error())
+			return
+		}
+		p = m.redial(p, w)
+	}
+
+	var idBytes [32]byte
+	copy(idBytes[:], m.ID)
+	init := packet.NewPacket(packet.TypeHandshakeInit, &payload.HandshakeInitPayload{
+		ID:        idBytes,
+		DHCP:      m.dhcp,
+		VirtualIP: m.VirtualIP,
+		Network:   m.networkID,
+		MAC:       m.mac(macInit, idBytes, m.VirtualIP),
+	})
+	init.SrcVIP = m.VirtualIP.IPv4()
+	if err := m.sched.enqueue(p, init); err != nil {
+		log.Printf("[peer] queue handshake to %s error: %v", p.RemoteAddr, err)
+	}
+	p.setState(STATE_HANDSHAKE_SENT)
+	p.deadline = now.Add(handshakeTimeout)
+}
+
+// fail schedules the next attempt of a static peer or drops a peer which connected to
+// us, the other side retries then. m.mu must be held.
+func (m *Manager) fail(p *Peer, now time.Time, reason string) {
+	if p.addr == "" {
+		log.Printf("[peer] drop %s: %s", p.RemoteAddr, reason)
+		delete(m.tempPeers, m.tempKey(p))
+		return
+	}
+
+	p.attempts++
+	if p.attempts >= maxHandshakeAttempts {
+		log.Printf("[peer] %s is dead after %d attempts: %s", p.addr, p.attempts, reason)
+		p.setState(STATE_DEAD)
+		p.deadline = now.Add(deadRetryInterval)
+		return
+	}
+	wait := backoff(p.attempts)
+	log.Printf("[peer] %s attempt %d failed: %s, retry in %v", p.addr, p.attempts, reason, wait)
+	p.setState(STATE_RECONNECTING)
+	p.deadline = now.Add(wait)
+}
+
+// redial replaces the static peer p by a peer writing to w, it is keyed by the resolved
+// address so the replies find it. The writer of a peer never changes, the scheduler may
+// still be sending the packets queued for p. m.mu must be held.
+func (m *Manager) redial(p *Peer, w packet.Writer) *Peer {
+	delete(m.tempPeers, m.tempKey(p))
+	np := newPeer(w)
+	np.addr, np.attempts = p.addr, p.attempts
+	m.tempPeers[np.RemoteAddr] = np
+	return np
+}
+
+// tempKey is the key of p in tempPeers, static peers are keyed by their configured
+// address until they are dialed
+func (m *Manager) tempKey(p *Peer) string {
+	if p.RemoteAddr == "" {
+		return p.addr
+	}
+	return p.RemoteAddr
+}
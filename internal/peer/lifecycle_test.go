@@ -0,0 +1,117 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// linkWriter delivers the packets to the manager on the other end, drop discards them
+type linkWriter struct {
+	local, remote net.Addr
+	from, to      *Manager
+	drop          bool
+}
+
+func (w *linkWriter) Write(bts []byte) (int, error) {
+	pkt := &packet.Packet[packet.Packable]{}
+	if err := pkt.Decode(bts); err != nil {
+		return 0, err
+	}
+	return w.WriteP(pkt)
+}
+
+func (w *linkWriter) WriteP(pkt *packet.Packet[packet.Packable]) (int, error) {
+	if !w.drop {
+		w.to.HandlePacket(&linkWriter{local: w.remote, remote: w.local, from: w.to, to: w.from}, pkt)
+	}
+	return 0, nil
+}
+
+func (w *linkWriter) WritePayload(typ byte, payload packet.Packable) (int, error) {
+	return w.WriteP(packet.NewPacket(typ, payload))
+}
+
+func (w *linkWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *linkWriter) GetConn() net.Conn    { return nil }
+
+func udpAddr(s string) net.Addr {
+	addr, _ := net.ResolveUDPAddr("udp", s)
+	return addr
+}
+
+func TestHandshake(t *testing.T) {
+	a := NewManager("a", utils.Must2IPMask("10.0.0.1/24"), "192.0.2.2:6780")
+	b := NewManager("b", utils.Must2IPMask("10.0.0.2/24"))
+	addrA, addrB := udpAddr("192.0.2.1:6780"), udpAddr("192.0.2.2:6780")
+
+	a.SetDialer(func(string) (packet.Writer, error) {
+		return &linkWriter{local: addrA, remote: addrB, from: a, to: b}, nil
+	})
+
+	go func() { _ = a.Manage() }()
+	go func() { _ = b.Manage() }()
+	t.Cleanup(func() {
+		a.Stop()
+		b.Stop()
+	})
+
+	require.Eventually(t, func() bool {
+		return a.GetPeer(utils.IPv4{10, 0, 0, 2}) != nil && b.GetPeer(utils.IPv4{10, 0, 0, 1}) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.peerMap[utils.IPv4{10, 0, 0, 2}]
+	assert.Equal(t, "b", p.ID)
+	assert.Equal(t, STATE_HANDSHAKED, p.State())
+	assert.Empty(t, a.tempPeers)
+}
+
+func TestHandshakeRetry(t *testing.T) {
+	m := NewManager("a", utils.Must2IPMask("10.0.0.1/24"), "192.0.2.2:6780")
+	dials := 0
+	m.SetDialer(func(string) (packet.Writer, error) {
+		dials++
+		return &linkWriter{local: udpAddr("192.0.2.1:6780"), remote: udpAddr("192.0.2.2:6780"), drop: true}, nil
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// every attempt dials again and replaces the peer
+	peer := func() *Peer {
+		p := m.tempPeers["192.0.2.2:6780"]
+		require.NotNil(t, p)
+		return p
+	}
+	now := time.Now()
+	m.tick(now)
+	assert.Equal(t, STATE_HANDSHAKE_SENT, peer().State())
+
+	for i := 1; i < maxHandshakeAttempts; i++ {
+		now = peer().deadline.Add(time.Millisecond)
+		m.tick(now)
+		require.Equal(t, STATE_RECONNECTING, peer().State(), "attempt %d", i)
+		assert.LessOrEqual(t, peer().deadline.Sub(now), min(backoffBase<<(i-1), backoffMax))
+		now = peer().deadline.Add(time.Millisecond)
+		m.tick(now)
+		require.Equal(t, STATE_HANDSHAKE_SENT, peer().State())
+	}
+	m.tick(peer().deadline.Add(time.Millisecond))
+	assert.Equal(t, STATE_DEAD, peer().State())
+	assert.Equal(t, maxHandshakeAttempts, dials)
+}
+
+func TestBackoff(t *testing.T) {
+	for n := 1; n < 40; n++ {
+		d := min(backoffBase<<min(n-1, 20), backoffMax)
+		got := backoff(n)
+		assert.GreaterOrEqual(t, got, d/2)
+		assert.LessOrEqual(t, got, d)
+	}
+}
@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"fmt"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// Liveness configures the keepalives of the handshaked peers
+type Liveness struct {
+	// Keepalive is the silence after which a peer is pinged, and the interval of the pings
+	Keepalive time.Duration
+	// SuspectAfter is the silence which marks a peer suspect, the routes avoid it
+	SuspectAfter time.Duration
+	// DeadAfter is the silence which evicts a peer, static peers handshake again
+	DeadAfter time.Duration
+}
+
+var DefaultLiveness = Liveness{
+	Keepalive:    5 * time.Second,
+	SuspectAfter: 15 * time.Second,
+	DeadAfter:    30 * time.Second,
+}
+
+// SetLiveness replaces the keepalive timings, zero values keep the defaults
+func (m *Manager) SetLiveness(l Liveness) {
+	if l.Keepalive <= 0 {
+		l.Keepalive = DefaultLiveness.Keepalive
+	}
+	if l.SuspectAfter <= 0 {
+		l.SuspectAfter = max(DefaultLiveness.SuspectAfter, l.Keepalive)
+	}
+	if l.DeadAfter <= l.SuspectAfter {
+		l.DeadAfter = max(DefaultLiveness.DeadAfter, 2*l.SuspectAfter)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.liveness = l
+}
+
+// addrKey is the key of a remote address in the snapshot, IPv4 is unmapped
+func addrKey(addr net.Addr) (netip.AddrPort, bool) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	ap := ua.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// PeerAt returns the handshaked peer at the remote addr, nil if there is none
+func (m *Manager) PeerAt(addr net.Addr) *Peer {
+	key, ok := addrKey(addr)
+	if !ok {
+		return nil
+	}
+	return m.peers.Load().byAddr[key]
+}
+
+// Seen records a packet received from addr, it keeps the peer at addr alive
+func (m *Manager) Seen(addr net.Addr) {
+	if p := m.PeerAt(addr); p != nil {
+		p.lastSeen.Store(time.Now().UnixNano())
+	}
+}
+
+// silent reports whether p sent nothing for the suspect timeout, m.mu must be held
+func (m *Manager) silent(p *Peer, now time.Time) bool {
+	return now.Sub(time.Unix(0, p.lastSeen.Load())) >= m.liveness.SuspectAfter
+}
+
+// checkLiveness pings the silent peers, marks them suspect and evicts the dead ones,
+// m.mu must be held
+func (m *Manager) checkLiveness(now time.Time) {
+	l := m.liveness
+	for _, p := range m.peerMap {
+		// self
+		if p.Writer == nil {
+			continue
+		}
+		silence := now.Sub(time.Unix(0, p.lastSeen.Load()))
+		switch {
+		case silence >= l.DeadAfter:
+			m.evict(p, fmt.Sprintf("silent for %v", silence.Round(time.Second)))
+			continue
+		case silence >= l.SuspectAfter:
+			if p.State() == STATE_HANDSHAKED {
+				log.Printf("[peer] %s %s is suspect, silent for %v", p.ID, p.RemoteAddr, silence.Round(time.Second))
+				p.setState(STATE_SUSPECT)
+			}
+		case p.State() == STATE_SUSPECT:
+			log.Printf("[peer] %s %s is alive again", p.ID, p.RemoteAddr)
+			p.setState(STATE_HANDSHAKED)
+		}
+
+		if silence >= l.Keepalive && now.Sub(p.lastPing) >= l.Keepalive {
+			m.ping(p, now)
+		}
+	}
+}
+
+// ping sends the send time, the pong echoes it back for the round trip time
+func (m *Manager) ping(p *Peer, now time.Time) {
+	p.lastPing = now
+	stamp := payload.StringPayload(strconv.FormatInt(now.UnixNano(), 10))
+	pkt := packet.NewPacket(packet.TypePing, &stamp)
+	pkt.SrcVIP = m.VirtualIP.IPv4()
+	pkt.DstVIP = p.VirtualIP.IPv4()
+	if err := m.sched.enqueue(p, pkt); err != nil {
+		log.Printf("[peer] queue ping to %s error: %v", p.RemoteAddr, err)
+	}
+}
+
+// handlePong measures the round trip time of the ping echoed by pkt
+func (m *Manager) handlePong(w packet.Writer, pkt *packet.Packet[packet.Packable]) {
+	p := m.PeerAt(w.RemoteAddr())
+	stamp, ok := pkt.Payload.(*payload.StringPayload)
+	if p == nil || !ok {
+		return
+	}
+	sent, err := strconv.ParseInt(string(*stamp), 10, 64)
+	if err != nil {
+		return
+	}
+	if rtt := time.Since(time.Unix(0, sent)); rtt > 0 {
+		m.observeRTT(p, rtt)
+	}
+}
+
+// evict removes a dead peer and drops its queued packets, a static peer starts over with
+// a fresh handshake. m.mu must be held.
+func (m *Manager) evict(p *Peer, reason string) {
+	log.Printf("[peer] %s %s is dead, %s", p.ID, p.RemoteAddr, reason)
+	m.removePeer(p)
+	p.setState(STATE_DEAD)
+	p.queue.clear()
+	m.emit(Event{Type: EventDisconnected, Peer: p.Info, RemoteAddr: p.RemoteAddr})
+
+	if p.addr != "" {
+		if _, ok := m.tempPeers[p.addr]; !ok {
+			m.tempPeers[p.addr] = &Peer{addr: p.addr, queue: newSendQueue()}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveness_SuspectAndEvict(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	s := m.Subscribe(0)
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+	require.Equal(t, EventConnected, nextEvent(t, s).Type)
+	p := m.GetPeer(utils.IPv4{10, 0, 0, 2})
+	require.NotNil(t, p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.liveness
+	now := time.Now()
+	queued := p.queue.len(PriorityControl)
+
+	m.checkLiveness(now.Add(l.SuspectAfter))
+	assert.Equal(t, STATE_SUSPECT, p.State())
+	assert.Equal(t, queued+1, p.queue.len(PriorityControl), "pinged")
+
+	// any packet from the peer revives it
+	m.Seen(udpAddr("192.0.2.2:6780"))
+	m.checkLiveness(time.Now())
+	assert.Equal(t, STATE_HANDSHAKED, p.State())
+
+	m.checkLiveness(time.Now().Add(l.DeadAfter))
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 2}))
+	assert.Len(t, m.GetPeers(""), 1)
+	assert.Equal(t, STATE_DEAD, p.State())
+	assert.Zero(t, p.queue.Stats().Depth)
+	assert.Equal(t, EventDisconnected, nextEvent(t, s).Type)
+	// a peer without a configured address reconnects by itself
+	assert.Empty(t, m.tempPeers)
+}
+
+func TestLiveness_StaticPeerHandshakesAgain(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"), "192.0.2.2:6780")
+	w := &linkWriter{local: udpAddr("192.0.2.1:6780"), remote: udpAddr("192.0.2.2:6780"), drop: true}
+	m.SetDialer(func(string) (packet.Writer, error) { return w, nil })
+
+	m.mu.Lock()
+	m.tick(time.Now())
+	m.mu.Unlock()
+	m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeReply, &payload.HandshakeReplyPayload{
+		ID:   [32]byte{'a'},
+		Self: utils.Must2IPMask("10.0.0.2/24"),
+	}))
+	require.NotNil(t, m.GetPeer(utils.IPv4{10, 0, 0, 2}))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkLiveness(time.Now().Add(m.liveness.DeadAfter))
+	assert.Nil(t, m.GetPeer(utils.IPv4{10, 0, 0, 2}))
+	p := m.tempPeers["192.0.2.2:6780"]
+	require.NotNil(t, p)
+	assert.Equal(t, STATE_INIT, p.State())
+}
+
+func TestLiveness_PongLatency(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+	s := m.Subscribe(0)
+
+	stamp := payload.StringPayload(strconv.FormatInt(time.Now().Add(-100*time.Millisecond).UnixNano(), 10))
+	w := &linkWriter{local: udpAddr("192.0.2.1:6780"), remote: udpAddr("192.0.2.2:6780"), drop: true}
+	m.HandlePacket(w, packet.NewPacket(packet.TypePong, &stamp))
+
+	ev := nextEvent(t, s)
+	assert.Equal(t, EventLatencyChanged, ev.Type)
+	assert.Equal(t, LatencyWAN, ev.Latency)
+}
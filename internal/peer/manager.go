@@ -2,121 +2,287 @@ package peer
 
 import (
 	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
 	"kevin-rd/my-tier/pkg/utils"
 	"log"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Dialer returns a writer to the peer at addr, "host:port"
+type Dialer func(addr string) (packet.Writer, error)
+
+// dialUDP dials addr with a connected socket of its own
+func dialUDP(addr string) (packet.Writer, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return packet.NewWriter(conn, conn.RemoteAddr()), nil
+}
+
+// peerSet is an immutable view of the handshaked peers, it is replaced as a whole on
+// every change so the packet path reads it without locking.
+type peerSet struct {
+	byVIP  map[utils.IPv4]*Peer
+	byAddr map[netip.AddrPort]*Peer
+	groups map[string][]*Peer
+}
+
+// Manager owns the peers. The handshakes and timeouts mutate its maps under mu, readers
+// get the handshaked peers from an immutable snapshot published after every change.
 type Manager struct {
 	Info
+	// Network is the name of the network the peers belong to, see SetNetwork
+	Network string
 
 	mu sync.Mutex
+	// networkID and secret admit the handshakes of the network
+	networkID payload.NetworkID
+	secret    []byte
 	// unHandshake, remoteAddr -> Peer
 	tempPeers map[string]*Peer
 	// virtualIP -> Peer
 	peerMap map[utils.IPv4]*Peer
 	// network_name -> []*Peer
 	peerGroup map[string][]*Peer
+
+	// peers is the snapshot of peerMap and peerGroup
+	peers atomic.Pointer[peerSet]
+
+	liveness Liveness
+
+	subMu sync.RWMutex
+	subs  map[*Subscription]struct{}
+
+	// swim is the cluster membership, it has its own lock
+	swim *swim
+	// srcVIP is VirtualIP for the senders outside mu, e.g. the gossip
+	srcVIP atomic.Pointer[utils.IPv4]
+
+	// dhcp nodes start without an address and lease one from an allocator, bound is
+	// closed once the address is final
+	dhcp  bool
+	lease leaseState
+	bound chan struct{}
+	// pool hands out the addresses of an allocator, nil if this node is none
+	pool *Pool
+	// conflicts are the recent handshakes rejected for a duplicate id or address
+	conflicts []Conflict
+
+	dial     Dialer
+	sched    *shardedScheduler
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
+// NewManager returns the manager of node id with the address cidr, a zero cidr leases an
+// address from the peers with DHCP
 func NewManager(id string, cidr [5]byte, addrs ...string) *Manager {
 	m := &Manager{
 		Info:      Info{ID: id, VirtualIP: cidr},
 		peerMap:   map[utils.IPv4]*Peer{},
 		peerGroup: map[string][]*Peer{},
 		tempPeers: map[string]*Peer{},
+		liveness:  DefaultLiveness,
+		subs:      map[*Subscription]struct{}{},
+		dial:      dialUDP,
+		sched:     newShardedScheduler(1),
+		stopCh:    make(chan struct{}),
+		dhcp:      cidr == utils.IPMask{},
+		bound:     make(chan struct{}),
 	}
+	m.swim = newSwim(m.Info, DefaultSwimConfig, m.sendGossip, m.memberChanged)
+	m.publish()
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// add self to peers
-	m.addPeer("", &Peer{
-		Info: Info{ID: id, VirtualIP: cidr},
-		// todo: Writer, RemoteAddr
-	})
+	if !m.dhcp {
+		close(m.bound)
+		// add self to peers
+		m.addPeer("", &Peer{
+			Info: Info{ID: id, VirtualIP: cidr},
+			// todo: Writer, RemoteAddr
+		})
+	}
+	vip := m.VirtualIP.IPv4()
+	m.srcVIP.Store(&vip)
 
-	// conn to default peers
+	// default peers are dialed by Manage, and again after failures
 	for _, addr := range addrs {
-		conn, err := net.Dial("udp", addr)
-		if err != nil {
-			log.Printf("[peer_manager] connect to %s error: %v", addr, err)
-			continue
-		}
-		log.Printf("[peer] connect to %s success", addr)
-		m.newConn(packet.NewWriter(conn, conn.RemoteAddr()))
+		m.tempPeers[addr] = &Peer{addr: addr, queue: newSendQueue()}
 	}
 
 	return m
 }
 
+// SetSendWorkers sets the number of goroutines sending the queued packets, the peers are
+// sharded over them. It must be called before Manage.
+func (m *Manager) SetSendWorkers(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sched = newShardedScheduler(n)
+}
+
+// SetDialer replaces the dialer of the default peers, it must be called before Manage
+func (m *Manager) SetDialer(dial Dialer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dial = dial
+}
+
 func (m *Manager) GetPeer(vip utils.IPv4) *Peer {
-	if peer, ok := m.peerMap[vip]; ok {
-		return peer
+	return m.peers.Load().byVIP[vip]
+}
+
+// PeerByID returns the handshaked peer with id, ids are compared case-insensitively
+func (m *Manager) PeerByID(id string) *Peer {
+	for _, p := range m.peers.Load().byVIP {
+		if strings.EqualFold(p.ID, id) {
+			return p
+		}
 	}
 	return nil
 }
 
+// GetPeers returns the handshaked peers of network, the slice must not be modified
 func (m *Manager) GetPeers(network string) []*Peer {
-	// todo
-	return m.peerGroup[network]
+	return m.peers.Load().groups[network]
 }
 
-func (m *Manager) Manage() error {
-	// process tempPeers
-	for _, p := range m.tempPeers {
-		switch p.State {
-		case STATE_INIT:
-			if err := p.handshake(m.Info); err != nil {
-				log.Println("[peer] handshake error:", err)
-				time.Sleep(time.Second * 1)
-				continue
-			}
-			m.handshaked(p, p.Info)
-			p.State = STATE_HANDSHAKED
-		case STATE_HANDSHAKED:
-			pkt := <-p.outputCh
-			_, err := p.WriteP(pkt)
-			if err != nil {
-				log.Println("[peer] write packet error:", err)
-				continue
-			}
-
-			// todo? 是否要将接受数据和发送数据逻辑整合到一起
-		}
+// Send queues pkt to the peer owning pkt.DstVIP, it never blocks.
+// ErrQueueFull is returned if the packet or an older one was dropped.
+func (m *Manager) Send(pkt *packet.Packet[packet.Packable]) error {
+	p := m.GetPeer(pkt.DstVIP)
+	if p == nil || p.queue == nil {
+		return ErrNoPeer
 	}
+	return m.sched.enqueue(p, pkt)
+}
 
-	return nil
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		m.swim.leave()
+		close(m.stopCh)
+	})
 }
 
-// newConn add new Conn to tempPeers
-func (m *Manager) newConn(writer packet.Writer) *Peer {
-	p, ok := m.tempPeers[writer.RemoteAddr().String()]
-	if !ok {
-		log.Printf("[peer] new peer: %s", writer.RemoteAddr())
-		p = &Peer{
-			State:      STATE_INIT,
-			RemoteAddr: writer.RemoteAddr().String(),
-			Writer:     writer,
-			outputCh:   make(chan *packet.Packet[packet.Packable]),
+// Manage drives the handshakes and sends the queued packets until Stop
+func (m *Manager) Manage() error {
+	// drain peer send queues
+	go m.sched.run(m.stopCh)
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		m.mu.Lock()
+		now := time.Now()
+		m.tick(now)
+		m.checkLiveness(now)
+		m.checkLease(now)
+		m.mu.Unlock()
+		m.swim.tick(now)
+
+		select {
+		case <-m.stopCh:
+			return nil
+		case <-ticker.C:
 		}
-		m.tempPeers[writer.RemoteAddr().String()] = p
 	}
-	return p
 }
 
+// handshaked moves p from tempPeers to the peers keyed by VirtualIP, m.mu must be held
 func (m *Manager) handshaked(p *Peer, info Info) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	delete(m.tempPeers, p.RemoteAddr)
-	m.addPeer("", p)
+	// the peer is keyed by its VirtualIP, set the info first
 	p.handshaked(info)
+	// the node moved to another address, e.g. it restarted or leased another one, the
+	// conflict check let it in once the old peer went silent
+	for _, prev := range m.peerMap {
+		if prev.Writer != nil && prev.ID == p.ID && prev.VirtualIP != p.VirtualIP {
+			m.removePeer(prev)
+			m.emit(Event{Type: EventDisconnected, Peer: prev.Info, RemoteAddr: prev.RemoteAddr})
+		}
+	}
+	old, ok := m.peerMap[p.VirtualIP.IPv4()]
+	if ok {
+		m.removePeer(old)
+		// keep redialing the node after it moved
+		if p.addr == "" && old.ID == p.ID {
+			p.addr = old.addr
+		}
+	}
+	m.addPeer("", p)
+	log.Printf("[peer] handshaked with %s %s at %s", p.ID, p.VirtualIP, p.RemoteAddr)
+	m.swim.join(p.Info, p.RemoteAddr, time.Now())
+
+	switch {
+	case ok && old.ID == p.ID && old.RemoteAddr != p.RemoteAddr:
+		m.emit(Event{Type: EventEndpointChanged, Peer: p.Info, RemoteAddr: p.RemoteAddr, OldRemoteAddr: old.RemoteAddr})
+	case ok && old.ID != p.ID:
+		m.emit(Event{Type: EventDisconnected, Peer: old.Info, RemoteAddr: old.RemoteAddr})
+		fallthrough
+	default:
+		m.emit(Event{Type: EventConnected, Peer: p.Info, RemoteAddr: p.RemoteAddr})
+	}
 }
 
 func (m *Manager) addPeer(network string, peer *Peer) {
 	m.peerMap[utils.IPv4(peer.VirtualIP[:4])] = peer
 	m.peerGroup[network] = append(m.peerGroup[network], peer)
+	m.publish()
+}
+
+func (m *Manager) removePeer(peer *Peer) {
+	vip := peer.VirtualIP.IPv4()
+	if m.peerMap[vip] == peer {
+		delete(m.peerMap, vip)
+	}
+	for network, peers := range m.peerGroup {
+		for i, p := range peers {
+			if p == peer {
+				m.peerGroup[network] = append(peers[:i:i], peers[i+1:]...)
+				break
+			}
+		}
+	}
+	m.publish()
+}
+
+// publish replaces the snapshot of the handshaked peers, m.mu must be held
+func (m *Manager) publish() {
+	set := &peerSet{
+		byVIP:  maps.Clone(m.peerMap),
+		byAddr: make(map[netip.AddrPort]*Peer, len(m.peerMap)),
+		groups: make(map[string][]*Peer, len(m.peerGroup)),
+	}
+	for _, p := range m.peerMap {
+		if p.Writer == nil {
+			continue
+		}
+		if key, ok := addrKey(p.Writer.RemoteAddr()); ok {
+			set.byAddr[key] = p
+		}
+	}
+	for network, peers := range m.peerGroup {
+		set.groups[network] = slices.Clone(peers)
+	}
+	m.peers.Store(set)
+}
+
+// peerByAddr returns the handshaked peer at the remote addr
+func (m *Manager) peerByAddr(addr string) *Peer {
+	for _, p := range m.peerMap {
+		if p.RemoteAddr == addr {
+			return p
+		}
+	}
+	return nil
 }
@@ -0,0 +1,79 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestManager_ConcurrentHandshakes handshakes many peers, some of them twice, while the
+// peers are read like the packet path and the IPC server do, run it with -race.
+func TestManager_ConcurrentHandshakes(t *testing.T) {
+	const n = 64
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/16"))
+	go func() { _ = m.Manage() }()
+	t.Cleanup(m.Stop)
+
+	var stop atomic.Bool
+	readers := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for !stop.Load() {
+				for j := 0; j < n; j++ {
+					if p := m.GetPeer(utils.IPv4{10, 0, byte(j >> 8), byte(j + 2)}); p != nil {
+						_ = p.State()
+						_ = m.Send(packet.NewPacket(packet.TypeData, &payload.DataPayload{}))
+					}
+				}
+				_ = m.PeerByID("peer7")
+				_, err := json.Marshal(m.GetPeers(""))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	handshakes := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		handshakes.Add(1)
+		go func() {
+			defer handshakes.Done()
+			w := &linkWriter{local: udpAddr("10.0.0.1:6780"), remote: udpAddr(fmt.Sprintf("192.0.2.%d:6780", i+2)), drop: true}
+			var id [32]byte
+			copy(id[:], fmt.Sprintf("peer%d", i))
+			// odd peers restart and handshake again
+			for round := 0; round <= i%2; round++ {
+				m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeInit, &payload.HandshakeInitPayload{
+					ID:        id,
+					VirtualIP: utils.IPMask{10, 0, 0, byte(i + 2), 16},
+				}))
+				m.HandlePacket(w, packet.NewPacket(packet.TypeHandshakeFinalize, new(payload.StringPayload)))
+			}
+		}()
+	}
+	handshakes.Wait()
+	stop.Store(true)
+	readers.Wait()
+
+	peers := m.GetPeers("")
+	require.Len(t, peers, n+1)
+	seen := map[string]bool{}
+	for _, p := range peers {
+		assert.False(t, seen[p.ID], "duplicate %s", p.ID)
+		seen[p.ID] = true
+		if p.ID == "self" {
+			continue
+		}
+		assert.Equal(t, STATE_HANDSHAKED, p.State())
+	}
+	assert.Equal(t, "peer7", m.PeerByID("PEER7").ID)
+}
@@ -0,0 +1,65 @@
+package peer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"strings"
+)
+
+// handshake message roles in the MAC, a reply can not be replayed as an init
+const (
+	macInit byte = iota + 1
+	macReply
+	macReject
+)
+
+// NetworkIDOf derives the id carried in the handshakes from the network name, names are
+// compared case-insensitively
+func NetworkIDOf(name string) payload.NetworkID {
+	var id payload.NetworkID
+	sum := sha256.Sum256([]byte("skytier-network:" + strings.ToLower(name)))
+	copy(id[:], sum[:])
+	return id
+}
+
+// SetNetwork binds the manager to a named network, handshakes of other networks are
+// rejected. With a secret the peers must prove they know it, the network is open otherwise.
+// It must be called before Manage.
+func (m *Manager) SetNetwork(name, secret string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Network = name
+	m.networkID = NetworkIDOf(name)
+	m.secret = []byte(secret)
+}
+
+// mac authenticates the identity and the addresses sent in a handshake message, m.mu
+// must be held
+func (m *Manager) mac(role byte, id [32]byte, vips ...utils.IPMask) payload.HandshakeMAC {
+	var mac payload.HandshakeMAC
+	if len(m.secret) == 0 {
+		return mac
+	}
+	h := hmac.New(sha256.New, m.secret)
+	h.Write([]byte{role})
+	h.Write(m.networkID[:])
+	h.Write(id[:])
+	for _, vip := range vips {
+		h.Write(vip[:])
+	}
+	copy(mac[:], h.Sum(nil))
+	return mac
+}
+
+// admit checks the network and the credentials of a handshake message, m.mu must be held
+func (m *Manager) admit(network payload.NetworkID, mac payload.HandshakeMAC, role byte, id [32]byte, vips ...utils.IPMask) string {
+	if network != m.networkID {
+		return "another network"
+	}
+	if want := m.mac(role, id, vips...); !hmac.Equal(mac[:], want[:]) {
+		return "invalid credentials"
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package peer
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkAdmission(t *testing.T) {
+	tests := []struct {
+		name           string
+		netA, secretA  string
+		netB, secretB  string
+		wantHandshaked bool
+	}{
+		{name: "open", netA: "office", netB: "Office", wantHandshaked: true},
+		{name: "secret", netA: "office", secretA: "s3cret", netB: "office", secretB: "s3cret", wantHandshaked: true},
+		{name: "another network", netA: "office", netB: "home"},
+		{name: "wrong secret", netA: "office", secretA: "s3cret", netB: "office", secretB: "guess"},
+		{name: "missing secret", netA: "office", netB: "office", secretB: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewManager("a", utils.Must2IPMask("10.0.0.1/24"), "192.0.2.2:6780")
+			b := NewManager("b", utils.Must2IPMask("10.0.0.2/24"))
+			a.SetNetwork(tt.netA, tt.secretA)
+			b.SetNetwork(tt.netB, tt.secretB)
+			addrA, addrB := udpAddr("192.0.2.1:6780"), udpAddr("192.0.2.2:6780")
+			a.SetDialer(func(string) (packet.Writer, error) {
+				return &linkWriter{local: addrA, remote: addrB, from: a, to: b}, nil
+			})
+
+			go func() { _ = a.Manage() }()
+			go func() { _ = b.Manage() }()
+			t.Cleanup(func() {
+				a.Stop()
+				b.Stop()
+			})
+
+			handshaked := func() bool {
+				return a.GetPeer(utils.IPv4{10, 0, 0, 2}) != nil || b.GetPeer(utils.IPv4{10, 0, 0, 1}) != nil
+			}
+			if tt.wantHandshaked {
+				assert.Eventually(t, handshaked, 5*time.Second, 10*time.Millisecond)
+			} else {
+				assert.Never(t, handshaked, 500*time.Millisecond, 10*time.Millisecond)
+			}
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package peer
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"kevin-rd/my-tier/pkg/packet"
 	"kevin-rd/my-tier/pkg/packet/payload"
 	"kevin-rd/my-tier/pkg/utils"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -13,73 +16,124 @@ const (
 	STATE_HANDSHAKE_SENT
 	STATE_HANDSHAKE_RECEIVED
 	STATE_HANDSHAKED
+	// STATE_RECONNECTING waits for the backoff before the next handshake
+	STATE_RECONNECTING
+	// STATE_DEAD gave up the handshake, static peers are retried after deadRetryInterval
+	STATE_DEAD
+	// STATE_SUSPECT a handshaked peer which is silent for Liveness.SuspectAfter
+	STATE_SUSPECT
 )
 
+var stateNames = [...]string{
+	STATE_INIT:               "init",
+	STATE_HANDSHAKE_SENT:     "handshake_sent",
+	STATE_HANDSHAKE_RECEIVED: "handshake_received",
+	STATE_HANDSHAKED:         "handshaked",
+	STATE_RECONNECTING:       "reconnecting",
+	STATE_DEAD:               "dead",
+	STATE_SUSPECT:            "suspect",
+}
+
+// StateName returns the name of a peer state
+func StateName(state byte) string {
+	if int(state) < len(stateNames) {
+		return stateNames[state]
+	}
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
 type Info struct {
 	ID        string       // Node ID
 	VirtualIP utils.IPMask // Virtual IP
 }
 
+// Peer is a remote node. Info, RemoteAddr and Writer do not change once the peer is
+// handshaked, a peer which handshakes again is replaced by a new Peer.
 type Peer struct {
 	Info
-	State      byte
 	RemoteAddr string
 
 	packet.Writer `json:"-"`
 
-	outputCh chan *packet.Packet[packet.Packable]
+	// Queue is a snapshot of the send queue stats, filled when the peer is encoded
+	Queue QueueStats
+
+	state atomic.Uint32
+	// latency is the LatencyClass of the last round trip time
+	latency atomic.Uint32
+	// rtt is the last round trip time, zero until the first pong
+	rtt atomic.Int64
+	// lastSeen is the time of the last packet received, unix nanoseconds
+	lastSeen atomic.Int64
+	// lastPing is the time of the last keepalive, guarded by Manager.mu
+	lastPing time.Time
+	queue    *sendQueue
+	// addr is the configured address of a static peer, which is dialed again after failures
+	addr string
+	// attempts is the number of failed handshakes in a row
+	attempts int
+	// deadline is the handshake timeout or the time of the next retry, guarded by Manager.mu
+	deadline time.Time
+	// scheduler state, guarded by the mu of the scheduler shard of the peer
+	scheduled [numPriorities]bool
+	deficit   [numPriorities]int
 }
 
-// polling 是一个状态机
-func (p *Peer) polling(self Info) error {
-	for {
-
+func newPeer(writer packet.Writer) *Peer {
+	return &Peer{
+		RemoteAddr: writer.RemoteAddr().String(),
+		Writer:     writer,
+		queue:      newSendQueue(),
 	}
+}
 
+// State is the lifecycle state, safe to read from any goroutine
+func (p *Peer) State() byte {
+	return byte(p.state.Load())
 }
 
-// handshake 主动握手
-func (p *Peer) handshake(self Info) error {
-	var idBytes [32]byte
-	copy(idBytes[:], self.ID)
+// RTT is the last measured round trip time, zero if it is unknown
+func (p *Peer) RTT() time.Duration {
+	return time.Duration(p.rtt.Load())
+}
 
-	handshake := &packet.Packet[packet.Packable]{
-		Type: packet.TypeHandshakeInit,
-		Payload: &payload.HandshakeInitPayload{
-			ID:        idBytes,
-			DHCP:      true,
-			VirtualIP: self.VirtualIP,
-		},
-	}
-	_, err := p.WriteP(handshake)
-	if err != nil {
-		return err
-	}
-	p.State = STATE_HANDSHAKE_SENT
+func (p *Peer) setState(state byte) {
+	p.state.Store(uint32(state))
+}
 
-	resp, err := packet.ReadPacketOnce(p.GetConn())
-	if err != nil {
-		return err
-	}
-	relay, ok := resp.Payload.(*payload.HandshakeReplyPayload)
-	if !ok {
-		return errors.New("invalid payload type")
+// peerJSON is the encoding of a Peer, e.g. in IPC responses
+type peerJSON struct {
+	Info
+	State      byte
+	RemoteAddr string
+	Queue      QueueStats
+}
+
+func (p *Peer) MarshalJSON() ([]byte, error) {
+	v := peerJSON{Info: p.Info, State: p.State(), RemoteAddr: p.RemoteAddr, Queue: p.Queue}
+	if p.queue != nil {
+		v.Queue = p.queue.Stats()
 	}
-	// todo: if need DHCP: relay.VirtualIP
-	log.Printf("[peer] handshake reply from %s: %s", resp.SrcVIP, relay.Hello)
+	return json.Marshal(v)
+}
 
-	// send HandshakeFinalize
-	finalize := payload.StringPayload("ok")
-	if _, err = p.WritePayload(packet.TypeHandshakeFinalize, &finalize); err != nil {
-		log.Printf("[peer] write handshake finalize error: %v", err)
+func (p *Peer) UnmarshalJSON(data []byte) error {
+	var v peerJSON
+	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
+	p.Info, p.RemoteAddr, p.Queue = v.Info, v.RemoteAddr, v.Queue
+	p.setState(v.State)
 	return nil
 }
 
+// HandlePing echoes the payload of a ping, it carries the send time of the ping
 func (p *Peer) HandlePing(pkt *packet.Packet[packet.Packable]) {
-	payload := payload.StringPayload("ping")
-	if _, err := p.WritePayload(packet.TypePong, &payload); err != nil {
+	stamp, ok := pkt.Payload.(*payload.StringPayload)
+	if !ok {
+		stamp = new(payload.StringPayload)
+	}
+	if _, err := p.WritePayload(packet.TypePong, stamp); err != nil {
 		log.Printf("[peer] write pong error: %v", err)
 		return
 	}
@@ -87,7 +141,10 @@ func (p *Peer) HandlePing(pkt *packet.Packet[packet.Packable]) {
 
 func (p *Peer) handshaked(info Info) {
 	p.Info = info
-	p.State = STATE_HANDSHAKED
+	p.setState(STATE_HANDSHAKED)
+	p.lastSeen.Store(time.Now().UnixNano())
+	p.attempts = 0
+	p.deadline = time.Time{}
 }
 
 type PeersReplyPayload struct {
@@ -0,0 +1,154 @@
+package peer
+
+import (
+	"errors"
+	"kevin-rd/my-tier/pkg/packet"
+	"sync"
+)
+
+// Priority is the scheduling class of an outgoing packet, lower value is sent first.
+type Priority byte
+
+const (
+	// PriorityControl handshake, ping, routing and other non-data packets
+	PriorityControl Priority = iota
+	// PriorityData TUN data packets
+	PriorityData
+
+	numPriorities
+)
+
+// DropPolicy decides which packet is dropped when a queue lane is full.
+type DropPolicy byte
+
+const (
+	// DropTail drops the incoming packet
+	DropTail DropPolicy = iota
+	// DropHead drops the oldest queued packet, keeps the freshest one
+	DropHead
+)
+
+const (
+	// headerLen is the encoded size of the packet header
+	headerLen = 4 + 4*2
+
+	DefaultControlQueueSize = 64
+	DefaultDataQueueSize    = 512
+)
+
+var (
+	ErrQueueFull = errors.New("peer send queue full")
+	ErrNoPeer    = errors.New("no peer for destination")
+)
+
+func PriorityOf(typ byte) Priority {
+	if typ == packet.TypeData || typ == packet.TypeFrame {
+		return PriorityData
+	}
+	return PriorityControl
+}
+
+type QueueStats struct {
+	Depth    int    `json:"depth"`
+	Enqueued uint64 `json:"enqueued"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type lane struct {
+	pkts   []*packet.Packet[packet.Packable]
+	limit  int
+	policy DropPolicy
+}
+
+// sendQueue is a bounded per-peer queue with one lane per Priority.
+type sendQueue struct {
+	mu    sync.Mutex
+	lanes [numPriorities]lane
+	stats QueueStats
+}
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{}
+	q.lanes[PriorityControl] = lane{limit: DefaultControlQueueSize, policy: DropHead}
+	q.lanes[PriorityData] = lane{limit: DefaultDataQueueSize, policy: DropTail}
+	return q
+}
+
+// push adds pkt to its lane, the returned error is ErrQueueFull if a packet was dropped.
+func (q *sendQueue) push(prio Priority, pkt *packet.Packet[packet.Packable]) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[prio]
+	if len(l.pkts) >= l.limit {
+		q.stats.Dropped++
+		if l.policy == DropTail {
+			return ErrQueueFull
+		}
+		l.pkts[0] = nil
+		l.pkts = l.pkts[1:]
+		l.pkts = append(l.pkts, pkt)
+		q.stats.Enqueued++
+		return ErrQueueFull
+	}
+
+	l.pkts = append(l.pkts, pkt)
+	q.stats.Enqueued++
+	q.stats.Depth++
+	return nil
+}
+
+// pop takes the head packet of the given lane, nil if it is empty.
+func (q *sendQueue) pop(prio Priority) *packet.Packet[packet.Packable] {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[prio]
+	if len(l.pkts) == 0 {
+		return nil
+	}
+	pkt := l.pkts[0]
+	l.pkts[0] = nil
+	l.pkts = l.pkts[1:]
+	q.stats.Depth--
+	q.stats.Sent++
+	return pkt
+}
+
+// peek returns the size of the head packet of the lane, -1 if it is empty.
+func (q *sendQueue) peek(prio Priority) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[prio]
+	if len(l.pkts) == 0 {
+		return -1
+	}
+	return headerLen + l.pkts[0].Payload.Length()
+}
+
+// clear drops the queued packets, e.g. of an evicted peer
+func (q *sendQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.lanes {
+		l := &q.lanes[i]
+		q.stats.Dropped += uint64(len(l.pkts))
+		clear(l.pkts)
+		l.pkts = l.pkts[:0]
+	}
+	q.stats.Depth = 0
+}
+
+func (q *sendQueue) len(prio Priority) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lanes[prio].pkts)
+}
+
+func (q *sendQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"hash/fnv"
+	"kevin-rd/my-tier/pkg/packet"
+	"log"
+	"sync"
+)
+
+// quantum is the number of bytes a peer may send per deficit round robin turn
+const quantum = 1500
+
+// shardedScheduler spreads the peers over schedulers drained by a goroutine each, a single
+// goroutine would bound the send rate of the node to what one CPU encodes and writes, see
+// BenchmarkScheduler. A peer always lands on the same shard, so its packets keep their order. Strict priority
+// and fairness hold among the peers of a shard, the shards share the link unweighted.
+type shardedScheduler struct {
+	shards []*scheduler
+}
+
+func newShardedScheduler(n int) *shardedScheduler {
+	s := &shardedScheduler{shards: make([]*scheduler, max(n, 1))}
+	for i := range s.shards {
+		s.shards[i] = newScheduler()
+	}
+	return s
+}
+
+// shard is the scheduler of p, chosen by its remote address which never changes
+func (s *shardedScheduler) shard(p *Peer) *scheduler {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(p.RemoteAddr))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// enqueue puts pkt into the send queue of p, never blocks.
+func (s *shardedScheduler) enqueue(p *Peer, pkt *packet.Packet[packet.Packable]) error {
+	return s.shard(p).enqueue(p, pkt)
+}
+
+// run drains every shard until stopCh is closed
+func (s *shardedScheduler) run(stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, shard := range s.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shard.run(stopCh)
+		}()
+	}
+	wg.Wait()
+}
+
+// scheduler drains the send queues of its peers.
+// Control packets of every peer are sent before any data packet (strict priority),
+// peers within the same priority share the link by deficit round robin.
+type scheduler struct {
+	mu sync.Mutex
+	// peers which have queued packets, per priority
+	active [numPriorities][]*Peer
+
+	wakeCh chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		wakeCh: make(chan struct{}, 1),
+	}
+}
+
+// enqueue puts pkt into the send queue of p, never blocks.
+func (s *scheduler) enqueue(p *Peer, pkt *packet.Packet[packet.Packable]) error {
+	prio := PriorityOf(pkt.Type)
+	err := p.queue.push(prio, pkt)
+
+	s.mu.Lock()
+	if !p.scheduled[prio] {
+		p.scheduled[prio] = true
+		s.active[prio] = append(s.active[prio], p)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// next picks the next packet to send, nil if all queues are empty.
+func (s *scheduler) next() (*Peer, *packet.Packet[packet.Packable]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for prio := Priority(0); prio < numPriorities; prio++ {
+		for len(s.active[prio]) > 0 {
+			p := s.active[prio][0]
+
+			size := p.queue.peek(prio)
+			if size < 0 {
+				// drained, leave the round
+				s.active[prio][0] = nil
+				s.active[prio] = s.active[prio][1:]
+				p.scheduled[prio] = false
+				p.deficit[prio] = 0
+				continue
+			}
+			if p.deficit[prio] < size {
+				// not enough credit, move to the tail of the round
+				p.deficit[prio] += quantum
+				s.active[prio] = append(s.active[prio][1:], p)
+				continue
+			}
+
+			p.deficit[prio] -= size
+			return p, p.queue.pop(prio)
+		}
+	}
+	return nil, nil
+}
+
+// run sends queued packets until stopCh is closed, up to packet.BatchSize packets
+// are written per sendmmsg.
+func (s *scheduler) run(stopCh <-chan struct{}) {
+	var batch packet.Batch
+	for {
+		if s.flush(&batch) {
+			continue
+		}
+
+		select {
+		case <-s.wakeCh:
+		case <-stopCh:
+			// one more batch for what was queued before the stop, e.g. the leave of the
+			// gossip, control packets go first
+			s.flush(&batch)
+			return
+		}
+	}
+}
+
+// flush sends up to packet.BatchSize queued packets, false if there were none
+func (s *scheduler) flush(batch *packet.Batch) bool {
+	for batch.Len() < packet.BatchSize {
+		p, pkt := s.next()
+		if p == nil {
+			break
+		}
+		if err := batch.Add(p.Writer, pkt); err != nil {
+			log.Printf("[scheduler] write packet to %s error: %v", p.RemoteAddr, err)
+		}
+	}
+	if batch.Len() == 0 {
+		return false
+	}
+	if err := batch.Flush(); err != nil {
+		log.Printf("[scheduler] write batch error: %v", err)
+	}
+	return true
+}
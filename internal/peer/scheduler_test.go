@@ -0,0 +1,236 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dataPacket(size int) *packet.Packet[packet.Packable] {
+	data := payload.StringPayload(make([]byte, size))
+	return packet.NewPacket(packet.TypeData, &data)
+}
+
+func controlPacket() *packet.Packet[packet.Packable] {
+	ping := payload.StringPayload("ping")
+	return packet.NewPacket(packet.TypePing, &ping)
+}
+
+func TestSendQueue_Drop(t *testing.T) {
+	q := newSendQueue()
+
+	// data drops the incoming packet
+	first := dataPacket(1)
+	require.NoError(t, q.push(PriorityData, first))
+	for i := 1; i < DefaultDataQueueSize; i++ {
+		require.NoError(t, q.push(PriorityData, dataPacket(1)))
+	}
+	assert.ErrorIs(t, q.push(PriorityData, dataPacket(2)), ErrQueueFull)
+	assert.Equal(t, DefaultDataQueueSize, q.len(PriorityData))
+	assert.Same(t, first, q.pop(PriorityData))
+
+	// control drops the oldest packet and keeps the freshest one
+	var pkts []*packet.Packet[packet.Packable]
+	for i := 0; i <= DefaultControlQueueSize; i++ {
+		pkts = append(pkts, controlPacket())
+		err := q.push(PriorityControl, pkts[i])
+		if i < DefaultControlQueueSize {
+			require.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, ErrQueueFull)
+		}
+	}
+	assert.Equal(t, DefaultControlQueueSize, q.len(PriorityControl))
+	assert.Same(t, pkts[1], q.pop(PriorityControl))
+
+	stats := q.Stats()
+	assert.Equal(t, uint64(2), stats.Dropped)
+	assert.Equal(t, DefaultDataQueueSize-1+DefaultControlQueueSize-1, stats.Depth)
+
+	q.clear()
+	assert.Equal(t, 0, q.Stats().Depth)
+	assert.Nil(t, q.pop(PriorityData))
+}
+
+func TestScheduler_StrictPriority(t *testing.T) {
+	s := newScheduler()
+	a, b := &Peer{queue: newSendQueue()}, &Peer{queue: newSendQueue()}
+
+	require.NoError(t, s.enqueue(a, dataPacket(100)))
+	require.NoError(t, s.enqueue(a, dataPacket(100)))
+	require.NoError(t, s.enqueue(b, controlPacket()))
+
+	p, pkt := s.next()
+	assert.Same(t, b, p)
+	assert.Equal(t, packet.TypePing, pkt.Type)
+	for range 2 {
+		p, pkt = s.next()
+		assert.Same(t, a, p)
+		assert.Equal(t, packet.TypeData, pkt.Type)
+	}
+	p, pkt = s.next()
+	assert.Nil(t, p)
+	assert.Nil(t, pkt)
+	// drained peers leave the round
+	assert.False(t, a.scheduled[PriorityData])
+	assert.False(t, b.scheduled[PriorityControl])
+}
+
+func TestScheduler_Fairness(t *testing.T) {
+	s := newScheduler()
+	a, b := &Peer{queue: newSendQueue()}, &Peer{queue: newSendQueue()}
+	// a sends large packets, b small ones: 1012 and 212 bytes with the header
+	for range 20 {
+		require.NoError(t, s.enqueue(a, dataPacket(1000)))
+	}
+	for range 100 {
+		require.NoError(t, s.enqueue(b, dataPacket(200)))
+	}
+
+	// every round a peer gets a quantum of credit: a sends one packet, b seven
+	var order []*Peer
+	for range 16 {
+		p, _ := s.next()
+		order = append(order, p)
+	}
+	want := []*Peer{a, b, b, b, b, b, b, b, a, b, b, b, b, b, b, b}
+	assert.Equal(t, want, order)
+
+	// the bytes sent by both peers stay within a quantum of each other
+	sent := map[*Peer]int{}
+	for range 60 {
+		p, pkt := s.next()
+		sent[p] += headerLen + pkt.Payload.Length()
+	}
+	assert.InDelta(t, sent[a], sent[b], quantum)
+}
+
+func TestScheduler_StatsRace(t *testing.T) {
+	m := NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	handshakeFrom(m, "a", "10.0.0.2/24", "192.0.2.2:6780")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			pkt := dataPacket(10)
+			pkt.DstVIP = utils.IPv4{10, 0, 0, 2}
+			_ = m.Send(pkt)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			_, err := json.Marshal(m.GetPeers(""))
+			assert.NoError(t, err)
+		}
+	}()
+	wg.Wait()
+}
+
+// countWriter encodes the packets written to it like a socket writer and counts them
+type countWriter struct {
+	addr net.Addr
+	n    *atomic.Int64
+}
+
+func (w countWriter) Write(pkt []byte) (int, error) {
+	w.n.Add(1)
+	return len(pkt), nil
+}
+
+func (w countWriter) WriteP(pkt *packet.Packet[packet.Packable]) (int, error) {
+	bts, err := pkt.Encode()
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(bts)
+}
+
+func (w countWriter) WritePayload(typ byte, payload packet.Packable) (int, error) {
+	return w.WriteP(packet.NewPacket(typ, payload))
+}
+
+func (w countWriter) RemoteAddr() net.Addr { return w.addr }
+func (w countWriter) GetConn() net.Conn    { return nil }
+
+// countPeers returns n peers writing to counting writers
+func countPeers(n int, sent *atomic.Int64) []*Peer {
+	peers := make([]*Peer, n)
+	for i := range peers {
+		peers[i] = newPeer(countWriter{addr: udpAddr(fmt.Sprintf("192.0.2.%d:6780", i+1)), n: sent})
+	}
+	return peers
+}
+
+func TestShardedScheduler(t *testing.T) {
+	s := newShardedScheduler(4)
+	var sent atomic.Int64
+	peers := countPeers(16, &sent)
+
+	// a peer always lands on the same shard
+	used := map[*scheduler]bool{}
+	for _, p := range peers {
+		assert.Same(t, s.shard(p), s.shard(p))
+		used[s.shard(p)] = true
+	}
+	assert.Greater(t, len(used), 1)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.run(stopCh)
+		close(done)
+	}()
+	for range 10 {
+		for _, p := range peers {
+			require.NoError(t, s.enqueue(p, dataPacket(100)))
+		}
+	}
+	require.Eventually(t, func() bool { return sent.Load() == 160 }, 2*time.Second, time.Millisecond)
+	close(stopCh)
+	<-done
+}
+
+// BenchmarkScheduler sends from every CPU to 64 peers until every packet is written, run it
+// with -cpu to see where the single goroutine of one shard stops scaling
+func BenchmarkScheduler(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newShardedScheduler(shards)
+			var sent atomic.Int64
+			peers := countPeers(64, &sent)
+			stopCh := make(chan struct{})
+			go s.run(stopCh)
+			defer close(stopCh)
+
+			var next atomic.Uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				p := peers[next.Add(1)%uint32(len(peers))]
+				pkt := dataPacket(1400)
+				for pb.Next() {
+					// a full queue refuses the packet, wait for the scheduler
+					for s.enqueue(p, pkt) != nil {
+						runtime.Gosched()
+					}
+				}
+			})
+			for sent.Load() < int64(b.N) {
+				runtime.Gosched()
+			}
+		})
+	}
+}
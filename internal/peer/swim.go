@@ -0,0 +1,545 @@
+package peer
+
+import (
+	"bytes"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SwimConfig tunes the SWIM failure detector and the dissemination of membership updates
+type SwimConfig struct {
+	// ProbeInterval is the protocol period, one member is probed per period
+	ProbeInterval time.Duration
+	// ProbeTimeout is the wait for the direct ack before the indirect probes
+	ProbeTimeout time.Duration
+	// IndirectProbes is the number of members asked to probe a member which did not ack
+	IndirectProbes int
+	// SuspicionMult scales the suspicion timeout, log10 of the cluster size protocol periods
+	SuspicionMult int
+	// RetransmitMult scales how often an update is piggybacked, log10 of the cluster size times
+	RetransmitMult int
+	// MaxPiggyback is the number of updates carried by one message
+	MaxPiggyback int
+	// SyncPeriods is the number of protocol periods between two pushes of the full member
+	// list to a random member, it repairs the updates the piggybacking missed
+	SyncPeriods int
+}
+
+var DefaultSwimConfig = SwimConfig{
+	ProbeInterval:  time.Second,
+	ProbeTimeout:   500 * time.Millisecond,
+	IndirectProbes: 3,
+	SuspicionMult:  4,
+	RetransmitMult: 4,
+	MaxPiggyback:   8,
+	SyncPeriods:    10,
+}
+
+// Member is a node of the cluster as seen by the gossip
+type Member struct {
+	ID          string       `json:"id"`
+	VirtualIP   utils.IPMask `json:"virtual_ip"`
+	Addr        string       `json:"addr,omitempty"`
+	State       byte         `json:"state"`
+	Incarnation uint32       `json:"incarnation"`
+	// Since is the time of the last state change
+	Since time.Time `json:"since"`
+}
+
+// MemberStateName returns the name of a payload.Member* state
+func MemberStateName(state byte) string {
+	switch state {
+	case payload.MemberAlive:
+		return "alive"
+	case payload.MemberSuspect:
+		return "suspect"
+	case payload.MemberDead:
+		return "dead"
+	case payload.MemberLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+type member struct {
+	Member
+	suspectDeadline time.Time
+}
+
+func (m *member) update(state byte) payload.MemberUpdate {
+	return payload.MemberUpdate{State: state, Incarnation: m.Incarnation, VIP: m.VirtualIP, ID: m.ID, Addr: m.Addr}
+}
+
+type broadcast struct {
+	update    payload.MemberUpdate
+	transmits int
+}
+
+// probe is the outstanding probe of the current protocol period
+type probe struct {
+	target     utils.IPv4
+	seq        uint32
+	indirectAt time.Time
+	deadline   time.Time
+	acked      bool
+	indirect   bool
+}
+
+// relay is an indirect probe made on behalf of origin
+type relay struct {
+	origin utils.IPv4
+	seq    uint32
+	target utils.IPv4
+	expire time.Time
+}
+
+// swim is the SWIM membership protocol: every period one member is pinged, members which
+// do not ack are probed indirectly through others, then suspected and declared dead once
+// the suspicion times out. A member refutes a suspicion with a higher incarnation. The
+// updates are disseminated piggybacked on the probes.
+type swim struct {
+	mu  sync.Mutex
+	cfg SwimConfig
+
+	self    payload.MemberUpdate
+	members map[utils.IPv4]*member
+
+	// round robin probe order, shuffled every round
+	order     []utils.IPv4
+	next      int
+	nextProbe time.Time
+	seq       uint32
+	periods   int
+	probe     *probe
+	relays    map[uint32]relay
+
+	queue []*broadcast
+	// changes are delivered to onChange once mu is released
+	changes []Member
+
+	send     func(dst utils.IPv4, g *payload.GossipPayload)
+	onChange func(Member)
+}
+
+func newSwim(self Info, cfg SwimConfig, send func(utils.IPv4, *payload.GossipPayload), onChange func(Member)) *swim {
+	return &swim{
+		cfg:      cfg,
+		self:     payload.MemberUpdate{State: payload.MemberAlive, VIP: self.VirtualIP, ID: self.ID},
+		members:  map[utils.IPv4]*member{},
+		relays:   map[uint32]relay{},
+		send:     send,
+		onChange: onChange,
+	}
+}
+
+// setSelf announces the new address of this node, e.g. a lease. The member of the old
+// address is left to the failure detection.
+func (s *swim) setSelf(info Info) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.self.VIP = info.VirtualIP
+	if info.VirtualIP == (utils.IPMask{}) {
+		return
+	}
+	s.self.Incarnation++
+	delete(s.members, info.VirtualIP.IPv4())
+	s.broadcast(s.self)
+}
+
+// deliver reports the changes collected while mu was held
+func (s *swim) deliver() {
+	s.mu.Lock()
+	changes := s.changes
+	s.changes = nil
+	s.mu.Unlock()
+	for _, c := range changes {
+		s.onChange(c)
+	}
+}
+
+// Members returns the members sorted by virtual IP, self included
+func (s *swim) Members() []Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]Member, 0, len(s.members)+1)
+	members = append(members, Member{
+		ID: s.self.ID, VirtualIP: s.self.VIP, State: s.self.State, Incarnation: s.self.Incarnation,
+	})
+	for _, m := range s.members {
+		members = append(members, m.Member)
+	}
+	slices.SortFunc(members, func(a, b Member) int { return bytes.Compare(a.VirtualIP[:4], b.VirtualIP[:4]) })
+	return members
+}
+
+// join adds a handshaked node as alive and pushes the member list to it. A node known as
+// dead is revived with a higher incarnation, the handshake proves it is back.
+// join only reports alive changes, so it may be called with Manager.mu held.
+func (s *swim) join(info Info, addr string, now time.Time) {
+	defer s.deliver()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vip := info.VirtualIP.IPv4()
+	if vip == s.self.VIP.IPv4() {
+		return
+	}
+	m := s.members[vip]
+	switch {
+	case m == nil:
+		m = &member{Member: Member{ID: info.ID, VirtualIP: info.VirtualIP}}
+		s.members[vip] = m
+	case m.State == payload.MemberDead || m.State == payload.MemberLeft || m.ID != info.ID:
+		m.ID, m.VirtualIP = info.ID, info.VirtualIP
+		m.Incarnation++
+	default:
+		m.Addr = addr
+		return
+	}
+	m.Addr = addr
+	s.setState(m, payload.MemberAlive, now)
+	s.broadcast(m.update(payload.MemberAlive))
+
+	// the new member learns the cluster without waiting for the updates, and answers with
+	// the members it knows
+	s.pushState(vip, true)
+}
+
+// pushState sends the full member list to dst, with pull dst answers with its own list.
+// mu must be held.
+func (s *swim) pushState(dst utils.IPv4, pull bool) {
+	updates := []payload.MemberUpdate{s.self}
+	for vip, m := range s.members {
+		if vip != dst {
+			updates = append(updates, m.update(m.State))
+		}
+	}
+	for len(updates) > 0 {
+		n := min(len(updates), s.cfg.MaxPiggyback)
+		g := &payload.GossipPayload{Kind: payload.GossipSync, Updates: updates[:n]}
+		updates = updates[n:]
+		// the last message asks for the list of dst
+		if pull && len(updates) == 0 {
+			g.Seq = 1
+		}
+		s.send(dst, g)
+	}
+}
+
+// leave tells the alive members that this node leaves, best effort
+func (s *swim) leave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.self.Incarnation++
+	s.self.State = payload.MemberLeft
+	for vip, m := range s.members {
+		if m.State == payload.MemberAlive || m.State == payload.MemberSuspect {
+			s.send(vip, &payload.GossipPayload{Kind: payload.GossipSync, Updates: []payload.MemberUpdate{s.self}})
+		}
+	}
+}
+
+// tick runs the protocol period: timeouts of the current probe, the next probe and the
+// suspicion timeouts
+func (s *swim) tick(now time.Time) {
+	defer s.deliver()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.probe; p != nil {
+		if !p.acked && !p.indirect && !now.Before(p.indirectAt) {
+			p.indirect = true
+			for _, vip := range s.randomMembers(s.cfg.IndirectProbes, p.target) {
+				s.sendMsg(vip, &payload.GossipPayload{Kind: payload.GossipPingReq, Seq: p.seq, Target: p.target})
+			}
+		}
+		if !now.Before(p.deadline) {
+			s.probe = nil
+			if m := s.members[p.target]; !p.acked && m != nil && m.State == payload.MemberAlive {
+				s.apply(m.update(payload.MemberSuspect), now)
+			}
+		}
+	}
+
+	if !now.Before(s.nextProbe) {
+		s.nextProbe = now.Add(s.cfg.ProbeInterval)
+		s.periods++
+		if s.cfg.SyncPeriods > 0 && s.periods%s.cfg.SyncPeriods == 0 {
+			for _, vip := range s.randomMembers(1, utils.IPv4{}) {
+				s.pushState(vip, true)
+			}
+		}
+		if target, ok := s.nextTarget(); ok {
+			s.seq++
+			s.probe = &probe{
+				target:     target,
+				seq:        s.seq,
+				indirectAt: now.Add(s.cfg.ProbeTimeout),
+				deadline:   now.Add(s.cfg.ProbeInterval),
+			}
+			s.sendMsg(target, &payload.GossipPayload{Kind: payload.GossipPing, Seq: s.seq})
+		}
+	}
+
+	gcAfter := 10 * s.suspicionTimeout()
+	for vip, m := range s.members {
+		switch m.State {
+		case payload.MemberSuspect:
+			if !now.Before(m.suspectDeadline) {
+				s.apply(m.update(payload.MemberDead), now)
+			}
+		case payload.MemberDead, payload.MemberLeft:
+			// forget the member once the update had time to spread
+			if now.Sub(m.Since) > gcAfter {
+				delete(s.members, vip)
+			}
+		}
+	}
+	for seq, r := range s.relays {
+		if now.After(r.expire) {
+			delete(s.relays, seq)
+		}
+	}
+}
+
+// handle applies the updates piggybacked on g and answers the probes
+func (s *swim) handle(from utils.IPv4, g *payload.GossipPayload, now time.Time) {
+	defer s.deliver()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range g.Updates {
+		s.apply(u, now)
+	}
+	switch g.Kind {
+	case payload.GossipPing:
+		s.sendMsg(from, &payload.GossipPayload{Kind: payload.GossipAck, Seq: g.Seq, Target: s.self.VIP.IPv4()})
+	case payload.GossipPingReq:
+		s.seq++
+		s.relays[s.seq] = relay{origin: from, seq: g.Seq, target: g.Target, expire: now.Add(s.cfg.ProbeInterval)}
+		s.sendMsg(g.Target, &payload.GossipPayload{Kind: payload.GossipPing, Seq: s.seq})
+	case payload.GossipAck:
+		if r, ok := s.relays[g.Seq]; ok {
+			delete(s.relays, g.Seq)
+			s.sendMsg(r.origin, &payload.GossipPayload{Kind: payload.GossipAck, Seq: r.seq, Target: r.target})
+		} else if p := s.probe; p != nil && p.seq == g.Seq {
+			p.acked = true
+		}
+	case payload.GossipSync:
+		if g.Seq != 0 {
+			s.pushState(from, false)
+		}
+	}
+}
+
+// apply merges an update, the higher incarnation wins and suspect overrides alive of the
+// same incarnation, dead and left override both. mu must be held.
+func (s *swim) apply(u payload.MemberUpdate, now time.Time) {
+	vip := u.VIP.IPv4()
+	if vip == s.self.VIP.IPv4() {
+		s.applySelf(u)
+		return
+	}
+
+	m := s.members[vip]
+	if m == nil {
+		// only the alive updates introduce members, the others are about forgotten ones
+		if u.State != payload.MemberAlive {
+			return
+		}
+		m = &member{Member: Member{ID: u.ID, VirtualIP: u.VIP, Addr: u.Addr, Incarnation: u.Incarnation}}
+		s.members[vip] = m
+		s.setState(m, payload.MemberAlive, now)
+		s.broadcast(u)
+		return
+	}
+
+	switch u.State {
+	case payload.MemberAlive:
+		if u.Incarnation <= m.Incarnation {
+			return
+		}
+	case payload.MemberSuspect:
+		switch {
+		case m.State == payload.MemberAlive && u.Incarnation >= m.Incarnation:
+		case m.State == payload.MemberSuspect && u.Incarnation > m.Incarnation:
+		default:
+			return
+		}
+	case payload.MemberDead, payload.MemberLeft:
+		if u.Incarnation < m.Incarnation {
+			return
+		}
+		if (m.State == payload.MemberDead || m.State == payload.MemberLeft) && u.Incarnation == m.Incarnation {
+			return
+		}
+	default:
+		return
+	}
+
+	m.Incarnation = u.Incarnation
+	m.ID, m.VirtualIP = u.ID, u.VIP
+	if m.Addr == "" {
+		m.Addr = u.Addr
+	}
+	if m.State != u.State {
+		s.setState(m, u.State, now)
+	}
+	s.broadcast(u)
+}
+
+// applySelf refutes a suspicion of this node with a higher incarnation. mu must be held.
+func (s *swim) applySelf(u payload.MemberUpdate) {
+	if u.ID != s.self.ID {
+		// another node claims the address, the manager resolves the conflict
+		if u.State == payload.MemberAlive {
+			s.changes = append(s.changes, Member{ID: u.ID, VirtualIP: u.VIP, State: u.State, Incarnation: u.Incarnation})
+		}
+		return
+	}
+	if s.self.State == payload.MemberLeft {
+		return
+	}
+	switch u.State {
+	case payload.MemberSuspect, payload.MemberDead:
+		if u.Incarnation >= s.self.Incarnation {
+			s.self.Incarnation = u.Incarnation + 1
+			log.Printf("[swim] refute %s with incarnation %d", MemberStateName(u.State), s.self.Incarnation)
+			s.broadcast(s.self)
+		}
+	case payload.MemberAlive:
+		// others may have revived this node after a restart
+		if u.Incarnation > s.self.Incarnation {
+			s.self.Incarnation = u.Incarnation
+		}
+	}
+}
+
+func (s *swim) setState(m *member, state byte, now time.Time) {
+	if m.State != state {
+		log.Printf("[swim] member %s %s is %s, incarnation %d", m.ID, m.VirtualIP, MemberStateName(state), m.Incarnation)
+	}
+	m.State = state
+	m.Since = now
+	if state == payload.MemberSuspect {
+		m.suspectDeadline = now.Add(s.suspicionTimeout())
+	}
+	s.changes = append(s.changes, m.Member)
+}
+
+// clusterLog is log10 of the cluster size, at least 1
+func (s *swim) clusterLog() float64 {
+	return max(1, math.Ceil(math.Log10(float64(len(s.members)+2))))
+}
+
+func (s *swim) suspicionTimeout() time.Duration {
+	return time.Duration(float64(s.cfg.SuspicionMult) * s.clusterLog() * float64(s.cfg.ProbeInterval))
+}
+
+// broadcast queues u for dissemination, it replaces the older update of the same member
+func (s *swim) broadcast(u payload.MemberUpdate) {
+	s.queue = slices.DeleteFunc(s.queue, func(b *broadcast) bool { return b.update.VIP == u.VIP })
+	s.queue = append(s.queue, &broadcast{update: u})
+}
+
+// sendMsg piggybacks the least sent updates on g and sends it, mu must be held
+func (s *swim) sendMsg(dst utils.IPv4, g *payload.GossipPayload) {
+	limit := int(float64(s.cfg.RetransmitMult) * s.clusterLog())
+	slices.SortStableFunc(s.queue, func(a, b *broadcast) int { return a.transmits - b.transmits })
+	for _, b := range s.queue {
+		if len(g.Updates) >= s.cfg.MaxPiggyback {
+			break
+		}
+		g.Updates = append(g.Updates, b.update)
+		b.transmits++
+	}
+	s.queue = slices.DeleteFunc(s.queue, func(b *broadcast) bool { return b.transmits >= limit })
+	s.send(dst, g)
+}
+
+// nextTarget returns the next member to probe, the order is shuffled every round
+func (s *swim) nextTarget() (utils.IPv4, bool) {
+	for attempt := 0; attempt < 2; attempt++ {
+		for ; s.next < len(s.order); s.next++ {
+			vip := s.order[s.next]
+			if m := s.members[vip]; m != nil && probeable(m) {
+				s.next++
+				return vip, true
+			}
+		}
+		s.order = s.order[:0]
+		for vip, m := range s.members {
+			if probeable(m) {
+				s.order = append(s.order, vip)
+			}
+		}
+		rand.Shuffle(len(s.order), func(i, j int) { s.order[i], s.order[j] = s.order[j], s.order[i] })
+		s.next = 0
+	}
+	return utils.IPv4{}, false
+}
+
+// randomMembers picks up to k alive members other than exclude
+func (s *swim) randomMembers(k int, exclude utils.IPv4) []utils.IPv4 {
+	var vips []utils.IPv4
+	for vip, m := range s.members {
+		if vip != exclude && m.State == payload.MemberAlive {
+			vips = append(vips, vip)
+		}
+	}
+	rand.Shuffle(len(vips), func(i, j int) { vips[i], vips[j] = vips[j], vips[i] })
+	return vips[:min(k, len(vips))]
+}
+
+func probeable(m *member) bool {
+	return m.State == payload.MemberAlive || m.State == payload.MemberSuspect
+}
+
+// Members returns the cluster membership as seen by the gossip, self included
+func (m *Manager) Members() []Member {
+	return m.swim.Members()
+}
+
+// sendGossip queues a SWIM message to the peer owning dst, the message is lost if there
+// is no session to it. The failure detector copes with it like with a lost packet.
+func (m *Manager) sendGossip(dst utils.IPv4, g *payload.GossipPayload) {
+	pkt := packet.NewPacket(packet.TypeGossip, g)
+	pkt.SrcVIP = *m.srcVIP.Load()
+	pkt.DstVIP = dst
+	_ = m.Send(pkt)
+}
+
+// memberChanged evicts the session of a member the cluster agreed is dead or gone, and
+// resolves the members claiming the address of this node
+func (m *Manager) memberChanged(mem Member) {
+	if mem.State == payload.MemberAlive {
+		// join reports alive members with m.mu held, they never claim the address of this node
+		if mem.VirtualIP.IPv4() != *m.srcVIP.Load() || mem.ID == m.ID {
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if mem.VirtualIP.IPv4() == m.VirtualIP.IPv4() {
+			m.addressConflict(Info{ID: mem.ID, VirtualIP: mem.VirtualIP})
+		}
+		return
+	}
+	if mem.State != payload.MemberDead && mem.State != payload.MemberLeft {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mem.State == payload.MemberLeft && m.pool != nil {
+		m.pool.Release(mem.ID)
+	}
+	if p, ok := m.peerMap[mem.VirtualIP.IPv4()]; ok && p.ID == mem.ID && p.Writer != nil {
+		m.evict(p, "member "+MemberStateName(mem.State))
+	}
+}
@@ -0,0 +1,171 @@
+package peer
+
+import (
+	"fmt"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type gossipMsg struct {
+	from, to utils.IPv4
+	data     []byte
+}
+
+// cluster runs swim nodes on a fake clock, messages go through the payload codec
+type cluster struct {
+	t     *testing.T
+	nodes []*swim
+	queue []gossipMsg
+	// down nodes neither send nor receive, cut links drop both directions
+	down map[utils.IPv4]bool
+	cut  map[[2]utils.IPv4]bool
+	now  time.Time
+}
+
+func nodeInfo(i int) Info {
+	return Info{ID: fmt.Sprintf("n%d", i), VirtualIP: utils.IPMask{10, 0, 0, byte(i + 1), 24}}
+}
+
+func newCluster(t *testing.T, n int) *cluster {
+	c := &cluster{t: t, down: map[utils.IPv4]bool{}, cut: map[[2]utils.IPv4]bool{}, now: time.Now()}
+	for i := 0; i < n; i++ {
+		from := nodeInfo(i).VirtualIP.IPv4()
+		send := func(dst utils.IPv4, g *payload.GossipPayload) {
+			data, err := g.Encode()
+			require.NoError(t, err)
+			c.queue = append(c.queue, gossipMsg{from: from, to: dst, data: data})
+		}
+		c.nodes = append(c.nodes, newSwim(nodeInfo(i), DefaultSwimConfig, send, func(Member) {}))
+	}
+	// everyone handshakes with n0, the rest is learned by gossip
+	for i := 1; i < n; i++ {
+		c.nodes[0].join(nodeInfo(i), "", c.now)
+		c.nodes[i].join(nodeInfo(0), "", c.now)
+	}
+	return c
+}
+
+func (c *cluster) node(vip utils.IPv4) *swim {
+	return c.nodes[int(vip[3])-1]
+}
+
+func (c *cluster) cutLink(a, b int) {
+	va, vb := nodeInfo(a).VirtualIP.IPv4(), nodeInfo(b).VirtualIP.IPv4()
+	c.cut[[2]utils.IPv4{va, vb}] = true
+	c.cut[[2]utils.IPv4{vb, va}] = true
+}
+
+func (c *cluster) run(d time.Duration) {
+	for end := c.now.Add(d); c.now.Before(end); c.now = c.now.Add(100 * time.Millisecond) {
+		for _, s := range c.nodes {
+			if !c.down[s.self.VIP.IPv4()] {
+				s.tick(c.now)
+			}
+		}
+		for len(c.queue) > 0 {
+			msg := c.queue[0]
+			c.queue = c.queue[1:]
+			if c.down[msg.from] || c.down[msg.to] || c.cut[[2]utils.IPv4{msg.from, msg.to}] {
+				continue
+			}
+			g := &payload.GossipPayload{}
+			require.NoError(c.t, g.Decode(msg.data))
+			c.node(msg.to).handle(msg.from, g, c.now)
+		}
+	}
+}
+
+// view returns the states of the other members as seen by node i
+func (c *cluster) view(i int) map[string]byte {
+	states := map[string]byte{}
+	for _, m := range c.nodes[i].Members() {
+		if m.ID != nodeInfo(i).ID {
+			states[m.ID] = m.State
+		}
+	}
+	return states
+}
+
+func TestSwim_Converge(t *testing.T) {
+	c := newCluster(t, 8)
+	c.run(10 * time.Second)
+
+	for i := range c.nodes {
+		view := c.view(i)
+		assert.Len(t, view, 7, "node %d", i)
+		for id, state := range view {
+			assert.Equal(t, payload.MemberAlive, state, "%s at node %d", id, i)
+		}
+	}
+}
+
+func TestSwim_DetectFailure(t *testing.T) {
+	c := newCluster(t, 8)
+	c.run(10 * time.Second)
+
+	c.down[nodeInfo(5).VirtualIP.IPv4()] = true
+	c.run(30 * time.Second)
+
+	for i := range c.nodes {
+		if i == 5 {
+			continue
+		}
+		view := c.view(i)
+		assert.Equal(t, payload.MemberDead, view["n5"], "node %d", i)
+		for id, state := range view {
+			if id != "n5" {
+				assert.Equal(t, payload.MemberAlive, state, "%s at node %d", id, i)
+			}
+		}
+	}
+}
+
+func TestSwim_IndirectProbe(t *testing.T) {
+	c := newCluster(t, 5)
+	c.run(5 * time.Second)
+
+	// n0 and n1 cannot talk to each other, the others ack for them
+	c.cutLink(0, 1)
+	c.run(30 * time.Second)
+
+	assert.Equal(t, payload.MemberAlive, c.view(0)["n1"])
+	assert.Equal(t, payload.MemberAlive, c.view(1)["n0"])
+}
+
+func TestSwim_RefuteSuspicion(t *testing.T) {
+	c := newCluster(t, 4)
+	c.run(5 * time.Second)
+
+	n0 := c.nodes[0]
+	n0.mu.Lock()
+	n0.apply(n0.members[nodeInfo(2).VirtualIP.IPv4()].update(payload.MemberSuspect), c.now)
+	n0.mu.Unlock()
+	c.run(10 * time.Second)
+
+	for i := range c.nodes {
+		if i != 2 {
+			assert.Equal(t, payload.MemberAlive, c.view(i)["n2"], "node %d", i)
+		}
+	}
+	assert.Positive(t, c.nodes[2].self.Incarnation)
+}
+
+func TestSwim_Leave(t *testing.T) {
+	c := newCluster(t, 4)
+	c.run(5 * time.Second)
+
+	// the leave messages are delivered, then the node is gone
+	c.nodes[3].leave()
+	c.run(100 * time.Millisecond)
+	c.down[nodeInfo(3).VirtualIP.IPv4()] = true
+	c.run(5 * time.Second)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, payload.MemberLeft, c.view(i)["n3"], "node %d", i)
+	}
+}
@@ -0,0 +1,97 @@
+// Package ratelimit implements token bucket rate limits and byte quotas for the data path.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket counting bytes, a zero rate means unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64 // bucket size in bytes
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate, burst uint64) *Bucket {
+	b := &Bucket{}
+	b.SetRate(rate, burst)
+	return b
+}
+
+// SetRate changes the rate and burst, burst defaults to one second of rate.
+func (b *Bucket) SetRate(rate, burst uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if burst == 0 {
+		burst = rate
+	}
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+	b.tokens = b.burst
+	b.last = time.Now()
+}
+
+func (b *Bucket) Rate() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return uint64(b.rate)
+}
+
+// Allow takes n tokens from the bucket, it returns false if there are not enough.
+func (b *Bucket) Allow(n int) bool {
+	return b.AllowAt(time.Now(), n)
+}
+
+func (b *Bucket) AllowAt(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.readyAt(now, n) {
+		return false
+	}
+	b.take(n)
+	return true
+}
+
+// ready is readyAt with the lock
+func (b *Bucket) ready(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.readyAt(now, n)
+}
+
+// consume is take with the lock
+func (b *Bucket) consume(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.take(n)
+}
+
+// readyAt refills the bucket and reports whether n tokens may be taken. A packet larger
+// than the burst passes once the bucket is full, b.mu must be held.
+func (b *Bucket) readyAt(now time.Time, n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	return b.tokens >= min(float64(n), b.burst)
+}
+
+// take removes n tokens, the bucket goes into debt for a packet larger than the burst.
+// b.mu must be held.
+func (b *Bucket) take(n int) {
+	if b.rate > 0 {
+		b.tokens -= float64(n)
+	}
+}
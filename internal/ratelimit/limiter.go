@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Direction byte
+
+const (
+	Ingress Direction = iota // overlay -> TUN
+	Egress                   // TUN -> overlay
+)
+
+type Period string
+
+const (
+	PeriodNone  Period = ""
+	PeriodDay   Period = "day"
+	PeriodMonth Period = "month"
+)
+
+// QuotaAction is applied to the traffic once the quota of a period is used up.
+type QuotaAction string
+
+const (
+	ActionBlock    QuotaAction = "block"
+	ActionThrottle QuotaAction = "throttle"
+)
+
+// Limit is the runtime configuration of a Limiter, zero values mean unlimited.
+type Limit struct {
+	IngressRate  uint64 `json:"ingress_rate,omitempty"` // bytes per second
+	IngressBurst uint64 `json:"ingress_burst,omitempty"`
+	EgressRate   uint64 `json:"egress_rate,omitempty"`
+	EgressBurst  uint64 `json:"egress_burst,omitempty"`
+
+	Quota        uint64      `json:"quota,omitempty"` // bytes per period, both directions
+	Period       Period      `json:"period,omitempty"`
+	Action       QuotaAction `json:"action,omitempty"`
+	ThrottleRate uint64      `json:"throttle_rate,omitempty"` // bytes per second once throttled
+}
+
+func (l *Limit) Validate() error {
+	switch l.Period {
+	case PeriodNone, PeriodDay, PeriodMonth:
+	default:
+		return fmt.Errorf("invalid quota period: %q", l.Period)
+	}
+	switch l.Action {
+	case "", ActionBlock:
+	case ActionThrottle:
+		if l.ThrottleRate == 0 {
+			return fmt.Errorf("throttle action needs a throttle rate")
+		}
+	default:
+		return fmt.Errorf("invalid quota action: %q", l.Action)
+	}
+	if l.Quota > 0 && l.Period == PeriodNone {
+		return fmt.Errorf("quota needs a period")
+	}
+	return nil
+}
+
+// Usage is the traffic accounted in the current quota period.
+type Usage struct {
+	RxBytes     uint64    `json:"rx_bytes"`
+	TxBytes     uint64    `json:"tx_bytes"`
+	PeriodStart time.Time `json:"period_start"`
+	Exceeded    bool      `json:"exceeded,omitempty"`
+}
+
+// Limiter enforces the Limit of one peer or network.
+type Limiter struct {
+	mu    sync.Mutex
+	limit Limit
+	usage Usage
+	// minBurst is the smallest bucket size, a packet of the MTU must fit
+	minBurst uint64
+	// lastUsed is the time of the last packet, idle limiters are evicted
+	lastUsed time.Time
+
+	buckets  [2]*Bucket
+	throttle *Bucket
+}
+
+func NewLimiter(limit Limit) *Limiter {
+	return newLimiter(limit, 0)
+}
+
+func newLimiter(limit Limit, minBurst uint64) *Limiter {
+	l := &Limiter{
+		minBurst: minBurst,
+		lastUsed: time.Now(),
+		buckets:  [2]*Bucket{NewBucket(0, 0), NewBucket(0, 0)},
+		throttle: NewBucket(0, 0),
+	}
+	l.SetLimit(limit)
+	return l
+}
+
+func (l *Limiter) SetLimit(limit Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	l.buckets[Ingress].SetRate(limit.IngressRate, l.burst(limit.IngressRate, limit.IngressBurst))
+	l.buckets[Egress].SetRate(limit.EgressRate, l.burst(limit.EgressRate, limit.EgressBurst))
+	l.throttle.SetRate(limit.ThrottleRate, l.burst(limit.ThrottleRate, 0))
+	l.usage.Exceeded = limit.Quota > 0 && l.usage.RxBytes+l.usage.TxBytes >= limit.Quota
+}
+
+// burst is the bucket size of rate, one second of rate by default and never below minBurst
+func (l *Limiter) burst(rate, burst uint64) uint64 {
+	if burst == 0 {
+		burst = rate
+	}
+	return max(burst, l.minBurst)
+}
+
+func (l *Limiter) Limit() Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *Limiter) Usage() Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.usage
+}
+
+// Allow accounts n bytes in the given direction, false means the packet must be dropped.
+func (l *Limiter) Allow(dir Direction, n int) bool {
+	return l.AllowAt(time.Now(), dir, n)
+}
+
+func (l *Limiter) AllowAt(now time.Time, dir Direction, n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.admit(now, dir, n) {
+		return false
+	}
+	l.account(dir, n)
+	return true
+}
+
+// admit reports whether n bytes pass the rate and quota without taking them, l.mu must
+// be held
+func (l *Limiter) admit(now time.Time, dir Direction, n int) bool {
+	l.rollover(now)
+	l.lastUsed = now
+
+	if l.usage.Exceeded {
+		if l.limit.Action != ActionThrottle || !l.throttle.ready(now, n) {
+			return false
+		}
+	}
+	return l.buckets[dir].ready(now, n)
+}
+
+// account takes n admitted bytes from the buckets and adds them to the usage, l.mu must
+// be held
+func (l *Limiter) account(dir Direction, n int) {
+	if l.usage.Exceeded {
+		l.throttle.consume(n)
+	}
+	l.buckets[dir].consume(n)
+
+	if dir == Ingress {
+		l.usage.RxBytes += uint64(n)
+	} else {
+		l.usage.TxBytes += uint64(n)
+	}
+	if l.limit.Quota > 0 && l.usage.RxBytes+l.usage.TxBytes >= l.limit.Quota {
+		l.usage.Exceeded = true
+	}
+}
+
+// rollover resets the usage when a new quota period begins.
+func (l *Limiter) rollover(now time.Time) {
+	start := periodStart(l.limit.Period, now)
+	if start.Equal(l.usage.PeriodStart) {
+		return
+	}
+	if l.limit.Period == PeriodNone && !l.usage.PeriodStart.IsZero() {
+		return
+	}
+	l.usage = Usage{PeriodStart: start}
+}
+
+func periodStart(period Period, now time.Time) time.Time {
+	y, m, d := now.Date()
+	switch period {
+	case PeriodDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	case PeriodMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	default:
+		return now
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Rate(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(Limit{EgressRate: 1000}, 1500)
+	l.buckets[Egress].last = now
+
+	// the burst is clamped to the MTU, a full packet passes
+	assert.True(t, l.AllowAt(now, Egress, 1500))
+	assert.False(t, l.AllowAt(now, Egress, 1))
+	// ingress is unlimited
+	assert.True(t, l.AllowAt(now, Ingress, 10000))
+	assert.True(t, l.AllowAt(now.Add(time.Second), Egress, 1000))
+	assert.False(t, l.AllowAt(now.Add(time.Second), Egress, 1))
+
+	// a packet larger than the burst passes once the bucket is full
+	now = now.Add(10 * time.Second)
+	assert.True(t, l.AllowAt(now, Egress, 4000))
+	assert.False(t, l.AllowAt(now.Add(time.Second), Egress, 100))
+	assert.True(t, l.AllowAt(now.Add(5*time.Second), Egress, 100))
+}
+
+func TestLimiter_Quota(t *testing.T) {
+	now := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(Limit{Quota: 1000, Period: PeriodDay})
+
+	assert.True(t, l.AllowAt(now, Ingress, 600))
+	assert.True(t, l.AllowAt(now, Egress, 400))
+	assert.True(t, l.Usage().Exceeded)
+	assert.False(t, l.AllowAt(now, Egress, 1))
+	assert.Equal(t, Usage{RxBytes: 600, TxBytes: 400, PeriodStart: time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC), Exceeded: true}, l.Usage())
+
+	// a new period starts over
+	assert.True(t, l.AllowAt(now.Add(12*time.Hour), Egress, 1))
+	assert.Equal(t, uint64(1), l.Usage().TxBytes)
+	assert.False(t, l.Usage().Exceeded)
+
+	// once exceeded the throttle rate applies instead of blocking
+	l.SetLimit(Limit{Quota: 1, Period: PeriodDay, Action: ActionThrottle, ThrottleRate: 100})
+	now = now.Add(12 * time.Hour)
+	l.throttle.last = now
+	assert.True(t, l.Usage().Exceeded)
+	assert.True(t, l.AllowAt(now, Egress, 100))
+	assert.False(t, l.AllowAt(now, Egress, 100))
+}
@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Registry holds the limiters of all peers and networks.
+// Every peer gets a limiter on first use so its usage is always accounted. The limiters of
+// a peer are kept per network, a node may be a peer in several networks of this node.
+type Registry struct {
+	mu       sync.RWMutex
+	peers    map[peerKey]*Limiter
+	networks map[string]*Limiter // network name -> Limiter
+
+	// minBurst is the smallest bucket size of the limiters, the MTU
+	minBurst uint64
+	// path of the state file, empty disables persistence
+	path string
+}
+
+// peerKey is the limiter key of a peer in a network
+type peerKey struct {
+	network string
+	id      string
+}
+
+// NewRegistry returns a registry persisted at path, the bursts of the limits are at least
+// mtu so that every packet can pass
+func NewRegistry(path string, mtu int) *Registry {
+	return &Registry{
+		peers:    map[peerKey]*Limiter{},
+		networks: map[string]*Limiter{},
+		minBurst: uint64(max(mtu, 0)),
+		path:     path,
+	}
+}
+
+// Allow checks the network and the peer limiter, the bytes are taken from both only if
+// both pass. An empty peerID is a source without a peer, only the network limits it.
+// The read lock is held until the bytes are taken, so Evict never drops a limiter which
+// is being charged.
+func (r *Registry) Allow(network, peerID string, dir Direction, n int) bool {
+	key := peerKey{network: network, id: peerID}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pl := r.peers[key]
+	for pl == nil && peerID != "" {
+		// the limiter is created under the write lock
+		r.mu.RUnlock()
+		r.peer(key)
+		r.mu.RLock()
+		pl = r.peers[key]
+	}
+	nl := r.networks[network]
+
+	// the network limiter is always locked first
+	now := time.Now()
+	limiters := make([]*Limiter, 0, 2)
+	for _, l := range []*Limiter{nl, pl} {
+		if l == nil {
+			continue
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !l.admit(now, dir, n) {
+			return false
+		}
+		limiters = append(limiters, l)
+	}
+	for _, l := range limiters {
+		l.account(dir, n)
+	}
+	return true
+}
+
+func (r *Registry) peer(key peerKey) *Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.peers[key]
+	if !ok {
+		l = newLimiter(Limit{}, r.minBurst)
+		r.peers[key] = l
+	}
+	return l
+}
+
+// Evict drops the limiters of the peers without a configured limit which were idle for
+// idle, e.g. of peers which are gone. Their usage is forgotten.
+func (r *Registry) Evict(idle time.Duration) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, l := range r.peers {
+		l.mu.Lock()
+		unused := l.limit == (Limit{}) && now.Sub(l.lastUsed) > idle
+		l.mu.Unlock()
+		if unused {
+			delete(r.peers, key)
+		}
+	}
+}
+
+// SetPeer limits the peer id in network, its limits in other networks are not changed
+func (r *Registry) SetPeer(network, id string, limit Limit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+	r.peer(peerKey{network: network, id: id}).SetLimit(limit)
+	return nil
+}
+
+func (r *Registry) SetNetwork(name string, limit Limit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.networks[name]; ok {
+		l.SetLimit(limit)
+	} else {
+		r.networks[name] = newLimiter(limit, r.minBurst)
+	}
+	return nil
+}
+
+// PeerUsage returns peer id -> Usage of the peers in network
+func (r *Registry) PeerUsage(network string) map[string]Usage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	usage := map[string]Usage{}
+	for key, l := range r.peers {
+		if key.network == network {
+			usage[key.id] = l.Usage()
+		}
+	}
+	return usage
+}
+
+type entry struct {
+	Limit Limit `json:"limit"`
+	Usage Usage `json:"usage"`
+}
+
+type state struct {
+	// Peers is network name -> peer id -> entry
+	Peers    map[string]map[string]entry `json:"network_peers"`
+	Networks map[string]entry            `json:"networks"`
+}
+
+// Load restores limits and usage from the state file, a missing file is not an error.
+func (r *Registry) Load() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var s state
+	if err = json.Unmarshal(data, &s); err != nil {
+		return errors.Join(errors.New("decode usage state error"), err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	restore := func(e entry) *Limiter {
+		l := newLimiter(e.Limit, r.minBurst)
+		l.usage = e.Usage
+		return l
+	}
+	for network, peers := range s.Peers {
+		for id, e := range peers {
+			r.peers[peerKey{network: network, id: id}] = restore(e)
+		}
+	}
+	for name, e := range s.Networks {
+		r.networks[name] = restore(e)
+	}
+	return nil
+}
+
+// Save writes limits and usage to the state file atomically.
+func (r *Registry) Save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	r.mu.RLock()
+	s := state{Peers: map[string]map[string]entry{}, Networks: map[string]entry{}}
+	for key, l := range r.peers {
+		if s.Peers[key.network] == nil {
+			s.Peers[key.network] = map[string]entry{}
+		}
+		s.Peers[key.network][key.id] = entry{Limit: l.Limit(), Usage: l.Usage()}
+	}
+	for k, l := range r.networks {
+		s.Networks[k] = entry{Limit: l.Limit(), Usage: l.Usage()}
+	}
+	r.mu.RUnlock()
+
+	data, err := json.MarshalIndent(&s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(r.path), 0o700); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Allow(t *testing.T) {
+	r := NewRegistry("", 100)
+	require.NoError(t, r.SetNetwork("default", Limit{EgressRate: 1000}))
+	require.NoError(t, r.SetPeer("default", "a", Limit{EgressRate: 100}))
+
+	assert.True(t, r.Allow("default", "a", Egress, 100))
+	// the peer limiter drops the packet, the network is not charged for it
+	assert.False(t, r.Allow("default", "a", Egress, 100))
+	assert.True(t, r.Allow("default", "b", Egress, 900))
+	assert.False(t, r.Allow("default", "b", Egress, 100))
+
+	usage := r.PeerUsage("default")
+	assert.Equal(t, uint64(100), usage["a"].TxBytes)
+	assert.Equal(t, uint64(900), usage["b"].TxBytes)
+
+	// sources without a peer only count for the network
+	assert.True(t, r.Allow("office", "", Ingress, 100))
+	assert.NotContains(t, r.PeerUsage("office"), "")
+}
+
+func TestRegistry_PeerPerNetwork(t *testing.T) {
+	r := NewRegistry("", 100)
+	require.NoError(t, r.SetPeer("office", "a", Limit{EgressRate: 100}))
+
+	// the limit of a peer in one network does not apply to it in another one
+	assert.True(t, r.Allow("office", "a", Egress, 100))
+	assert.False(t, r.Allow("office", "a", Egress, 100))
+	assert.True(t, r.Allow("home", "a", Egress, 1000))
+
+	assert.Equal(t, uint64(100), r.PeerUsage("office")["a"].TxBytes)
+	assert.Equal(t, uint64(1000), r.PeerUsage("home")["a"].TxBytes)
+}
+
+func TestRegistry_Evict(t *testing.T) {
+	r := NewRegistry("", 1500)
+	require.NoError(t, r.SetPeer("default", "limited", Limit{EgressRate: 100}))
+	assert.True(t, r.Allow("default", "gone", Egress, 100))
+	assert.True(t, r.Allow("default", "active", Egress, 100))
+
+	r.peers[peerKey{"default", "gone"}].lastUsed = time.Now().Add(-time.Hour)
+	r.peers[peerKey{"default", "limited"}].lastUsed = time.Now().Add(-time.Hour)
+	r.Evict(time.Minute)
+	usage := r.PeerUsage("default")
+	assert.NotContains(t, usage, "gone")
+	assert.Contains(t, usage, "active")
+	assert.Contains(t, usage, "limited")
+}
+
+func TestRegistry_EvictRace(t *testing.T) {
+	r := NewRegistry("", 1500)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			r.Allow("default", "a", Egress, 100)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			r.Evict(0)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestRegistry_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	r := NewRegistry(path, 1500)
+	require.NoError(t, r.SetPeer("default", "a", Limit{Quota: 1 << 20, Period: PeriodMonth}))
+	assert.True(t, r.Allow("default", "a", Ingress, 1000))
+	require.NoError(t, r.Save())
+
+	loaded := NewRegistry(path, 1500)
+	require.NoError(t, loaded.Load())
+	want, got := r.PeerUsage("default")["a"], loaded.PeerUsage("default")["a"]
+	assert.Equal(t, want.RxBytes, got.RxBytes)
+	assert.True(t, want.PeriodStart.Equal(got.PeriodStart))
+	assert.Equal(t, uint64(1<<20), loaded.peers[peerKey{"default", "a"}].Limit().Quota)
+}
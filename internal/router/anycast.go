@@ -0,0 +1,173 @@
+package router
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"math"
+	"sort"
+	"time"
+)
+
+const DefaultAnycastWeight = 100
+
+type AnycastClaimant struct {
+	ID      string `json:"id"`
+	VIP     string `json:"vip"`
+	Weight  uint16 `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	// Latency is the latency class of the claimant, the lowest one is preferred
+	Latency string `json:"latency"`
+}
+
+// AnycastService is an anycast VIP and the nodes claiming it
+type AnycastService struct {
+	VIP       string            `json:"vip"`
+	Local     bool              `json:"local"` // claimed by this node
+	Claimants []AnycastClaimant `json:"claimants"`
+}
+
+// WithAnycast claims an anycast service VIP on this node, weight 0 means DefaultAnycastWeight
+func WithAnycast(vip utils.IPv4, weight uint16) Option {
+	return func(r *Router) {
+		if weight == 0 {
+			weight = DefaultAnycastWeight
+		}
+		r.routes.addLocal(payload.Advert{
+			Kind:   payload.AdvertAnycast,
+			Prefix: utils.IPMask{vip[0], vip[1], vip[2], vip[3], 32},
+			Weight: weight,
+		})
+	}
+}
+
+// anycastTarget picks the claimant of the anycast destination dst for the flow of data.
+// The claimants of the lowest latency class win. Among them the claimant is chosen by
+// weighted rendezvous hashing of the 5-tuple, so a flow sticks to one claimant and only
+// moves when its claimant is withdrawn or the latency classes change.
+func (r *Router) anycastTarget(dst utils.IPv4, data []byte) (utils.IPv4, bool) {
+	claims := r.routes.claims(payload.AdvertAnycast, func(ad payload.Advert) bool {
+		return ad.Prefix.Contains(dst)
+	})
+
+	flow := flowHash(data)
+	var (
+		found     bool
+		best      utils.IPv4
+		bestClass peer.LatencyClass
+		bestScore float64
+	)
+	for vip, ad := range claims {
+		p := r.manager.GetPeer(vip)
+		if p == nil || p.State() != peer.STATE_HANDSHAKED || ad.Weight == 0 {
+			continue
+		}
+		class := latencyRank(p.RTT())
+		score := rendezvousScore(flow, vip, ad.Weight)
+		if !found || class < bestClass || class == bestClass && score > bestScore {
+			found, best, bestClass, bestScore = true, vip, class, score
+		}
+	}
+	return best, found
+}
+
+// latencyRank is the latency class of rtt for the claimant selection, a claimant which
+// was not measured yet counts as a WAN one
+func latencyRank(rtt time.Duration) peer.LatencyClass {
+	if class := peer.LatencyClassOf(rtt); class != peer.LatencyUnknown {
+		return class
+	}
+	return peer.LatencyWAN
+}
+
+// rendezvousScore is the weighted rendezvous hash of a flow on the claimant vip
+func rendezvousScore(flow uint64, vip utils.IPv4, weight uint16) float64 {
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.BigEndian, flow)
+	_, _ = h.Write(vip[:])
+	// uniform in (0, 1), the high bits of FNV barely depend on the last bytes
+	x := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(x)
+}
+
+// isLocalAnycast reports whether ip is an anycast VIP claimed by this node
+func (r *Router) isLocalAnycast(ip utils.IPv4) bool {
+	for _, ad := range r.routes.localAdverts() {
+		if ad.Kind == payload.AdvertAnycast && ad.Prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) healthy(vip utils.IPv4) bool {
+	p := r.manager.GetPeer(vip)
+	return p != nil && p.State() == peer.STATE_HANDSHAKED
+}
+
+// mix64 is the splitmix64 finalizer, every bit of x affects every bit of the result
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// flowHash hashes the 5-tuple of an IPv4 packet, ports are zero for other protocols
+func flowHash(data []byte) uint64 {
+	h := fnv.New64a()
+	ihl := ipv4HeaderSize(data)
+	if ihl == 0 {
+		_, _ = h.Write(data)
+		return h.Sum64()
+	}
+	_, _ = h.Write(data[12:20]) // src, dst
+	_, _ = h.Write(data[9:10])  // protocol
+	if proto := data[9]; (proto == protoTCP || proto == protoUDP) && len(data) >= ihl+4 && ipv4FragOffset(data) == 0 {
+		_, _ = h.Write(data[ihl : ihl+4]) // ports
+	}
+	return h.Sum64()
+}
+
+// AnycastServices lists the anycast VIPs claimed by this node or its peers
+func (r *Router) AnycastServices() []AnycastService {
+	services := map[utils.IPv4]*AnycastService{}
+	get := func(vip utils.IPv4) *AnycastService {
+		s, ok := services[vip]
+		if !ok {
+			s = &AnycastService{VIP: vip.String()}
+			services[vip] = s
+		}
+		return s
+	}
+
+	for _, ad := range r.routes.localAdverts() {
+		if ad.Kind == payload.AdvertAnycast {
+			get(utils.IPv4(ad.Prefix[:4])).Local = true
+		}
+	}
+	claims := r.routes.claimsAll(payload.AdvertAnycast)
+	for peerVIP, adverts := range claims {
+		c := AnycastClaimant{VIP: peerVIP.String(), Healthy: r.healthy(peerVIP)}
+		if p := r.manager.GetPeer(peerVIP); p != nil {
+			c.ID = p.ID
+			c.Latency = peer.LatencyClassOf(p.RTT()).String()
+		}
+		for _, ad := range adverts {
+			c.Weight = ad.Weight
+			s := get(utils.IPv4(ad.Prefix[:4]))
+			s.Claimants = append(s.Claimants, c)
+		}
+	}
+
+	res := make([]AnycastService, 0, len(services))
+	for _, s := range services {
+		sort.Slice(s.Claimants, func(i, j int) bool { return s.Claimants[i].VIP < s.Claimants[j].VIP })
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].VIP < res[j].VIP })
+	return res
+}
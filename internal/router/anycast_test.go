@@ -0,0 +1,167 @@
+package router
+
+import (
+	"fmt"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var anycastVIP = utils.IPv4{10, 0, 0, 100}
+
+// anycastAdvert claims anycastVIP with weight
+func anycastAdvert(weight uint16) payload.Advert {
+	return payload.Advert{Kind: payload.AdvertAnycast, Prefix: utils.IPMask{10, 0, 0, 100, 32}, Weight: weight}
+}
+
+// setRTT answers a ping of the peer at w sent rtt ago
+func (r *testRouter) setRTT(w *mockWriter, rtt time.Duration) {
+	stamp := payload.StringPayload(strconv.FormatInt(time.Now().Add(-rtt).UnixNano(), 10))
+	r.Input(w, packet.NewPacket(packet.TypePong, &stamp))
+}
+
+func TestAnycastTarget(t *testing.T) {
+	type claimant struct {
+		vip    utils.IPv4
+		weight uint16
+		rtt    time.Duration
+		// down claims without a handshaked peer
+		down bool
+	}
+	a, b := utils.IPv4{10, 0, 0, 2}, utils.IPv4{10, 0, 0, 3}
+
+	tests := []struct {
+		name      string
+		claimants []claimant
+		want      utils.IPv4
+		ok        bool
+	}{
+		{name: "single claimant", claimants: []claimant{{vip: a, weight: 100}}, want: a, ok: true},
+		{name: "unhealthy claimant skipped", claimants: []claimant{{vip: a, weight: 1}, {vip: b, weight: 1000, down: true}}, want: a, ok: true},
+		{name: "zero weight skipped", claimants: []claimant{{vip: a, weight: 0}, {vip: b, weight: 1}}, want: b, ok: true},
+		{name: "lower latency class wins", claimants: []claimant{
+			{vip: a, weight: 1, rtt: 100 * time.Millisecond},
+			{vip: b, weight: 1000, rtt: 300 * time.Millisecond}}, want: a, ok: true},
+		{name: "unmeasured counts as wan", claimants: []claimant{
+			{vip: a, weight: 1},
+			{vip: b, weight: 1000, rtt: 300 * time.Millisecond}}, want: a, ok: true},
+		{name: "no healthy claimant", claimants: []claimant{{vip: a, weight: 100, down: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t)
+			for _, c := range tt.claimants {
+				if !c.down {
+					w := r.addPeer(t, "peer"+c.vip.String(), c.vip.String()+"/24", "192.0.2."+strconv.Itoa(int(c.vip[3])))
+					if c.rtt > 0 {
+						r.setRTT(w, c.rtt)
+					}
+				}
+				r.routes.update(c.vip, []payload.Advert{anycastAdvert(c.weight)}, time.Now())
+			}
+
+			got, ok := r.anycastTarget(anycastVIP, udpPacket(utils.IPv4{10, 0, 0, 1}, anycastVIP, 64, 100))
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRendezvousScore(t *testing.T) {
+	weights := map[utils.IPv4]uint16{
+		{10, 0, 0, 2}: 100,
+		{10, 0, 0, 3}: 300,
+		{10, 0, 0, 4}: 100,
+	}
+	pick := func(flow uint64) utils.IPv4 {
+		var (
+			best      utils.IPv4
+			bestScore float64
+		)
+		for vip, weight := range weights {
+			if score := rendezvousScore(flow, vip, weight); score > bestScore || best == (utils.IPv4{}) {
+				best, bestScore = vip, score
+			}
+		}
+		return best
+	}
+
+	const flows = 5000
+	before := make([]utils.IPv4, flows)
+	count := map[utils.IPv4]int{}
+	for i := range flows {
+		before[i] = pick(uint64(i))
+		count[before[i]]++
+	}
+	// the flows split by weight although the claimants differ in the last byte only
+	assert.InDelta(t, 0.6, float64(count[utils.IPv4{10, 0, 0, 3}])/flows, 0.05)
+	assert.InDelta(t, 0.2, float64(count[utils.IPv4{10, 0, 0, 2}])/flows, 0.05)
+
+	// only the flows of a withdrawn claimant move
+	delete(weights, utils.IPv4{10, 0, 0, 4})
+	for i := range flows {
+		if before[i] != (utils.IPv4{10, 0, 0, 4}) {
+			assert.Equal(t, before[i], pick(uint64(i)))
+		}
+	}
+}
+
+func TestHandleAdvert(t *testing.T) {
+	r := newTestRouter(t)
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	unknown := newMockWriter("192.0.2.9")
+	a, b := utils.IPv4{10, 0, 0, 2}, utils.IPv4{10, 0, 0, 3}
+	r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+
+	tests := []struct {
+		name string
+		w    packet.Writer
+		src  utils.IPv4
+		want []utils.IPv4
+	}{
+		{name: "from the claimant", w: w2, src: a, want: []utils.IPv4{a}},
+		{name: "spoofed source", w: w2, src: b},
+		{name: "unknown sender", w: unknown, src: b},
+		{name: "no writer", src: a},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.routes = newRouteTable()
+			r.handleAdvert(tt.w, advertPacket(tt.src, anycastAdvert(100)))
+			var got []utils.IPv4
+			for vip := range r.routes.claimsAll(payload.AdvertAnycast) {
+				got = append(got, vip)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSyncRoutes_Anycast(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		hooks []string
+	)
+	r := newTestRouter(t, WithRouteHook(func(prefix *net.IPNet, add bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		hooks = append(hooks, fmt.Sprintf("%v %v", prefix, add))
+	}))
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+
+	// a VIP inside the overlay needs no route of its own
+	r.Input(w2, advertPacket(utils.IPv4{10, 0, 0, 2}, anycastAdvert(100),
+		payload.Advert{Kind: payload.AdvertAnycast, Prefix: utils.IPMask{10, 9, 9, 9, 32}, Weight: 100}))
+	r.Input(w2, advertPacket(utils.IPv4{10, 0, 0, 2}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"10.9.9.9/32 true", "10.9.9.9/32 false"}, hooks)
+}
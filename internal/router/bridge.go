@@ -0,0 +1,173 @@
+package router
+
+import (
+	"fmt"
+	"kevin-rd/my-tier/internal/ratelimit"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ethHeaderLen = 14
+	// macAgeing forgets a learned MAC address, the same as the Linux bridge default
+	macAgeing = 300 * time.Second
+)
+
+type MAC [6]byte
+
+func (m MAC) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+// isGroup reports whether m is a broadcast or multicast address
+func (m MAC) isGroup() bool {
+	return m[0]&0x01 != 0
+}
+
+// MACEntry is a learned MAC address and the peer it is reachable through
+type MACEntry struct {
+	MAC string `json:"mac"`
+	VIP string `json:"vip"`
+	ID  string `json:"id"`
+	Age int64  `json:"age"` // seconds since last seen
+}
+
+type macEntry struct {
+	vip  utils.IPv4
+	seen time.Time
+}
+
+// macTable is the forwarding table of TAP mode, it learns MAC addresses from the
+// source of the frames received from peers.
+type macTable struct {
+	mu      sync.RWMutex
+	entries map[MAC]macEntry
+}
+
+func newMACTable() *macTable {
+	return &macTable{entries: map[MAC]macEntry{}}
+}
+
+func (t *macTable) learn(mac MAC, vip utils.IPv4, now time.Time) {
+	if mac.isGroup() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.entries[mac]; ok && old.vip != vip {
+		log.Printf("[router] mac %v moved from %v to %v", mac, old.vip, vip)
+	}
+	t.entries[mac] = macEntry{vip: vip, seen: now}
+}
+
+func (t *macTable) lookup(mac MAC, now time.Time) (utils.IPv4, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, ok := t.entries[mac]
+	if !ok || now.Sub(e.seen) > macAgeing {
+		return utils.IPv4{}, false
+	}
+	return e.vip, true
+}
+
+// expire forgets the MAC addresses not seen within macAgeing
+func (t *macTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for mac, e := range t.entries {
+		if now.Sub(e.seen) > macAgeing {
+			delete(t.entries, mac)
+		}
+	}
+}
+
+// WithTAP switches the router to layer 2, TUN carries Ethernet frames instead of IP packets.
+func WithTAP() Option {
+	return func(r *Router) {
+		r.macs = newMACTable()
+	}
+}
+
+// outputFrame sends an Ethernet frame read from TAP to the peer which has learned its
+// destination. Broadcast, multicast and unknown unicast frames are flooded to every peer.
+func (r *Router) outputFrame(frame []byte) {
+	if len(frame) < ethHeaderLen {
+		return
+	}
+	dst := MAC(frame[0:6])
+
+	var targets []utils.IPv4
+	if !dst.isGroup() {
+		if vip, ok := r.macs.lookup(dst, time.Now()); ok && r.healthy(vip) {
+			targets = append(targets, vip)
+		}
+	}
+	self := r.selfVIP()
+	if len(targets) == 0 {
+		if !r.storm.allow(self) {
+			return
+		}
+		for _, p := range r.manager.GetPeers("") {
+			targets = append(targets, utils.IPv4(p.VirtualIP[:4]))
+		}
+	}
+
+	for _, target := range targets {
+		if target == self {
+			continue
+		}
+		buf := make([]byte, len(frame))
+		copy(buf, frame)
+		pkt := packet.NewPacket(packet.TypeFrame, &payload.DataPayload{Data: buf})
+		pkt.SrcVIP = self
+		pkt.DstVIP = target
+		if !r.allow(target, ratelimit.Egress, pkt) {
+			continue
+		}
+		if err := r.manager.Send(pkt); err != nil {
+			log.Printf("[router] output frame to %v error: %v", target, err)
+		}
+	}
+}
+
+// inputFrame learns the source MAC of a frame from a peer and writes it to TAP.
+// Frames are never relayed to other peers, the sender floods to everyone itself.
+func (r *Router) inputFrame(pkt *packet.Packet[packet.Packable]) {
+	data, ok := pkt.Payload.(*payload.DataPayload)
+	if !ok || r.macs == nil || len(data.Data) < ethHeaderLen {
+		return
+	}
+	if !r.allow(pkt.SrcVIP, ratelimit.Ingress, pkt) {
+		return
+	}
+	if MAC(data.Data[0:6]).isGroup() && !r.storm.allow(pkt.SrcVIP) {
+		return
+	}
+	r.macs.learn(MAC(data.Data[6:12]), pkt.SrcVIP, time.Now())
+	r.toTun(data.Data)
+}
+
+// MACTable lists the MAC addresses learned in TAP mode
+func (r *Router) MACTable() []MACEntry {
+	if r.macs == nil {
+		return nil
+	}
+	now := time.Now()
+	r.macs.mu.RLock()
+	res := make([]MACEntry, 0, len(r.macs.entries))
+	for mac, e := range r.macs.entries {
+		entry := MACEntry{MAC: mac.String(), VIP: e.vip.String(), Age: int64(now.Sub(e.seen) / time.Second)}
+		if p := r.manager.GetPeer(e.vip); p != nil {
+			entry.ID = p.ID
+		}
+		res = append(res, entry)
+	}
+	r.macs.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].MAC < res[j].MAC })
+	return res
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"sort"
+	"sync"
+)
+
+// icmpCodeAdminProhibited is sent to clients not allowed to use this exit node
+const icmpCodeAdminProhibited = 13
+
+// exitPolicy is the exit node configuration of a router.
+//
+// An exit node advertises 0.0.0.0/0 and forwards the traffic of allowed clients into TUN,
+// the kernel masquerades it to the internet. A client opts in to exactly one exit node,
+// the default route is accepted from that peer only.
+type exitPolicy struct {
+	mu sync.RWMutex
+
+	// this node is an exit node
+	enabled bool
+	// client peer id -> allowed, clients not in the map follow allowAll
+	clients  map[string]bool
+	allowAll bool
+
+	// peer id of the exit node used by this node, empty if none
+	via string
+}
+
+type ExitClient struct {
+	ID      string `json:"id"`
+	Allowed bool   `json:"allowed"`
+}
+
+type ExitNode struct {
+	ID       string `json:"id"`
+	VIP      string `json:"vip"`
+	Selected bool   `json:"selected"`
+	Healthy  bool   `json:"healthy"`
+}
+
+// ExitStatus is the exit node state of this node
+type ExitStatus struct {
+	Enabled  bool         `json:"enabled"`
+	AllowAll bool         `json:"allow_all"`
+	Clients  []ExitClient `json:"clients,omitempty"`
+	Via      string       `json:"via,omitempty"`
+	Nodes    []ExitNode   `json:"nodes,omitempty"`
+}
+
+// WithExitNode makes this node an exit node, only the listed client ids may use it.
+// An empty list allows every peer.
+func WithExitNode(allowed ...string) Option {
+	return func(r *Router) {
+		r.exit.enabled = true
+		r.exit.allowAll = len(allowed) == 0
+		for _, id := range allowed {
+			r.exit.clients[id] = true
+		}
+		r.routes.addLocal(payload.Advert{Kind: payload.AdvertExit})
+	}
+}
+
+// WithExitVia routes the traffic outside the overlay through the exit node with peer id
+func WithExitVia(id string) Option {
+	return func(r *Router) {
+		r.exit.via = id
+	}
+}
+
+func newExitPolicy() *exitPolicy {
+	return &exitPolicy{clients: map[string]bool{}}
+}
+
+func (e *exitPolicy) allowed(id string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.enabled {
+		return false
+	}
+	if allowed, ok := e.clients[id]; ok {
+		return allowed
+	}
+	return e.allowAll
+}
+
+// SetExitClient allows or denies a client of this exit node at runtime
+func (r *Router) SetExitClient(id string, allowed bool) {
+	r.exit.mu.Lock()
+	defer r.exit.mu.Unlock()
+	r.exit.clients[id] = allowed
+	log.Printf("[router] exit client %s allowed: %v", id, allowed)
+}
+
+// SetExitVia selects the exit node of this node by peer id, empty disables it
+func (r *Router) SetExitVia(id string) {
+	r.exit.mu.Lock()
+	defer r.exit.mu.Unlock()
+	r.exit.via = id
+	log.Printf("[router] exit via: %q", id)
+}
+
+// exitTarget returns the VIP of the selected exit node if it is healthy and advertises the default route
+func (r *Router) exitTarget() (utils.IPv4, bool) {
+	r.exit.mu.RLock()
+	via := r.exit.via
+	r.exit.mu.RUnlock()
+	if via == "" {
+		return utils.IPv4{}, false
+	}
+
+	for vip := range r.routes.claimsAll(payload.AdvertExit) {
+		p := r.manager.GetPeer(vip)
+		if p != nil && p.ID == via && r.healthy(vip) {
+			return vip, true
+		}
+	}
+	return utils.IPv4{}, false
+}
+
+// acceptExit checks whether a packet leaving the overlay through this node may pass. The
+// client is the peer at the remote address of w, clients which are not allowed get an ICMP
+// administratively prohibited.
+func (r *Router) acceptExit(w packet.Writer, data []byte) bool {
+	p := r.manager.PeerAt(w.RemoteAddr())
+	if p == nil {
+		return false
+	}
+	if r.exit.allowed(p.ID) {
+		return true
+	}
+	r.reply(p.VirtualIP.IPv4(), icmpError(data, r.selfVIP(), icmpDestUnreachable, icmpCodeAdminProhibited, 0))
+	return false
+}
+
+func (r *Router) ExitStatus() ExitStatus {
+	r.exit.mu.RLock()
+	status := ExitStatus{Enabled: r.exit.enabled, AllowAll: r.exit.allowAll, Via: r.exit.via}
+	for id, allowed := range r.exit.clients {
+		status.Clients = append(status.Clients, ExitClient{ID: id, Allowed: allowed})
+	}
+	r.exit.mu.RUnlock()
+
+	for vip := range r.routes.claimsAll(payload.AdvertExit) {
+		node := ExitNode{VIP: vip.String(), Healthy: r.healthy(vip)}
+		if p := r.manager.GetPeer(vip); p != nil {
+			node.ID = p.ID
+		}
+		node.Selected = node.ID != "" && node.ID == status.Via
+		status.Nodes = append(status.Nodes, node)
+	}
+	sort.Slice(status.Clients, func(i, j int) bool { return status.Clients[i].ID < status.Clients[j].ID })
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].VIP < status.Nodes[j].VIP })
+	return status
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var internetIP = utils.IPv4{8, 8, 8, 8}
+
+func TestExitPolicy_Allowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		clients map[string]bool
+		id      string
+		want    bool
+	}{
+		{name: "not an exit node", id: "peer2"},
+		{name: "empty list allows all", opts: []Option{WithExitNode()}, id: "peer2", want: true},
+		{name: "listed client", opts: []Option{WithExitNode("peer2")}, id: "peer2", want: true},
+		{name: "unlisted client", opts: []Option{WithExitNode("peer2")}, id: "peer3"},
+		{name: "denied at runtime", opts: []Option{WithExitNode()}, clients: map[string]bool{"peer2": false}, id: "peer2"},
+		{name: "allowed at runtime", opts: []Option{WithExitNode("peer2")}, clients: map[string]bool{"peer3": true}, id: "peer3", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(nil, nil, nil, tt.opts...)
+			for id, allowed := range tt.clients {
+				r.SetExitClient(id, allowed)
+			}
+			assert.Equal(t, tt.want, r.exit.allowed(tt.id))
+		})
+	}
+}
+
+func TestAcceptExit(t *testing.T) {
+	r := newTestRouter(t, WithExitNode("peer2"))
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	w3 := r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+
+	input := func(w *mockWriter, src utils.IPv4) {
+		pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: udpPacket(src, internetIP, 64, 100)})
+		pkt.SrcVIP, pkt.DstVIP = src, utils.IPv4{10, 0, 0, 1}
+		r.Input(w, pkt)
+	}
+
+	// a client which is not allowed is told so
+	input(w3, utils.IPv4{10, 0, 0, 3})
+	icmp := w3.waitData(t).Payload.(*payload.DataPayload).Data
+	assert.Equal(t, utils.IPv4{10, 0, 0, 3}, ipv4Dst(icmp))
+	assert.Equal(t, byte(icmpDestUnreachable), icmp[ipv4HeaderLen])
+	assert.Equal(t, byte(icmpCodeAdminProhibited), icmp[ipv4HeaderLen+1])
+
+	// an allowed one leaves through TUN
+	input(w2, utils.IPv4{10, 0, 0, 2})
+	got := r.readHost(t)
+	assert.Equal(t, internetIP, ipv4Dst(got))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, ipv4Src(got))
+}
+
+func TestAcceptExit_Spoofed(t *testing.T) {
+	r := newTestRouter(t, WithExitNode("peer2"))
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	w3 := r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+
+	input := func(w *mockWriter, src utils.IPv4, size int) {
+		pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: udpPacket(src, internetIP, 64, size)})
+		pkt.SrcVIP, pkt.DstVIP = src, utils.IPv4{10, 0, 0, 1}
+		r.Input(w, pkt)
+	}
+
+	// peer3 claims the VIP of the allowed client, the packet is dropped and nobody is answered
+	input(w3, utils.IPv4{10, 0, 0, 2}, 200)
+
+	// the next packet in TUN is the one of the real client
+	input(w2, utils.IPv4{10, 0, 0, 2}, 100)
+	got := r.readHost(t)
+	assert.Len(t, got, 100)
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, ipv4Src(got))
+
+	w2.mu.Lock()
+	defer w2.mu.Unlock()
+	w3.mu.Lock()
+	defer w3.mu.Unlock()
+	for _, pkt := range append(w2.pkts, w3.pkts...) {
+		assert.NotEqual(t, packet.TypeData, pkt.Type)
+	}
+}
+
+func TestExitTarget(t *testing.T) {
+	r := newTestRouter(t, WithExitVia("peer3"))
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	w3 := r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+	self := utils.IPv4{10, 0, 0, 1}
+
+	// the selected node does not advertise the default route yet
+	_, ok := r.exitTarget()
+	assert.False(t, ok)
+
+	r.Input(w2, advertPacket(utils.IPv4{10, 0, 0, 2}, payload.Advert{Kind: payload.AdvertExit}))
+	r.Input(w3, advertPacket(utils.IPv4{10, 0, 0, 3}, payload.Advert{Kind: payload.AdvertExit}))
+	require.NoError(t, r.host.WritePacket(udpPacket(self, internetIP, 64, 100)))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 3}, w3.waitData(t).DstVIP)
+
+	r.SetExitVia("")
+	require.NoError(t, r.host.WritePacket(udpPacket(self, internetIP, 64, 100)))
+	icmp := r.readHost(t)
+	assert.Equal(t, byte(icmpDestUnreachable), icmp[ipv4HeaderLen])
+}
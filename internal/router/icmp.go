@@ -0,0 +1,168 @@
+package router
+
+import (
+	"encoding/binary"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+)
+
+// ICMP and ICMPv6 error messages synthesized by the router
+const (
+	icmpDestUnreachable = 3
+	icmpTimeExceeded    = 11
+
+	icmpCodeNetUnreachable  = 0
+	icmpCodeHostUnreachable = 1
+	icmpCodeFragNeeded      = 4
+
+	icmp6DestUnreachable = 1
+	icmp6PacketTooBig    = 2
+	icmp6TimeExceeded    = 3
+
+	icmp6CodeNoRoute         = 0
+	icmp6CodeAddrUnreachable = 3
+
+	// an ICMP error never exceeds the minimum MTU, RFC 1812 and RFC 4443
+	icmpMaxLen  = 576
+	icmp6MaxLen = 1280
+)
+
+// icmpErrorAllowed reports whether an ICMP error may be sent about orig (RFC 1122, RFC 4443).
+// No errors are sent about ICMP errors, non-first fragments, broadcast or multicast packets.
+func icmpErrorAllowed(orig []byte) bool {
+	switch ipVersion(orig) {
+	case 4:
+		ihl := ipv4HeaderSize(orig)
+		if ihl == 0 || ipv4FragOffset(orig) != 0 {
+			return false
+		}
+		src, dst := ipv4Src(orig), ipv4Dst(orig)
+		if src == (utils.IPv4{}) || dst[0] >= 224 || src[0] >= 224 {
+			return false
+		}
+		if orig[9] == protoICMP && len(orig) > ihl {
+			// only echo request / reply and other queries, types 3,4,5,11,12 are errors
+			switch orig[ihl] {
+			case 3, 4, 5, 11, 12:
+				return false
+			}
+		}
+		return true
+	case 6:
+		if len(orig) < ipv6HeaderLen {
+			return false
+		}
+		src, dst := ipv6Src(orig), ipv6Dst(orig)
+		if src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() {
+			return false
+		}
+		if orig[6] == protoICMPv6 && len(orig) > ipv6HeaderLen && orig[ipv6HeaderLen] < 128 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// icmpError builds an ICMPv4 error from src about orig, mtu is set for Fragmentation Needed.
+func icmpError(orig []byte, src utils.IPv4, typ, code byte, mtu int) []byte {
+	if !icmpErrorAllowed(orig) || ipVersion(orig) != 4 {
+		return nil
+	}
+
+	body := orig
+	if max := icmpMaxLen - ipv4HeaderLen - 8; len(body) > max {
+		body = body[:max]
+	}
+	out := make([]byte, ipv4HeaderLen+8+len(body))
+
+	// IPv4 header
+	out[0] = 0x45
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+	out[8] = 64 // TTL
+	out[9] = protoICMP
+	copy(out[12:16], src[:])
+	copy(out[16:20], orig[12:16])
+	binary.BigEndian.PutUint16(out[10:12], checksum(out[:ipv4HeaderLen], 0))
+
+	// ICMP
+	msg := out[ipv4HeaderLen:]
+	msg[0] = typ
+	msg[1] = code
+	if typ == icmpDestUnreachable && code == icmpCodeFragNeeded {
+		binary.BigEndian.PutUint16(msg[6:8], uint16(mtu))
+	}
+	copy(msg[8:], body)
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg, 0))
+	return out
+}
+
+// icmp6Error builds an ICMPv6 error from src about orig, param is the MTU of Packet Too Big.
+func icmp6Error(orig []byte, src net.IP, typ, code byte, param uint32) []byte {
+	if !icmpErrorAllowed(orig) || ipVersion(orig) != 6 {
+		return nil
+	}
+
+	body := orig
+	if max := icmp6MaxLen - ipv6HeaderLen - 8; len(body) > max {
+		body = body[:max]
+	}
+	out := make([]byte, ipv6HeaderLen+8+len(body))
+
+	// IPv6 header
+	out[0] = 0x60
+	binary.BigEndian.PutUint16(out[4:6], uint16(8+len(body)))
+	out[6] = protoICMPv6
+	out[7] = 64 // hop limit
+	copy(out[8:24], src.To16())
+	copy(out[24:40], ipv6Src(orig))
+
+	// ICMPv6
+	msg := out[ipv6HeaderLen:]
+	msg[0] = typ
+	msg[1] = code
+	binary.BigEndian.PutUint32(msg[4:8], param)
+	copy(msg[8:], body)
+	sum := pseudoHeaderSum(out[8:24], out[24:40], protoICMPv6, len(msg))
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg, sum))
+	return out
+}
+
+// unreachable builds a Destination Unreachable about orig, code is chosen by whether
+// the destination belongs to the overlay network.
+func (r *Router) unreachable(orig []byte) []byte {
+	switch ipVersion(orig) {
+	case 4:
+		code := byte(icmpCodeNetUnreachable)
+		if r.inOverlay(ipv4Dst(orig)) {
+			code = icmpCodeHostUnreachable
+		}
+		return icmpError(orig, r.selfVIP(), icmpDestUnreachable, code, 0)
+	case 6:
+		// the overlay is IPv4 only, answer on behalf of the destination
+		return icmp6Error(orig, ipv6Dst(orig), icmp6DestUnreachable, icmp6CodeNoRoute, 0)
+	}
+	return nil
+}
+
+// tooBig builds Fragmentation Needed / Packet Too Big about orig with the overlay MTU.
+func (r *Router) tooBig(orig []byte) []byte {
+	switch ipVersion(orig) {
+	case 4:
+		return icmpError(orig, r.selfVIP(), icmpDestUnreachable, icmpCodeFragNeeded, r.mtu)
+	case 6:
+		return icmp6Error(orig, ipv6Dst(orig), icmp6PacketTooBig, 0, uint32(r.mtu))
+	}
+	return nil
+}
+
+// timeExceeded builds Time Exceeded about orig once its hop limit ran out in the overlay.
+func (r *Router) timeExceeded(orig []byte) []byte {
+	switch ipVersion(orig) {
+	case 4:
+		return icmpError(orig, r.selfVIP(), icmpTimeExceeded, 0, 0)
+	case 6:
+		return icmp6Error(orig, ipv6Dst(orig), icmp6TimeExceeded, 0, 0)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package router
+
+import (
+	"encoding/binary"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+)
+
+// IP header helpers for the raw packets read from and written to TUN
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+func ipVersion(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	return int(b[0] >> 4)
+}
+
+// ipv4HeaderSize returns the IPv4 header length (IHL) in bytes, 0 if b is not a valid IPv4 packet.
+func ipv4HeaderSize(b []byte) int {
+	if len(b) < ipv4HeaderLen || ipVersion(b) != 4 {
+		return 0
+	}
+	ihl := int(b[0]&0x0F) * 4
+	if ihl < ipv4HeaderLen || ihl > len(b) {
+		return 0
+	}
+	return ihl
+}
+
+func ipv4Src(b []byte) utils.IPv4 {
+	return utils.IPv4{b[12], b[13], b[14], b[15]}
+}
+
+func ipv4Dst(b []byte) utils.IPv4 {
+	return utils.IPv4{b[16], b[17], b[18], b[19]}
+}
+
+// ipv4DF reports whether the Don't Fragment flag is set
+func ipv4DF(b []byte) bool {
+	return b[6]&0x40 != 0
+}
+
+// ipv4FragOffset returns the fragment offset, non-first fragments have a non-zero offset
+func ipv4FragOffset(b []byte) int {
+	return int(binary.BigEndian.Uint16(b[6:8]) & 0x1FFF)
+}
+
+func ipv6Src(b []byte) net.IP {
+	return net.IP(b[8:24])
+}
+
+func ipv6Dst(b []byte) net.IP {
+	return net.IP(b[24:40])
+}
+
+// checksum computes the internet checksum of b, initial is a partial sum, e.g. a pseudo header.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum is the partial checksum of the TCP/UDP/ICMPv6 pseudo header.
+func pseudoHeaderSum(src, dst []byte, proto byte, length int) uint32 {
+	var sum uint32
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(addr); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(addr[i:]))
+		}
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// checksumUpdate updates checksum sum after a 16 bit word changed from old to new (RFC 1624).
+func checksumUpdate(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	for s > 0xFFFF {
+		s = (s >> 16) + (s & 0xFFFF)
+	}
+	return ^uint16(s)
+}
+
+// decrementTTL decrements the IPv4 TTL or the IPv6 hop limit in place,
+// it returns false if the packet must not be forwarded any more.
+func decrementTTL(b []byte) bool {
+	switch ipVersion(b) {
+	case 4:
+		if ipv4HeaderSize(b) == 0 || b[8] <= 1 {
+			return false
+		}
+		old := binary.BigEndian.Uint16(b[8:10])
+		b[8]--
+		sum := checksumUpdate(binary.BigEndian.Uint16(b[10:12]), old, binary.BigEndian.Uint16(b[8:10]))
+		binary.BigEndian.PutUint16(b[10:12], sum)
+		return true
+	case 6:
+		if len(b) < ipv6HeaderLen || b[7] <= 1 {
+			return false
+		}
+		b[7]--
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package router
+
+import "encoding/binary"
+
+const (
+	tcpHeaderLen = 20
+
+	tcpFlagSYN = 0x02
+
+	tcpOptEnd = 0
+	tcpOptNOP = 1
+	tcpOptMSS = 2
+)
+
+// clampMSS lowers the MSS option of a TCP SYN or SYN-ACK in place, so that
+// full sized segments fit into mtu. It returns true if the packet was changed.
+func clampMSS(b []byte, mtu int) bool {
+	var ihl, maxMSS int
+	switch ipVersion(b) {
+	case 4:
+		ihl = ipv4HeaderSize(b)
+		if ihl == 0 || b[9] != protoTCP || ipv4FragOffset(b) != 0 {
+			return false
+		}
+		maxMSS = mtu - ipv4HeaderLen - tcpHeaderLen
+	case 6:
+		// extension headers are not walked, SYNs rarely carry them
+		if len(b) < ipv6HeaderLen || b[6] != protoTCP {
+			return false
+		}
+		ihl = ipv6HeaderLen
+		maxMSS = mtu - ipv6HeaderLen - tcpHeaderLen
+	default:
+		return false
+	}
+
+	tcp := b[ihl:]
+	if len(tcp) < tcpHeaderLen || tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff < tcpHeaderLen || dataOff > len(tcp) {
+		return false
+	}
+
+	opts := tcp[tcpHeaderLen:dataOff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case tcpOptEnd:
+			return false
+		case tcpOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return false
+		}
+		if opts[i] == tcpOptMSS && opts[i+1] == 4 {
+			mss := int(binary.BigEndian.Uint16(opts[i+2:]))
+			if mss <= maxMSS {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[i+2:], uint16(maxMSS))
+			fixTCPChecksum(b, ihl)
+			return true
+		}
+		i += int(opts[i+1])
+	}
+	return false
+}
+
+// fixTCPChecksum recomputes the TCP checksum of the packet
+func fixTCPChecksum(b []byte, ihl int) {
+	tcp := b[ihl:]
+	var src, dst []byte
+	if ipVersion(b) == 4 {
+		src, dst = b[12:16], b[16:20]
+		// the IPv4 total length may be shorter than the buffer
+		if total := int(binary.BigEndian.Uint16(b[2:4])); total >= ihl && total <= len(b) {
+			tcp = b[ihl:total]
+		}
+	} else {
+		src, dst = b[8:24], b[24:40]
+		if total := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6])); total <= len(b) {
+			tcp = b[ihl:total]
+		}
+	}
+	tcp[16], tcp[17] = 0, 0
+	sum := checksum(tcp, pseudoHeaderSum(src, dst, protoTCP, len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:18], sum)
+}
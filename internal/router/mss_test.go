@@ -0,0 +1,74 @@
+package router
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const tcpFlagACK = 0x10
+
+// tcpPacket builds an IPv4 TCP segment with the options opts and valid checksums
+func tcpPacket(flags byte, opts ...byte) []byte {
+	size := ipv4HeaderLen + tcpHeaderLen + len(opts)
+	b := make([]byte, size)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(size))
+	b[8] = 64
+	b[9] = protoTCP
+	copy(b[12:16], []byte{10, 0, 0, 1})
+	copy(b[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20], 0))
+	tcp := b[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	tcp[12] = byte((tcpHeaderLen+len(opts))/4) << 4
+	tcp[13] = flags
+	copy(tcp[tcpHeaderLen:], opts)
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(tcp, pseudoHeaderSum(b[12:16], b[16:20], protoTCP, len(tcp))))
+	return b
+}
+
+// mssOpt is the MSS option of mss
+func mssOpt(mss uint16) []byte {
+	return []byte{tcpOptMSS, 4, byte(mss >> 8), byte(mss)}
+}
+
+func tcpChecksumValid(b []byte) bool {
+	tcp := b[ipv4HeaderLen:]
+	return checksum(tcp, pseudoHeaderSum(b[12:16], b[16:20], protoTCP, len(tcp))) == 0
+}
+
+func TestClampMSS(t *testing.T) {
+	const mtu = 1400
+	// NOP, NOP, window scale and SACK permitted before the MSS
+	prefix := []byte{tcpOptNOP, tcpOptNOP, 3, 3, 7, 4, 2, tcpOptNOP}
+
+	tests := []struct {
+		name    string
+		pkt     []byte
+		changed bool
+		mss     uint16
+		offset  int
+	}{
+		{name: "syn", pkt: tcpPacket(tcpFlagSYN, mssOpt(1460)...), changed: true, mss: 1360},
+		{name: "syn-ack", pkt: tcpPacket(tcpFlagSYN|tcpFlagACK, mssOpt(1460)...), changed: true, mss: 1360},
+		{name: "ack", pkt: tcpPacket(tcpFlagACK, mssOpt(1460)...), mss: 1460},
+		{name: "below the clamp", pkt: tcpPacket(tcpFlagSYN, mssOpt(1200)...), mss: 1200},
+		{name: "non-zero offset", pkt: tcpPacket(tcpFlagSYN, append(prefix, mssOpt(1460)...)...), changed: true, mss: 1360, offset: len(prefix)},
+		// the MSS option runs past the end of the header
+		{name: "truncated", pkt: tcpPacket(tcpFlagSYN, tcpOptNOP, tcpOptNOP, tcpOptNOP, tcpOptNOP, tcpOptNOP, tcpOptNOP, tcpOptMSS, 4)},
+		{name: "after end of options", pkt: tcpPacket(tcpFlagSYN, append([]byte{tcpOptEnd, 0, 0, 0}, mssOpt(1460)...)...), mss: 1460, offset: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.changed, clampMSS(tt.pkt, mtu))
+			assert.True(t, tcpChecksumValid(tt.pkt))
+			if tt.mss != 0 {
+				opt := tt.pkt[ipv4HeaderLen+tcpHeaderLen+tt.offset:]
+				assert.Equal(t, tt.mss, binary.BigEndian.Uint16(opt[2:4]))
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package router
+
+import (
+	"encoding/binary"
+	"kevin-rd/my-tier/internal/ratelimit"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	protoIGMP = 2
+
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+
+	// IGMPv3 group record types, RFC 3376 4.2.12
+	igmpModeIsInclude   = 1
+	igmpModeIsExclude   = 2
+	igmpChangeToInclude = 3
+	igmpChangeToExclude = 4
+	igmpAllowNewSources = 5
+	igmpBlockOldSources = 6
+
+	igmpQueryType = 0x11
+	// igmpQueryResponse is the max response time of the queries, 10s in 1/10 seconds
+	igmpQueryResponse = 100
+	igmpRobustness    = 2
+	// igmpQueryInterval RFC 3376 8.2
+	igmpQueryInterval = 125 * time.Second
+	// groupMembershipInterval RFC 3376 8.4
+	groupMembershipInterval = igmpRobustness*igmpQueryInterval + igmpQueryResponse*time.Second/10
+
+	// stormIdle drops the storm control bucket of a source idle for that long
+	stormIdle = time.Minute
+
+	// DefaultBroadcastRate packets per second of broadcast and multicast per source
+	DefaultBroadcastRate = 200
+)
+
+func isMulticast(ip utils.IPv4) bool {
+	return ip[0]&0xF0 == 0xE0
+}
+
+// isLinkLocalMulticast 224.0.0.0/24 is never snooped, e.g. mDNS 224.0.0.251
+func isLinkLocalMulticast(ip utils.IPv4) bool {
+	return ip[0] == 224 && ip[1] == 0 && ip[2] == 0
+}
+
+// isBroadcast reports whether ip is the limited broadcast or the overlay subnet broadcast
+func (r *Router) isBroadcast(ip utils.IPv4) bool {
+	if ip == (utils.IPv4{255, 255, 255, 255}) {
+		return true
+	}
+	vip := r.manager.VirtualIP
+	bits := int(vip[4])
+	if bits >= 31 || !vip.Contains(ip) {
+		return false
+	}
+	host := binary.BigEndian.Uint32(ip[:]) & (1<<(32-bits) - 1)
+	return host == 1<<(32-bits)-1
+}
+
+// membership is the IGMPv3 state of a member of a group. An INCLUDE membership receives
+// from its sources only, an EXCLUDE one from every source, its excluded sources are not kept.
+type membership struct {
+	expiry  time.Time
+	exclude bool
+	sources map[utils.IPv4]struct{}
+}
+
+// groupTable is the IGMP snooping membership table, group -> member peer -> membership.
+// Only IPv4 groups are snooped, there is no MLD snooping of IPv6 groups.
+type groupTable struct {
+	mu     sync.Mutex
+	groups map[utils.IPv4]map[utils.IPv4]*membership
+}
+
+func newGroupTable() *groupTable {
+	return &groupTable{groups: map[utils.IPv4]map[utils.IPv4]*membership{}}
+}
+
+// get returns the membership of member in group, it is created if create is set.
+// t.mu must be held.
+func (t *groupTable) get(group, member utils.IPv4, create bool) *membership {
+	m, ok := t.groups[group][member]
+	if ok || !create {
+		return m
+	}
+	if t.groups[group] == nil {
+		t.groups[group] = map[utils.IPv4]*membership{}
+	}
+	m = &membership{sources: map[utils.IPv4]struct{}{}}
+	t.groups[group][member] = m
+	return m
+}
+
+// join subscribes member to every source of group, IGMPv1/v2 reports and EXCLUDE records
+func (t *groupTable) join(group, member utils.IPv4, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.get(group, member, true)
+	m.exclude = true
+	clear(m.sources)
+	m.expiry = now.Add(groupMembershipInterval)
+}
+
+// include subscribes member to the sources of group only, no sources is a leave
+func (t *groupTable) include(group, member utils.IPv4, sources []utils.IPv4, now time.Time) {
+	if len(sources) == 0 {
+		t.leave(group, member)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.get(group, member, true)
+	m.exclude = false
+	clear(m.sources)
+	for _, src := range sources {
+		m.sources[src] = struct{}{}
+	}
+	m.expiry = now.Add(groupMembershipInterval)
+}
+
+// allow adds sources to the membership of member, an EXCLUDE membership receives them already
+func (t *groupTable) allow(group, member utils.IPv4, sources []utils.IPv4, now time.Time) {
+	if len(sources) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.get(group, member, true)
+	if !m.exclude {
+		for _, src := range sources {
+			m.sources[src] = struct{}{}
+		}
+	}
+	m.expiry = now.Add(groupMembershipInterval)
+}
+
+// block removes sources from an INCLUDE membership, without sources left member leaves.
+// Blocked sources of an EXCLUDE membership are not filtered, it does not refresh it.
+func (t *groupTable) block(group, member utils.IPv4, sources []utils.IPv4) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.get(group, member, false)
+	if m == nil || m.exclude {
+		return
+	}
+	for _, src := range sources {
+		delete(m.sources, src)
+	}
+	if len(m.sources) == 0 {
+		t.remove(group, member)
+	}
+}
+
+func (t *groupTable) leave(group, member utils.IPv4) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(group, member)
+}
+
+// remove drops the membership, t.mu must be held
+func (t *groupTable) remove(group, member utils.IPv4) {
+	delete(t.groups[group], member)
+	if len(t.groups[group]) == 0 {
+		delete(t.groups, group)
+	}
+}
+
+// members returns the peers receiving group from src, known is false if nobody reported
+// the group. Expired memberships are removed.
+func (t *groupTable) members(group, src utils.IPv4, now time.Time) (members []utils.IPv4, known bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for member, m := range t.groups[group] {
+		if now.After(m.expiry) {
+			t.remove(group, member)
+			continue
+		}
+		known = true
+		if _, ok := m.sources[src]; m.exclude || ok {
+			members = append(members, member)
+		}
+	}
+	return members, known
+}
+
+// expire drops the memberships which were not reported within groupMembershipInterval
+func (t *groupTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for group, ms := range t.groups {
+		for member, m := range ms {
+			if now.After(m.expiry) {
+				t.remove(group, member)
+			}
+		}
+	}
+}
+
+// snoop learns group membership of member from an IGMP report or leave in data
+func (t *groupTable) snoop(member utils.IPv4, data []byte, now time.Time) {
+	ihl := ipv4HeaderSize(data)
+	if ihl == 0 || data[9] != protoIGMP || len(data) < ihl+8 {
+		return
+	}
+	igmp := data[ihl:]
+	group := utils.IPv4(igmp[4:8])
+
+	switch igmp[0] {
+	case igmpV1Report, igmpV2Report:
+		t.join(group, member, now)
+	case igmpV2Leave:
+		t.leave(group, member)
+	case igmpV3Report:
+		n := int(binary.BigEndian.Uint16(igmp[6:8]))
+		rec := igmp[8:]
+		for i := 0; i < n && len(rec) >= 8; i++ {
+			typ, auxLen, nSrc := rec[0], int(rec[1]), int(binary.BigEndian.Uint16(rec[2:4]))
+			size := 8 + nSrc*4 + auxLen*4
+			if size > len(rec) {
+				return
+			}
+			group = utils.IPv4(rec[4:8])
+			sources := make([]utils.IPv4, nSrc)
+			for j := range sources {
+				sources[j] = utils.IPv4(rec[8+j*4 : 12+j*4])
+			}
+
+			switch typ {
+			case igmpModeIsInclude, igmpChangeToInclude:
+				t.include(group, member, sources, now)
+			case igmpModeIsExclude, igmpChangeToExclude:
+				t.join(group, member, now)
+			case igmpAllowNewSources:
+				t.allow(group, member, sources, now)
+			case igmpBlockOldSources:
+				t.block(group, member, sources)
+			}
+			rec = rec[size:]
+		}
+	}
+}
+
+// igmpQuery is an IGMPv3 general query to 224.0.0.1 with the router alert option. Its
+// source is 0.0.0.0 like the one of a snooping switch (RFC 4541 2.1.1), the kernel
+// refuses its own address as source.
+func igmpQuery() []byte {
+	const ihl = ipv4HeaderLen + 4
+	b := make([]byte, ihl+12)
+	b[0] = 0x40 | ihl/4
+	b[1] = 0xC0 // internetwork control
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 1
+	b[9] = protoIGMP
+	copy(b[16:20], []byte{224, 0, 0, 1})
+	copy(b[20:24], []byte{0x94, 0x04, 0, 0})
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:ihl], 0))
+
+	igmp := b[ihl:]
+	igmp[0] = igmpQueryType
+	igmp[1] = igmpQueryResponse
+	igmp[8] = igmpRobustness
+	igmp[9] = byte(igmpQueryInterval / time.Second)
+	binary.BigEndian.PutUint16(igmp[2:4], checksum(igmp, 0))
+	return b
+}
+
+// queryGroups asks the hosts behind TUN for their memberships, they answer with reports
+// which are flooded to the peers. Without a querier the hosts report only once on join.
+func (r *Router) queryGroups(now time.Time) {
+	if r.macs != nil || now.Sub(r.lastQuery) < igmpQueryInterval {
+		return
+	}
+	r.lastQuery = now
+	r.toTun(igmpQuery())
+}
+
+// stormSource is the bucket of a source of broadcast and multicast packets
+type stormSource struct {
+	bucket   *ratelimit.Bucket
+	lastUsed time.Time
+}
+
+// stormControl limits broadcast and multicast packets per source
+type stormControl struct {
+	mu      sync.Mutex
+	rate    uint64
+	buckets map[utils.IPv4]*stormSource
+}
+
+func newStormControl(rate uint64) *stormControl {
+	return &stormControl{rate: rate, buckets: map[utils.IPv4]*stormSource{}}
+}
+
+func (s *stormControl) allow(src utils.IPv4) bool {
+	return s.allowAt(src, time.Now())
+}
+
+func (s *stormControl) allowAt(src utils.IPv4, now time.Time) bool {
+	s.mu.Lock()
+	b, ok := s.buckets[src]
+	if !ok {
+		b = &stormSource{bucket: ratelimit.NewBucket(s.rate, 2*s.rate)}
+		s.buckets[src] = b
+	}
+	b.lastUsed = now
+	s.mu.Unlock()
+	return b.bucket.AllowAt(now, 1)
+}
+
+// prune drops the buckets of the sources idle for stormIdle, their buckets are full again
+func (s *stormControl) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for src, b := range s.buckets {
+		if now.Sub(b.lastUsed) > stormIdle {
+			delete(s.buckets, src)
+		}
+	}
+}
+
+// fanOut delivers a broadcast or multicast packet from TUN to every peer in the network,
+// or only to the subscribed peers of a snooped multicast group.
+func (r *Router) fanOut(data []byte, dst utils.IPv4) {
+	self := r.selfVIP()
+	if !r.storm.allow(self) {
+		return
+	}
+
+	var targets []utils.IPv4
+	known := false
+	// IGMP reports are flooded so every peer can snoop them
+	if isMulticast(dst) && !isLinkLocalMulticast(dst) && data[9] != protoIGMP {
+		targets, known = r.groups.members(dst, ipv4Src(data), time.Now())
+	}
+	if !known {
+		// broadcast, link-local or unregistered multicast is flooded
+		for _, p := range r.manager.GetPeers("") {
+			targets = append(targets, utils.IPv4(p.VirtualIP[:4]))
+		}
+	}
+
+	for _, target := range targets {
+		if target == self {
+			continue
+		}
+		buf := make([]byte, len(data))
+		copy(buf, data)
+		pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: buf})
+		pkt.SrcVIP = self
+		pkt.DstVIP = target
+		if !r.allow(target, ratelimit.Egress, pkt) {
+			continue
+		}
+		if err := r.manager.Send(pkt); err != nil {
+			log.Printf("[router] fan out to %v error: %v", target, err)
+		}
+	}
+}
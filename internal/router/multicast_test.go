@@ -0,0 +1,138 @@
+package router
+
+import (
+	"encoding/binary"
+	"kevin-rd/my-tier/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type igmpRecord struct {
+	typ     byte
+	group   utils.IPv4
+	sources []utils.IPv4
+}
+
+// igmpReport builds an IGMPv3 membership report with the records
+func igmpReport(records ...igmpRecord) []byte {
+	igmp := make([]byte, 8)
+	igmp[0] = igmpV3Report
+	binary.BigEndian.PutUint16(igmp[6:8], uint16(len(records)))
+	for _, rec := range records {
+		igmp = append(igmp, rec.typ, 0, 0, byte(len(rec.sources)))
+		igmp = append(igmp, rec.group[:]...)
+		for _, src := range rec.sources {
+			igmp = append(igmp, src[:]...)
+		}
+	}
+	b := make([]byte, ipv4HeaderLen, ipv4HeaderLen+len(igmp))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(ipv4HeaderLen+len(igmp)))
+	b[8] = 1
+	b[9] = protoIGMP
+	copy(b[16:20], []byte{224, 0, 0, 22})
+	return append(b, igmp...)
+}
+
+func TestGroupTable_Snoop(t *testing.T) {
+	now := time.Now()
+	group := utils.IPv4{239, 1, 1, 1}
+	a, b := utils.IPv4{10, 0, 0, 2}, utils.IPv4{10, 0, 0, 3}
+	src1, src2 := utils.IPv4{10, 0, 0, 9}, utils.IPv4{10, 0, 0, 8}
+
+	tests := []struct {
+		name    string
+		records []igmpRecord
+		src     utils.IPv4
+		members []utils.IPv4
+		known   bool
+	}{
+		{name: "exclude joins every source", records: []igmpRecord{{typ: igmpChangeToExclude, group: group}},
+			src: src1, members: []utils.IPv4{a}, known: true},
+		{name: "include filters sources", records: []igmpRecord{{typ: igmpChangeToInclude, group: group, sources: []utils.IPv4{src1}}},
+			src: src2, known: true},
+		{name: "allow adds a source", records: []igmpRecord{
+			{typ: igmpChangeToInclude, group: group, sources: []utils.IPv4{src1}},
+			{typ: igmpAllowNewSources, group: group, sources: []utils.IPv4{src2}}},
+			src: src2, members: []utils.IPv4{a}, known: true},
+		{name: "block does not join", records: []igmpRecord{{typ: igmpBlockOldSources, group: group, sources: []utils.IPv4{src1}}},
+			src: src1},
+		{name: "block of the last source leaves", records: []igmpRecord{
+			{typ: igmpModeIsInclude, group: group, sources: []utils.IPv4{src1}},
+			{typ: igmpBlockOldSources, group: group, sources: []utils.IPv4{src1}}},
+			src: src1},
+		{name: "block keeps an exclude membership", records: []igmpRecord{
+			{typ: igmpModeIsExclude, group: group},
+			{typ: igmpBlockOldSources, group: group, sources: []utils.IPv4{src1}}},
+			src: src2, members: []utils.IPv4{a}, known: true},
+		{name: "empty include leaves", records: []igmpRecord{
+			{typ: igmpModeIsExclude, group: group},
+			{typ: igmpChangeToInclude, group: group}},
+			src: src1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGroupTable()
+			g.snoop(a, igmpReport(tt.records...), now)
+			members, known := g.members(group, tt.src, now)
+			assert.Equal(t, tt.members, members)
+			assert.Equal(t, tt.known, known)
+		})
+	}
+
+	// a truncated record is ignored
+	g := newGroupTable()
+	report := igmpReport(igmpRecord{typ: igmpModeIsInclude, group: group, sources: []utils.IPv4{src1, src2}})
+	g.snoop(b, report[:len(report)-4], now)
+	_, known := g.members(group, src1, now)
+	assert.False(t, known)
+
+	// memberships expire without reports
+	g.snoop(b, igmpReport(igmpRecord{typ: igmpModeIsExclude, group: group}), now)
+	g.expire(now.Add(groupMembershipInterval + time.Second))
+	assert.Empty(t, g.groups)
+}
+
+func TestStormControl(t *testing.T) {
+	now := time.Now()
+	s := newStormControl(10)
+	src := utils.IPv4{10, 0, 0, 2}
+
+	allowed := 0
+	for range 50 {
+		if s.allowAt(src, now) {
+			allowed++
+		}
+	}
+	// the burst is two seconds of rate
+	assert.LessOrEqual(t, allowed, 21)
+	assert.GreaterOrEqual(t, allowed, 20)
+
+	s.prune(now.Add(stormIdle / 2))
+	assert.Len(t, s.buckets, 1)
+	s.prune(now.Add(2 * stormIdle))
+	assert.Empty(t, s.buckets)
+}
+
+func TestQueryGroups(t *testing.T) {
+	r := newTestRouter(t)
+	now := time.Now()
+	r.queryGroups(now)
+
+	q := r.readHost(t)
+	require.Len(t, q, ipv4HeaderLen+4+12)
+	assert.Equal(t, uint16(0), checksum(q[:ipv4HeaderSize(q)], 0))
+	assert.Equal(t, utils.IPv4{224, 0, 0, 1}, ipv4Dst(q))
+	igmp := q[ipv4HeaderSize(q):]
+	assert.Equal(t, byte(igmpQueryType), igmp[0])
+	assert.Equal(t, uint16(0), checksum(igmp, 0))
+
+	// the next query is due after the query interval
+	r.queryGroups(now.Add(time.Second))
+	assert.Equal(t, now, r.lastQuery)
+	r.queryGroups(now.Add(igmpQueryInterval))
+	assert.Equal(t, now.Add(igmpQueryInterval), r.lastQuery)
+}
@@ -0,0 +1,179 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"strings"
+)
+
+// NATRule maps the prefix of a remote network 1:1 to a locally chosen prefix of the same size,
+// so overlapping virtual subnets can reach each other without renumbering.
+//
+// Packets to Local are sent to Remote, packets from Remote are delivered as from Local.
+type NATRule struct {
+	Network string
+	Remote  *net.IPNet
+	Local   *net.IPNet
+}
+
+// ParseNATRule parses "[network:]remote=local", e.g. "office:192.168.100.0/24=10.200.0.0/24"
+func ParseNATRule(s string) (NATRule, error) {
+	var rule NATRule
+	if network, rest, ok := strings.Cut(s, ":"); ok {
+		rule.Network, s = network, rest
+	}
+	remote, local, ok := strings.Cut(s, "=")
+	if !ok {
+		return rule, fmt.Errorf("invalid nat rule %q, want remote=local", s)
+	}
+
+	var err error
+	if _, rule.Remote, err = net.ParseCIDR(remote); err != nil {
+		return rule, fmt.Errorf("invalid nat remote prefix: %w", err)
+	}
+	if _, rule.Local, err = net.ParseCIDR(local); err != nil {
+		return rule, fmt.Errorf("invalid nat local prefix: %w", err)
+	}
+	if rule.Remote.IP.To4() == nil || rule.Local.IP.To4() == nil {
+		return rule, fmt.Errorf("only IPv4 nat rules are supported")
+	}
+	rOnes, _ := rule.Remote.Mask.Size()
+	lOnes, _ := rule.Local.Mask.Size()
+	if rOnes != lOnes {
+		return rule, fmt.Errorf("nat prefixes differ in size: /%d and /%d", rOnes, lOnes)
+	}
+	return rule, nil
+}
+
+// WithNAT adds 1:1 NAT rules, the rules of other networks than the one of the router are
+// ignored, see WithNetwork
+func WithNAT(rules ...NATRule) Option {
+	return func(r *Router) {
+		r.nat = append(r.nat, rules...)
+	}
+}
+
+// appliesTo reports whether the rule translates the packets of network, a rule without a
+// network applies to any
+func (rule NATRule) appliesTo(network string) bool {
+	return rule.Network == "" || rule.Network == network
+}
+
+// translate moves the host part of ip from prefix `from` into prefix `to`
+func translate(ip utils.IPv4, from, to *net.IPNet) (utils.IPv4, bool) {
+	if !from.Contains(net.IP(ip[:])) {
+		return ip, false
+	}
+	mask := binary.BigEndian.Uint32(from.Mask)
+	host := binary.BigEndian.Uint32(ip[:]) &^ mask
+	var res utils.IPv4
+	binary.BigEndian.PutUint32(res[:], binary.BigEndian.Uint32(to.IP.To4())&mask|host)
+	return res, true
+}
+
+// natToRemote rewrites the destination of a packet from TUN from a local to a remote prefix.
+// The rules are the ones of the network of the router, so the remote prefix resolves to the
+// peers of that network even if it overlaps another network of this node.
+func (r *Router) natToRemote(data []byte) {
+	if len(r.nat) == 0 || ipv4HeaderSize(data) == 0 {
+		return
+	}
+	for _, rule := range r.nat {
+		if !rule.appliesTo(r.network) {
+			continue
+		}
+		if addr, ok := translate(ipv4Dst(data), rule.Local, rule.Remote); ok {
+			natRewrite(data, 16, addr)
+			// the packet quoted by an ICMP error was sent by the remote peer
+			natRewriteQuoted(data, 12, rule.Local, rule.Remote)
+			return
+		}
+	}
+}
+
+// natToLocal rewrites the source of a packet from a peer from a remote to a local prefix.
+func (r *Router) natToLocal(data []byte) {
+	if len(r.nat) == 0 || ipv4HeaderSize(data) == 0 {
+		return
+	}
+	for _, rule := range r.nat {
+		if !rule.appliesTo(r.network) {
+			continue
+		}
+		if addr, ok := translate(ipv4Src(data), rule.Remote, rule.Local); ok {
+			natRewrite(data, 12, addr)
+			natRewriteQuoted(data, 16, rule.Remote, rule.Local)
+			return
+		}
+	}
+}
+
+// natRewrite replaces the IPv4 address at off (12 source, 16 destination) and
+// updates the IP, TCP and UDP checksums incrementally.
+func natRewrite(b []byte, off int, addr utils.IPv4) {
+	ihl := ipv4HeaderSize(b)
+	if ihl == 0 {
+		return
+	}
+
+	old := [2]uint16{binary.BigEndian.Uint16(b[off:]), binary.BigEndian.Uint16(b[off+2:])}
+	copy(b[off:off+4], addr[:])
+	update := func(sumOff int) {
+		sum := binary.BigEndian.Uint16(b[sumOff:])
+		for i := 0; i < 2; i++ {
+			sum = checksumUpdate(sum, old[i], binary.BigEndian.Uint16(b[off+2*i:]))
+		}
+		binary.BigEndian.PutUint16(b[sumOff:], sum)
+	}
+	update(10)
+
+	if ipv4FragOffset(b) != 0 {
+		return
+	}
+	switch b[9] {
+	case protoTCP:
+		if len(b) >= ihl+tcpHeaderLen {
+			update(ihl + 16)
+		}
+	case protoUDP:
+		// a zero UDP checksum means no checksum
+		if len(b) >= ihl+8 && binary.BigEndian.Uint16(b[ihl+6:]) != 0 {
+			update(ihl + 6)
+			if binary.BigEndian.Uint16(b[ihl+6:]) == 0 {
+				binary.BigEndian.PutUint16(b[ihl+6:], 0xFFFF)
+			}
+		}
+	}
+}
+
+// natRewriteQuoted translates the address at off of the packet quoted by an ICMP error,
+// the ICMP checksum is recomputed.
+func natRewriteQuoted(b []byte, off int, from, to *net.IPNet) {
+	ihl := ipv4HeaderSize(b)
+	if ihl == 0 || b[9] != protoICMP || len(b) < ihl+8 {
+		return
+	}
+	switch b[ihl] {
+	case icmpDestUnreachable, icmpTimeExceeded, 4, 5, 12:
+	default:
+		return
+	}
+
+	icmp := b[ihl:]
+	inner := icmp[8:]
+	if ipv4HeaderSize(inner) == 0 {
+		return
+	}
+	addr, ok := translate(utils.IPv4(inner[off:off+4]), from, to)
+	if !ok {
+		return
+	}
+	copy(inner[off:off+4], addr[:])
+	inner[10], inner[11] = 0, 0
+	binary.BigEndian.PutUint16(inner[10:12], checksum(inner[:ipv4HeaderSize(inner)], 0))
+
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+}
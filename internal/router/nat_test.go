@@ -0,0 +1,171 @@
+package router
+
+import (
+	"encoding/binary"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustNATRule(t *testing.T, s string) NATRule {
+	t.Helper()
+	rule, err := ParseNATRule(s)
+	require.NoError(t, err)
+	return rule
+}
+
+// udpPacket builds an IPv4 UDP packet with valid checksums
+func udpPacket(src, dst utils.IPv4, ttl byte, size int) []byte {
+	b := make([]byte, size)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(size))
+	b[6] = 0x40 // DF
+	b[8] = ttl
+	b[9] = protoUDP
+	copy(b[12:16], src[:])
+	copy(b[16:20], dst[:])
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20], 0))
+	udp := b[20:]
+	binary.BigEndian.PutUint16(udp[0:2], 40000)
+	binary.BigEndian.PutUint16(udp[2:4], 53)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	binary.BigEndian.PutUint16(udp[6:8], checksum(udp, pseudoHeaderSum(b[12:16], b[16:20], protoUDP, len(udp))))
+	return b
+}
+
+func udpChecksumValid(b []byte) bool {
+	udp := b[ipv4HeaderLen:]
+	return checksum(udp, pseudoHeaderSum(b[12:16], b[16:20], protoUDP, len(udp))) == 0
+}
+
+func TestParseNATRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		remote  string
+		local   string
+		err     string
+	}{
+		{in: "192.168.100.0/24=10.200.0.0/24", remote: "192.168.100.0/24", local: "10.200.0.0/24"},
+		{in: "office:192.168.100.0/24=10.200.0.0/24", network: "office", remote: "192.168.100.0/24", local: "10.200.0.0/24"},
+		{in: "192.168.100.0/24", err: "want remote=local"},
+		{in: "192.168.100.0/24=10.200.0.0/16", err: "differ in size"},
+		{in: "192.168.100.0/24=10.200.0.0", err: "invalid nat local prefix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			rule, err := ParseNATRule(tt.in)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.network, rule.Network)
+			assert.Equal(t, tt.remote, rule.Remote.String())
+			assert.Equal(t, tt.local, rule.Local.String())
+		})
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	_, from, _ := net.ParseCIDR("192.168.100.0/24")
+	_, to, _ := net.ParseCIDR("10.200.0.0/24")
+
+	got, ok := translate(utils.IPv4{192, 168, 100, 5}, from, to)
+	assert.True(t, ok)
+	assert.Equal(t, utils.IPv4{10, 200, 0, 5}, got)
+
+	got, ok = translate(utils.IPv4{192, 168, 101, 5}, from, to)
+	assert.False(t, ok)
+	assert.Equal(t, utils.IPv4{192, 168, 101, 5}, got)
+}
+
+func TestNATRewrite(t *testing.T) {
+	addr := utils.IPv4{10, 200, 0, 5}
+	tests := []struct {
+		name  string
+		pkt   []byte
+		off   int
+		valid func([]byte) bool
+	}{
+		{name: "udp destination", pkt: udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{192, 168, 100, 5}, 64, 100), off: 16, valid: udpChecksumValid},
+		{name: "udp source", pkt: udpPacket(utils.IPv4{192, 168, 100, 5}, utils.IPv4{10, 0, 0, 1}, 64, 100), off: 12, valid: udpChecksumValid},
+		{name: "tcp destination", pkt: tcpPacket(tcpFlagACK), off: 16, valid: tcpChecksumValid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			natRewrite(tt.pkt, tt.off, addr)
+			assert.Equal(t, addr[:], tt.pkt[tt.off:tt.off+4])
+			assert.Zero(t, checksum(tt.pkt[:ipv4HeaderLen], 0))
+			assert.True(t, tt.valid(tt.pkt))
+		})
+	}
+
+	// a zero UDP checksum is not computed
+	pkt := udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{192, 168, 100, 5}, 64, 100)
+	pkt[ipv4HeaderLen+6], pkt[ipv4HeaderLen+7] = 0, 0
+	natRewrite(pkt, 16, addr)
+	assert.Zero(t, binary.BigEndian.Uint16(pkt[ipv4HeaderLen+6:]))
+	assert.Zero(t, checksum(pkt[:ipv4HeaderLen], 0))
+}
+
+func TestNATRewriteQuoted(t *testing.T) {
+	_, remote, _ := net.ParseCIDR("192.168.100.0/24")
+	_, local, _ := net.ParseCIDR("10.200.0.0/24")
+	// the remote host answers a packet this node sent to its translated address
+	sent := udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{192, 168, 100, 5}, 64, 100)
+	pkt := icmpError(sent, utils.IPv4{192, 168, 100, 5}, icmpDestUnreachable, icmpCodeHostUnreachable, 0)
+
+	natRewrite(pkt, 12, utils.IPv4{10, 200, 0, 5})
+	natRewriteQuoted(pkt, 16, remote, local)
+
+	icmp := pkt[ipv4HeaderLen:]
+	inner := icmp[8:]
+	assert.Equal(t, utils.IPv4{10, 200, 0, 5}, ipv4Src(pkt))
+	assert.Equal(t, utils.IPv4{10, 200, 0, 5}, ipv4Dst(inner))
+	assert.Zero(t, checksum(pkt[:ipv4HeaderLen], 0))
+	assert.Zero(t, checksum(inner[:ipv4HeaderLen], 0))
+	assert.Zero(t, checksum(icmp, 0))
+
+	// no error quotes in other ICMP messages
+	echo := icmpError(sent, utils.IPv4{192, 168, 100, 5}, icmpDestUnreachable, icmpCodeHostUnreachable, 0)
+	echo[ipv4HeaderLen] = 0
+	before := append([]byte(nil), echo...)
+	natRewriteQuoted(echo, 16, remote, local)
+	assert.Equal(t, before, echo)
+}
+
+func TestNAT_Network(t *testing.T) {
+	r := newTestRouter(t, WithNetwork("office"), WithNAT(
+		mustNATRule(t, "office:10.0.0.0/24=10.200.0.0/24"),
+		mustNATRule(t, "home:10.0.0.0/24=10.201.0.0/24"),
+	))
+	w := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	self := utils.IPv4{10, 0, 0, 1}
+
+	// the rule of the network translates to the remote peer
+	require.NoError(t, r.host.WritePacket(udpPacket(self, utils.IPv4{10, 200, 0, 2}, 64, 100)))
+	pkt := w.waitData(t)
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, pkt.DstVIP)
+	data := pkt.Payload.(*payload.DataPayload).Data
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, ipv4Dst(data))
+	assert.True(t, udpChecksumValid(data))
+
+	// the rule of another network does not
+	require.NoError(t, r.host.WritePacket(udpPacket(self, utils.IPv4{10, 201, 0, 2}, 64, 100)))
+	icmp := r.readHost(t)
+	assert.Equal(t, byte(icmpDestUnreachable), icmp[ipv4HeaderLen])
+
+	// the replies come from the local prefix
+	in := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: udpPacket(utils.IPv4{10, 0, 0, 2}, self, 64, 100)})
+	in.SrcVIP, in.DstVIP = utils.IPv4{10, 0, 0, 2}, self
+	r.Input(w, in)
+	got := r.readHost(t)
+	assert.Equal(t, utils.IPv4{10, 200, 0, 2}, ipv4Src(got))
+	assert.True(t, udpChecksumValid(got))
+}
@@ -1,48 +1,320 @@
 package router
 
 import (
+	"errors"
 	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/ratelimit"
 	"kevin-rd/my-tier/internal/tun"
 	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
 	"log"
+	"time"
 )
 
-type Router struct {
-	// buffer
-	outputCh chan *packet.Packet[packet.Packable]
+// DefaultMTU is the overlay MTU, it leaves room for the outer IP/UDP and packet headers
+const DefaultMTU = 1420
 
-	tun     *tun.TunDevice
+type Router struct {
+	tun     tun.Device
 	manager *peer.Manager
+	limits  *ratelimit.Registry
+	// network is the name of the network, its limits apply to all the peers
+	network string
+
+	mtu int
+	// mssClamp rewrites the MSS of TCP SYNs crossing TUN to fit mtu
+	mssClamp bool
+
+	// broadcast and multicast
+	groups *groupTable
+	storm  *stormControl
+	// lastQuery is the time of the last IGMP query into TUN, only used by Run
+	lastQuery time.Time
+
+	// routes claimed by this node and advertised by peers
+	routes *routeTable
+	// subnets and anycast VIPs of peers installed in the kernel
+	subnets *subnetRoutes
+
+	// 1:1 NAT of overlapping remote networks
+	nat []NATRule
+
+	exit *exitPolicy
+
+	// macs is the forwarding table of TAP mode, nil in TUN mode
+	macs *macTable
+}
+
+type Option func(*Router)
+
+func WithMTU(mtu int) Option {
+	return func(r *Router) {
+		if mtu > 0 {
+			r.mtu = mtu
+		}
+	}
+}
+
+// WithNetwork names the network of the router for the network limits
+func WithNetwork(name string) Option {
+	return func(r *Router) {
+		r.network = name
+	}
+}
+
+func WithMSSClamp(enable bool) Option {
+	return func(r *Router) {
+		r.mssClamp = enable
+	}
+}
+
+// WithBroadcastRate limits broadcast and multicast packets per second of every source
+func WithBroadcastRate(pps uint64) Option {
+	return func(r *Router) {
+		r.storm = newStormControl(pps)
+	}
 }
 
-func NewRouter(tun *tun.TunDevice, manager *peer.Manager) *Router {
-	return &Router{
-		outputCh: make(chan *packet.Packet[packet.Packable], 1024),
+func NewRouter(tun tun.Device, manager *peer.Manager, limits *ratelimit.Registry, opts ...Option) *Router {
+	r := &Router{
 		tun:      tun,
 		manager:  manager,
+		limits:   limits,
+		mtu:      DefaultMTU,
+		mssClamp: true,
+		groups:   newGroupTable(),
+		storm:    newStormControl(DefaultBroadcastRate),
+		routes:   newRouteTable(),
+		subnets:  newSubnetRoutes(),
+		exit:     newExitPolicy(),
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
-func (r *Router) Output(pkt *packet.Packet[packet.Packable]) {
+// Output sends an IP packet read from TUN, or an Ethernet frame in TAP mode, to its peer through the peer send queues.
+// Packets which can not be delivered are answered with an ICMP error into TUN.
+func (r *Router) Output(data []byte) {
+	if r.macs != nil {
+		r.outputFrame(data)
+		return
+	}
+
+	var dst utils.IPv4
+	switch ipVersion(data) {
+	case 4:
+		if ipv4HeaderSize(data) == 0 {
+			return
+		}
+		if len(data) > r.mtu && ipv4DF(data) {
+			r.toTun(r.tooBig(data))
+			return
+		}
+		dst = ipv4Dst(data)
+	case 6:
+		if len(data) < ipv6HeaderLen {
+			return
+		}
+		if len(data) > r.mtu {
+			r.toTun(r.tooBig(data))
+			return
+		}
+		// no IPv6 peers in the overlay
+		r.toTun(r.unreachable(data))
+		return
+	default:
+		return
+	}
+
+	if r.isBroadcast(dst) || isMulticast(dst) {
+		r.fanOut(data, dst)
+		return
+	}
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	if r.mssClamp {
+		clampMSS(buf, r.mtu)
+	}
+	r.natToRemote(buf)
+	dst = ipv4Dst(buf)
+
+	pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: buf})
+	pkt.SrcVIP = r.selfVIP()
+	pkt.DstVIP = dst
+	if target, ok := r.anycastTarget(dst, data); ok {
+		pkt.DstVIP = target
+	} else if !r.inOverlay(dst) && r.manager.GetPeer(dst) == nil {
+		if target, ok = r.subnetTarget(dst); ok {
+			pkt.DstVIP = target
+		} else if target, ok = r.exitTarget(); ok {
+			// default route through the exit node
+			pkt.DstVIP = target
+		}
+	}
 
+	if pkt.DstVIP == pkt.SrcVIP || r.manager.GetPeer(pkt.DstVIP) == nil {
+		r.toTun(r.unreachable(data))
+		return
+	}
+	if !r.allow(pkt.DstVIP, ratelimit.Egress, pkt) {
+		return
+	}
+	if err := r.manager.Send(pkt); err != nil {
+		if errors.Is(err, peer.ErrNoPeer) {
+			r.toTun(r.unreachable(data))
+			return
+		}
+		log.Printf("[router] output to %v error: %v", pkt.DstVIP, err)
+	}
 }
 
 func (r *Router) Input(w packet.Writer, pkt *packet.Packet[packet.Packable]) {
-	// todo
-	log.Printf("[router] input packet: %v", pkt.Type)
+	// any packet keeps the sending peer alive
+	if w != nil {
+		r.manager.Seen(w.RemoteAddr())
+	}
 	switch pkt.Type {
 	case packet.TypeData:
+		data, ok := pkt.Payload.(*payload.DataPayload)
+		if !ok || !r.fromSource(w, pkt) {
+			return
+		}
 		// 1. 是否转发
-		// 2. 转发到其他节点
+		if pkt.DstVIP != r.selfVIP() && pkt.DstVIP != (utils.IPv4{}) {
+			// 2. 转发到其他节点
+			r.forward(pkt, data)
+			return
+		}
 		// 3. 转发到本地
-		r.toTun(pkt)
+		if !r.allow(pkt.SrcVIP, ratelimit.Ingress, pkt) {
+			return
+		}
+		if ipv4HeaderSize(data.Data) > 0 {
+			dst := ipv4Dst(data.Data)
+			switch {
+			case r.isBroadcast(dst) || isMulticast(dst):
+				if !r.storm.allow(pkt.SrcVIP) {
+					return
+				}
+				r.groups.snoop(pkt.SrcVIP, data.Data, time.Now())
+			case dst != r.selfVIP() && !r.inOverlay(dst) && !r.isLocalAnycast(dst) && !r.isLocalSubnet(dst):
+				// leaving the overlay, this node is the exit node
+				if !r.acceptExit(w, data.Data) {
+					return
+				}
+			}
+		}
+		if r.mssClamp {
+			clampMSS(data.Data, r.mtu)
+		}
+		r.natToLocal(data.Data)
+		r.toTun(data.Data)
+	case packet.TypeFrame:
+		if r.fromSource(w, pkt) {
+			r.inputFrame(pkt)
+		}
+	case packet.TypeRouteAdvert:
+		r.handleAdvert(w, pkt)
+	case packet.TypeGossip:
+		// every protocol period, too frequent to log
+		r.manager.HandlePacket(w, pkt)
 	default:
+		log.Printf("[router] input packet: %v", pkt.Type)
 		r.manager.HandlePacket(w, pkt)
 	}
 }
 
-func (r *Router) toTun(pkt *packet.Packet[packet.Packable]) {
-	if err := r.tun.WritePacket(pkt); err != nil {
+// fromSource reports whether the source VIP of pkt is the one of the peer at the remote
+// address of w. The source VIP is set by the sender, a packet claiming another peer as its
+// source is dropped before it is delivered, forwarded or let out through the exit node.
+func (r *Router) fromSource(w packet.Writer, pkt *packet.Packet[packet.Packable]) bool {
+	if w == nil {
+		return false
+	}
+	p := r.manager.PeerAt(w.RemoteAddr())
+	if p == nil {
+		log.Printf("[router] packet of %v from unknown peer %v dropped", pkt.SrcVIP, w.RemoteAddr())
+		return false
+	}
+	if vip := p.VirtualIP.IPv4(); pkt.SrcVIP != vip {
+		log.Printf("[router] packet of %v sent by %s %v dropped", pkt.SrcVIP, p.ID, vip)
+		return false
+	}
+	return true
+}
+
+// forward relays a data packet to another peer, the inner hop limit is decremented
+// and Time Exceeded is sent back to the source once it runs out.
+func (r *Router) forward(pkt *packet.Packet[packet.Packable], data *payload.DataPayload) {
+	if !decrementTTL(data.Data) {
+		r.reply(pkt.SrcVIP, r.timeExceeded(data.Data))
+		return
+	}
+	if err := r.manager.Send(pkt); err != nil {
+		if errors.Is(err, peer.ErrNoPeer) {
+			r.reply(pkt.SrcVIP, r.unreachable(data.Data))
+			return
+		}
+		log.Printf("[router] forward to %v error: %v", pkt.DstVIP, err)
+	}
+}
+
+// reply sends an ICMP error generated by this node back to a remote peer.
+func (r *Router) reply(dst utils.IPv4, icmp []byte) {
+	if icmp == nil {
+		return
+	}
+	pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: icmp})
+	pkt.SrcVIP = r.selfVIP()
+	pkt.DstVIP = dst
+	if err := r.manager.Send(pkt); err != nil {
+		log.Printf("[router] send icmp to %v error: %v", dst, err)
+	}
+}
+
+func (r *Router) toTun(data []byte) {
+	if r.tun == nil || data == nil {
+		return
+	}
+	if err := r.tun.WritePacket(data); err != nil {
 		log.Println("[router] TUN write error:", err)
 	}
 }
+
+// Flush writes the packets TUN holds back for coalescing, it is called after a batch of Input
+func (r *Router) Flush() {
+	f, ok := r.tun.(tun.Flusher)
+	if !ok {
+		return
+	}
+	if err := f.Flush(); err != nil {
+		log.Println("[router] TUN flush error:", err)
+	}
+}
+
+func (r *Router) selfVIP() utils.IPv4 {
+	vip := r.manager.VirtualIP
+	return utils.IPv4(vip[:4])
+}
+
+// inOverlay reports whether ip belongs to the virtual network of this node
+func (r *Router) inOverlay(ip utils.IPv4) bool {
+	return r.manager.VirtualIP.Contains(ip)
+}
+
+// allow applies the rate limits and quotas of the remote peer, the packet is dropped if false.
+func (r *Router) allow(remote utils.IPv4, dir ratelimit.Direction, pkt *packet.Packet[packet.Packable]) bool {
+	if r.limits == nil {
+		return true
+	}
+	// a source without a peer, e.g. a spoofed one, gets no limiter of its own
+	var id string
+	if p := r.manager.GetPeer(remote); p != nil {
+		id = p.ID
+	}
+	return r.limits.Allow(r.network, id, dir, pkt.Payload.Length())
+}
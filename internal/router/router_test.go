@@ -0,0 +1,297 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/tun"
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockWriter records the packets sent to a peer
+type mockWriter struct {
+	mu   sync.Mutex
+	addr net.Addr
+	pkts []*packet.Packet[packet.Packable]
+	sent chan struct{}
+}
+
+func newMockWriter(addr string) *mockWriter {
+	return &mockWriter{
+		addr: &net.UDPAddr{IP: net.ParseIP(addr), Port: 6780},
+		sent: make(chan struct{}, 64),
+	}
+}
+
+func (w *mockWriter) Write(pkt []byte) (int, error) {
+	p := &packet.Packet[packet.Packable]{}
+	if err := p.Decode(pkt); err != nil {
+		return 0, err
+	}
+	return len(pkt), w.record(p)
+}
+
+func (w *mockWriter) WriteP(pkt *packet.Packet[packet.Packable]) (int, error) {
+	return 0, w.record(pkt)
+}
+
+func (w *mockWriter) WritePayload(typ byte, payload packet.Packable) (int, error) {
+	return w.WriteP(packet.NewPacket(typ, payload))
+}
+
+func (w *mockWriter) RemoteAddr() net.Addr { return w.addr }
+func (w *mockWriter) GetConn() net.Conn    { return nil }
+
+func (w *mockWriter) record(pkt *packet.Packet[packet.Packable]) error {
+	w.mu.Lock()
+	w.pkts = append(w.pkts, pkt)
+	w.mu.Unlock()
+	w.sent <- struct{}{}
+	return nil
+}
+
+// waitData waits for the next data packet sent to the peer
+func (w *mockWriter) waitData(t *testing.T) *packet.Packet[packet.Packable] {
+	t.Helper()
+	return w.wait(t, packet.TypeData)
+}
+
+// waitFrame waits for the next Ethernet frame sent to the peer
+func (w *mockWriter) waitFrame(t *testing.T) *packet.Packet[packet.Packable] {
+	t.Helper()
+	return w.wait(t, packet.TypeFrame)
+}
+
+func (w *mockWriter) wait(t *testing.T, typ byte) *packet.Packet[packet.Packable] {
+	t.Helper()
+	for {
+		select {
+		case <-w.sent:
+			w.mu.Lock()
+			pkt := w.pkts[len(w.pkts)-1]
+			w.mu.Unlock()
+			if pkt.Type == typ {
+				return pkt
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for packet type %d", typ)
+		}
+	}
+}
+
+type testRouter struct {
+	*Router
+	manager *peer.Manager
+	host    *tun.Pipe
+}
+
+func newTestRouter(t *testing.T, opts ...Option) *testRouter {
+	t.Helper()
+	dev, host := tun.NewPipe("sky0", 1420)
+	m := peer.NewManager("self", utils.Must2IPMask("10.0.0.1/24"))
+	go func() { _ = m.Manage() }()
+
+	r := NewRouter(dev, m, nil, opts...)
+	go func() { _ = tun.Run(dev, r.Output) }()
+
+	t.Cleanup(func() {
+		m.Stop()
+		_ = dev.Close()
+	})
+	return &testRouter{Router: r, manager: m, host: host}
+}
+
+// addPeer handshakes a remote peer with the given VIP
+func (r *testRouter) addPeer(t *testing.T, id, vip, addr string) *mockWriter {
+	t.Helper()
+	w := newMockWriter(addr)
+	var idBytes [32]byte
+	copy(idBytes[:], id)
+	r.Input(w, packet.NewPacket(packet.TypeHandshakeInit, &payload.HandshakeInitPayload{
+		ID:        idBytes,
+		VirtualIP: utils.Must2IPMask(vip),
+	}))
+	w.wait(t, packet.TypeHandshakeReply)
+	r.Input(w, packet.NewPacket(packet.TypeHandshakeFinalize, new(payload.StringPayload)))
+	require.NotNil(t, r.manager.GetPeer(utils.Must2IPMask(vip).IPv4()))
+	return w
+}
+
+// readHost waits for the next packet written into TUN
+func (r *testRouter) readHost(t *testing.T) []byte {
+	t.Helper()
+	got := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		n, err := r.host.ReadPacket(buf)
+		if err == nil {
+			got <- buf[:n]
+		}
+	}()
+	select {
+	case data := <-got:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for TUN packet")
+		return nil
+	}
+}
+
+// advertPacket is a route advert of src
+func advertPacket(src utils.IPv4, adverts ...payload.Advert) *packet.Packet[packet.Packable] {
+	pkt := packet.NewPacket(packet.TypeRouteAdvert, &payload.AdvertPayload{Adverts: adverts})
+	pkt.SrcVIP = src
+	return pkt
+}
+
+func TestOutput_ToPeer(t *testing.T) {
+	r := newTestRouter(t)
+	w := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+
+	data := udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{10, 0, 0, 2}, 64, 100)
+	require.NoError(t, r.host.WritePacket(data))
+
+	pkt := w.waitData(t)
+	assert.Equal(t, utils.IPv4{10, 0, 0, 1}, pkt.SrcVIP)
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, pkt.DstVIP)
+	assert.Equal(t, data, pkt.Payload.(*payload.DataPayload).Data)
+}
+
+func TestOutput_Unreachable(t *testing.T) {
+	r := newTestRouter(t)
+
+	data := udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{10, 0, 0, 9}, 64, 100)
+	require.NoError(t, r.host.WritePacket(data))
+
+	icmp := r.readHost(t)
+	require.Equal(t, 4, ipVersion(icmp))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 1}, ipv4Src(icmp))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 1}, ipv4Dst(icmp))
+	assert.Equal(t, byte(icmpDestUnreachable), icmp[20])
+	assert.Equal(t, byte(icmpCodeHostUnreachable), icmp[21])
+	assert.Zero(t, checksum(icmp[20:], 0))
+	assert.Equal(t, data[:28], icmp[28:56])
+}
+
+func TestOutput_TooBig(t *testing.T) {
+	r := newTestRouter(t, WithMTU(1280))
+	r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+
+	require.NoError(t, r.host.WritePacket(udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{10, 0, 0, 2}, 64, 1400)))
+
+	icmp := r.readHost(t)
+	assert.Equal(t, byte(icmpDestUnreachable), icmp[20])
+	assert.Equal(t, byte(icmpCodeFragNeeded), icmp[21])
+	assert.Equal(t, uint16(1280), binary.BigEndian.Uint16(icmp[26:28]))
+}
+
+func TestInput_DeliverToTun(t *testing.T) {
+	r := newTestRouter(t)
+	w := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+
+	data := udpPacket(utils.IPv4{10, 0, 0, 2}, utils.IPv4{10, 0, 0, 1}, 64, 100)
+	pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: data})
+	pkt.SrcVIP = utils.IPv4{10, 0, 0, 2}
+	pkt.DstVIP = utils.IPv4{10, 0, 0, 1}
+	r.Input(w, pkt)
+
+	assert.Equal(t, data, r.readHost(t))
+}
+
+func TestInput_ForwardTimeExceeded(t *testing.T) {
+	r := newTestRouter(t)
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+
+	data := udpPacket(utils.IPv4{10, 0, 0, 2}, utils.IPv4{10, 0, 0, 3}, 1, 100)
+	pkt := packet.NewPacket(packet.TypeData, &payload.DataPayload{Data: data})
+	pkt.SrcVIP = utils.IPv4{10, 0, 0, 2}
+	pkt.DstVIP = utils.IPv4{10, 0, 0, 3}
+	r.Input(w2, pkt)
+
+	reply := w2.waitData(t)
+	icmp := reply.Payload.(*payload.DataPayload).Data
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, reply.DstVIP)
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, ipv4Dst(icmp))
+	assert.Equal(t, byte(icmpTimeExceeded), icmp[20])
+}
+
+func TestOutput_SubnetRoute(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		hooks []string
+	)
+	r := newTestRouter(t, WithAcceptSubnets(true), WithRouteHook(func(prefix *net.IPNet, add bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		hooks = append(hooks, fmt.Sprintf("%v %v", prefix, add))
+	}))
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	w3 := r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+
+	advert := func(w *mockWriter, src utils.IPv4, prefix string) {
+		r.Input(w, advertPacket(src, payload.Advert{Kind: payload.AdvertSubnet, Prefix: utils.Must2IPMask(prefix)}))
+	}
+	advert(w2, utils.IPv4{10, 0, 0, 2}, "192.168.0.0/16")
+	advert(w3, utils.IPv4{10, 0, 0, 3}, "192.168.1.0/24")
+
+	// longest prefix wins
+	require.NoError(t, r.host.WritePacket(udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{192, 168, 1, 5}, 64, 100)))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 3}, w3.waitData(t).DstVIP)
+	require.NoError(t, r.host.WritePacket(udpPacket(utils.IPv4{10, 0, 0, 1}, utils.IPv4{192, 168, 2, 5}, 64, 100)))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, w2.waitData(t).DstVIP)
+
+	advert(w3, utils.IPv4{10, 0, 0, 3}, "172.16.0.0/12")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"192.168.0.0/16 true", "192.168.1.0/24 true", "192.168.1.0/24 false", "172.16.0.0/12 true"}, hooks)
+}
+
+func TestTAP_LearnAndFlood(t *testing.T) {
+	r := newTestRouter(t, WithTAP())
+	w2 := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	w3 := r.addPeer(t, "peer3", "10.0.0.3/24", "192.0.2.3")
+
+	local := MAC{0x02, 0, 0, 0, 0, 0x01}
+	remote := MAC{0x02, 0, 0, 0, 0, 0x03}
+	frame := func(dst, src MAC) []byte {
+		b := make([]byte, 60)
+		copy(b[0:6], dst[:])
+		copy(b[6:12], src[:])
+		b[12], b[13] = 0x08, 0x06 // ARP
+		return b
+	}
+
+	// unknown unicast floods
+	require.NoError(t, r.host.WritePacket(frame(remote, local)))
+	for _, w := range []*mockWriter{w2, w3} {
+		pkt := w.waitFrame(t)
+		assert.Equal(t, frame(remote, local), pkt.Payload.(*payload.DataPayload).Data)
+	}
+
+	// the reply teaches where remote lives
+	reply := packet.NewPacket(packet.TypeFrame, &payload.DataPayload{Data: frame(local, remote)})
+	reply.SrcVIP = utils.IPv4{10, 0, 0, 3}
+	reply.DstVIP = utils.IPv4{10, 0, 0, 1}
+	r.Input(w3, reply)
+	assert.Equal(t, frame(local, remote), r.readHost(t))
+
+	require.NoError(t, r.host.WritePacket(frame(remote, local)))
+	assert.Equal(t, utils.IPv4{10, 0, 0, 3}, w3.waitFrame(t).DstVIP)
+	select {
+	case <-w2.sent:
+		t.Fatal("learned unicast flooded to peer2")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Len(t, r.MACTable(), 1)
+	assert.Equal(t, "02:00:00:00:00:03", r.MACTable()[0].MAC)
+}
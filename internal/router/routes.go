@@ -0,0 +1,163 @@
+package router
+
+import (
+	"kevin-rd/my-tier/pkg/packet"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// advertInterval is how often the local routes are advertised to every peer
+	advertInterval = 10 * time.Second
+	// advertTimeout withdraws the routes of a peer which stopped advertising
+	advertTimeout = 3 * advertInterval
+)
+
+type remoteAdverts struct {
+	adverts []payload.Advert
+	expiry  time.Time
+}
+
+// routeTable keeps the routes claimed by this node and the ones advertised by peers.
+type routeTable struct {
+	mu     sync.RWMutex
+	local  []payload.Advert
+	remote map[utils.IPv4]*remoteAdverts // peer VIP -> adverts
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{remote: map[utils.IPv4]*remoteAdverts{}}
+}
+
+func (t *routeTable) addLocal(ad payload.Advert) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.local = append(t.local, ad)
+}
+
+func (t *routeTable) localAdverts() []payload.Advert {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.local
+}
+
+// update replaces the routes of a peer
+func (t *routeTable) update(peer utils.IPv4, adverts []payload.Advert, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(adverts) == 0 {
+		delete(t.remote, peer)
+		return
+	}
+	t.remote[peer] = &remoteAdverts{adverts: adverts, expiry: now.Add(advertTimeout)}
+}
+
+// expire withdraws the routes of peers not heard of within advertTimeout
+func (t *routeTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for peer, r := range t.remote {
+		if now.After(r.expiry) {
+			log.Printf("[router] routes of %v expired", peer)
+			delete(t.remote, peer)
+		}
+	}
+}
+
+// claims returns peer VIP -> advert of every remote advert of kind matching fn
+func (t *routeTable) claims(kind byte, fn func(ad payload.Advert) bool) map[utils.IPv4]payload.Advert {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	res := map[utils.IPv4]payload.Advert{}
+	for peer, r := range t.remote {
+		for _, ad := range r.adverts {
+			if ad.Kind == kind && fn(ad) {
+				res[peer] = ad
+				break
+			}
+		}
+	}
+	return res
+}
+
+// claimsAll returns peer VIP -> adverts of the given kind
+func (t *routeTable) claimsAll(kind byte) map[utils.IPv4][]payload.Advert {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	res := map[utils.IPv4][]payload.Advert{}
+	for peer, r := range t.remote {
+		for _, ad := range r.adverts {
+			if ad.Kind == kind {
+				res[peer] = append(res[peer], ad)
+			}
+		}
+	}
+	return res
+}
+
+// Run advertises the local routes to every peer, expires stale remote routes and
+// memberships and queries the multicast groups until stopCh is closed.
+func (r *Router) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(advertInterval)
+	defer ticker.Stop()
+	r.queryGroups(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			r.routes.expire(now)
+			r.syncRoutes()
+			if r.macs != nil {
+				r.macs.expire(now)
+			}
+			r.groups.expire(now)
+			r.storm.prune(now)
+			r.queryGroups(now)
+			r.advertise()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// advertise sends the full local route set to every peer
+func (r *Router) advertise() {
+	adverts := r.routes.localAdverts()
+	self := r.selfVIP()
+	for _, p := range r.manager.GetPeers("") {
+		vip := utils.IPv4(p.VirtualIP[:4])
+		if vip == self {
+			continue
+		}
+		pkt := packet.NewPacket(packet.TypeRouteAdvert, &payload.AdvertPayload{Adverts: adverts})
+		pkt.SrcVIP = self
+		pkt.DstVIP = vip
+		if err := r.manager.Send(pkt); err != nil {
+			log.Printf("[router] advertise routes to %v error: %v", vip, err)
+		}
+	}
+}
+
+// handleAdvert replaces the routes of the peer the advert came from. The routes are keyed
+// on the peer at the remote address of w, the source VIP in the packet is not trusted.
+func (r *Router) handleAdvert(w packet.Writer, pkt *packet.Packet[packet.Packable]) {
+	ad, ok := pkt.Payload.(*payload.AdvertPayload)
+	if !ok || w == nil {
+		return
+	}
+	p := r.manager.PeerAt(w.RemoteAddr())
+	if p == nil {
+		log.Printf("[router] routes from unknown peer %v ignored", w.RemoteAddr())
+		return
+	}
+	vip := p.VirtualIP.IPv4()
+	if pkt.SrcVIP != vip {
+		log.Printf("[router] routes of %v sent by %s %v ignored", pkt.SrcVIP, p.ID, vip)
+		return
+	}
+	r.routes.update(vip, ad.Adverts, time.Now())
+	r.syncRoutes()
+}
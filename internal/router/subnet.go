@@ -0,0 +1,165 @@
+package router
+
+import (
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"sync"
+)
+
+// RouteHook installs (add) or removes a route of prefix through TUN in the kernel
+type RouteHook func(prefix *net.IPNet, add bool)
+
+// subnetRoutes tracks the subnets and anycast VIPs advertised by peers which are
+// installed in the kernel
+type subnetRoutes struct {
+	mu        sync.Mutex
+	hook      RouteHook
+	installed map[utils.IPMask]bool
+
+	// the subnets of peers are installed if acceptAll is set or they are inside a prefix
+	// of accept, none by default
+	acceptAll bool
+	accept    []utils.IPMask
+}
+
+// WithSubnet advertises a subnet reachable behind this node, e.g. its LAN
+func WithSubnet(prefix *net.IPNet) Option {
+	return func(r *Router) {
+		ip := prefix.IP.To4()
+		if ip == nil {
+			return
+		}
+		ones, _ := prefix.Mask.Size()
+		r.routes.addLocal(payload.Advert{
+			Kind:   payload.AdvertSubnet,
+			Prefix: utils.IPMask{ip[0], ip[1], ip[2], ip[3], byte(ones)},
+		})
+	}
+}
+
+// WithRouteHook is called whenever a subnet or an anycast VIP advertised by a peer appears
+// or is withdrawn
+func WithRouteHook(hook RouteHook) Option {
+	return func(r *Router) {
+		r.subnets.hook = hook
+	}
+}
+
+// WithAcceptSubnets installs the routes of the subnets advertised by peers, all of them or
+// the ones inside the allowed prefixes. Without it only the anycast VIPs are installed.
+func WithAcceptSubnets(all bool, allowed ...utils.IPMask) Option {
+	return func(r *Router) {
+		r.subnets.acceptAll = all
+		r.subnets.accept = append(r.subnets.accept, allowed...)
+	}
+}
+
+// accepts reports whether the route of prefix may be installed
+func (s *subnetRoutes) accepts(prefix utils.IPMask) bool {
+	if s.acceptAll {
+		return true
+	}
+	for _, allowed := range s.accept {
+		if allowed[4] <= prefix[4] && allowed.Contains(prefix.IPv4()) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSubnetRoutes() *subnetRoutes {
+	return &subnetRoutes{installed: map[utils.IPMask]bool{}}
+}
+
+// subnetTarget picks the healthy peer advertising the longest prefix containing dst
+func (r *Router) subnetTarget(dst utils.IPv4) (utils.IPv4, bool) {
+	claims := r.routes.claims(payload.AdvertSubnet, func(ad payload.Advert) bool {
+		return ad.Prefix.Contains(dst)
+	})
+
+	var (
+		best     utils.IPv4
+		bestOnes = -1
+	)
+	for vip, ad := range claims {
+		if !r.healthy(vip) || !r.validSubnet(ad.Prefix) {
+			continue
+		}
+		// ties go to the lower VIP so every packet of a subnet takes the same peer
+		ones := int(ad.Prefix[4])
+		if ones > bestOnes || ones == bestOnes && string(vip[:]) < string(best[:]) {
+			best, bestOnes = vip, ones
+		}
+	}
+	return best, bestOnes >= 0
+}
+
+// validSubnet reports whether a subnet advertised by a peer may be routed. The default
+// route is taken from exit nodes only and the overlay is never routed to a single peer.
+func (r *Router) validSubnet(prefix utils.IPMask) bool {
+	return prefix[4] > 0 && prefix[4] <= 32 && !overlaps(prefix, r.manager.VirtualIP)
+}
+
+// overlaps reports whether the prefixes a and b share an address
+func overlaps(a, b utils.IPMask) bool {
+	if a[4] > b[4] {
+		a, b = b, a
+	}
+	return a.Contains(b.IPv4())
+}
+
+// isLocalSubnet reports whether ip is in a subnet advertised by this node
+func (r *Router) isLocalSubnet(ip utils.IPv4) bool {
+	for _, ad := range r.routes.localAdverts() {
+		if ad.Kind == payload.AdvertSubnet && ad.Prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRoutes calls the route hook for the accepted subnets and the anycast VIPs advertised
+// by peers since the last sync. Anycast VIPs inside the overlay are covered by its route
+// already.
+func (r *Router) syncRoutes() {
+	if r.subnets.hook == nil {
+		return
+	}
+	current := map[utils.IPMask]bool{}
+	for _, adverts := range r.routes.claimsAll(payload.AdvertSubnet) {
+		for _, ad := range adverts {
+			if r.validSubnet(ad.Prefix) && r.subnets.accepts(ad.Prefix) && !r.isLocalSubnet(ad.Prefix.IPv4()) {
+				current[ad.Prefix] = true
+			}
+		}
+	}
+	for _, adverts := range r.routes.claimsAll(payload.AdvertAnycast) {
+		for _, ad := range adverts {
+			if ip := ad.Prefix.IPv4(); !r.inOverlay(ip) && !r.isLocalAnycast(ip) {
+				current[ad.Prefix] = true
+			}
+		}
+	}
+
+	r.subnets.mu.Lock()
+	defer r.subnets.mu.Unlock()
+	for prefix := range r.subnets.installed {
+		if !current[prefix] {
+			delete(r.subnets.installed, prefix)
+			r.subnets.hook(ipNet(prefix), false)
+		}
+	}
+	for prefix := range current {
+		if !r.subnets.installed[prefix] {
+			r.subnets.installed[prefix] = true
+			r.subnets.hook(ipNet(prefix), true)
+		}
+	}
+}
+
+func ipNet(prefix utils.IPMask) *net.IPNet {
+	ip := prefix.IPv4()
+	mask := net.CIDRMask(int(prefix[4]), 32)
+	return &net.IPNet{IP: net.IP(ip[:]).Mask(mask), Mask: mask}
+}
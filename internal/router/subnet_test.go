@@ -0,0 +1,93 @@
+package router
+
+import (
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func subnetAdvert(prefix string) payload.Advert {
+	return payload.Advert{Kind: payload.AdvertSubnet, Prefix: utils.Must2IPMask(prefix)}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "10.0.0.0/24", b: "10.0.0.0/24", want: true},
+		{a: "10.0.0.0/8", b: "10.0.1.0/24", want: true},
+		{a: "10.0.1.0/24", b: "10.0.0.0/8", want: true},
+		{a: "10.0.0.0/24", b: "10.0.1.0/24"},
+		{a: "0.0.0.0/0", b: "192.168.1.0/24", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.want, overlaps(utils.Must2IPMask(tt.a), utils.Must2IPMask(tt.b)))
+		})
+	}
+}
+
+func TestSyncRoutes_Accept(t *testing.T) {
+	adverts := []payload.Advert{
+		subnetAdvert("192.168.1.0/24"),
+		subnetAdvert("172.16.0.0/12"),
+		subnetAdvert("0.0.0.0/0"),
+		// the overlay and a prefix containing it
+		subnetAdvert("10.0.0.0/24"),
+		subnetAdvert("10.0.0.0/8"),
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{name: "none by default"},
+		{name: "all", opts: []Option{WithAcceptSubnets(true)}, want: []string{"172.16.0.0/12", "192.168.1.0/24"}},
+		{name: "allow list", opts: []Option{WithAcceptSubnets(false, utils.Must2IPMask("192.168.0.0/16"))}, want: []string{"192.168.1.0/24"}},
+		{name: "narrower allow list", opts: []Option{WithAcceptSubnets(false, utils.Must2IPMask("172.16.1.0/24"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu  sync.Mutex
+				got []string
+			)
+			hook := WithRouteHook(func(prefix *net.IPNet, add bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, prefix.String())
+			})
+			r := newTestRouter(t, append(tt.opts, hook)...)
+			w := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+			r.Input(w, advertPacket(utils.IPv4{10, 0, 0, 2}, adverts...))
+
+			mu.Lock()
+			defer mu.Unlock()
+			sort.Strings(got)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSubnetTarget_Invalid(t *testing.T) {
+	r := newTestRouter(t)
+	w := r.addPeer(t, "peer2", "10.0.0.2/24", "192.0.2.2")
+	r.Input(w, advertPacket(utils.IPv4{10, 0, 0, 2}, subnetAdvert("0.0.0.0/0"), subnetAdvert("10.0.0.0/8")))
+
+	// neither the default route nor a prefix overlapping the overlay is taken from a subnet router
+	_, ok := r.subnetTarget(utils.IPv4{8, 8, 8, 8})
+	assert.False(t, ok)
+	_, ok = r.subnetTarget(utils.IPv4{10, 1, 0, 1})
+	assert.False(t, ok)
+
+	r.Input(w, advertPacket(utils.IPv4{10, 0, 0, 2}, subnetAdvert("192.168.1.0/24")))
+	target, ok := r.subnetTarget(utils.IPv4{192, 168, 1, 5})
+	assert.True(t, ok)
+	assert.Equal(t, utils.IPv4{10, 0, 0, 2}, target)
+}
@@ -0,0 +1,68 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Device is a virtual network interface carrying raw packets, e.g. a kernel TUN or an in-memory Pipe.
+type Device interface {
+	// ReadPacket reads one packet into buf and returns its length
+	ReadPacket(buf []byte) (int, error)
+	// WritePacket writes one packet, data may be reused once it returns
+	WritePacket(data []byte) error
+
+	MTU() int
+	Name() string
+	Close() error
+}
+
+// Flusher is a Device which holds written packets back, e.g. to coalesce them.
+// Flush writes them out and is called once a batch of packets is written.
+type Flusher interface {
+	Flush() error
+}
+
+// Run reads packets from dev and hands them to output until dev is closed,
+// the buffer is reused after output returns. A MultiQueue is read by one worker per
+// queue, so output must be safe for concurrent use.
+func Run(dev Device, output func(data []byte)) error {
+	mq, ok := dev.(interface{ Queues() []Device })
+	if !ok || len(mq.Queues()) < 2 {
+		return runQueue(dev, output)
+	}
+
+	queues := mq.Queues()
+	errs := make([]error, len(queues))
+	wg := sync.WaitGroup{}
+	wg.Add(len(queues))
+	for i, q := range queues {
+		go func() {
+			defer wg.Done()
+			errs[i] = runQueue(q, output)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func runQueue(dev Device, output func(data []byte)) error {
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+
+	// TUN → PeerManager
+	for {
+		n, err := dev.ReadPacket(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF) {
+				return nil
+			}
+			log.Printf("[tun] %s read error: %v", dev.Name(), err)
+			continue
+		}
+		output(buf[:n])
+	}
+}
@@ -0,0 +1,81 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"github.com/songgao/water"
+	"sync/atomic"
+)
+
+// MultiQueue is a TUN or TAP device opened with IFF_MULTI_QUEUE. The kernel spreads the
+// flows over the queues, each queue is read by its own worker so one flow stays in order.
+type MultiQueue struct {
+	queues []*TunDevice
+	next   atomic.Uint32
+}
+
+var _ Device = (*MultiQueue)(nil)
+
+// NewMultiQueueTun opens the TUN name with the given number of queues
+func NewMultiQueueTun(name string, mtu, queues int) (*MultiQueue, error) {
+	return newMultiQueue(water.TUN, name, mtu, queues)
+}
+
+// NewMultiQueueTap opens the TAP name with the given number of queues
+func NewMultiQueueTap(name string, mtu, queues int) (*MultiQueue, error) {
+	return newMultiQueue(water.TAP, name, mtu, queues)
+}
+
+func newMultiQueue(typ water.DeviceType, name string, mtu, queues int) (*MultiQueue, error) {
+	if queues < 1 {
+		return nil, fmt.Errorf("invalid number of queues: %d", queues)
+	}
+	m := &MultiQueue{}
+	for i := 0; i < queues; i++ {
+		q, err := newDevice(typ, name, mtu, true)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("open queue %d error: %w", i, err), m.Close())
+		}
+		// the kernel names the interface on the first open
+		name = q.Name()
+		m.queues = append(m.queues, q)
+	}
+	return m, nil
+}
+
+// Queues returns a Device for every queue
+func (m *MultiQueue) Queues() []Device {
+	res := make([]Device, len(m.queues))
+	for i, q := range m.queues {
+		res[i] = q
+	}
+	return res
+}
+
+// ReadPacket reads from the first queue, use Queues to read all of them
+func (m *MultiQueue) ReadPacket(buf []byte) (int, error) {
+	return m.queues[0].ReadPacket(buf)
+}
+
+// WritePacket writes to the queues in turn. A write hands the packet to the kernel
+// synchronously, so the packets of a flow written by one worker stay in order.
+func (m *MultiQueue) WritePacket(data []byte) error {
+	i := m.next.Add(1) % uint32(len(m.queues))
+	return m.queues[i].WritePacket(data)
+}
+
+func (m *MultiQueue) MTU() int {
+	return m.queues[0].MTU()
+}
+
+func (m *MultiQueue) Name() string {
+	return m.queues[0].Name()
+}
+
+func (m *MultiQueue) Close() error {
+	var errs []error
+	for _, q := range m.queues {
+		errs = append(errs, q.Close())
+	}
+	return errors.Join(errs...)
+}
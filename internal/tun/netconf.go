@@ -0,0 +1,10 @@
+package tun
+
+import "kevin-rd/my-tier/pkg/utils"
+
+// NetConfig is the interface configuration applied by a Configurator
+type NetConfig struct {
+	// Addr is the virtual address and prefix, the route of the network comes with it
+	Addr utils.IPMask
+	MTU  int
+}
@@ -0,0 +1,246 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"kevin-rd/my-tier/pkg/utils"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Configurator configures a TUN interface via netlink and removes everything it
+// installed again on Close.
+type Configurator struct {
+	mu     sync.Mutex
+	link   netlink.Link
+	addrs  []*netlink.Addr
+	routes map[string]*netlink.Route // dst -> route
+	// underlay is the default route outside the interface, kept while the default route
+	// leads into the interface
+	underlay *netlink.Route
+}
+
+// splitRoutes cover the whole IPv4 space and win over the default route without replacing it
+var splitRoutes = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+}
+
+func NewConfigurator(name string) (*Configurator, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("find link %s error: %w", name, err)
+	}
+	return &Configurator{link: link, routes: map[string]*netlink.Route{}}, nil
+}
+
+// Up sets the MTU, assigns the virtual address and brings the link up.
+func (c *Configurator) Up(cfg NetConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := c.link.Attrs().Name
+	if cfg.MTU > 0 {
+		if err := netlink.LinkSetMTU(c.link, cfg.MTU); err != nil {
+			return fmt.Errorf("set mtu of %s error: %w", name, err)
+		}
+	}
+
+	addr := &netlink.Addr{IPNet: ipNet(cfg.Addr)}
+	if err := netlink.AddrReplace(c.link, addr); err != nil {
+		return fmt.Errorf("assign %s to %s error: %w", cfg.Addr, name, err)
+	}
+	c.addrs = append(c.addrs, addr)
+
+	if err := netlink.LinkSetUp(c.link); err != nil {
+		return fmt.Errorf("set %s up error: %w", name, err)
+	}
+	log.Printf("[tun] %s up with %s mtu %d", name, cfg.Addr, cfg.MTU)
+	return nil
+}
+
+// AddAddr assigns another address to the interface, e.g. an anycast VIP
+func (c *Configurator) AddAddr(ip utils.IPMask) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addr := &netlink.Addr{IPNet: ipNet(ip)}
+	if err := netlink.AddrReplace(c.link, addr); err != nil {
+		return fmt.Errorf("assign %s to %s error: %w", ip, c.link.Attrs().Name, err)
+	}
+	c.addrs = append(c.addrs, addr)
+	log.Printf("[tun] %s assigned to %s", ip, c.link.Attrs().Name)
+	return nil
+}
+
+// AddRoute routes dst through the interface, a route of dst which is not installed by the
+// Configurator is never replaced
+func (c *Configurator) AddRoute(dst *net.IPNet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.routes[dst.String()]; ok {
+		return nil
+	}
+	route := &netlink.Route{LinkIndex: c.link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+	if err := netlink.RouteAdd(route); err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("add route %s error: the route exists already", dst)
+		}
+		return fmt.Errorf("add route %s error: %w", dst, err)
+	}
+	c.routes[dst.String()] = route
+	log.Printf("[tun] route %s dev %s", dst, c.link.Attrs().Name)
+	return nil
+}
+
+// RouteConflict returns an error if dst overlaps a route through another interface, e.g.
+// the LAN of the host. The default routes do not count.
+func (c *Configurator) RouteConflict(dst *net.IPNet) error {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("list routes error: %w", err)
+	}
+	for _, route := range routes {
+		if route.LinkIndex == c.link.Attrs().Index || route.Dst == nil {
+			continue
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		if route.Dst.Contains(dst.IP) || dst.Contains(route.Dst.IP) {
+			return fmt.Errorf("route %s overlaps the route %s outside %s", dst, route.Dst, c.link.Attrs().Name)
+		}
+	}
+	return nil
+}
+
+func (c *Configurator) DelRoute(dst *net.IPNet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	route, ok := c.routes[dst.String()]
+	if !ok {
+		return nil
+	}
+	delete(c.routes, dst.String())
+	if err := netlink.RouteDel(route); err != nil {
+		return fmt.Errorf("delete route %s error: %w", dst, err)
+	}
+	return nil
+}
+
+// RouteDefault routes everything without a more specific route through the interface with
+// the split routes, or removes them again. Use AddBypass for the addresses which must keep
+// the route they take outside the interface.
+func (c *Configurator) RouteDefault(enable bool) error {
+	if !enable {
+		return errors.Join(c.DelRoute(splitRoutes[0]), c.DelRoute(splitRoutes[1]))
+	}
+
+	c.mu.Lock()
+	underlay, err := c.defaultRoute()
+	c.underlay = underlay
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, dst := range splitRoutes {
+		if err := c.AddRoute(dst); err != nil {
+			return errors.Join(err, c.RouteDefault(false))
+		}
+	}
+	return nil
+}
+
+// defaultRoute returns the IPv4 default route leaving through another interface, c.mu must be held
+func (c *Configurator) defaultRoute() (*netlink.Route, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("list routes error: %w", err)
+	}
+	for _, route := range routes {
+		if route.LinkIndex == c.link.Attrs().Index {
+			continue
+		}
+		if route.Dst == nil {
+			return &route, nil
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			return &route, nil
+		}
+	}
+	return nil, errors.New("no default route outside the interface")
+}
+
+// AddBypass keeps the route ip takes outside the interface with a host route, e.g. for the
+// endpoint of a peer while the default route leads into the interface. A host route which
+// exists already is left alone.
+func (c *Configurator) AddBypass(ip net.IP) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ip = ip.To4()
+	if ip == nil {
+		return nil
+	}
+	dst := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	if _, ok := c.routes[dst.String()]; ok {
+		return nil
+	}
+	route := &netlink.Route{Dst: dst}
+	found, err := netlink.RouteGet(ip)
+	switch {
+	case err == nil && len(found) > 0 && found[0].LinkIndex != c.link.Attrs().Index:
+		route.LinkIndex, route.Gw = found[0].LinkIndex, found[0].Gw
+	case c.underlay != nil:
+		route.LinkIndex, route.Gw = c.underlay.LinkIndex, c.underlay.Gw
+	default:
+		return fmt.Errorf("no route to %s outside the interface", ip)
+	}
+	if route.Gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("add bypass route %s error: %w", dst, err)
+	}
+	c.routes[dst.String()] = route
+	log.Printf("[tun] bypass route %s outside %s", dst, c.link.Attrs().Name)
+	return nil
+}
+
+// Close removes the routes and the addresses and sets the link down
+func (c *Configurator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for key, route := range c.routes {
+		if err := netlink.RouteDel(route); err != nil {
+			errs = append(errs, fmt.Errorf("delete route %s error: %w", key, err))
+		}
+		delete(c.routes, key)
+	}
+	for _, addr := range c.addrs {
+		if err := netlink.AddrDel(c.link, addr); err != nil {
+			errs = append(errs, fmt.Errorf("delete address %s error: %w", addr.IPNet, err))
+		}
+	}
+	c.addrs = nil
+	if err := netlink.LinkSetDown(c.link); err != nil {
+		errs = append(errs, fmt.Errorf("set %s down error: %w", c.link.Attrs().Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// ipNet converts an IPMask to the address with the mask of its network
+func ipNet(addr utils.IPMask) *net.IPNet {
+	ip := addr.IPv4()
+	return &net.IPNet{IP: net.IP(ip[:]), Mask: net.CIDRMask(int(addr[4]), 32)}
+}
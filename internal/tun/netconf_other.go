@@ -0,0 +1,50 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"kevin-rd/my-tier/pkg/utils"
+	"net"
+)
+
+var errNetConfUnsupported = errors.New("interface configuration is only supported on linux")
+
+// Configurator is only implemented on linux, configure the interface by hand elsewhere.
+type Configurator struct{}
+
+func NewConfigurator(name string) (*Configurator, error) {
+	return nil, errNetConfUnsupported
+}
+
+func (c *Configurator) Up(cfg NetConfig) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) AddAddr(ip utils.IPMask) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) AddRoute(dst *net.IPNet) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) RouteConflict(dst *net.IPNet) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) DelRoute(dst *net.IPNet) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) RouteDefault(enable bool) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) AddBypass(ip net.IP) error {
+	return errNetConfUnsupported
+}
+
+func (c *Configurator) Close() error {
+	return nil
+}
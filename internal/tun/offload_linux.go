@@ -0,0 +1,162 @@
+package tun
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"sync"
+)
+
+// OffloadDevice is a TUN opened with IFF_VNET_HDR and TSO enabled. The kernel hands over
+// TCP super-packets which are split into MTU sized segments on read, and TCP segments
+// written are coalesced into super-packets until Flush (GRO).
+type OffloadDevice struct {
+	file *os.File
+	name string
+	mtu  int
+
+	rmu     sync.Mutex
+	rbuf    []byte
+	pending [][]byte
+
+	wmu  sync.Mutex
+	wbuf []byte
+	gro  groTable
+}
+
+var _ Device = (*OffloadDevice)(nil)
+
+func NewOffloadDevice(name string, mtu int) (*OffloadDevice, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/net/tun: %w", err)
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, unix.TUN_F_CSUM|unix.TUN_F_TSO4|unix.TUN_F_TSO6); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to enable TUN offload: %w", err)
+	}
+	// non-blocking so Close interrupts a pending read
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
+	return &OffloadDevice{
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: ifr.Name(),
+		mtu:  mtu,
+		rbuf: make([]byte, vnetHdrLen+maxGROSize),
+		wbuf: make([]byte, vnetHdrLen+maxGROSize),
+	}, nil
+}
+
+// ReadPacket returns the next segment of a super-packet or reads a new packet
+func (d *OffloadDevice) ReadPacket(buf []byte) (int, error) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+
+	for len(d.pending) == 0 {
+		n, err := d.file.Read(d.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		var h vnetHdr
+		if err := h.decode(d.rbuf[:n]); err != nil {
+			return 0, err
+		}
+		pkt := d.rbuf[vnetHdrLen:n]
+
+		switch h.gsoType &^ vnetGSOECN {
+		case vnetGSONone:
+			if h.flags&vnetHdrFlagNeedsCsum != 0 {
+				if err := completeChecksum(pkt, &h); err != nil {
+					log.Printf("[tun] %s drop packet: %v", d.name, err)
+					continue
+				}
+			}
+			return copy(buf, pkt), nil
+		case vnetGSOTCPv4, vnetGSOTCPv6:
+			segs, err := gsoSplit(pkt, &h)
+			if err != nil {
+				log.Printf("[tun] %s drop super-packet: %v", d.name, err)
+				continue
+			}
+			d.pending = segs
+		default:
+			log.Printf("[tun] %s drop packet of unsupported gso type %d", d.name, h.gsoType)
+		}
+	}
+
+	n := copy(buf, d.pending[0])
+	d.pending = d.pending[1:]
+	return n, nil
+}
+
+// WritePacket writes a packet, TCP data segments are held back for coalescing until Flush
+func (d *OffloadDevice) WritePacket(data []byte) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	flows, taken := d.gro.add(data)
+	for _, f := range flows {
+		if err := d.writeFlow(f); err != nil {
+			return err
+		}
+	}
+	if taken {
+		return nil
+	}
+	return d.write(vnetHdr{}, data)
+}
+
+// Flush writes the coalesced packets
+func (d *OffloadDevice) Flush() error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	var firstErr error
+	for _, f := range d.gro.takeAll() {
+		if err := d.writeFlow(f); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (d *OffloadDevice) writeFlow(f *groFlow) error {
+	return d.write(f.finish(), f.pkt)
+}
+
+func (d *OffloadDevice) write(h vnetHdr, pkt []byte) error {
+	h.encode(d.wbuf)
+	n := copy(d.wbuf[vnetHdrLen:], pkt)
+	_, err := d.file.Write(d.wbuf[:vnetHdrLen+n])
+	return err
+}
+
+func (d *OffloadDevice) MTU() int {
+	return d.mtu
+}
+
+func (d *OffloadDevice) Name() string {
+	return d.name
+}
+
+func (d *OffloadDevice) Close() error {
+	return d.file.Close()
+}
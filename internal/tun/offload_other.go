@@ -0,0 +1,18 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+// OffloadDevice needs IFF_VNET_HDR of the linux TUN driver
+type OffloadDevice struct {
+	Device
+}
+
+func NewOffloadDevice(name string, mtu int) (*OffloadDevice, error) {
+	return nil, errors.New("TUN segmentation offload is only supported on linux")
+}
+
+func (d *OffloadDevice) Flush() error {
+	return nil
+}
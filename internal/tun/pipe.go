@@ -0,0 +1,69 @@
+package tun
+
+import (
+	"io"
+	"sync"
+)
+
+// pipeQueueSize is the number of packets buffered in each direction of a Pipe
+const pipeQueueSize = 256
+
+// Pipe is one end of an in-memory Device pair, packets written to one end are read from the other.
+// It stands in for a kernel TUN in tests: the router uses one end, the test plays the host with the other.
+type Pipe struct {
+	name string
+	mtu  int
+
+	rx <-chan []byte
+	tx chan<- []byte
+
+	// closed is shared by both ends
+	closed chan struct{}
+	once   *sync.Once
+}
+
+var _ Device = (*Pipe)(nil)
+
+// NewPipe returns two connected ends, closing either end closes both.
+func NewPipe(name string, mtu int) (*Pipe, *Pipe) {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	a, b := make(chan []byte, pipeQueueSize), make(chan []byte, pipeQueueSize)
+	closed, once := make(chan struct{}), &sync.Once{}
+	return &Pipe{name: name, mtu: mtu, rx: a, tx: b, closed: closed, once: once},
+		&Pipe{name: name + "-host", mtu: mtu, rx: b, tx: a, closed: closed, once: once}
+}
+
+func (p *Pipe) ReadPacket(buf []byte) (int, error) {
+	select {
+	case data := <-p.rx:
+		return copy(buf, data), nil
+	case <-p.closed:
+		return 0, io.EOF
+	}
+}
+
+func (p *Pipe) WritePacket(data []byte) error {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case p.tx <- buf:
+		return nil
+	case <-p.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (p *Pipe) MTU() int {
+	return p.mtu
+}
+
+func (p *Pipe) Name() string {
+	return p.name
+}
+
+func (p *Pipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
@@ -2,73 +2,83 @@
 package tun
 
 import (
-	"errors"
 	"fmt"
 	"github.com/songgao/water"
-	"kevin-rd/my-tier/pkg/packet"
-	"log"
 	"sync"
 )
 
+// DefaultMTU of a new TUN device
+const DefaultMTU = 1420
+
 var (
 	bufPool = sync.Pool{
 		New: func() any {
-			return make([]byte, 1500)
+			return make([]byte, 65535)
 		},
 	}
 )
 
+// TunDevice is a kernel TUN or TAP device backed by water
 type TunDevice struct {
 	Iface *water.Interface
+	mtu   int
+}
+
+var _ Device = (*TunDevice)(nil)
+
+func NewTunDevice(name string, mtu int) (*TunDevice, error) {
+	return newDevice(water.TUN, name, mtu, false)
+}
+
+// NewTapDevice creates a TAP device, it carries Ethernet frames instead of IP packets
+func NewTapDevice(name string, mtu int) (*TunDevice, error) {
+	return newDevice(water.TAP, name, mtu, false)
 }
 
-func NewTunDevice(name string) (*TunDevice, error) {
+func newDevice(typ water.DeviceType, name string, mtu int, multiQueue bool) (*TunDevice, error) {
 	config := water.Config{
-		DeviceType: water.TUN,
+		DeviceType: typ,
 	}
 	config.Name = name
+	if multiQueue {
+		if err := setMultiQueue(&config); err != nil {
+			return nil, err
+		}
+	}
 
 	ifce, err := water.New(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create TUN device: %v", err)
+		kind := "TUN"
+		if typ == water.TAP {
+			kind = "TAP"
+		}
+		return nil, fmt.Errorf("failed to create %s device: %v", kind, err)
+	}
+	if mtu <= 0 {
+		mtu = DefaultMTU
 	}
 
-	return &TunDevice{Iface: ifce}, nil
+	return &TunDevice{Iface: ifce, mtu: mtu}, nil
 }
 
-func (t *TunDevice) Run(outputCh chan *packet.Packet[packet.Packable]) error {
-	// TUN → PeerManager
-	for {
-		pkt, err := t.ReadPacket()
-		if err != nil {
-			log.Println("tun read error:", err)
-			continue
-		}
-		outputCh <- pkt
-	}
+func (t *TunDevice) ReadPacket(buf []byte) (int, error) {
+	return t.Iface.Read(buf)
 }
 
-func (t *TunDevice) ReadPacket() (*packet.Packet[packet.Packable], error) {
-	buf := bufPool.Get().([]byte)
-	defer bufPool.Put(buf)
+// WritePacket writes a raw IP packet to TUN or an Ethernet frame to TAP
+func (t *TunDevice) WritePacket(data []byte) error {
+	_, err := t.Iface.Write(data)
+	return err
+}
 
-	_, err := t.Iface.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-	pkt := new(packet.Packet[packet.Packable])
-	if err = pkt.Decode(buf); err != nil {
-		return nil, errors.Join(packet.ErrPacketDecode, err)
-	}
-	return pkt, nil
+func (t *TunDevice) MTU() int {
+	return t.mtu
 }
 
-func (t *TunDevice) WritePacket(pkt *packet.Packet[packet.Packable]) error {
-	buf, err := pkt.Encode()
-	if err != nil {
-		return errors.Join(packet.ErrPacketEncode, err)
-	}
+func (t *TunDevice) Name() string {
+	return t.Iface.Name()
+}
 
-	_, err = t.Iface.Write(buf)
-	return err
+func (t *TunDevice) Close() error {
+	return t.Iface.Close()
 }
@@ -0,0 +1,8 @@
+package tun
+
+import "github.com/songgao/water"
+
+func setMultiQueue(config *water.Config) error {
+	config.MultiQueue = true
+	return nil
+}
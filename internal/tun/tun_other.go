@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"github.com/songgao/water"
+)
+
+func setMultiQueue(config *water.Config) error {
+	return errors.New("multi-queue TUN is only supported on linux")
+}
@@ -0,0 +1,381 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// virtio-net header prepended to every packet of a TUN opened with IFF_VNET_HDR
+const (
+	vnetHdrLen = 10
+
+	vnetHdrFlagNeedsCsum = 1
+
+	vnetGSONone  = 0
+	vnetGSOTCPv4 = 1
+	vnetGSOTCPv6 = 4
+	vnetGSOECN   = 0x80
+)
+
+const (
+	protoTCP = 6
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+
+	// maxGROSize is the largest coalesced packet, the IPv4 total length is 16 bits
+	maxGROSize = 65535
+	// maxGROFlows bounds the flows held between two flushes
+	maxGROFlows = 64
+)
+
+var errVnetHdr = errors.New("invalid virtio-net header")
+
+// vnetHdr is the legacy virtio_net_hdr, its fields are in host byte order
+type vnetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *vnetHdr) decode(b []byte) error {
+	if len(b) < vnetHdrLen {
+		return errVnetHdr
+	}
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:])
+	return nil
+}
+
+func (h *vnetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// checksum returns the internet checksum of b added to initial
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return ^fold(sum)
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum is the unfolded sum of the IPv4 or IPv6 pseudo header
+func pseudoHeaderSum(src, dst []byte, proto byte, length int) uint32 {
+	var sum uint32
+	for _, b := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+	}
+	return sum + uint32(proto) + uint32(length)>>16 + uint32(length)&0xFFFF
+}
+
+// ipAddrs returns the source and destination address of an IPv4 or IPv6 packet
+func ipAddrs(pkt []byte) (src, dst []byte) {
+	if pkt[0]>>4 == 4 {
+		return pkt[12:16], pkt[16:20]
+	}
+	return pkt[8:24], pkt[24:40]
+}
+
+// completeChecksum fills in the checksum the kernel left partial, the field holds the
+// pseudo header sum and everything from csumStart on is covered.
+func completeChecksum(pkt []byte, h *vnetHdr) error {
+	start, off := int(h.csumStart), int(h.csumStart)+int(h.csumOffset)
+	if off+2 > len(pkt) {
+		return fmt.Errorf("checksum offset %d out of packet of %d bytes", off, len(pkt))
+	}
+	binary.BigEndian.PutUint16(pkt[off:], checksum(pkt[start:], 0))
+	return nil
+}
+
+// gsoSplit splits a TCP super-packet of the kernel into segments of h.gsoSize payload
+// bytes with their own IP and TCP headers and checksums.
+func gsoSplit(pkt []byte, h *vnetHdr) ([][]byte, error) {
+	if h.gsoSize == 0 || len(pkt) < 20 {
+		return nil, errVnetHdr
+	}
+	v4 := h.gsoType&^vnetGSOECN == vnetGSOTCPv4
+	iphLen := 40
+	if v4 {
+		iphLen = int(pkt[0]&0x0F) * 4
+	}
+	tcpStart := iphLen
+	if len(pkt) < tcpStart+20 {
+		return nil, errVnetHdr
+	}
+	hdrLen := tcpStart + int(pkt[tcpStart+12]>>4)*4
+	if len(pkt) < hdrLen {
+		return nil, errVnetHdr
+	}
+
+	payload := pkt[hdrLen:]
+	firstSeq := binary.BigEndian.Uint32(pkt[tcpStart+4:])
+	firstID := binary.BigEndian.Uint16(pkt[4:])
+	gsoSize := int(h.gsoSize)
+	segs := make([][]byte, 0, (len(payload)+gsoSize-1)/gsoSize)
+	for i, off := 0, 0; off < len(payload); i, off = i+1, off+gsoSize {
+		end := min(off+gsoSize, len(payload))
+		seg := make([]byte, hdrLen+end-off)
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		if v4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], firstID+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:], checksum(seg[:iphLen], 0))
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-iphLen))
+		}
+
+		tcp := seg[tcpStart:]
+		binary.BigEndian.PutUint32(tcp[4:], firstSeq+uint32(off))
+		if end != len(payload) {
+			tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i > 0 {
+			tcp[13] &^= tcpFlagCWR
+		}
+		tcp[16], tcp[17] = 0, 0
+		src, dst := ipAddrs(seg)
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoHeaderSum(src, dst, protoTCP, len(tcp))))
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// groKey identifies a TCP flow, addresses and ports
+type groKey struct {
+	src, dst [16]byte
+	ports    [4]byte
+}
+
+type groFlow struct {
+	key     groKey
+	pkt     []byte
+	iphLen  int
+	hdrLen  int
+	gsoSize int
+	segs    int
+	nextSeq uint32
+	// closed flows take no more segments, e.g. after a short or PSH segment
+	closed bool
+}
+
+// tcpSegment describes a TCP packet which can be coalesced
+type tcpSegment struct {
+	key      groKey
+	iphLen   int
+	hdrLen   int
+	seq      uint32
+	flags    byte
+	mergable bool
+}
+
+// parseTCP parses the headers of an IPv4 or IPv6 TCP packet, ok is false for other packets
+func parseTCP(pkt []byte) (seg tcpSegment, ok bool) {
+	if len(pkt) < 20 {
+		return seg, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		seg.iphLen = int(pkt[0]&0x0F) * 4
+		// fragments and IP options are never coalesced
+		if pkt[9] != protoTCP || seg.iphLen < 20 || binary.BigEndian.Uint16(pkt[6:])&0x3FFF != 0 {
+			return seg, false
+		}
+		if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return seg, false
+		}
+		seg.mergable = seg.iphLen == 20
+	case 6:
+		seg.iphLen = 40
+		if len(pkt) < 40 || pkt[6] != protoTCP || int(binary.BigEndian.Uint16(pkt[4:]))+40 != len(pkt) {
+			return seg, false
+		}
+		seg.mergable = true
+	default:
+		return seg, false
+	}
+	if len(pkt) < seg.iphLen+20 {
+		return seg, false
+	}
+	tcp := pkt[seg.iphLen:]
+	seg.hdrLen = seg.iphLen + int(tcp[12]>>4)*4
+	if seg.hdrLen > len(pkt) || seg.hdrLen < seg.iphLen+20 {
+		return seg, false
+	}
+	src, dst := ipAddrs(pkt)
+	copy(seg.key.src[:], src)
+	copy(seg.key.dst[:], dst)
+	copy(seg.key.ports[:], tcp[0:4])
+	seg.seq = binary.BigEndian.Uint32(tcp[4:])
+	seg.flags = tcp[13]
+	// only pure data segments are coalesced
+	seg.mergable = seg.mergable && seg.flags&^(tcpFlagACK|tcpFlagPSH) == 0 && seg.flags&tcpFlagACK != 0 && len(pkt) > seg.hdrLen
+	return seg, true
+}
+
+// groTable coalesces consecutive TCP segments of a flow written to TUN into one
+// super-packet, it is written by flush.
+type groTable struct {
+	flows []*groFlow
+}
+
+func (t *groTable) find(key groKey) int {
+	for i, f := range t.flows {
+		if f.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// add offers pkt to the table. It returns the packets which have to be written first,
+// and whether pkt was taken by the table.
+func (t *groTable) add(pkt []byte) (out []*groFlow, taken bool) {
+	seg, ok := parseTCP(pkt)
+	if !ok {
+		return nil, false
+	}
+	i := t.find(seg.key)
+	if i >= 0 {
+		f := t.flows[i]
+		if seg.mergable && f.canAppend(pkt, seg) {
+			f.append(pkt, seg)
+			if f.closed || len(f.pkt)+f.gsoSize > maxGROSize {
+				t.remove(i)
+				out = append(out, f)
+			}
+			return out, true
+		}
+		// keep the order of the flow
+		t.remove(i)
+		out = append(out, f)
+	}
+	if !seg.mergable {
+		return out, false
+	}
+	if len(t.flows) >= maxGROFlows {
+		out = append(out, t.flows...)
+		t.flows = t.flows[:0]
+	}
+	buf := make([]byte, len(pkt), maxGROSize)
+	copy(buf, pkt)
+	t.flows = append(t.flows, &groFlow{
+		key:     seg.key,
+		pkt:     buf,
+		iphLen:  seg.iphLen,
+		hdrLen:  seg.hdrLen,
+		gsoSize: len(pkt) - seg.hdrLen,
+		segs:    1,
+		nextSeq: seg.seq + uint32(len(pkt)-seg.hdrLen),
+		closed:  seg.flags&tcpFlagPSH != 0,
+	})
+	return out, true
+}
+
+func (t *groTable) remove(i int) {
+	t.flows = append(t.flows[:i], t.flows[i+1:]...)
+}
+
+// takeAll empties the table
+func (t *groTable) takeAll() []*groFlow {
+	flows := t.flows
+	t.flows = nil
+	return flows
+}
+
+func (f *groFlow) canAppend(pkt []byte, seg tcpSegment) bool {
+	size := len(pkt) - seg.hdrLen
+	if f.closed || seg.seq != f.nextSeq || seg.hdrLen != f.hdrLen || size > f.gsoSize || len(f.pkt)+size > maxGROSize {
+		return false
+	}
+	held := f.pkt
+	if pkt[0]>>4 == 4 {
+		// TOS, DF and TTL
+		if pkt[1] != held[1] || pkt[6]&0x40 != held[6]&0x40 || pkt[8] != held[8] {
+			return false
+		}
+	} else {
+		// traffic class and hop limit
+		if pkt[0] != held[0] || pkt[1]&0xF0 != held[1]&0xF0 || pkt[7] != held[7] {
+			return false
+		}
+	}
+	tcp, heldTCP := pkt[seg.iphLen:seg.hdrLen], held[f.iphLen:f.hdrLen]
+	// same ack and options
+	return bytes.Equal(tcp[8:12], heldTCP[8:12]) && bytes.Equal(tcp[20:], heldTCP[20:])
+}
+
+func (f *groFlow) append(pkt []byte, seg tcpSegment) {
+	size := len(pkt) - seg.hdrLen
+	f.pkt = append(f.pkt, pkt[seg.hdrLen:]...)
+	f.segs++
+	f.nextSeq += uint32(size)
+	tcp := f.pkt[f.iphLen:]
+	// the latest window and PSH win
+	copy(tcp[14:16], pkt[seg.iphLen+14:seg.iphLen+16])
+	tcp[13] |= seg.flags & tcpFlagPSH
+	if size < f.gsoSize || seg.flags&tcpFlagPSH != 0 {
+		f.closed = true
+	}
+}
+
+// finish fixes the headers of the coalesced packet and returns its virtio-net header.
+// A single segment is passed on untouched.
+func (f *groFlow) finish() vnetHdr {
+	if f.segs == 1 {
+		return vnetHdr{}
+	}
+	pkt := f.pkt
+	h := vnetHdr{
+		flags:      vnetHdrFlagNeedsCsum,
+		hdrLen:     uint16(f.hdrLen),
+		gsoSize:    uint16(f.gsoSize),
+		csumStart:  uint16(f.iphLen),
+		csumOffset: 16,
+	}
+	if pkt[0]>>4 == 4 {
+		h.gsoType = vnetGSOTCPv4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:f.iphLen], 0))
+	} else {
+		h.gsoType = vnetGSOTCPv6
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-f.iphLen))
+	}
+	// the kernel completes the checksum from the pseudo header sum
+	src, dst := ipAddrs(pkt)
+	tcp := pkt[f.iphLen:]
+	binary.BigEndian.PutUint16(tcp[16:], fold(pseudoHeaderSum(src, dst, protoTCP, len(tcp))))
+	return h
+}
@@ -0,0 +1,131 @@
+package tun
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPacket builds an IPv4 TCP ACK|PSH packet with a timestamp option and valid checksums
+func tcpPacket(seq uint32, payload []byte) []byte {
+	const iphLen, tcpLen = 20, 32
+	b := make([]byte, iphLen+tcpLen+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:], 0x1234)
+	b[6] = 0x40 // DF
+	b[8] = 64
+	b[9] = protoTCP
+	copy(b[12:16], []byte{10, 0, 0, 1})
+	copy(b[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(b[10:], checksum(b[:iphLen], 0))
+
+	tcp := b[iphLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 5201)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 777)
+	tcp[12] = tcpLen / 4 << 4
+	tcp[13] = tcpFlagACK | tcpFlagPSH
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+	copy(tcp[20:], []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2})
+	copy(tcp[tcpLen:], payload)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoHeaderSum(b[12:16], b[16:20], protoTCP, len(tcp))))
+	return b
+}
+
+func validChecksums(t *testing.T, pkt []byte) {
+	t.Helper()
+	assert.Zero(t, checksum(pkt[:20], 0), "ip checksum")
+	assert.Zero(t, checksum(pkt[20:], pseudoHeaderSum(pkt[12:16], pkt[16:20], protoTCP, len(pkt)-20)), "tcp checksum")
+}
+
+func TestGSOSplit(t *testing.T) {
+	payload := make([]byte, 2500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	super := tcpPacket(1000, payload)
+
+	segs, err := gsoSplit(super, &vnetHdr{gsoType: vnetGSOTCPv4, gsoSize: 1000})
+	require.NoError(t, err)
+	require.Len(t, segs, 3)
+	for i, seg := range segs {
+		validChecksums(t, seg)
+		assert.Equal(t, uint32(1000+1000*i), binary.BigEndian.Uint32(seg[24:]))
+		assert.Equal(t, uint16(0x1234+i), binary.BigEndian.Uint16(seg[4:]))
+		assert.Equal(t, i == 2, seg[33]&tcpFlagPSH != 0, "PSH on the last segment only")
+	}
+	assert.Len(t, segs[2], 52+500)
+	assert.Equal(t, payload[2000:], segs[2][52:])
+}
+
+func TestGROCoalesce(t *testing.T) {
+	var segs [][]byte
+	for i := 0; i < 3; i++ {
+		payload := make([]byte, 1000)
+		for j := range payload {
+			payload[j] = byte(i)
+		}
+		seg := tcpPacket(uint32(1000*i), payload)
+		binary.BigEndian.PutUint16(seg[4:], uint16(0x1234+i))
+		seg[10], seg[11] = 0, 0
+		binary.BigEndian.PutUint16(seg[10:], checksum(seg[:20], 0))
+		if i < 2 {
+			// only the last segment pushes
+			seg[33] &^= tcpFlagPSH
+			seg[36], seg[37] = 0, 0
+			binary.BigEndian.PutUint16(seg[36:], checksum(seg[20:], pseudoHeaderSum(seg[12:16], seg[16:20], protoTCP, len(seg)-20)))
+		}
+		segs = append(segs, seg)
+	}
+
+	var (
+		table groTable
+		out   []*groFlow
+	)
+	for i, seg := range segs {
+		var taken bool
+		out, taken = table.add(seg)
+		assert.True(t, taken)
+		if i < 2 {
+			assert.Empty(t, out)
+		}
+	}
+	// PSH closes the flow
+	require.Len(t, out, 1)
+	assert.Empty(t, table.takeAll())
+	f := out[0]
+	assert.Equal(t, 3, f.segs)
+
+	h := f.finish()
+	assert.Equal(t, uint8(vnetGSOTCPv4), h.gsoType)
+	assert.Equal(t, uint16(1000), h.gsoSize)
+	assert.Equal(t, uint16(52), h.hdrLen)
+
+	// a split restores the segments
+	resegs, err := gsoSplit(f.pkt, &h)
+	require.NoError(t, err)
+	assert.Equal(t, segs, resegs)
+}
+
+func TestGROSkipsOtherPackets(t *testing.T) {
+	var table groTable
+	_, taken := table.add(tcpPacket(0, make([]byte, 100)))
+	assert.True(t, taken)
+
+	// a FIN of the same flow flushes the held segment first
+	fin := tcpPacket(100, nil)
+	fin[33] = tcpFlagACK | tcpFlagFIN
+	out, taken := table.add(fin)
+	assert.False(t, taken)
+	require.Len(t, out, 1)
+	assert.Equal(t, vnetHdr{}, out[0].finish(), "a single segment is written as is")
+
+	udp := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, 0, 1, 0, 2, 0, 8, 0, 0}
+	out, taken = table.add(udp)
+	assert.False(t, taken)
+	assert.Empty(t, out)
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"kevin-rd/my-tier/internal/peer"
+	"kevin-rd/my-tier/internal/ratelimit"
+	"kevin-rd/my-tier/internal/router"
 	"net"
 )
 
@@ -47,14 +49,148 @@ const (
 const (
 	KindCommand = iota
 	KindPeers
+	KindLimit
+	KindAnycast
+	KindExit
+	KindMACs
+	KindMembers
+	KindNetworks
+	KindLeases
+	KindConflicts
+	KindIdentity
 )
 
+// The requests select a network by name, the primary network of the daemon if empty.
+// The responses carry the error of an unknown network.
+
 type PeersReq struct {
 	Network string `json:"network,omitempty"`
 }
 
 type PeersResp struct {
+	Error string       `json:"error,omitempty"`
 	Peers []*peer.Peer `json:"peers"`
+	// Usage peer id -> traffic usage of the current quota period
+	Usage map[string]ratelimit.Usage `json:"usage,omitempty"`
+}
+
+// LimitReq sets the rate limits and quota of a peer, or of a network if Peer is empty.
+type LimitReq struct {
+	Network string          `json:"network,omitempty"`
+	Peer    string          `json:"peer,omitempty"`
+	Limit   ratelimit.Limit `json:"limit"`
+}
+
+type LimitResp struct {
+	Error string `json:"error,omitempty"`
+}
+
+type AnycastReq struct {
+	Network string `json:"network,omitempty"`
+}
+
+type AnycastResp struct {
+	Error    string                  `json:"error,omitempty"`
+	Services []router.AnycastService `json:"services"`
+}
+
+// ExitReq actions
+const (
+	ExitStatus = "status"
+	ExitAllow  = "allow"
+	ExitDeny   = "deny"
+	ExitVia    = "via"
+)
+
+// ExitReq allows or denies an exit node client, or selects the exit node of this node
+type ExitReq struct {
+	Network string `json:"network,omitempty"`
+	Action  string `json:"action"`
+	Peer    string `json:"peer,omitempty"`
+}
+
+type ExitResp struct {
+	Error  string            `json:"error,omitempty"`
+	Status router.ExitStatus `json:"status"`
+}
+
+type MACsReq struct {
+	Network string `json:"network,omitempty"`
+}
+
+type MACsResp struct {
+	Error string            `json:"error,omitempty"`
+	MACs  []router.MACEntry `json:"macs"`
+}
+
+type MembersReq struct {
+	Network string `json:"network,omitempty"`
+}
+
+type MembersResp struct {
+	Error   string        `json:"error,omitempty"`
+	Members []peer.Member `json:"members"`
+}
+
+type LeasesReq struct {
+	Network string `json:"network,omitempty"`
+}
+
+type LeasesResp struct {
+	Error string `json:"error,omitempty"`
+	// Leases handed out by this node, empty if it has no DHCP pool
+	Leases []peer.Lease `json:"leases"`
+}
+
+type ConflictsReq struct {
+	Network string `json:"network,omitempty"`
+}
+
+type ConflictsResp struct {
+	Error string `json:"error,omitempty"`
+	// Conflicts are the recent handshakes rejected for a duplicate id or VIP, the latest first
+	Conflicts []peer.Conflict `json:"conflicts"`
+}
+
+type IdentityReq struct {
+	// Rotate replaces the keypair, the node uses it after a restart
+	Rotate bool `json:"rotate,omitempty"`
+}
+
+type Identity struct {
+	// ID is the id of the running node, KeyID the one derived from the keypair
+	ID    string `json:"id"`
+	KeyID string `json:"key_id,omitempty"`
+	// PublicKey is the Ed25519 public key, KeyAgreement the X25519 one, base64
+	PublicKey    string `json:"public_key,omitempty"`
+	KeyAgreement string `json:"key_agreement,omitempty"`
+	Path         string `json:"path"`
+	// Restart is set once the keypair was rotated and is not used yet
+	Restart bool `json:"restart,omitempty"`
+}
+
+type IdentityResp struct {
+	Error    string   `json:"error,omitempty"`
+	Identity Identity `json:"identity"`
+}
+
+type NetworksReq struct {
+}
+
+// Network is a network joined by the daemon
+type Network struct {
+	Name      string `json:"name"`
+	VirtualIP string `json:"virtual_ip"`
+	UDPPort   int    `json:"udp_port"`
+	Tun       string `json:"tun,omitempty"`
+	// Secret reports whether the handshakes are authenticated, the secret is not exposed
+	Secret  bool `json:"secret"`
+	Peers   int  `json:"peers"`
+	Primary bool `json:"primary"`
+}
+
+type NetworksResp struct {
+	Networks []Network `json:"networks"`
 }
 
 type Writer interface {
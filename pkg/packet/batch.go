@@ -0,0 +1,114 @@
+package packet
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// BatchSize is the number of packets read or written with one recvmmsg/sendmmsg
+const BatchSize = 64
+
+// BatchConn reads and writes many UDP packets per syscall, recvmmsg and sendmmsg on linux.
+// Other platforms fall back to one packet per syscall.
+type BatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// NewBatchConn wraps a UDP socket of a single address family, the family of an IPv4
+// destination must match the socket so a dual-stack socket only takes IPv6 peers.
+func NewBatchConn(conn *net.UDPConn) BatchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && len(addr.IP) > 0 {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// Batch collects encoded packets and sends the ones sharing a socket with one
+// sendmmsg on Flush. Packets of other writers are written right away.
+type Batch struct {
+	queues []*batchQueue
+}
+
+type batchQueue struct {
+	conn *net.UDPConn
+	bc   BatchConn
+	msgs []ipv4.Message
+}
+
+// Add encodes pkt and queues it for w
+func (b *Batch) Add(w Writer, pkt *Packet[Packable]) error {
+	bw, ok := w.(*writer)
+	if !ok {
+		_, err := w.WriteP(pkt)
+		return err
+	}
+	conn, ok := bw.Conn.(*net.UDPConn)
+	if !ok {
+		_, err := w.WriteP(pkt)
+		return err
+	}
+	bts, err := pkt.Encode()
+	if err != nil {
+		return err
+	}
+
+	msg := ipv4.Message{Buffers: [][]byte{bts}}
+	// connected sockets have no destination per message
+	if conn.RemoteAddr() == nil {
+		msg.Addr = bw.remoteAddr
+	}
+	q := b.queue(conn)
+	q.msgs = append(q.msgs, msg)
+	return nil
+}
+
+func (b *Batch) queue(conn *net.UDPConn) *batchQueue {
+	for _, q := range b.queues {
+		if q.conn == conn {
+			return q
+		}
+	}
+	q := &batchQueue{conn: conn, bc: NewBatchConn(conn), msgs: make([]ipv4.Message, 0, BatchSize)}
+	b.queues = append(b.queues, q)
+	return q
+}
+
+// Len is the number of queued packets
+func (b *Batch) Len() int {
+	n := 0
+	for _, q := range b.queues {
+		n += len(q.msgs)
+	}
+	return n
+}
+
+// Flush sends the queued packets, the batch is empty afterwards
+func (b *Batch) Flush() error {
+	var errs []error
+	active := b.queues[:0]
+	for _, q := range b.queues {
+		// forget sockets idle for a whole flush, e.g. closed ones
+		if len(q.msgs) == 0 {
+			continue
+		}
+		active = append(active, q)
+		for msgs := q.msgs; len(msgs) > 0; {
+			n, err := q.bc.WriteBatch(msgs, 0)
+			if err != nil {
+				errs = append(errs, err)
+				// skip the packet which failed, e.g. an unreachable destination
+				n++
+			}
+			msgs = msgs[min(n, len(msgs)):]
+		}
+		clear(q.msgs)
+		q.msgs = q.msgs[:0]
+	}
+	clear(b.queues[len(active):])
+	b.queues = active
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package packet
+
+import (
+	"errors"
+	"kevin-rd/my-tier/pkg/packet/payload"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+func listenLoopback(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func dataPacket(size int) *Packet[Packable] {
+	return NewPacket(TypeData, &payload.DataPayload{Data: make([]byte, size)})
+}
+
+func TestBatch(t *testing.T) {
+	sink := listenLoopback(t)
+	conn := listenLoopback(t)
+	w := NewWriter(conn, sink.LocalAddr())
+
+	var batch Batch
+	for i := 0; i < 10; i++ {
+		require.NoError(t, batch.Add(w, dataPacket(100+i)))
+	}
+	assert.Equal(t, 10, batch.Len())
+	require.NoError(t, batch.Flush())
+	assert.Zero(t, batch.Len())
+
+	msgs := make([]ipv4.Message, BatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 1500)}
+	}
+	bc := NewBatchConn(sink)
+	_ = sink.SetReadDeadline(time.Now().Add(time.Second))
+	for got := 0; got < 10; {
+		n, err := bc.ReadBatch(msgs, 0)
+		require.NoError(t, err)
+		for _, msg := range msgs[:n] {
+			pkt := &Packet[Packable]{}
+			require.NoError(t, pkt.Decode(msg.Buffers[0][:msg.N]))
+			assert.Len(t, pkt.Payload.(*payload.DataPayload).Data, 100+got)
+			got++
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	sink := listenLoopback(b)
+	conn := listenLoopback(b)
+	w := NewWriter(conn, sink.LocalAddr())
+	pkt := dataPacket(1400)
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.WriteP(pkt); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+	})
+	b.Run("batch", func(b *testing.B) {
+		var batch Batch
+		for i := 0; i < b.N; i++ {
+			_ = batch.Add(w, pkt)
+			if batch.Len() == BatchSize {
+				if err := batch.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := batch.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+	})
+}
+
+// BenchmarkRead receives packets sent in batches by a background sender, packets the
+// receiver is too slow for are dropped by the kernel and not counted.
+func BenchmarkRead(b *testing.B) {
+	read := func(b *testing.B, recv func(conn *net.UDPConn) (int, error)) {
+		sink := listenLoopback(b)
+		_ = sink.SetReadBuffer(4 << 20)
+		conn := listenLoopback(b)
+		w := NewWriter(conn, sink.LocalAddr())
+
+		var stop atomic.Bool
+		defer stop.Store(true)
+		go func() {
+			var batch Batch
+			for !stop.Load() {
+				for batch.Len() < BatchSize {
+					_ = batch.Add(w, dataPacket(1400))
+				}
+				_ = batch.Flush()
+			}
+		}()
+
+		b.ResetTimer()
+		for got := 0; got < b.N; {
+			n, err := recv(sink)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				b.Fatal(err)
+			}
+			got += n
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+	}
+
+	b.Run("single", func(b *testing.B) {
+		buf := make([]byte, 1500)
+		read(b, func(conn *net.UDPConn) (int, error) {
+			if _, _, err := conn.ReadFromUDP(buf); err != nil {
+				return 0, err
+			}
+			return 1, nil
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		msgs := make([]ipv4.Message, BatchSize)
+		for i := range msgs {
+			msgs[i].Buffers = [][]byte{make([]byte, 1500)}
+		}
+		var bc BatchConn
+		read(b, func(conn *net.UDPConn) (int, error) {
+			if bc == nil {
+				bc = NewBatchConn(conn)
+			}
+			return bc.ReadBatch(msgs, 0)
+		})
+	})
+}
@@ -36,6 +36,21 @@ const (
 
 	TypeCmdRequest
 	TypeCmdReply
+
+	// TypeRouteAdvert advertises the routes a node claims, e.g. anycast VIPs
+	TypeRouteAdvert
+
+	// TypeFrame carries an Ethernet frame of TAP mode
+	TypeFrame
+
+	// TypeGossip carries the SWIM probes and membership updates
+	TypeGossip
+
+	// TypeLease renews the addresses leased to DHCP nodes
+	TypeLease
+
+	// TypeHandshakeReject refuses a handshake, e.g. of a node with a duplicate id
+	TypeHandshakeReject
 )
 
 // Packet errors
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"kevin-rd/my-tier/pkg/packet/payload"
 	"kevin-rd/my-tier/pkg/utils"
 	"reflect"
@@ -38,14 +39,24 @@ type Packet[T Packable] struct {
 
 func newPayload(typ byte) Packable {
 	switch typ {
+	case TypeData, TypeFrame:
+		return &payload.DataPayload{}
 	case TypeHandshakeInit:
 		return &payload.HandshakeInitPayload{}
 	case TypeHandshakeReply:
 		return &payload.HandshakeReplyPayload{}
-	case TypeHandshakeFinalize:
+	case TypeRouteAdvert:
+		return &payload.AdvertPayload{}
+	case TypeGossip:
+		return &payload.GossipPayload{}
+	case TypeLease:
+		return &payload.LeasePayload{}
+	case TypeHandshakeReject:
+		return &payload.HandshakeRejectPayload{}
+	case TypeHandshakeFinalize, TypePing, TypePong:
 		return new(payload.StringPayload)
 	default:
-		panic("unhandled default case")
+		return nil
 	}
 }
 
@@ -149,7 +160,11 @@ func (p *Packet[T]) Decode(data []byte) error {
 	// read payload
 	val := reflect.ValueOf(p.Payload)
 	if val.Kind() == reflect.Invalid || val.IsNil() {
-		p.Payload = newPayload(p.Type).(T)
+		pl := newPayload(p.Type)
+		if pl == nil {
+			return errors.Join(ErrPacketDecode, fmt.Errorf("unknown packet type: %d", p.Type))
+		}
+		p.Payload = pl.(T)
 	}
 	if err := p.Payload.Decode(data[4+4*2 : 4+4*2+p.Length]); err != nil {
 		return errors.Join(ErrPacketDecode, err)
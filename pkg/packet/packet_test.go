@@ -89,6 +89,8 @@ func TestEncode_Success(t *testing.T) {
 		TestVersion << 4, // Version(4),Reserved(4)
 		TestType,         // Type(8)
 		0x00, 0x02,       // Length(16)
+		0, 0, 0, 0, // SrcVIP(32)
+		0, 0, 0, 0, // DstVIP(32)
 		0x01, 0x02, // Payload
 	}
 
@@ -122,6 +124,8 @@ func TestDecode_Success(t *testing.T) {
 		TestVersion << 4, // Version
 		TestType,         // Type
 		0x00, 0x02,       // Length
+		0, 0, 0, 0, // SrcVIP
+		0, 0, 0, 0, // DstVIP
 		0x01, 0x02, // Payload
 	}
 
@@ -156,11 +160,13 @@ func TestDecode_TooSmall(t *testing.T) {
 
 func TestDecode_IncompleteData(t *testing.T) {
 	data := []byte{
-		TestVersion << 4, 0x00,
+		TestVersion << 4,
 		TestType,
 		0x00, 0x03, // Length=3
+		0, 0, 0, 0,
+		0, 0, 0, 0,
 		0x01,
-	} // total length < 4+3
+	} // total length < 12+3
 
 	pkt := &Packet[Packable]{}
 
@@ -174,6 +180,8 @@ func TestDecode_UnknownType(t *testing.T) {
 		TestVersion << 4,
 		0xFF, // unknown type
 		0x00, 0x00,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
 	}
 
 	pkt := &Packet[Packable]{}
@@ -188,6 +196,8 @@ func TestDecode_PayloadDecodeError(t *testing.T) {
 		TestVersion << 4,
 		TestType,
 		0x00, 0x02,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
 		0x00, 0x00,
 	}
 
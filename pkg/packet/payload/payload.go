@@ -8,11 +8,24 @@ import (
 	"net"
 )
 
+// DataPayload carries a raw IP packet read from TUN
 type DataPayload struct {
 	Data []byte
 }
 
-// todo
+func (d *DataPayload) Encode() ([]byte, error) {
+	return d.Data, nil
+}
+
+func (d *DataPayload) Decode(data []byte) error {
+	d.Data = make([]byte, len(data))
+	copy(d.Data, data)
+	return nil
+}
+
+func (d *DataPayload) Length() int {
+	return len(d.Data)
+}
 
 type StringPayload string
 
@@ -29,14 +42,31 @@ func (s *StringPayload) Length() int {
 	return len(*s)
 }
 
+// NetworkID identifies the overlay network a handshake is meant for
+type NetworkID [8]byte
+
+// HandshakeMAC proves the knowledge of the network secret, zero in open networks
+type HandshakeMAC [16]byte
+
+// HandshakeInitPayload starts a handshake. ID is claimed, not proven by a signature, see
+// package identity.
+//
+// +--------+---------+------------+-------------+----------+
+// | ID(256)| DHCP(8) | VIP(40)    | Network(64) | MAC(128) |
+// +--------+---------+------------+-------------+----------+
 type HandshakeInitPayload struct {
 	ID [32]byte
 
 	// CIDR e.g. 192.168.1.1/24
 	VirtualIP utils.IPMask
 	DHCP      bool
+
+	Network NetworkID
+	MAC     HandshakeMAC
 }
 
+const handshakeInitLen = 32 + 1 + 5 + 8 + 16
+
 func (p *HandshakeInitPayload) Encode() ([]byte, error) {
 	return p.MarshalBinary()
 }
@@ -46,7 +76,7 @@ func (p *HandshakeInitPayload) Decode(data []byte) error {
 }
 
 func (p *HandshakeInitPayload) Length() int {
-	return 32 + 1 + 5
+	return handshakeInitLen
 }
 
 func (p *HandshakeInitPayload) MarshalBinary() ([]byte, error) {
@@ -83,11 +113,13 @@ func (p *HandshakeInitPayload) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 
+	buf.Write(p.Network[:])
+	buf.Write(p.MAC[:])
 	return buf.Bytes(), nil
 }
 
 func (p *HandshakeInitPayload) UnmarshalBinary(data []byte) error {
-	if len(data) < 32+1+5 {
+	if len(data) < handshakeInitLen {
 		return fmt.Errorf("data too short: %d", len(data))
 	}
 
@@ -112,23 +144,366 @@ func (p *HandshakeInitPayload) UnmarshalBinary(data []byte) error {
 		return fmt.Errorf("invalid mask length: %d", maskLen)
 	}
 
+	if _, err := buf.Read(p.Network[:]); err != nil {
+		return err
+	}
+	if _, err := buf.Read(p.MAC[:]); err != nil {
+		return err
+	}
 	return nil
 }
 
+// HandshakeReplyPayload answers a HandshakeInit with the identity of the responder. A
+// DHCP initiator gets its leased VirtualIP, zero if the responder allocates no addresses.
+//
+// +--------+-----------+-------------+----------+---------------+-----------+-------+
+// | ID(256)| Self(40)  | Network(64) | MAC(128) | VirtualIP(40) | Lease(32) | Hello |
+// +--------+-----------+-------------+----------+---------------+-----------+-------+
 type HandshakeReplyPayload struct {
-	Hello     string
+	ID [32]byte
+	// Self is the virtual IP and prefix of the responder
+	Self      utils.IPMask
+	Network   NetworkID
+	MAC       HandshakeMAC
 	VirtualIP utils.IPMask // client virtual IP
+	// Lease is the lease time of VirtualIP in seconds
+	Lease uint32
+	Hello string
 }
 
+const handshakeReplyLen = 32 + 5 + 8 + 16 + 5 + 4
+
 func (h *HandshakeReplyPayload) Encode() ([]byte, error) {
-	return []byte(h.Hello), nil
+	buf := make([]byte, 0, h.Length())
+	buf = append(buf, h.ID[:]...)
+	buf = append(buf, h.Self[:]...)
+	buf = append(buf, h.Network[:]...)
+	buf = append(buf, h.MAC[:]...)
+	buf = append(buf, h.VirtualIP[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, h.Lease)
+	return append(buf, h.Hello...), nil
 }
 
 func (h *HandshakeReplyPayload) Decode(data []byte) error {
-	h.Hello = string(data)
+	if len(data) < handshakeReplyLen {
+		return fmt.Errorf("handshake reply too short: %d", len(data))
+	}
+	copy(h.ID[:], data[:32])
+	copy(h.Self[:], data[32:37])
+	copy(h.Network[:], data[37:45])
+	copy(h.MAC[:], data[45:61])
+	copy(h.VirtualIP[:], data[61:66])
+	if h.Self[4] > 32 || h.VirtualIP[4] > 32 {
+		return fmt.Errorf("invalid mask length: %d %d", h.Self[4], h.VirtualIP[4])
+	}
+	h.Lease = binary.BigEndian.Uint32(data[66:70])
+	h.Hello = string(data[handshakeReplyLen:])
 	return nil
 }
 
 func (h *HandshakeReplyPayload) Length() int {
-	return len(h.Hello)
+	return handshakeReplyLen + len(h.Hello)
+}
+
+// RejectCode is the reason of a HandshakeReject
+type RejectCode byte
+
+const (
+	// RejectDuplicateID another node with the same id is connected
+	RejectDuplicateID RejectCode = iota + 1
+	// RejectDuplicateVIP another node with the same virtual IP is connected
+	RejectDuplicateVIP
+)
+
+func (c RejectCode) String() string {
+	switch c {
+	case RejectDuplicateID:
+		return "duplicate_id"
+	case RejectDuplicateVIP:
+		return "duplicate_vip"
+	}
+	return fmt.Sprintf("reject_%d", byte(c))
+}
+
+// HandshakeRejectPayload refuses a handshake, VirtualIP is the address of the rejected
+// node so that the MAC binds the reject to it.
+//
+// +--------+-------------+----------+---------+---------------+
+// | ID(256)| Network(64) | MAC(128) | Code(8) | VirtualIP(40) |
+// +--------+-------------+----------+---------+---------------+
+type HandshakeRejectPayload struct {
+	ID        [32]byte
+	Network   NetworkID
+	MAC       HandshakeMAC
+	Code      RejectCode
+	VirtualIP utils.IPMask
+}
+
+const handshakeRejectLen = 32 + 8 + 16 + 1 + 5
+
+func (h *HandshakeRejectPayload) Encode() ([]byte, error) {
+	buf := make([]byte, 0, handshakeRejectLen)
+	buf = append(buf, h.ID[:]...)
+	buf = append(buf, h.Network[:]...)
+	buf = append(buf, h.MAC[:]...)
+	buf = append(buf, byte(h.Code))
+	return append(buf, h.VirtualIP[:]...), nil
+}
+
+func (h *HandshakeRejectPayload) Decode(data []byte) error {
+	if len(data) < handshakeRejectLen {
+		return fmt.Errorf("handshake reject too short: %d", len(data))
+	}
+	copy(h.ID[:], data[:32])
+	copy(h.Network[:], data[32:40])
+	copy(h.MAC[:], data[40:56])
+	h.Code = RejectCode(data[56])
+	copy(h.VirtualIP[:], data[57:62])
+	if h.VirtualIP[4] > 32 {
+		return fmt.Errorf("invalid mask length: %d", h.VirtualIP[4])
+	}
+	return nil
+}
+
+func (h *HandshakeRejectPayload) Length() int {
+	return handshakeRejectLen
+}
+
+// Lease message kinds
+const (
+	// LeaseRenew asks to extend the lease of VIP
+	LeaseRenew byte = iota + 1
+	// LeaseGrant extends the lease of VIP by TTL seconds
+	LeaseGrant
+	// LeaseNak refuses VIP, it belongs to another node
+	LeaseNak
+)
+
+// LeasePayload renews the address leased by a DHCP node.
+//
+// +---------+---------+---------+
+// | Kind(8) | VIP(40) | TTL(32) |
+// +---------+---------+---------+
+type LeasePayload struct {
+	Kind byte
+	VIP  utils.IPMask
+	TTL  uint32
+}
+
+const leaseLen = 1 + 5 + 4
+
+func (l *LeasePayload) Encode() ([]byte, error) {
+	buf := make([]byte, 0, leaseLen)
+	buf = append(buf, l.Kind)
+	buf = append(buf, l.VIP[:]...)
+	return binary.BigEndian.AppendUint32(buf, l.TTL), nil
+}
+
+func (l *LeasePayload) Decode(data []byte) error {
+	if len(data) < leaseLen {
+		return fmt.Errorf("lease too short: %d", len(data))
+	}
+	l.Kind = data[0]
+	copy(l.VIP[:], data[1:6])
+	if l.VIP[4] > 32 {
+		return fmt.Errorf("invalid mask length: %d", l.VIP[4])
+	}
+	l.TTL = binary.BigEndian.Uint32(data[6:10])
+	return nil
+}
+
+func (l *LeasePayload) Length() int {
+	return leaseLen
+}
+
+// Advert kinds
+const (
+	// AdvertAnycast claims an anycast service VIP
+	AdvertAnycast byte = iota + 1
+	// AdvertExit offers the default route 0.0.0.0/0, the node is an exit node
+	AdvertExit
+	// AdvertSubnet offers a subnet reachable behind the node, e.g. its LAN
+	AdvertSubnet
+)
+
+// Advert is one route claimed by the sending node
+type Advert struct {
+	Kind   byte
+	Prefix utils.IPMask
+	Weight uint16
+}
+
+// AdvertPayload is the full set of routes of a node, it replaces the previous one.
+//
+// +---------+---------+------------+------------+
+// | Count(8)| Kind(8) | Prefix(40) | Weight(16) | ...
+// +---------+---------+------------+------------+
+type AdvertPayload struct {
+	Adverts []Advert
+}
+
+const advertLen = 1 + 5 + 2
+
+func (a *AdvertPayload) Encode() ([]byte, error) {
+	if len(a.Adverts) > 0xFF {
+		return nil, fmt.Errorf("too many adverts: %d", len(a.Adverts))
+	}
+	buf := make([]byte, 0, a.Length())
+	buf = append(buf, byte(len(a.Adverts)))
+	for _, ad := range a.Adverts {
+		buf = append(buf, ad.Kind)
+		buf = append(buf, ad.Prefix[:]...)
+		buf = binary.BigEndian.AppendUint16(buf, ad.Weight)
+	}
+	return buf, nil
+}
+
+func (a *AdvertPayload) Decode(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("data too short: %d", len(data))
+	}
+	n := int(data[0])
+	if len(data) < 1+n*advertLen {
+		return fmt.Errorf("data too short for %d adverts: %d", n, len(data))
+	}
+	a.Adverts = make([]Advert, n)
+	for i := range a.Adverts {
+		b := data[1+i*advertLen:]
+		a.Adverts[i].Kind = b[0]
+		copy(a.Adverts[i].Prefix[:], b[1:6])
+		a.Adverts[i].Weight = binary.BigEndian.Uint16(b[6:8])
+		if a.Adverts[i].Prefix[4] > 32 {
+			return fmt.Errorf("invalid mask length: %d", a.Adverts[i].Prefix[4])
+		}
+	}
+	return nil
+}
+
+func (a *AdvertPayload) Length() int {
+	return 1 + len(a.Adverts)*advertLen
+}
+
+// Gossip message kinds of the SWIM membership protocol
+const (
+	// GossipPing probes a member directly
+	GossipPing byte = iota + 1
+	// GossipAck answers a ping, relayed back to the origin of an indirect probe
+	GossipAck
+	// GossipPingReq asks a member to probe Target on behalf of the sender
+	GossipPingReq
+	// GossipSync pushes membership updates without a probe, e.g. the full list to a new
+	// member. A non-zero Seq asks for the list of the receiver in return.
+	GossipSync
+)
+
+// Member states of the gossip updates
+const (
+	MemberAlive byte = iota + 1
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+// MemberUpdate is a membership change of one node, the higher Incarnation wins
+type MemberUpdate struct {
+	State       byte
+	Incarnation uint32
+	VIP         utils.IPMask
+	ID          string
+	// Addr is the UDP endpoint of the node as seen by the sender, "" if unknown
+	Addr string
+}
+
+// GossipPayload is a SWIM message with piggybacked membership updates.
+//
+// +---------+---------+-------------+-------------+----------+
+// | Kind(8) | Seq(32) | Target(32)  | Origin(32)  | Count(8) | ...
+// +---------+---------+-------------+-------------+----------+
+// | State(8) | Incarnation(32) | VIP(40) | IDLen(8) | ID | AddrLen(8) | Addr | ...
+// +----------+-----------------+---------+----------+----+------------+------+
+type GossipPayload struct {
+	Kind byte
+	Seq  uint32
+	// Target is the member probed by a PingReq and acked by a relayed Ack
+	Target utils.IPv4
+	// Origin is the member which asked for an indirect probe
+	Origin  utils.IPv4
+	Updates []MemberUpdate
+}
+
+const (
+	gossipHeaderLen = 1 + 4 + 4 + 4 + 1
+	memberUpdateLen = 1 + 4 + 5 + 1 + 1
+)
+
+func (g *GossipPayload) Encode() ([]byte, error) {
+	if len(g.Updates) > 0xFF {
+		return nil, fmt.Errorf("too many updates: %d", len(g.Updates))
+	}
+	buf := make([]byte, 0, g.Length())
+	buf = append(buf, g.Kind)
+	buf = binary.BigEndian.AppendUint32(buf, g.Seq)
+	buf = append(buf, g.Target[:]...)
+	buf = append(buf, g.Origin[:]...)
+	buf = append(buf, byte(len(g.Updates)))
+	for _, u := range g.Updates {
+		if len(u.ID) > 32 || len(u.Addr) > 0xFF {
+			return nil, fmt.Errorf("member update too long: %q %q", u.ID, u.Addr)
+		}
+		buf = append(buf, u.State)
+		buf = binary.BigEndian.AppendUint32(buf, u.Incarnation)
+		buf = append(buf, u.VIP[:]...)
+		buf = append(buf, byte(len(u.ID)))
+		buf = append(buf, u.ID...)
+		buf = append(buf, byte(len(u.Addr)))
+		buf = append(buf, u.Addr...)
+	}
+	return buf, nil
+}
+
+func (g *GossipPayload) Decode(data []byte) error {
+	if len(data) < gossipHeaderLen {
+		return fmt.Errorf("data too short: %d", len(data))
+	}
+	g.Kind = data[0]
+	g.Seq = binary.BigEndian.Uint32(data[1:5])
+	copy(g.Target[:], data[5:9])
+	copy(g.Origin[:], data[9:13])
+	n := int(data[13])
+	data = data[gossipHeaderLen:]
+
+	g.Updates = make([]MemberUpdate, n)
+	for i := range g.Updates {
+		u := &g.Updates[i]
+		if len(data) < memberUpdateLen {
+			return fmt.Errorf("data too short for update %d: %d", i, len(data))
+		}
+		u.State = data[0]
+		u.Incarnation = binary.BigEndian.Uint32(data[1:5])
+		copy(u.VIP[:], data[5:10])
+		if u.VIP[4] > 32 {
+			return fmt.Errorf("invalid mask length: %d", u.VIP[4])
+		}
+		idLen := int(data[10])
+		if len(data) < memberUpdateLen+idLen {
+			return fmt.Errorf("data too short for update %d: %d", i, len(data))
+		}
+		u.ID = string(data[11 : 11+idLen])
+		data = data[11+idLen:]
+		addrLen := int(data[0])
+		if len(data) < 1+addrLen {
+			return fmt.Errorf("data too short for update %d: %d", i, len(data))
+		}
+		u.Addr = string(data[1 : 1+addrLen])
+		data = data[1+addrLen:]
+	}
+	return nil
+}
+
+func (g *GossipPayload) Length() int {
+	n := gossipHeaderLen
+	for _, u := range g.Updates {
+		n += memberUpdateLen + len(u.ID) + len(u.Addr)
+	}
+	return n
 }
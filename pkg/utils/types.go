@@ -19,17 +19,41 @@ func Must2IPMask(addr string) IPMask {
 	if ip == nil {
 		panic(fmt.Sprintf("invalid ip: %v", ip.String()))
 	}
-	_, bits := ipNet.Mask.Size()
-	if bits <= 0 || bits > 32 {
-		panic(fmt.Sprintf("invalid mask size: %d", bits))
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 || ones < 0 || ones > 32 {
+		panic(fmt.Sprintf("invalid mask size: %d", ones))
 	}
-	return IPMask{ip[0], ip[1], ip[2], ip[3], byte(bits)}
+	return IPMask{ip[0], ip[1], ip[2], ip[3], byte(ones)}
+}
+
+func (ip IPv4) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
 }
 
 func (ip IPMask) String() string {
 	return fmt.Sprintf("%d.%d.%d.%d/%d", ip[0], ip[1], ip[2], ip[3], ip[4])
 }
 
+// IPv4 returns the address without the mask
+func (ip IPMask) IPv4() IPv4 {
+	return IPv4{ip[0], ip[1], ip[2], ip[3]}
+}
+
+// Contains reports whether addr is in the network of ip
+func (ip IPMask) Contains(addr IPv4) bool {
+	bits := int(ip[4])
+	if bits > 32 {
+		return false
+	}
+	mask := net.CIDRMask(bits, 32)
+	for i := 0; i < 4; i++ {
+		if ip[i]&mask[i] != addr[i]&mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (ip IPMask) toIP() net.IP {
 	return net.IPv4(ip[0], ip[1], ip[2], ip[3])
 }
@@ -2,10 +2,9 @@ package utils
 
 import (
 	"log"
-	"math/rand"
+	"math/rand/v2"
 	"os"
 	"os/signal"
-	"time"
 )
 
 func WaitSignal(signals []os.Signal, fns ...func()) {
@@ -38,12 +37,13 @@ func WaitSignal(signals []os.Signal, fns ...func()) {
 	}
 }
 
+// RandomString returns length random alphanumerics, the generator is seeded once by the
+// runtime so that concurrent callers do not draw the same strings
 func RandomString(length int) string {
-	rand.Seed(time.Now().UnixNano())
 	chars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	result := make([]byte, length)
 	for i := 0; i < length; i++ {
-		result[i] = chars[rand.Intn(len(chars))]
+		result[i] = chars[rand.IntN(len(chars))]
 	}
 	return string(result)
 }
@@ -0,0 +1,61 @@
+#!/usr/bin/env bash
+# Exit node test with network namespaces, run as root from the repo root.
+#
+#   inet (203.0.113.1) --- exit (203.0.113.2 | 172.16.0.1) --- client (172.16.0.2)
+#
+# The client reaches 203.0.113.1 through the overlay, the exit node masquerades it. The
+# cores assign the VIPs to sky0 and bring it up.
+set -euo pipefail
+
+# not in /tmp, every core gets a private /tmp for its unix socket
+BIN=$(mktemp -d -p /var/tmp)
+go build -o "$BIN/skytier-core" ./cmd/core
+
+# core NS ARGS... runs a core in the namespace NS
+core() {
+  local ns=$1
+  shift
+  ip netns exec "$ns" unshare -m sh -c 'mount -t tmpfs tmpfs /tmp && exec "$@"' sh "$BIN/skytier-core" "$@"
+}
+
+cleanup() {
+  set +e
+  for ns in client exit; do
+    ip netns pids "$ns" 2>/dev/null | xargs -r kill
+  done
+  sleep 1
+  for ns in inet exit client; do ip netns del "$ns" 2>/dev/null; done
+  rm -rf "$BIN"
+}
+trap cleanup EXIT
+
+for ns in inet exit client; do ip netns add "$ns"; ip -n "$ns" link set lo up; done
+
+ip link add veth-inet netns inet type veth peer name veth-up netns exit
+ip -n inet addr add 203.0.113.1/24 dev veth-inet && ip -n inet link set veth-inet up
+ip -n exit addr add 203.0.113.2/24 dev veth-up && ip -n exit link set veth-up up
+
+ip link add veth-client netns client type veth peer name veth-down netns exit
+ip -n client addr add 172.16.0.2/24 dev veth-client && ip -n client link set veth-client up
+ip -n exit addr add 172.16.0.1/24 dev veth-down && ip -n exit link set veth-down up
+
+core exit --id exit --virtual-ip 10.0.0.1 --tun sky0 \
+  --state-dir "$BIN/exit" --exit-node --exit-allow client >"$BIN/exit.log" 2>&1 &
+sleep 1
+
+core client --id client --virtual-ip 10.0.0.2 --tun sky0 \
+  --state-dir "$BIN/client" --exit-via exit --peer 172.16.0.1:6780 >"$BIN/client.log" 2>&1 &
+sleep 1
+# the "internet" is routed through the overlay, the underlay keeps its own route
+ip -n client route add 203.0.113.0/24 dev sky0
+
+# wait for the exit node advert
+sleep 12
+
+if ip netns exec client ping -c 3 -W 2 203.0.113.1; then
+  echo "✅ client reached the internet through the exit node"
+else
+  echo "❌ exit node test failed"
+  tail -n 50 "$BIN/exit.log" "$BIN/client.log"
+  exit 1
+fi